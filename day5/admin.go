@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// 10. Admin Listener (pprof, expvar, runtime stats)
+//
+// WHY A SECOND LISTENER?
+// Profiling endpoints leak internals (and can burn CPU on demand), so they
+// must never be reachable through the public routes() mux. They get their
+// own http.Server and mux on a separate address (admin_addr in the config),
+// guarded by adminAuth:
+//   - admin_token set   -> every request needs "Authorization: Bearer <token>"
+//   - admin_token empty -> only loopback clients (127.0.0.1 / ::1) are allowed
+//
+// Endpoints:
+//   /debug/pprof/...     net/http/pprof profiles
+//   /debug/vars          expvar (memstats, cmdline, ...)
+//   /debug/goroutines    full goroutine dump (text)
+//   /debug/gc            GC stats and heap numbers (JSON)
+//   /debug/stats         live config + store statistics (JSON)
+//   /admin/tenants       create, list and delete tenants (see tenant.go)
+
+// StoreStats describes the size of a UserStore and its indexes.
+type StoreStats struct {
+	Users            int `json:"users"`
+	AgeIndexEntries  int `json:"age_index_entries"`
+	NameIndexEntries int `json:"name_index_entries"`
+	Trigrams         int `json:"trigrams"`
+}
+
+// Stats returns a consistent snapshot of the store's sizes. A sharded
+// store reports the sum over its shards.
+func (us *UserStore) Stats() StoreStats {
+	if us.shards != nil {
+		return us.shards.Stats()
+	}
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	return StoreStats{
+		Users:            len(us.users),
+		AgeIndexEntries:  us.byAge.len(),
+		NameIndexEntries: us.byName.len(),
+		Trigrams:         len(us.byGram),
+	}
+}
+
+// adminRoutes builds the admin mux. It is deliberately separate from routes().
+func (s *Server) adminRoutes(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	// Register pprof explicitly: importing net/http/pprof also registers on
+	// http.DefaultServeMux, which nothing in this program serves.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+	mux.HandleFunc("/debug/gc", handleGCStats)
+	mux.HandleFunc("/debug/stats", s.handleAdminStats)
+	mux.HandleFunc("GET /admin/tenants", s.handleListTenants)
+	mux.HandleFunc("POST /admin/tenants", s.handleCreateTenant)
+	mux.HandleFunc("DELETE /admin/tenants/{id}", s.handleDeleteTenant)
+	mux.HandleFunc("POST /admin/events/snapshot", s.handleSnapshot)
+	mux.HandleFunc("POST /admin/events/rebuild", s.handleRebuild)
+	mux.HandleFunc("GET /admin/replication", s.handleReplicationStatus)
+	mux.HandleFunc("GET /admin/replication/stream", s.handleReplicationStream)
+	mux.HandleFunc("GET /admin/raft", s.handleRaftStatus)
+	mux.HandleFunc("POST /admin/raft", s.handleRaftMessage)
+	mux.HandleFunc("GET /admin/shards", s.handleListShards)
+	mux.HandleFunc("POST /admin/shards", s.handleAddShard)
+	mux.HandleFunc("DELETE /admin/shards/{name}", s.handleRemoveShard)
+	mux.HandleFunc("POST /admin/backup", s.handleBackup)
+	mux.HandleFunc("POST /admin/restore", s.handleRestore)
+	mux.HandleFunc("GET /admin/keys", s.handleKeyStatus)
+	mux.HandleFunc("POST /admin/keys/rotate", s.handleKeyRotate)
+	mux.HandleFunc("GET /admin/faults", s.handleGetFaults)
+	mux.HandleFunc("PUT /admin/faults", s.handleSetFaults)
+	mux.HandleFunc("DELETE /admin/faults", s.handleClearFaults)
+	mux.HandleFunc("GET /admin/gateway", s.handleGatewayStatus)
+	if s.gateway == nil {
+		s.registerUI(mux) // admin web UI (see ui.go)
+	}
+
+	return adminAuth(token)(mux)
+}
+
+// adminAuth allows a request if it carries the bearer token, or - when no
+// token is configured - if it comes from a loopback address. Browsers
+// can't send a bearer token, so the web UI's users give it as the password
+// of the basic-auth prompt (any user name). Only /ui/ takes it that way:
+// browsers re-send basic credentials on requests other sites make, and
+// only the UI guards against that (CSRF checks, see ui.go) - a page could
+// otherwise make an admin's browser POST /admin/restore.
+//
+// Without a token a browser on the admin's machine is trusted by address
+// alone, so a page could still send that POST through it: unsafe requests
+// that the browser marks cross-site are refused everywhere (the UI
+// answers them with its own page). Peers and scripts send no such marks.
+func adminAuth(token string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token != "" {
+				got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+				ui := strings.HasPrefix(r.URL.Path, "/ui/")
+				if !ok && ui {
+					_, got, ok = r.BasicAuth()
+				}
+				// ConstantTimeCompare: don't leak how many bytes matched via timing
+				if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+					if ui {
+						w.Header().Add("WWW-Authenticate", `Basic realm="admin", charset="UTF-8"`)
+					}
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+			} else if !isLoopback(r.RemoteAddr) && !isUnixConn(r) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if !strings.HasPrefix(r.URL.Path, "/ui/") {
+				if err := uiCrossOrigin.Check(r); err != nil {
+					http.Error(w, "cross-site request refused", http.StatusForbidden)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isLoopback(hostport string) bool {
+	if strings.HasPrefix(hostport, "unix:") {
+		return true // a Unix socket is only reachable from this machine
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// all=true dumps every goroutine with its full stack, like a crash does;
+	// grow the buffer until the whole dump fits
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			w.Write(buf[:n])
+			return
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func handleGCStats(w http.ResponseWriter, r *http.Request) {
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"num_gc":         gc.NumGC,
+		"last_gc":        gc.LastGC,
+		"pause_total":    gc.PauseTotal.String(),
+		"heap_alloc":     mem.HeapAlloc,
+		"heap_objects":   mem.HeapObjects,
+		"heap_sys":       mem.HeapSys,
+		"next_gc":        mem.NextGC,
+		"goroutines":     runtime.NumGoroutine(),
+		"gomaxprocs":     runtime.GOMAXPROCS(0),
+		"go_version":     runtime.Version(),
+		"gc_cpu_percent": mem.GCCPUFraction * 100,
+	})
+}
+
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	cfg := s.Config()
+	cfg.AdminToken = redacted(cfg.AdminToken)
+	cfg.TenantTokenSecret = redacted(cfg.TenantTokenSecret)
+
+	stats := map[string]any{
+		"config": cfg,
+		"store":  s.store.Stats(),
+	}
+	if s.tenants != nil {
+		stats["tenants"] = len(s.tenants.List())
+	}
+	if c := s.current.Load(); c != nil {
+		if c.concurrency != nil {
+			stats["concurrency"] = c.concurrency.Stats()
+		}
+		if c.cache != nil {
+			stats["cache_entries"] = c.cache.Size()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
+
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// AdminHook returns a lifecycle hook running the admin listener on addr.
+// Priority 5: it starts first and stops last, so it stays available while
+// the rest of the server shuts down.
+func (s *Server) AdminHook(addr, token string) Hook {
+	// Shutdown waits for running requests, but replication streams never
+	// finish on their own: cancel their contexts when shutdown begins.
+	base, cancel := context.WithCancel(context.Background())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.adminRoutes(token),
+		ReadHeaderTimeout: 5 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return base },
+	}
+	srv.RegisterOnShutdown(cancel)
+	return Hook{
+		Name:     "admin-server",
+		Priority: 5,
+		Timeout:  2 * time.Second,
+		OnStart: func(ctx context.Context) error {
+			ln, err := s.listen(addr, "admin")
+			if err != nil {
+				return fmt.Errorf("admin listener: %w", err)
+			}
+			log.Printf("Admin listening on %s", ln.Addr())
+			go func() {
+				if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					log.Printf("admin serve: %v", err)
+				}
+			}()
+			return nil
+		},
+		OnStop: srv.Shutdown,
+	}
+}
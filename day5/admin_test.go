@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+
+	tests := []struct {
+		name       string
+		token      string
+		remote     string
+		authHeader string
+		wantStatus int
+	}{
+		{"loopback without token", "", "127.0.0.1:5000", "", http.StatusOK},
+		{"ipv6 loopback without token", "", "[::1]:5000", "", http.StatusOK},
+		{"remote without token", "", "10.0.0.7:5000", "", http.StatusForbidden},
+		{"remote with valid token", "s3cret", "10.0.0.7:5000", "Bearer s3cret", http.StatusOK},
+		{"remote with wrong token", "s3cret", "10.0.0.7:5000", "Bearer nope", http.StatusUnauthorized},
+		{"loopback still needs configured token", "s3cret", "127.0.0.1:5000", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/debug/stats", nil)
+			req.RemoteAddr = tt.remote
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rr := httptest.NewRecorder()
+			s.adminRoutes(tt.token).ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminAuth_CrossSite(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	s.store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+
+	tests := []struct {
+		name       string
+		token      string
+		basic      string // basic-auth password, if set
+		site       string // Sec-Fetch-Site, if set
+		wantStatus int
+	}{
+		{"basic credentials outside /ui/", "s3cret", "s3cret", "", http.StatusUnauthorized},
+		{"cross-site with basic credentials", "s3cret", "s3cret", "cross-site", http.StatusUnauthorized},
+		{"cross-site from loopback without token", "", "", "cross-site", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin/restore", strings.NewReader(`[]`))
+			req.RemoteAddr = "127.0.0.1:5000"
+			if tt.basic != "" {
+				req.SetBasicAuth("admin", tt.basic)
+			}
+			if tt.site != "" {
+				req.Header.Set("Sec-Fetch-Site", tt.site)
+			}
+			rr := httptest.NewRecorder()
+			s.adminRoutes(tt.token).ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+	if users, _ := s.store.List(context.Background()); len(users) != 1 {
+		t.Errorf("store has %d users after refused restores; want 1", len(users))
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		store *UserStore
+	}{
+		{"plain", NewUserStore()},
+		{"sharded", NewShardedUserStore(3)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{store: tt.store}
+			s.routes()
+			defer s.stopCurrentLimiter(context.Background())
+			for i := range 10 {
+				s.store.Create(context.Background(), User{ID: fmt.Sprint(i), Name: "Alice", Age: 30})
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/debug/stats", nil)
+			req.RemoteAddr = "127.0.0.1:5000"
+			rr := httptest.NewRecorder()
+			s.adminRoutes("").ServeHTTP(rr, req)
+
+			var body struct {
+				Config Config     `json:"config"`
+				Store  StoreStats `json:"store"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+				t.Fatalf("decode failed: %v", err)
+			}
+			if body.Store.Users != 10 || body.Store.AgeIndexEntries != 10 {
+				t.Errorf("unexpected store stats: %+v", body.Store)
+			}
+			if body.Config.RateLimit != DefaultConfig().RateLimit {
+				t.Errorf("unexpected config: %+v", body.Config)
+			}
+		})
+	}
+}
+
+func TestAdminEndpointsNotOnPublicMux(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/debug/stats", "/debug/goroutines"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = "127.0.0.1:5000"
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("public %s = %d; want 404", path, rr.Code)
+		}
+	}
+}
+
+func TestAdminGoroutineDump(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/debug/goroutines", nil)
+	rr := httptest.NewRecorder()
+	handleGoroutines(rr, req)
+	if !strings.Contains(rr.Body.String(), "goroutine ") {
+		t.Errorf("dump does not look like a goroutine dump: %.80q", rr.Body.String())
+	}
+}
+
+func TestConfigValidate_AdminAddr(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AdminAddr = ":6060"
+	if err := cfg.Validate(); err == nil {
+		t.Error("expected non-loopback admin_addr without token to be rejected")
+	}
+	cfg.AdminToken = "s3cret"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unexpected error with token: %v", err)
+	}
+	cfg = DefaultConfig()
+	cfg.AdminAddr = "127.0.0.1:6060"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unexpected error for loopback admin_addr: %v", err)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gzipLines builds a backup-like file from raw lines.
+func gzipLines(lines ...string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, strings.Join(lines, "\n")+"\n")
+	zw.Close()
+	return buf.Bytes()
+}
+
+// backupOf returns a backup of a fresh store holding users.
+func backupOf(t *testing.T, users ...User) []byte {
+	t.Helper()
+	us := NewUserStore()
+	for _, u := range users {
+		us.Create(context.Background(), u)
+	}
+	var buf bytes.Buffer
+	if _, err := us.Backup(context.Background(), &buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// unzip returns the lines of a gzip'ed backup.
+func unzip(t *testing.T, data []byte) []string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(zr)
+	return strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+}
+
+func TestBackup_RoundTrip(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := User{ID: "1", Name: "Alice", Age: 30}, User{ID: "2", Name: "Bob", Age: 25}
+	data := backupOf(t, bob, alice)
+
+	users, info, err := ReadBackup(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadBackup: %v", err)
+	}
+	if info.Users != 2 || len(info.SHA256) != 64 || len(users) != 2 || users[0] != alice || users[1] != bob {
+		t.Errorf("ReadBackup = %+v, %+v; want Alice and Bob sorted by ID with a checksum", users, info)
+	}
+
+	// restore replaces everything, indexes included
+	us := NewUserStore()
+	us.Create(ctx, User{ID: "9", Name: "Old", Age: 99})
+	if err := us.Restore(users); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.Get(ctx, "9"); err == nil {
+		t.Error("user from before the restore survived")
+	}
+	if got, _ := us.List(ctx, NameEquals("alice")); len(got) != 1 {
+		t.Errorf("name index after restore found %d users; want 1", len(got))
+	}
+	if got, _ := us.Search(ctx, "Bob", 5); len(got) != 1 {
+		t.Errorf("search after restore found %d users; want 1", len(got))
+	}
+}
+
+func TestReadBackup_RejectsBadFiles(t *testing.T) {
+	good := unzip(t, backupOf(t, User{ID: "1", Name: "Alice", Age: 30}, User{ID: "2", Name: "Bob", Age: 25}))
+	header, alice, bob, trailer := good[0], good[1], good[2], good[3]
+	sumOf := func(lines ...string) string {
+		// a trailer that matches its content, so only the other checks fail
+		sum := sha256.Sum256([]byte(strings.Join(lines, "\n") + "\n"))
+		return `{"sha256":"` + hex.EncodeToString(sum[:]) + `"}`
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{"not gzip", []byte(`{"id":"1"}`), "not gzip"},
+		{"not a backup", gzipLines(`{"hello":"world"}`, trailer), "not a day5-users-backup"},
+		{"truncated", gzipLines(header, alice, bob), "missing checksum trailer"},
+		{"edited", gzipLines(header, alice, strings.Replace(bob, "25", "26", 1), trailer), "checksum mismatch"},
+		{"users missing", gzipLines(header, alice, sumOf(header, alice)), "header says 2 users"},
+		{"duplicate id", gzipLines(header, alice, alice, trailer), "duplicate id"},
+		{"invalid user", gzipLines(header, alice, `{"id":"3","name":"","age":1}`, trailer), "needs id, name"},
+		{"only a header", gzipLines(header), "missing header or trailer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, _, err := ReadBackup(bytes.NewReader(tt.data))
+			if !errors.Is(err, ErrBadBackup) || !strings.Contains(err.Error(), tt.wantErr) || users != nil {
+				t.Errorf("ReadBackup = %d users, %v; want ErrBadBackup containing %q", len(users), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBackup_ConsistentDuringWrites(t *testing.T) {
+	// writers keep updating while backups are taken; each backup must be
+	// complete and pass its own checksum
+	for _, sharded := range []bool{false, true} {
+		t.Run(fmt.Sprintf("sharded=%v", sharded), func(t *testing.T) {
+			ctx := context.Background()
+			us := NewUserStore()
+			if sharded {
+				us = NewShardedUserStore(3)
+			}
+			for i := range 200 {
+				us.Create(ctx, User{ID: fmt.Sprint("base-", i), Name: "Base", Age: 20})
+			}
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			for w := range 4 {
+				id := fmt.Sprint("w", w)
+				us.Create(ctx, User{ID: id, Name: "Token", Age: 1})
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for age := 2; ; age++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						us.Update(ctx, User{ID: id, Name: "Token", Age: age})
+					}
+				}()
+			}
+			for range 20 {
+				var buf bytes.Buffer
+				if _, err := us.Backup(ctx, &buf); err != nil {
+					t.Fatal(err)
+				}
+				users, _, err := ReadBackup(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(users) != 204 {
+					t.Fatalf("backup has %d users; want 204", len(users))
+				}
+			}
+			close(stop)
+			wg.Wait()
+
+			if err := us.Restore([]User{{ID: "r", Name: "Restored", Age: 5}}); err != nil {
+				t.Fatal(err)
+			}
+			if users, _ := us.List(ctx); len(users) != 1 || users[0].ID != "r" {
+				t.Errorf("after restore List = %+v; want only the restored user", users)
+			}
+		})
+	}
+}
+
+func TestBackupAdminEndpoints(t *testing.T) {
+	ctx := context.Background()
+	s := &Server{store: NewUserStore()}
+	s.store.Create(ctx, User{ID: "1", Name: "Alice", Age: 30})
+	admin := s.adminRoutes("")
+	do := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:50000" // admin routes are loopback-only without a token
+		admin.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do(http.MethodPost, "/admin/backup", nil)
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("backup = %d %s", rr.Code, rr.Header())
+	}
+	backup := rr.Body.Bytes()
+	s.store.Create(ctx, User{ID: "2", Name: "Bob", Age: 25})
+
+	eventSourced, _ := NewEventSourcedStore(NewEventLog(), "")
+	tests := []struct {
+		name       string
+		server     *Server
+		body       []byte
+		wantStatus int
+		wantUsers  int
+	}{
+		{"corrupt backup", s, backup[:len(backup)/2], http.StatusBadRequest, 2},
+		{"restore", s, backup, http.StatusOK, 1},
+		{"event-sourced store", &Server{store: eventSourced}, backup, http.StatusConflict, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/admin/restore", bytes.NewReader(tt.body))
+			req.RemoteAddr = "127.0.0.1:50000"
+			tt.server.adminRoutes("").ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("restore = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+			if users, _ := tt.server.store.List(ctx); len(users) != tt.wantUsers {
+				t.Errorf("store holds %d users; want %d", len(users), tt.wantUsers)
+			}
+		})
+	}
+
+	var info BackupInfo
+	json.Unmarshal(do(http.MethodPost, "/admin/restore", backup).Body.Bytes(), &info)
+	if info.Users != 1 || info.SHA256 == "" {
+		t.Errorf("restore response = %+v; want the backup's info", info)
+	}
+}
+
+func TestRunVerifyBackup(t *testing.T) {
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.ndjson.gz")
+	os.WriteFile(good, backupOf(t, User{ID: "1", Name: "Alice", Age: 30}), 0o600)
+	bad := filepath.Join(dir, "bad.ndjson.gz")
+	os.WriteFile(bad, gzipLines(`{"format":"day5-users-backup","version":1,"users":0}`), 0o600)
+
+	tests := []struct {
+		file string
+		want int
+	}{
+		{good, 0},
+		{bad, 1},
+		{filepath.Join(dir, "missing"), 1},
+	}
+	for _, tt := range tests {
+		if got := runVerifyBackup(tt.file); got != tt.want {
+			t.Errorf("runVerifyBackup(%s) = %d; want %d", filepath.Base(tt.file), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 18. Read-Through Response Cache
+//
+// WHY?
+// GET /users and GET /users/{id} used to hit the store and re-encode the
+// response on every call. ResponseCache keeps the encoded bytes (status,
+// headers, body) of successful GETs in a ConcurrentCache (same design as
+// day8's) for cache_ttl, so repeated reads skip the handler entirely.
+//
+// KEY = tenant | path ? sorted query | Accept
+// The Accept header is part of the key because content negotiation can
+// return JSON or CSV for the same URL.
+//
+// Clients can steer it with Cache-Control request directives:
+//
+//	no-store        don't read or write the cache
+//	no-cache        skip the lookup but store the fresh answer
+//	max-age=N       only accept an entry at most N seconds old
+//	only-if-cached  answer from the cache or 504, never run the handler
+//
+// Responses carry X-Cache (HIT, MISS or BYPASS) and, on hits, Age.
+// The user write handlers invalidate the affected keys after a write, so
+// readers see their own changes without waiting for the TTL.
+//
+// A miss that runs across a write is the tricky case: the handler reads
+// the old user, the write lands and invalidates, and only then the miss
+// stores its (now stale) body - which would stay until the TTL. So every
+// invalidation also bumps the tenant's generation (cacheGenerations), and a
+// miss stores its response only if the generation it started in is still
+// current.
+
+// maxCacheEntries bounds memory: varying query strings shouldn't be able to
+// grow the cache forever.
+const maxCacheEntries = 10000
+
+// CacheItem represents an item in the cache with TTL (see day8)
+type CacheItem struct {
+	Value     interface{}
+	ExpiresAt time.Time
+}
+
+// ConcurrentCache is a thread-safe cache with TTL support (see day8)
+type ConcurrentCache struct {
+	data map[string]CacheItem
+	mu   sync.RWMutex
+	ttl  time.Duration
+}
+
+// NewConcurrentCache creates a new cache with default TTL
+func NewConcurrentCache(ttl time.Duration) *ConcurrentCache {
+	return &ConcurrentCache{
+		data: make(map[string]CacheItem),
+		ttl:  ttl,
+	}
+}
+
+// Set adds or updates a value in the cache
+func (c *ConcurrentCache) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key] = CacheItem{
+		Value:     value,
+		ExpiresAt: time.Now().Add(c.ttl),
+	}
+}
+
+// Get retrieves a value from the cache
+func (c *ConcurrentCache) Get(key string) (interface{}, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	item, exists := c.data[key]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(item.ExpiresAt) {
+		return nil, false
+	}
+	return item.Value, true
+}
+
+// Delete removes a key from the cache
+func (c *ConcurrentCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+}
+
+// DeleteFunc removes every key for which match returns true and reports
+// how many were removed.
+func (c *ConcurrentCache) DeleteFunc(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	for key := range c.data {
+		if match(key) {
+			delete(c.data, key)
+			count++
+		}
+	}
+	return count
+}
+
+// Size returns the number of items in the cache (including expired ones)
+func (c *ConcurrentCache) Size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.data)
+}
+
+// Clear removes all items from the cache
+func (c *ConcurrentCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = make(map[string]CacheItem)
+}
+
+// CleanupExpired removes expired items from the cache
+func (c *ConcurrentCache) CleanupExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count := 0
+	now := time.Now()
+	for key, item := range c.data {
+		if now.After(item.ExpiresAt) {
+			delete(c.data, key)
+			count++
+		}
+	}
+	return count
+}
+
+// cacheGenerations counts invalidations per tenant (plus a global count
+// for invalidateAll). The zero value is ready to use.
+type cacheGenerations struct {
+	mu     sync.Mutex
+	all    uint64
+	tenant map[string]uint64
+}
+
+// current returns tenant's generation.
+func (g *cacheGenerations) current(tenant string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.all + g.tenant[tenant]
+}
+
+// storeIf runs store if tenant's generation is still gen. Holding the lock
+// keeps an invalidation from slipping in between the check and the store.
+func (g *cacheGenerations) storeIf(tenant string, gen uint64, store func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.all+g.tenant[tenant] != gen {
+		return false
+	}
+	store()
+	return true
+}
+
+// bump starts a new generation for tenant ("" with all set: for every
+// tenant) and runs invalidate under the same lock.
+func (g *cacheGenerations) bump(tenant string, all bool, invalidate func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if all {
+		g.all++
+	} else {
+		if g.tenant == nil {
+			g.tenant = make(map[string]uint64)
+		}
+		g.tenant[tenant]++
+	}
+	invalidate()
+}
+
+// cachedResponse is one stored GET response.
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+}
+
+// cacheDirectives are the Cache-Control request directives we honour.
+type cacheDirectives struct {
+	noStore, noCache, onlyIfCached bool
+	maxAge                         time.Duration // -1 = not given
+}
+
+func parseCacheControl(r *http.Request) cacheDirectives {
+	d := cacheDirectives{maxAge: -1}
+	for _, part := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(part)), "=")
+		switch name {
+		case "no-store":
+			d.noStore = true
+		case "no-cache":
+			d.noCache = true
+		case "only-if-cached":
+			d.onlyIfCached = true
+		case "max-age":
+			if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && n >= 0 {
+				d.maxAge = time.Duration(n) * time.Second
+			}
+		}
+	}
+	// HTTP/1.0 clients say the same thing with Pragma
+	if r.Header.Get("Pragma") == "no-cache" && r.Header.Get("Cache-Control") == "" {
+		d.noCache = true
+	}
+	return d
+}
+
+// cacheKey identifies a response; see the KEY line at the top.
+func cacheKey(tenant string, r *http.Request) string {
+	// /v1/users and the /users alias are the same resource (see routes.go)
+	return fmt.Sprintf("%s|%s?%s|%s", tenant, unversioned(r.URL.Path), r.URL.Query().Encode(), r.Header.Get("Accept"))
+}
+
+// cacheWriter passes the response through and keeps a copy of the body.
+type cacheWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.buf.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ResponseCache serves repeated GETs for which cacheable(r) is true from c.
+// tenantOf names the key's tenant so tenants never share entries; gens is
+// bumped by whoever invalidates c.
+func ResponseCache(c *ConcurrentCache, gens *cacheGenerations, cacheable func(*http.Request) bool, tenantOf func(*http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet || !cacheable(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cc := parseCacheControl(r)
+			if cc.noStore {
+				w.Header().Set("X-Cache", "BYPASS")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			tenant := tenantOf(r)
+			key := cacheKey(tenant, r)
+			if !cc.noCache {
+				if v, ok := c.Get(key); ok {
+					cached := v.(*cachedResponse)
+					age := time.Since(cached.stored)
+					if cc.maxAge < 0 || age <= cc.maxAge {
+						dst := w.Header()
+						for k, vv := range cached.header {
+							dst[k] = vv
+						}
+						dst.Set("X-Cache", "HIT")
+						dst.Set("Age", strconv.Itoa(int(age.Seconds())))
+						w.WriteHeader(cached.status)
+						w.Write(cached.body)
+						return
+					}
+				}
+			}
+			if cc.onlyIfCached {
+				writeProblem(w, http.StatusGatewayTimeout, "not in cache (only-if-cached)")
+				return
+			}
+
+			w.Header().Set("X-Cache", "MISS")
+			gen := gens.current(tenant) // before the handler reads the store
+			cw := &cacheWriter{ResponseWriter: w}
+			next.ServeHTTP(cw, r)
+
+			if cw.status != http.StatusOK || strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+				return
+			}
+			if c.Size() >= maxCacheEntries && c.CleanupExpired() == 0 {
+				return // full of live entries: serve uncached rather than grow
+			}
+			header := w.Header().Clone()
+			header.Del("X-Cache")
+			gens.storeIf(tenant, gen, func() {
+				c.Set(key, &cachedResponse{status: cw.status, header: header, body: cw.buf.Bytes(), stored: time.Now()})
+			})
+		})
+	}
+}
+
+// isUserRead reports whether r reads the user collection (the routes whose
+// responses ResponseCache may keep).
+func isUserRead(r *http.Request) bool {
+	path := unversioned(r.URL.Path)
+	return path == "/users" || strings.HasPrefix(path, "/users/")
+}
+
+// invalidateUsers drops the cached list and search responses of the
+// request's tenant plus every cached response for user id.
+func (s *Server) invalidateUsers(r *http.Request, id string) {
+	s.invalidateUser(s.storeFor(r).tenant, id)
+}
+
+// invalidateUser is invalidateUsers for changes that didn't come in as a
+// request, e.g. events replicated from the leader (see replication.go) or
+// committed through raft (see raft.go).
+func (s *Server) invalidateUser(tenant, id string) {
+	c := s.current.Load()
+	if c == nil || c.cache == nil {
+		return
+	}
+	prefixes := []string{
+		tenant + "|/users?",
+		tenant + "|/users/search?",
+		tenant + "|/users/" + id + "?",
+		tenant + "|/users/" + id + "/history?",
+	}
+	s.cacheGens.bump(tenant, false, func() {
+		c.cache.DeleteFunc(func(key string) bool {
+			for _, p := range prefixes {
+				if strings.HasPrefix(key, p) {
+					return true
+				}
+			}
+			return false
+		})
+	})
+}
+
+// invalidateTenant drops every cached response of tenant, so a tenant
+// deleted and created again under the same ID starts out empty.
+func (s *Server) invalidateTenant(tenant string) {
+	c := s.current.Load()
+	if c == nil || c.cache == nil {
+		return
+	}
+	s.cacheGens.bump(tenant, false, func() {
+		c.cache.DeleteFunc(func(key string) bool { return strings.HasPrefix(key, tenant+"|") })
+	})
+}
+
+// invalidateAll drops every cached response.
+func (s *Server) invalidateAll() {
+	if c := s.current.Load(); c != nil && c.cache != nil {
+		s.cacheGens.bump("", true, c.cache.Clear)
+	}
+}
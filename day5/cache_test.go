@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCachedServer(t *testing.T, ttl time.Duration) (*Server, http.Handler) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.CacheTTL = Duration{ttl}
+	s := &Server{store: NewUserStore(), config: &cfg}
+	h := s.routes()
+	t.Cleanup(func() { s.stopCurrentLimiter(context.Background()) })
+	s.store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+	return s, h
+}
+
+func cachedGet(h http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestResponseCache_HitMissAndDirectives(t *testing.T) {
+	s, h := newCachedServer(t, time.Minute)
+
+	if got := cachedGet(h, "/users/1").Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("first GET X-Cache = %q; want MISS", got)
+	}
+
+	// change the store behind the cache's back: a hit still shows the old data
+	s.store.Delete(context.Background(), "1")
+	rr := cachedGet(h, "/users/1")
+	if rr.Header().Get("X-Cache") != "HIT" || rr.Header().Get("Age") == "" || !strings.Contains(rr.Body.String(), "Alice") {
+		t.Errorf("second GET = %d %v %s; want cached HIT with Age", rr.Code, rr.Header(), rr.Body.String())
+	}
+
+	tests := []struct {
+		name      string
+		header    []string
+		wantCache string
+		wantCode  int
+	}{
+		{"different Accept is a different entry", []string{"Accept", "application/xml"}, "MISS", http.StatusNotFound},
+		{"max-age=0 rejects the entry", []string{"Cache-Control", "max-age=0"}, "MISS", http.StatusNotFound},
+		{"no-store bypasses", []string{"Cache-Control", "no-store"}, "BYPASS", http.StatusNotFound},
+		{"only-if-cached miss", []string{"Cache-Control", "only-if-cached", "Accept", "text/xml"}, "", http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := cachedGet(h, "/users/1", tt.header...)
+			if rr.Code != tt.wantCode || rr.Header().Get("X-Cache") != tt.wantCache {
+				t.Errorf("got %d X-Cache=%q; want %d X-Cache=%q", rr.Code, rr.Header().Get("X-Cache"), tt.wantCode, tt.wantCache)
+			}
+		})
+	}
+
+	// 404s aren't cached, and no-cache replaced nothing, so the 200 is still there
+	if got := cachedGet(h, "/users/1", "Cache-Control", "only-if-cached").Code; got != http.StatusOK {
+		t.Errorf("only-if-cached hit = %d; want 200", got)
+	}
+	if got := cachedGet(h, "/users/1", "Cache-Control", "no-cache").Code; got != http.StatusNotFound {
+		t.Errorf("no-cache = %d; want fresh 404", got)
+	}
+}
+
+func TestResponseCache_WriteInvalidates(t *testing.T) {
+	_, h := newCachedServer(t, time.Minute)
+
+	cachedGet(h, "/users")
+	cachedGet(h, "/users/search?q=bob")
+	if got := cachedGet(h, "/users").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("X-Cache = %q; want HIT before the write", got)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"id":"2","name":"Bob","age":25}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create = %d", rr.Code)
+	}
+
+	for _, target := range []string{"/users", "/users/search?q=bob"} {
+		rr := cachedGet(h, target)
+		if rr.Header().Get("X-Cache") != "MISS" || !strings.Contains(rr.Body.String(), "Bob") {
+			t.Errorf("%s after create: X-Cache=%q body=%s; want fresh MISS with Bob", target, rr.Header().Get("X-Cache"), rr.Body.String())
+		}
+	}
+
+	cachedGet(h, "/users/2")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/users/2", nil))
+	if got := cachedGet(h, "/users/2").Code; got != http.StatusNotFound {
+		t.Errorf("GET after delete = %d; want 404 (entry invalidated)", got)
+	}
+}
+
+func TestResponseCache_MissAcrossWriteIsNotStored(t *testing.T) {
+	tests := []struct {
+		name        string
+		writeTenant string // tenant whose write lands while the miss runs
+		all         bool   // invalidateAll instead
+		wantStored  bool
+	}{
+		{"same tenant", "t1", false, false},
+		{"everything", "", true, false},
+		{"other tenant", "t2", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConcurrentCache(time.Minute)
+			var gens cacheGenerations
+			version := "old"
+			during := func() {
+				// a write and its invalidation, after the handler read the store
+				version = "new"
+				gens.bump(tt.writeTenant, tt.all, c.Clear)
+			}
+			h := ResponseCache(c, &gens, func(*http.Request) bool { return true }, func(*http.Request) string { return "t1" })(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					body := version
+					if during != nil {
+						during()
+						during = nil
+					}
+					io.WriteString(w, body)
+				}))
+
+			if rr := cachedGet(h, "/users/1"); rr.Body.String() != "old" {
+				t.Fatalf("first GET = %q", rr.Body)
+			}
+			rr := cachedGet(h, "/users/1")
+			if stored := rr.Header().Get("X-Cache") == "HIT"; stored != tt.wantStored {
+				t.Errorf("second GET = %s %q; stored = %v, want %v", rr.Header().Get("X-Cache"), rr.Body, stored, tt.wantStored)
+			}
+			if !tt.wantStored && rr.Body.String() != "new" {
+				t.Errorf("second GET = %q; want the new version", rr.Body)
+			}
+		})
+	}
+}
+
+func TestResponseCache_Expires(t *testing.T) {
+	_, h := newCachedServer(t, 20*time.Millisecond)
+	cachedGet(h, "/users/1")
+	time.Sleep(30 * time.Millisecond)
+	if got := cachedGet(h, "/users/1").Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache after TTL = %q; want MISS", got)
+	}
+}
+
+func TestResponseCache_DeletedTenantStartsEmpty(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CacheTTL = Duration{time.Minute}
+	s, h := newTenantServer(t, cfg)
+	admin := s.adminRoutes("")
+	adminDo := func(method, target, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:5000"
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, tenantRequest(http.MethodPost, "/users", "a", `{"id":"1","name":"Alice","age":30}`))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create = %d", rr.Code)
+	}
+	cachedGet(h, "/users", "X-Tenant-ID", "a")
+	if got := cachedGet(h, "/users", "X-Tenant-ID", "a").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("X-Cache = %q; want HIT", got)
+	}
+
+	if code := adminDo(http.MethodDelete, "/admin/tenants/a", ""); code != http.StatusNoContent {
+		t.Fatalf("delete tenant = %d", code)
+	}
+	if code := adminDo(http.MethodPost, "/admin/tenants", `{"id":"a"}`); code != http.StatusCreated {
+		t.Fatalf("recreate tenant = %d", code)
+	}
+	rr = cachedGet(h, "/users", "X-Tenant-ID", "a")
+	if rr.Header().Get("X-Cache") == "HIT" || strings.Contains(rr.Body.String(), "Alice") {
+		t.Errorf("recreated tenant got the old cached list (%s): %s", rr.Header().Get("X-Cache"), rr.Body)
+	}
+}
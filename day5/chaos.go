@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 29. Fault Injection
+//
+// WHY?
+// Timeouts, retries, the rate limiter and the load generator are only
+// proven when things go wrong - and day6's UserStore faked that with a
+// hard-coded time.Sleep(100 * time.Millisecond). A FaultInjector makes
+// things go wrong on purpose, on demand:
+//
+//	{
+//	  "seed": 42,
+//	  "rules": [
+//	    {"op": "create", "latency": "100ms", "jitter": "20ms", "distribution": "normal"},
+//	    {"route": "GET /users/{id}", "error_rate": 0.1, "status": 503},
+//	    {"op": "*", "cancel_rate": 0.01, "panic_rate": 0.001}
+//	  ]
+//	}
+//
+// A rule matches a store operation ("op": create, get, list, update,
+// delete, search) or an HTTP route ("route": the path pattern, optionally
+// prefixed with the method). The first matching rule applies:
+//  1. the call is delayed by a latency drawn from the rule's distribution
+//     (fixed, uniform latency±jitter, or normal with stddev jitter)
+//  2. then, by one random draw, it panics, sees its context cancelled,
+//     fails (store: ErrInjectedFault, HTTP: status, default 503) or
+//     goes through.
+//
+// HOW IT IS USED:
+//   - FaultyStore wraps a UserStore and calls Inject(ctx, op) before each
+//     of its operations. Handlers get one from s.storeFor, so the store
+//     itself - and the shards, raft and tenants behind it - knows nothing
+//     of faults (a nil injector does nothing).
+//   - The Faults middleware sits inside Logging, so injected failures are
+//     logged, and inside RequestTimeout, so injected latency counts
+//     against the deadline.
+//   - GET/PUT/DELETE /admin/faults read, replace and clear the rules while
+//     the server runs.
+//
+// REPRODUCIBLE CHAOS:
+// Every decision comes from one seeded generator. Replacing the rules
+// reseeds it, so the same seed and the same sequence of calls give the
+// same faults. With "seed": 0 a random seed is chosen and reported by
+// GET /admin/faults, so a run that found a bug can be repeated. (Calls
+// from concurrent goroutines draw in scheduling order; a test that needs
+// exact repeats makes its calls one at a time.)
+
+// ErrInjectedFault is returned by store operations a rule made fail.
+var ErrInjectedFault = errors.New("injected fault")
+
+// faultOps are the store operations a rule's "op" can name.
+var faultOps = []string{"create", "get", "list", "update", "delete", "search"}
+
+// FaultRule describes the faults for one operation or route.
+type FaultRule struct {
+	Op    string `json:"op,omitempty"`    // store operation, "*" = all
+	Route string `json:"route,omitempty"` // "/users/{id}" or "GET /users/{id}", "*" = all
+
+	Latency      Duration `json:"latency"`
+	Jitter       Duration `json:"jitter"`
+	Distribution string   `json:"distribution,omitempty"` // fixed (default), uniform, normal
+
+	ErrorRate  float64 `json:"error_rate"`
+	Status     int     `json:"status,omitempty"` // HTTP status for injected errors (default 503)
+	CancelRate float64 `json:"cancel_rate"`
+	PanicRate  float64 `json:"panic_rate"`
+}
+
+// FaultConfig is what -faults loads and PUT /admin/faults replaces.
+type FaultConfig struct {
+	Seed  uint64      `json:"seed"` // 0 = pick one
+	Rules []FaultRule `json:"rules"`
+}
+
+// Validate rejects rules that would match nothing or can't be drawn from.
+func (c FaultConfig) Validate() error {
+	for i, r := range c.Rules {
+		if (r.Op == "") == (r.Route == "") {
+			return fmt.Errorf("rule %d: set exactly one of op and route", i)
+		}
+		if r.Op != "" && r.Op != "*" && !slices.Contains(faultOps, r.Op) {
+			return fmt.Errorf("rule %d: unknown op %q (want one of %v or *)", i, r.Op, faultOps)
+		}
+		switch r.Distribution {
+		case "", "fixed", "uniform", "normal":
+		default:
+			return fmt.Errorf("rule %d: unknown distribution %q (want fixed, uniform or normal)", i, r.Distribution)
+		}
+		if r.Latency.Duration < 0 || r.Jitter.Duration < 0 {
+			return fmt.Errorf("rule %d: latency and jitter can't be negative", i)
+		}
+		for _, rate := range []float64{r.ErrorRate, r.CancelRate, r.PanicRate} {
+			if rate < 0 || rate > 1 {
+				return fmt.Errorf("rule %d: rates must be between 0 and 1", i)
+			}
+		}
+		if sum := r.ErrorRate + r.CancelRate + r.PanicRate; sum > 1 {
+			return fmt.Errorf("rule %d: error, cancel and panic rates add up to %v (max 1)", i, sum)
+		}
+		if r.Status != 0 && (r.Status < 400 || r.Status > 599) {
+			return fmt.Errorf("rule %d: status %d is not an error status", i, r.Status)
+		}
+	}
+	return nil
+}
+
+// LoadFaultConfig reads a FaultConfig from a JSON file.
+func LoadFaultConfig(path string) (FaultConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FaultConfig{}, err
+	}
+	defer f.Close()
+	var cfg FaultConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return FaultConfig{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return FaultConfig{}, fmt.Errorf("invalid faults %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// FaultCounts counts the faults injected since the rules were last set.
+type FaultCounts struct {
+	Delayed  uint64 `json:"delayed"`
+	Errors   uint64 `json:"errors"`
+	Cancels  uint64 `json:"cancels"`
+	Panics   uint64 `json:"panics"`
+	Unharmed uint64 `json:"unharmed"` // matched a rule, no fault drawn
+}
+
+// FaultStatus is what GET /admin/faults returns.
+type FaultStatus struct {
+	FaultConfig
+	Injected FaultCounts `json:"injected"`
+}
+
+// faultKind is what a draw decided beyond the delay.
+type faultKind int
+
+const (
+	faultNone faultKind = iota
+	faultError
+	faultCancel
+	faultPanic
+)
+
+// fault is one drawn decision.
+type fault struct {
+	delay  time.Duration
+	kind   faultKind
+	status int
+}
+
+// FaultInjector holds the rules and the seeded generator behind them.
+// A nil *FaultInjector injects nothing.
+type FaultInjector struct {
+	mu     sync.Mutex
+	cfg    FaultConfig
+	rng    *rand.Rand
+	counts FaultCounts
+}
+
+// NewFaultInjector returns an injector for cfg.
+func NewFaultInjector(cfg FaultConfig) (*FaultInjector, error) {
+	fi := &FaultInjector{}
+	if err := fi.Set(cfg); err != nil {
+		return nil, err
+	}
+	return fi, nil
+}
+
+// Set replaces the rules, reseeds the generator and resets the counts.
+func (fi *FaultInjector) Set(cfg FaultConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.Seed == 0 {
+		cfg.Seed = rand.Uint64() | 1 // never 0: the status must show a seed that reproduces the run
+	}
+	cfg.Rules = slices.Clone(cfg.Rules)
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	fi.cfg = cfg
+	fi.rng = rand.New(rand.NewPCG(cfg.Seed, cfg.Seed))
+	fi.counts = FaultCounts{}
+	return nil
+}
+
+// Status returns the rules, the seed in use and the counts.
+func (fi *FaultInjector) Status() FaultStatus {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	cfg := fi.cfg
+	cfg.Rules = slices.Clone(cfg.Rules)
+	return FaultStatus{FaultConfig: cfg, Injected: fi.counts}
+}
+
+// draw finds the first rule that matches and decides its fault.
+func (fi *FaultInjector) draw(match func(FaultRule) bool) (fault, bool) {
+	if fi == nil {
+		return fault{}, false
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	i := slices.IndexFunc(fi.cfg.Rules, match)
+	if i < 0 {
+		return fault{}, false
+	}
+	r := fi.cfg.Rules[i]
+
+	f := fault{delay: r.Latency.Duration, status: r.Status}
+	switch jitter := float64(r.Jitter.Duration); r.Distribution {
+	case "uniform":
+		f.delay += time.Duration((fi.rng.Float64()*2 - 1) * jitter)
+	case "normal":
+		f.delay += time.Duration(fi.rng.NormFloat64() * jitter)
+	}
+	f.delay = max(f.delay, 0)
+	if f.status == 0 {
+		f.status = http.StatusServiceUnavailable
+	}
+
+	// one draw for all outcomes: the rates are slices of [0, 1)
+	switch u := fi.rng.Float64(); {
+	case u < r.PanicRate:
+		f.kind = faultPanic
+		fi.counts.Panics++
+	case u < r.PanicRate+r.CancelRate:
+		f.kind = faultCancel
+		fi.counts.Cancels++
+	case u < r.PanicRate+r.CancelRate+r.ErrorRate:
+		f.kind = faultError
+		fi.counts.Errors++
+	case f.delay == 0:
+		fi.counts.Unharmed++
+	}
+	if f.delay > 0 {
+		fi.counts.Delayed++
+	}
+	return f, true
+}
+
+// sleepCtx waits for d, or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Inject applies the faults for a store operation. The error wraps
+// ErrInjectedFault, or context.Canceled for an injected cancellation (the
+// caller's context is not ours to cancel, so the store reports it).
+func (fi *FaultInjector) Inject(ctx context.Context, op string) error {
+	f, ok := fi.draw(func(r FaultRule) bool { return r.Op == op || r.Op == "*" })
+	if !ok {
+		return nil
+	}
+	if err := sleepCtx(ctx, f.delay); err != nil {
+		return err
+	}
+	switch f.kind {
+	case faultPanic:
+		panic(fmt.Sprintf("injected panic in UserStore.%s", op))
+	case faultCancel:
+		return fmt.Errorf("%s: injected cancellation: %w", op, context.Canceled)
+	case faultError:
+		return fmt.Errorf("%s: %w", op, ErrInjectedFault)
+	}
+	return nil
+}
+
+// FaultyStore is a UserStore whose operations first go through Inject.
+// Everything else (tenant, history, stats) is the wrapped store's.
+type FaultyStore struct {
+	*UserStore
+	faults *FaultInjector
+}
+
+func (f FaultyStore) Create(ctx context.Context, user User) error {
+	if err := f.faults.Inject(ctx, "create"); err != nil {
+		return err
+	}
+	return f.UserStore.Create(ctx, user)
+}
+
+func (f FaultyStore) Get(ctx context.Context, id string) (User, error) {
+	if err := f.faults.Inject(ctx, "get"); err != nil {
+		return User{}, err
+	}
+	return f.UserStore.Get(ctx, id)
+}
+
+func (f FaultyStore) List(ctx context.Context, filters ...Predicate) ([]User, error) {
+	if err := f.faults.Inject(ctx, "list"); err != nil {
+		return nil, err
+	}
+	return f.UserStore.List(ctx, filters...)
+}
+
+func (f FaultyStore) Update(ctx context.Context, user User) error {
+	if err := f.faults.Inject(ctx, "update"); err != nil {
+		return err
+	}
+	return f.UserStore.Update(ctx, user)
+}
+
+func (f FaultyStore) Delete(ctx context.Context, id string) error {
+	if err := f.faults.Inject(ctx, "delete"); err != nil {
+		return err
+	}
+	return f.UserStore.Delete(ctx, id)
+}
+
+func (f FaultyStore) Search(ctx context.Context, q string, limit int) ([]SearchResult, error) {
+	if err := f.faults.Inject(ctx, "search"); err != nil {
+		return nil, err
+	}
+	return f.UserStore.Search(ctx, q, limit)
+}
+
+// Faults injects the faults of route rules into HTTP requests. routeOf
+// returns the mux pattern a request will be served by (this middleware
+// runs before the mux has matched it).
+func Faults(fi *FaultInjector, routeOf func(*http.Request) string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeKey(routeOf(r))
+			f, ok := fi.draw(func(rule FaultRule) bool {
+				return rule.Route == "*" || rule.Route == route || rule.Route == r.Method+" "+route
+			})
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if err := sleepCtx(r.Context(), f.delay); err != nil {
+				return // client gone or deadline passed; RequestTimeout answers for us
+			}
+			switch f.kind {
+			case faultPanic:
+				panic(fmt.Sprintf("injected panic on %s %s", r.Method, route))
+			case faultCancel:
+				// as if the client hung up just as the handler started
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			case faultError:
+				writeProblem(w, f.status, fmt.Sprintf("injected fault on %s %s", r.Method, route))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// HTTP handlers (admin listener)
+
+const faultsOff = "fault injection is off (start the server with -faults)"
+
+// handleGetFaults serves GET /admin/faults.
+func (s *Server) handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	if s.faults == nil {
+		writeProblem(w, http.StatusNotImplemented, faultsOff)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.faults.Status())
+}
+
+// handleSetFaults serves PUT /admin/faults.
+func (s *Server) handleSetFaults(w http.ResponseWriter, r *http.Request) {
+	if s.faults == nil {
+		writeProblem(w, http.StatusNotImplemented, faultsOff)
+		return
+	}
+	var cfg FaultConfig
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	if err := s.faults.Set(cfg); err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.handleGetFaults(w, r)
+}
+
+// handleClearFaults serves DELETE /admin/faults: no rules, nothing injected.
+func (s *Server) handleClearFaults(w http.ResponseWriter, r *http.Request) {
+	if s.faults == nil {
+		writeProblem(w, http.StatusNotImplemented, faultsOff)
+		return
+	}
+	_ = s.faults.Set(FaultConfig{})
+	w.WriteHeader(http.StatusNoContent)
+}
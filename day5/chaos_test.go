@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    FaultRule
+		wantErr string
+	}{
+		{"op", FaultRule{Op: "create", Latency: Duration{time.Millisecond}}, ""},
+		{"route", FaultRule{Route: "GET /users/{id}", ErrorRate: 0.5, Status: 500}, ""},
+		{"neither", FaultRule{ErrorRate: 1}, "exactly one of op and route"},
+		{"both", FaultRule{Op: "get", Route: "*"}, "exactly one of op and route"},
+		{"unknown op", FaultRule{Op: "upsert"}, "unknown op"},
+		{"distribution", FaultRule{Op: "*", Distribution: "poisson"}, "unknown distribution"},
+		{"rate", FaultRule{Op: "*", ErrorRate: 1.5}, "between 0 and 1"},
+		{"rates add up", FaultRule{Op: "*", ErrorRate: 0.6, PanicRate: 0.6}, "add up"},
+		{"status", FaultRule{Route: "*", ErrorRate: 1, Status: 200}, "not an error status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := FaultConfig{Rules: []FaultRule{tt.rule}}.Validate()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate = %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFaultInjector_SameSeedSameFaults(t *testing.T) {
+	run := func(seed uint64) string {
+		fi, err := NewFaultInjector(FaultConfig{Seed: seed, Rules: []FaultRule{{Op: "get", ErrorRate: 0.5}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var outcome strings.Builder
+		for range 64 {
+			if fi.Inject(context.Background(), "get") != nil {
+				outcome.WriteByte('x')
+			} else {
+				outcome.WriteByte('.')
+			}
+		}
+		return outcome.String()
+	}
+	a, b, c := run(42), run(42), run(7)
+	if a != b {
+		t.Errorf("seed 42 gave\n%s\n%s", a, b)
+	}
+	if a == c {
+		t.Errorf("seeds 42 and 7 gave the same faults %s", a)
+	}
+	if n := strings.Count(a, "x"); n < 16 || n > 48 {
+		t.Errorf("%d of 64 calls failed at error_rate 0.5", n)
+	}
+
+	// without a seed one is picked, and reported so the run can be repeated
+	fi, _ := NewFaultInjector(FaultConfig{})
+	if fi.Status().Seed == 0 {
+		t.Error("no seed reported")
+	}
+}
+
+func TestFaultInjector_LatencyDistributions(t *testing.T) {
+	const n = 2000
+	tests := []struct {
+		dist     string
+		min, max time.Duration // every draw
+		mean     time.Duration // of all draws, ±5%
+	}{
+		{"fixed", 10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond},
+		{"uniform", 6 * time.Millisecond, 14 * time.Millisecond, 10 * time.Millisecond},
+		{"normal", 0, time.Second, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dist, func(t *testing.T) {
+			fi, _ := NewFaultInjector(FaultConfig{Seed: 1, Rules: []FaultRule{
+				{Op: "get", Latency: Duration{10 * time.Millisecond}, Jitter: Duration{4 * time.Millisecond}, Distribution: tt.dist},
+			}})
+			var sum time.Duration
+			var delayed uint64
+			for range n {
+				f, ok := fi.draw(func(r FaultRule) bool { return r.Op == "get" })
+				if !ok || f.delay < tt.min || f.delay > tt.max {
+					t.Fatalf("delay %v; want within [%v, %v]", f.delay, tt.min, tt.max)
+				}
+				sum += f.delay
+				if f.delay > 0 {
+					delayed++ // a normal draw below zero is no delay
+				}
+			}
+			if mean := sum / n; math.Abs(float64(mean-tt.mean)) > 0.05*float64(tt.mean) {
+				t.Errorf("mean delay %v; want about %v", mean, tt.mean)
+			}
+			if got := fi.Status().Injected.Delayed; got != delayed {
+				t.Errorf("counted %d delays; want %d", got, delayed)
+			}
+		})
+	}
+}
+
+func TestUserStore_InjectedFaults(t *testing.T) {
+	ctx := context.Background()
+	inner := NewUserStore()
+	inner.Create(ctx, User{ID: "1", Name: "Alice", Age: 30})
+	fi, _ := NewFaultInjector(FaultConfig{Seed: 1, Rules: []FaultRule{
+		{Op: "create", ErrorRate: 1},
+		{Op: "get", CancelRate: 1},
+		{Op: "list", Latency: Duration{time.Second}},
+		{Op: "delete", PanicRate: 1},
+	}})
+	us := FaultyStore{inner, fi}
+
+	tests := []struct {
+		name    string
+		call    func(context.Context) error
+		wantErr error
+	}{
+		{"error", func(ctx context.Context) error { return us.Create(ctx, User{ID: "2", Name: "Bob", Age: 25}) }, ErrInjectedFault},
+		{"cancel", func(ctx context.Context) error { _, err := us.Get(ctx, "1"); return err }, context.Canceled},
+		{"latency past the deadline", func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+			defer cancel()
+			_, err := us.List(ctx)
+			return err
+		}, context.DeadlineExceeded},
+		{"no rule", func(ctx context.Context) error { return us.Update(ctx, User{ID: "1", Name: "Alice", Age: 31}) }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(ctx); !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	func() {
+		defer func() {
+			if p := recover(); p == nil || !strings.Contains(p.(string), "injected panic in UserStore.delete") {
+				t.Errorf("recovered %v; want the injected panic", p)
+			}
+		}()
+		us.Delete(ctx, "1")
+	}()
+
+	if _, err := inner.Get(ctx, "1"); err != nil {
+		t.Errorf("the wrapped store saw a fault: %v", err)
+	}
+	got := fi.Status().Injected
+	if got != (FaultCounts{Delayed: 1, Errors: 1, Cancels: 1, Panics: 1}) {
+		t.Errorf("counts = %+v", got)
+	}
+}
+
+func TestFaultsMiddleware(t *testing.T) {
+	fi, _ := NewFaultInjector(FaultConfig{Seed: 1, Rules: []FaultRule{
+		{Route: "GET /users/{id}", ErrorRate: 1, Status: http.StatusBadGateway},
+		{Route: "/users/search", CancelRate: 1},
+		{Route: "DELETE /users/{id}", PanicRate: 1},
+	}})
+	s := &Server{store: NewUserStore(), faults: fi}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+	s.store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+
+	tests := []struct {
+		method, path string
+		wantStatus   int
+	}{
+		{http.MethodGet, "/users/1", http.StatusBadGateway},
+		{http.MethodGet, "/v1/users/1", http.StatusBadGateway}, // versioned routes share the rule
+		{http.MethodPut, "/users/1", http.StatusOK},            // other method, no rule
+		{http.MethodGet, "/users", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"name":"Alice","age":31}`)))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+		})
+	}
+
+	// the handler sees a cancelled context, as if the client had hung up
+	var sawCancel bool
+	mw := Faults(fi, func(*http.Request) string { return "GET /users/search" })
+	mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawCancel = r.Context().Err() == context.Canceled
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/search?q=al", nil))
+	if !sawCancel {
+		t.Error("handler did not see a cancelled context")
+	}
+
+	defer func() {
+		if p := recover(); p == nil {
+			t.Error("DELETE did not panic")
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/users/1", nil))
+}
+
+func TestFaultAdminEndpoints(t *testing.T) {
+	fi, _ := NewFaultInjector(FaultConfig{})
+	tests := []struct {
+		name       string
+		faults     *FaultInjector
+		method     string
+		body       string
+		wantStatus int
+	}{
+		{"off", nil, http.MethodGet, "", http.StatusNotImplemented},
+		{"get", fi, http.MethodGet, "", http.StatusOK},
+		{"set", fi, http.MethodPut, `{"seed":9,"rules":[{"op":"get","error_rate":0.2}]}`, http.StatusOK},
+		{"invalid rule", fi, http.MethodPut, `{"rules":[{"op":"get","error_rate":2}]}`, http.StatusBadRequest},
+		{"unknown field", fi, http.MethodPut, `{"rulez":[]}`, http.StatusBadRequest},
+		{"clear", fi, http.MethodDelete, "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{store: NewUserStore(), faults: tt.faults}
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/admin/faults", strings.NewReader(tt.body))
+			req.RemoteAddr = "127.0.0.1:50000" // admin routes are loopback-only without a token
+			s.adminRoutes("").ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+			if tt.name == "set" {
+				var st FaultStatus
+				json.NewDecoder(bytes.NewReader(rr.Body.Bytes())).Decode(&st)
+				if st.Seed != 9 || len(st.Rules) != 1 || st.Rules[0].ErrorRate != 0.2 {
+					t.Errorf("after PUT status = %+v", st)
+				}
+			}
+		})
+	}
+	if st := fi.Status(); len(st.Rules) != 0 {
+		t.Errorf("rules after DELETE = %+v; want none", st.Rules)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 13. Client SDK
+//
+// A small typed client for the user API. Every call takes a ctx, so callers
+// control timeouts and cancellation, and the ctx's span (if any) is carried
+// to the server by TracingTransport.
+//
+// Example:
+//
+//	c := NewClient("http://localhost:8080", nil)
+//	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+//	defer cancel()
+//	u, err := c.GetUser(ctx, "1")
+
+// APIError is returned for any non-2xx response.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+}
+
+// Client talks to the day5 user API (v1, see routes.go).
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	Tenant  string // sent as X-Tenant-ID when set (see tenant.go)
+}
+
+// NewClient creates a client. With a tracer, every request gets a client
+// span and a traceparent header; without one, an existing span in the
+// request ctx is still propagated.
+func NewClient(baseURL string, tracer *Tracer) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTP:    &http.Client{Transport: &TracingTransport{Tracer: tracer}},
+	}
+}
+
+// do sends a request and decodes a JSON response into out (if non-nil).
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.Tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.Tenant)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &APIError{StatusCode: resp.StatusCode, Body: string(b)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) CreateUser(ctx context.Context, u User) (User, error) {
+	var created User
+	err := c.do(ctx, http.MethodPost, "/v1/users", u, &created)
+	return created, err
+}
+
+func (c *Client) GetUser(ctx context.Context, id string) (User, error) {
+	var u User
+	err := c.do(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(id), nil, &u)
+	return u, err
+}
+
+// ListUsers lists users; query holds optional filters (name, name_prefix, age, ...).
+func (c *Client) ListUsers(ctx context.Context, query url.Values) ([]User, error) {
+	path := "/v1/users"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var users []User
+	err := c.do(ctx, http.MethodGet, path, nil, &users)
+	return users, err
+}
+
+func (c *Client) UpdateUser(ctx context.Context, u User) (User, error) {
+	var updated User
+	err := c.do(ctx, http.MethodPut, "/v1/users/"+url.PathEscape(u.ID), u, &updated)
+	return updated, err
+}
+
+// UserHistory returns every change to a user (event-sourced servers only).
+func (c *Client) UserHistory(ctx context.Context, id string) ([]StoredEvent, error) {
+	var events []StoredEvent
+	err := c.do(ctx, http.MethodGet, "/v1/users/"+url.PathEscape(id)+"/history", nil, &events)
+	return events, err
+}
+
+func (c *Client) DeleteUser(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/v1/users/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *Client) SearchUsers(ctx context.Context, q string, limit int) ([]SearchResult, error) {
+	var results []SearchResult
+	path := fmt.Sprintf("/v1/users/search?q=%s&limit=%d", url.QueryEscape(q), limit)
+	err := c.do(ctx, http.MethodGet, path, nil, &results)
+	return results, err
+}
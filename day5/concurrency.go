@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 14. Adaptive Concurrency Limiting and Load Shedding
+//
+// WHY?
+// Under overload the RateLimiter lets requests queue until their context
+// expires, so EVERYONE's latency explodes. Instead we cap how many requests
+// are in flight and reject the excess immediately with 503 - a fast "no" is
+// better than a slow timeout.
+//
+// The cap isn't fixed. It follows AIMD (Additive Increase, Multiplicative
+// Decrease - the same idea TCP uses for congestion control):
+//   - request finished fast and OK -> limit += 1/limit  (~ +1 per "window")
+//   - request slow or 5xx          -> limit *= 0.9      (back off quickly)
+// so the limit settles around what the server can actually handle.
+//
+// The limiter sits inside the RateLimiter: requests waiting there for a
+// token hold no slot, so the limit only reacts to how fast the server
+// handles what it admitted.
+//
+// Health probes get a small reserved Semaphore (same design as day8's
+// Semaphore) so they still answer while user traffic is shed. (Admin
+// routes are on their own listener, see admin.go, and never get here.)
+
+// Semaphore limits the number of concurrent operations (see day8).
+type Semaphore struct {
+	ch chan struct{}
+}
+
+// NewSemaphore creates a new semaphore with the given limit
+func NewSemaphore(limit int) *Semaphore {
+	return &Semaphore{
+		ch: make(chan struct{}, limit),
+	}
+}
+
+// Acquire blocks until a slot is available
+func (s *Semaphore) Acquire() {
+	s.ch <- struct{}{}
+}
+
+// TryAcquire attempts to acquire without blocking
+func (s *Semaphore) TryAcquire() bool {
+	select {
+	case s.ch <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees a slot
+func (s *Semaphore) Release() {
+	<-s.ch
+}
+
+// AdaptiveLimiter is a semaphore whose capacity moves with observed latency.
+// Unlike Semaphore it never blocks: TryAcquire either admits or sheds.
+type AdaptiveLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	min, max float64
+	inflight int
+	target   time.Duration // latency above this counts as "overloaded"
+	backoff  float64       // multiplicative decrease factor
+
+	shed atomic.Int64 // requests rejected so far
+}
+
+// NewAdaptiveLimiter starts halfway between min and max.
+func NewAdaptiveLimiter(min, max int, target time.Duration) *AdaptiveLimiter {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &AdaptiveLimiter{
+		limit:   float64(min) + float64(max-min)/2,
+		min:     float64(min),
+		max:     float64(max),
+		target:  target,
+		backoff: 0.9,
+	}
+}
+
+// TryAcquire admits a request if fewer than Limit() are in flight.
+func (l *AdaptiveLimiter) TryAcquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight >= int(l.limit) {
+		l.shed.Add(1)
+		return false
+	}
+	l.inflight++
+	return true
+}
+
+// Release frees a slot and feeds the request's outcome into the AIMD rule.
+func (l *AdaptiveLimiter) Release(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inflight--
+	if failed || latency > l.target {
+		l.limit = max(l.min, l.limit*l.backoff)
+	} else {
+		l.limit = min(l.max, l.limit+1/l.limit)
+	}
+}
+
+// LimiterStats is a snapshot for /debug/stats.
+type LimiterStats struct {
+	Limit    int   `json:"limit"`
+	InFlight int   `json:"in_flight"`
+	Shed     int64 `json:"shed"`
+}
+
+func (l *AdaptiveLimiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return LimiterStats{Limit: int(l.limit), InFlight: l.inflight, Shed: l.shed.Load()}
+}
+
+// isHealthProbe reports whether r is a health check.
+func isHealthProbe(r *http.Request) bool {
+	return r.URL.Path == "/healthz"
+}
+
+// ConcurrencyLimit sheds user traffic with 503 once l is full. Health
+// probes first try their reserved slots and only then compete for l.
+func ConcurrencyLimit(l *AdaptiveLimiter, reserved *Semaphore) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHealthProbe(r) && reserved.TryAcquire() {
+				defer reserved.Release()
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !l.TryAcquire() {
+				w.Header().Set("Retry-After", "1")
+				writeProblem(w, http.StatusServiceUnavailable, fmt.Sprintf("server overloaded (concurrency limit %d)", l.Stats().Limit))
+				return
+			}
+
+			// defer: the slot must come back even if the handler panics
+			// (a panic counts as a failure)
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			completed := false
+			defer func() {
+				l.Release(time.Since(start), !completed || sw.status >= 500)
+			}()
+			next.ServeHTTP(sw, r)
+			completed = true
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveLimiter_AIMD(t *testing.T) {
+	l := NewAdaptiveLimiter(2, 10, 50*time.Millisecond)
+	if got := l.Stats().Limit; got != 6 {
+		t.Fatalf("initial limit = %d; want 6", got)
+	}
+
+	// fast successes grow the limit, capped at max
+	for i := 0; i < 500; i++ {
+		if !l.TryAcquire() {
+			t.Fatalf("acquire %d failed", i)
+		}
+		l.Release(time.Millisecond, false)
+	}
+	if got := l.Stats().Limit; got != 10 {
+		t.Errorf("limit after fast successes = %d; want 10", got)
+	}
+
+	// slow or failed requests shrink it, floored at min
+	for i := 0; i < 100; i++ {
+		l.TryAcquire()
+		l.Release(time.Second, false)
+	}
+	if got := l.Stats().Limit; got != 2 {
+		t.Errorf("limit after slow requests = %d; want 2", got)
+	}
+}
+
+func TestAdaptiveLimiter_Sheds(t *testing.T) {
+	l := NewAdaptiveLimiter(2, 2, time.Second)
+	if !l.TryAcquire() || !l.TryAcquire() {
+		t.Fatal("first two acquires should succeed")
+	}
+	if l.TryAcquire() {
+		t.Fatal("third acquire should be shed")
+	}
+	if got := l.Stats().Shed; got != 1 {
+		t.Errorf("Shed = %d; want 1", got)
+	}
+	l.Release(time.Millisecond, false)
+	if !l.TryAcquire() {
+		t.Error("acquire after release should succeed")
+	}
+}
+
+func TestConcurrencyLimit_ShedsAndPrioritizes(t *testing.T) {
+	l := NewAdaptiveLimiter(1, 1, time.Second)
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	h := ConcurrencyLimit(l, NewSemaphore(1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// occupy the only user slot
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+	}()
+	<-started
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("overflow request status = %d; want 503", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("shed response has no Retry-After")
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("healthz while saturated = %d; want 200", rr.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	if got := l.Stats().InFlight; got != 0 {
+		t.Errorf("InFlight after completion = %d; want 0", got)
+	}
+}
+
+func TestConcurrencyLimit_ReleasesOnPanic(t *testing.T) {
+	l := NewAdaptiveLimiter(1, 1, time.Second)
+	h := ConcurrencyLimit(l, NewSemaphore(1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	func() {
+		defer func() { recover() }()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users", nil))
+	}()
+	if got := l.Stats().InFlight; got != 0 {
+		t.Errorf("slot leaked after panic: InFlight = %d", got)
+	}
+}
+
+func TestConcurrencyLimit_InsideRateLimiter(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+	cfg := DefaultConfig()
+	cfg.RateLimit, cfg.RateBurst = 10, 1 // a token every 100ms
+	cfg.MinConcurrency, cfg.MaxConcurrency = 1, 1
+	if err := s.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// requests queued for a token hold no slot, so none of them is shed
+	codes := make(chan int, 4)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users", nil))
+			codes <- rr.Code
+		})
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("status = %d; want 200 for every rate-limited request", code)
+		}
+	}
+}
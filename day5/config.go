@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 9. Configuration and Hot Reload
+//
+// WHY?
+// Changing the rate limit or timeout used to mean a restart (and dropped
+// connections). Now the tunable settings live in a JSON file:
+//
+//	{
+//	  "rate_limit": 20,
+//	  "rate_burst": 10,
+//	  "request_timeout": "1s",
+//	  "route_timeouts": {"/users/search": "3s"},
+//	  "log_level": "info",
+//	  "cors_origins": ["https://admin.example.com"]
+//	}
+//
+// On SIGHUP (or when the file's modification time changes) the file is
+// re-read, validated, and - only if valid - a new middleware chain is built
+// and swapped in with one atomic pointer store. Requests already running
+// finish on the chain they started with.
+
+// Duration is a time.Duration that reads/writes JSON as "1s", "250ms", ...
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Config holds the server settings. Everything except the listener
+// settings (Addr, AdminAddr, AdminToken, SocketMode) and WebhookBackoff can
+// be reloaded while the server runs.
+type Config struct {
+	Addr           string              `json:"addr"`        // host:port, or unix:/path.sock (see listen.go)
+	SocketMode     FileMode            `json:"socket_mode"` // permissions of unix: sockets
+	AdminAddr      string              `json:"admin_addr"`  // "" = no admin listener (see admin.go)
+	AdminToken     string              `json:"admin_token"` // required unless AdminAddr is loopback
+	RateLimit      int                 `json:"rate_limit"`
+	RateBurst      int                 `json:"rate_burst"`
+	RequestTimeout Duration            `json:"request_timeout"`
+	RouteTimeouts  map[string]Duration `json:"route_timeouts"` // route path ("/users/{id}") -> timeout
+	LogLevel       string              `json:"log_level"`
+	CORSOrigins    []string            `json:"cors_origins"`
+
+	// Adaptive concurrency limit (see concurrency.go); MaxConcurrency 0 disables it.
+	MaxConcurrency int      `json:"max_concurrency"`
+	MinConcurrency int      `json:"min_concurrency"`
+	TargetLatency  Duration `json:"target_latency"`
+
+	// Multi-tenancy (see tenant.go): every user request must name a tenant.
+	MultiTenant       bool   `json:"multi_tenant"`
+	TenantDomain      string `json:"tenant_domain"`       // "api.example.com": acme.api.example.com -> tenant "acme"
+	TenantTokenSecret string `json:"tenant_token_secret"` // HS256 key for bearer tokens with a "tenant" claim
+
+	// Response cache for user reads (see cache.go); 0 disables it.
+	CacheTTL Duration `json:"cache_ttl"`
+
+	// Delay before the first webhook retry; doubles each time (see webhook.go).
+	WebhookBackoff Duration `json:"webhook_backoff"`
+}
+
+// DefaultConfig returns the settings the server used before config files existed.
+func DefaultConfig() Config {
+	return Config{
+		Addr:           ":8080",
+		SocketMode:     FileMode{0o660},
+		RateLimit:      20,
+		RateBurst:      10,
+		RequestTimeout: Duration{1 * time.Second},
+		LogLevel:       "info",
+		MaxConcurrency: 100,
+		MinConcurrency: 4,
+		TargetLatency:  Duration{250 * time.Millisecond},
+		WebhookBackoff: Duration{1 * time.Second},
+	}
+}
+
+// LoadConfig reads a JSON config file. Fields missing from the file keep
+// their DefaultConfig values.
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields() // catch typos like "rate_limt"
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return Config{}, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate rejects settings the middleware chain can't run with.
+func (c Config) Validate() error {
+	if c.Addr == "" {
+		return fmt.Errorf("addr required")
+	}
+	if c.Addr == "unix:" || c.AdminAddr == "unix:" {
+		return fmt.Errorf("unix: address needs a socket path")
+	}
+	if c.SocketMode.FileMode&^os.ModePerm != 0 {
+		return fmt.Errorf("socket_mode must be a permission mode like 0660, got %s", c.SocketMode)
+	}
+	if c.RateLimit <= 0 {
+		return fmt.Errorf("rate_limit must be > 0, got %d", c.RateLimit)
+	}
+	if c.RateBurst <= 0 {
+		return fmt.Errorf("rate_burst must be > 0, got %d", c.RateBurst)
+	}
+	if c.RequestTimeout.Duration <= 0 {
+		return fmt.Errorf("request_timeout must be > 0, got %s", c.RequestTimeout)
+	}
+	if c.AdminAddr != "" && c.AdminToken == "" && !isLoopback(c.AdminAddr) {
+		return fmt.Errorf("admin_addr %q is not loopback; set admin_token", c.AdminAddr)
+	}
+	for pattern, d := range c.RouteTimeouts {
+		if d.Duration <= 0 {
+			return fmt.Errorf("route_timeouts[%q] must be > 0, got %s", pattern, d)
+		}
+	}
+	if c.MaxConcurrency < 0 {
+		return fmt.Errorf("max_concurrency must be >= 0, got %d", c.MaxConcurrency)
+	}
+	if c.MaxConcurrency > 0 {
+		if c.MinConcurrency < 1 || c.MinConcurrency > c.MaxConcurrency {
+			return fmt.Errorf("min_concurrency must be between 1 and max_concurrency, got %d", c.MinConcurrency)
+		}
+		if c.TargetLatency.Duration <= 0 {
+			return fmt.Errorf("target_latency must be > 0, got %s", c.TargetLatency)
+		}
+	}
+	if c.WebhookBackoff.Duration <= 0 {
+		return fmt.Errorf("webhook_backoff must be > 0, got %s", c.WebhookBackoff)
+	}
+	if c.CacheTTL.Duration < 0 {
+		return fmt.Errorf("cache_ttl must be >= 0, got %s", c.CacheTTL)
+	}
+	if strings.HasPrefix(c.TenantDomain, ".") {
+		return fmt.Errorf("tenant_domain %q must not start with a dot", c.TenantDomain)
+	}
+	if _, ok := parseLogLevel(c.LogLevel); !ok {
+		return fmt.Errorf("unknown log_level %q", c.LogLevel)
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("invalid cors origin %q (want scheme://host[:port] or *)", origin)
+		}
+	}
+	return nil
+}
+
+// diffConfig lists changed fields as "name: old -> new", using the JSON names.
+func diffConfig(old, new Config) []string {
+	var changes []string
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	for i := 0; i < ov.NumField(); i++ {
+		a, b := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		name := strings.Split(ov.Type().Field(i).Tag.Get("json"), ",")[0]
+		switch name {
+		case "admin_token":
+			a, b = redacted(old.AdminToken), redacted(new.AdminToken)
+		case "tenant_token_secret":
+			a, b = redacted(old.TenantTokenSecret), redacted(new.TenantTokenSecret)
+		}
+		changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, a, b))
+	}
+	return changes
+}
+
+// Log levels
+
+type LogLevel int32
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[string]LogLevel{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+func parseLogLevel(s string) (LogLevel, bool) {
+	l, ok := logLevelNames[strings.ToLower(s)]
+	return l, ok
+}
+
+// currentLogLevel is read on every log call, so it is atomic rather than
+// guarded by a mutex.
+var currentLogLevel atomic.Int32
+
+func init() {
+	currentLogLevel.Store(int32(LevelInfo))
+}
+
+// SetLogLevel changes the level used by logf.
+func SetLogLevel(l LogLevel) {
+	currentLogLevel.Store(int32(l))
+}
+
+// logf logs only if level is at or above the current log level.
+func logf(level LogLevel, format string, args ...any) {
+	if int32(level) >= currentLogLevel.Load() {
+		log.Printf(format, args...)
+	}
+}
+
+// CORS middleware
+
+// corsMethods and corsHeaders are what a preflight allows: every method
+// the API routes use, and the request headers it reads (X-Tenant-ID and
+// Authorization pick the tenant, see tenant.go).
+const (
+	corsMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsHeaders = "Content-Type, Accept, Authorization, X-Tenant-ID, Cache-Control, traceparent, tracestate"
+)
+
+// CORS adds Access-Control-Allow-Origin for allowed origins ("*" allows any)
+// and answers preflight OPTIONS requests directly with 204.
+func CORS(origins []string) Middleware {
+	allowAny := slices.Contains(origins, "*")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && (allowAny || slices.Contains(origins, origin)) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+					w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Swappable middleware chain
+
+// chain is one fully built middleware stack for a given Config.
+type chain struct {
+	cfg         Config
+	handler     http.Handler
+	limiter     Middleware
+	stopLimiter func()
+	concurrency *AdaptiveLimiter // nil when max_concurrency is 0
+	cache       *ConcurrentCache // nil when cache_ttl is 0
+}
+
+// ApplyConfig validates cfg, builds a new middleware chain around the
+// routes and swaps it in atomically. On error the running chain is kept.
+//
+// The rate limiter is only replaced when rate_limit or rate_burst changed,
+// so an unrelated reload (say, log_level) doesn't refill everyone's bucket.
+func (s *Server) ApplyConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.cfgMu.Lock()
+	defer s.cfgMu.Unlock()
+
+	old := s.current.Load()
+	next := &chain{cfg: cfg}
+	reuseLimiter := old != nil && old.cfg.RateLimit == cfg.RateLimit && old.cfg.RateBurst == cfg.RateBurst
+	if reuseLimiter {
+		next.limiter, next.stopLimiter = old.limiter, old.stopLimiter
+	} else {
+		next.limiter, next.stopLimiter = RateLimiterWithStop(cfg.RateLimit, cfg.RateBurst)
+	}
+
+	// Keep the learned concurrency limit unless its settings changed.
+	if cfg.MaxConcurrency > 0 {
+		if old != nil && old.concurrency != nil && old.cfg.MaxConcurrency == cfg.MaxConcurrency &&
+			old.cfg.MinConcurrency == cfg.MinConcurrency && old.cfg.TargetLatency == cfg.TargetLatency {
+			next.concurrency = old.concurrency
+		} else {
+			next.concurrency = NewAdaptiveLimiter(cfg.MinConcurrency, cfg.MaxConcurrency, cfg.TargetLatency.Duration)
+		}
+	}
+
+	// A reload that keeps cache_ttl keeps the cached responses. A gateway
+	// never caches: it doesn't see the writes that would invalidate.
+	if cfg.CacheTTL.Duration > 0 && s.gateway == nil {
+		if old != nil && old.cache != nil && old.cfg.CacheTTL == cfg.CacheTTL {
+			next.cache = old.cache
+		} else {
+			next.cache = NewConcurrentCache(cfg.CacheTTL.Duration)
+		}
+	}
+
+	// With a tracer every layer records its own span (see tracing.go).
+	wrap := func(name string, mw Middleware) Middleware { return mw }
+	var h http.Handler = s.mux
+	if s.tracer != nil {
+		wrap = Traced
+		h = tracedMux(s.mux)
+	}
+	if s.follower != nil {
+		// inside Logging so forwarded and rejected writes are logged
+		h = wrap("FollowerWrites", FollowerWrites(s.follower))(h)
+	}
+	if next.cache != nil {
+		tenantOf := func(r *http.Request) string { return s.storeFor(r).tenant }
+		h = wrap("ResponseCache", ResponseCache(next.cache, &s.cacheGens, isUserRead, tenantOf))(h)
+	}
+	if s.faults != nil {
+		// inside Logging and RequestTimeout: injected failures are logged and
+		// injected latency counts against the deadline
+		routeOf := func(r *http.Request) string { _, pattern := s.mux.Handler(r); return pattern }
+		h = wrap("Faults", Faults(s.faults, routeOf))(h)
+	}
+	h = wrap("Logging", Logging)(h)
+	h = wrap("RequestTimeout", RequestTimeoutPolicy(s.timeoutPolicy(cfg)))(h)
+	if next.concurrency != nil {
+		// inside the rate limiters: a request waiting there for a token
+		// holds no slot, and its wait doesn't count as latency - only
+		// admitted requests shrink or grow the limit
+		h = wrap("ConcurrencyLimit", ConcurrencyLimit(next.concurrency, s.reserved))(h)
+	}
+	if cfg.MultiTenant {
+		// inside the global limiter: a tenant's own limit only narrows it
+		h = wrap("Tenancy", Tenancy(s.tenants, cfg))(h)
+	}
+	h = wrap("RateLimiter", next.limiter)(h)
+	h = wrap("CORS", CORS(cfg.CORSOrigins))(h)
+	if s.recorder != nil {
+		// outside the limits: record what clients actually got, 429s included
+		h = wrap("Record", Record(s.recorder))(h)
+	}
+	if s.tracer != nil {
+		h = Tracing(s.tracer)(h)
+	}
+	next.handler = h
+
+	level, _ := parseLogLevel(cfg.LogLevel)
+	SetLogLevel(level)
+	s.current.Store(next)
+
+	// Requests still queued on the old bucket are let through once it stops
+	// (see RateLimiterWithStop), so nobody is stranded by a reload.
+	if old != nil && !reuseLimiter {
+		old.stopLimiter()
+	}
+	return nil
+}
+
+// Config returns the settings of the chain currently serving requests.
+func (s *Server) Config() Config {
+	if c := s.current.Load(); c != nil {
+		return c.cfg
+	}
+	return DefaultConfig()
+}
+
+// serveCurrent dispatches to whichever chain is current right now.
+func (s *Server) serveCurrent(w http.ResponseWriter, r *http.Request) {
+	s.current.Load().handler.ServeHTTP(w, r)
+}
+
+// stopCurrentLimiter ends the refill goroutine of the active rate limiter.
+func (s *Server) stopCurrentLimiter(ctx context.Context) error {
+	if c := s.current.Load(); c != nil {
+		c.stopLimiter()
+	}
+	return nil
+}
+
+// ConfigReloader re-reads a config file on SIGHUP or when it changes on disk.
+type ConfigReloader struct {
+	path     string
+	server   *Server
+	interval time.Duration // how often to check the file's mtime
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func NewConfigReloader(path string, server *Server, interval time.Duration) *ConfigReloader {
+	r := &ConfigReloader{path: path, server: server, interval: interval}
+	if fi, err := os.Stat(path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+	return r
+}
+
+// Reload loads, validates and applies the config file, logging what changed.
+// An invalid file is reported and the running config stays untouched.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if fi, err := os.Stat(r.path); err == nil {
+		r.modTime = fi.ModTime()
+	}
+
+	cfg, err := LoadConfig(r.path)
+	if err != nil {
+		log.Printf("config reload rejected: %v", err)
+		return err
+	}
+	old := r.server.Config()
+	if cfg.Addr != old.Addr || cfg.AdminAddr != old.AdminAddr || cfg.AdminToken != old.AdminToken || cfg.SocketMode != old.SocketMode {
+		log.Printf("config reload: listener settings (addr, admin_addr, admin_token, socket_mode) require a restart; keeping current ones")
+		cfg.Addr, cfg.AdminAddr, cfg.AdminToken, cfg.SocketMode = old.Addr, old.AdminAddr, old.AdminToken, old.SocketMode
+	}
+	if err := r.server.ApplyConfig(cfg); err != nil {
+		log.Printf("config reload rejected: %v", err)
+		return err
+	}
+
+	changes := diffConfig(old, cfg)
+	if len(changes) == 0 {
+		log.Printf("config reloaded from %s: no changes", r.path)
+	} else {
+		log.Printf("config reloaded from %s: %s", r.path, strings.Join(changes, "; "))
+	}
+	return nil
+}
+
+// changed reports whether the file's modification time moved since the last load.
+func (r *ConfigReloader) changed() bool {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !fi.ModTime().Equal(r.modTime)
+}
+
+// Watch reloads on SIGHUP and on file changes until ctx is canceled.
+func (r *ConfigReloader) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("received SIGHUP, reloading config")
+			r.Reload()
+		case <-t.C:
+			if r.changed() {
+				log.Printf("%s changed, reloading config", r.path)
+				r.Reload()
+			}
+		}
+	}
+}
+
+// Hook returns a lifecycle hook that runs Watch in the background.
+func (r *ConfigReloader) Hook() Hook {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	return Hook{
+		Name:     "config-reloader",
+		Priority: 20,
+		OnStart: func(context.Context) error {
+			go func() {
+				defer close(done)
+				r.Watch(ctx)
+			}()
+			return nil
+		},
+		OnStop: func(stopCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-stopCtx.Done():
+				return stopCtx.Err()
+			}
+		},
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, dir, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"partial file keeps defaults", `{"rate_limit": 50}`, false},
+		{"full file", `{"rate_limit": 5, "rate_burst": 2, "request_timeout": "250ms", "log_level": "warn", "cors_origins": ["*"]}`, false},
+		{"bad json", `{"rate_limit": `, true},
+		{"unknown field", `{"rate_limt": 5}`, true},
+		{"zero rate", `{"rate_limit": 0}`, true},
+		{"bad duration", `{"request_timeout": "soon"}`, true},
+		{"zero webhook backoff", `{"webhook_backoff": "0s"}`, true},
+		{"bad log level", `{"log_level": "loud"}`, true},
+		{"bad origin", `{"cors_origins": ["example.com"]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, t.TempDir(), tt.body)
+			_, err := LoadConfig(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadConfig err = %v; wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	cfg, _ := LoadConfig(writeConfig(t, t.TempDir(), `{"rate_limit": 50}`))
+	if cfg.RateLimit != 50 || cfg.RateBurst != 10 || cfg.RequestTimeout.Duration != time.Second {
+		t.Errorf("unexpected merged config: %+v", cfg)
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	old := DefaultConfig()
+	new := old
+	new.RateLimit = 50
+	new.CORSOrigins = []string{"*"}
+
+	got := diffConfig(old, new)
+	want := []string{"rate_limit: 20 -> 50", "cors_origins: [] -> [*]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffConfig = %v; want %v", got, want)
+	}
+}
+
+func TestConfigReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, `{"rate_limit": 20, "rate_burst": 10}`)
+	s := &Server{store: NewUserStore()}
+	s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+	r := NewConfigReloader(path, s, time.Hour)
+
+	before := s.current.Load()
+	writeConfig(t, dir, `{"rate_limit": 20, "rate_burst": 10, "log_level": "error"}`)
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	after := s.current.Load()
+	if after == before {
+		t.Fatal("chain was not swapped")
+	}
+	if reflect.ValueOf(after.limiter).Pointer() != reflect.ValueOf(before.limiter).Pointer() {
+		t.Error("limiter replaced although rate settings did not change")
+	}
+	if LogLevel(currentLogLevel.Load()) != LevelError {
+		t.Errorf("log level not applied")
+	}
+
+	// An invalid file is rejected and the running chain stays in place.
+	writeConfig(t, dir, `{"rate_limit": -1}`)
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected invalid config to be rejected")
+	}
+	if s.current.Load() != after {
+		t.Error("invalid config disturbed the running chain")
+	}
+
+	writeConfig(t, dir, `{"rate_limit": 100, "log_level": "info"}`)
+	r.Reload()
+	if got := s.Config().RateLimit; got != 100 {
+		t.Errorf("RateLimit = %d; want 100", got)
+	}
+}
+
+func TestConfigReloader_Changed(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, `{}`)
+	r := NewConfigReloader(path, &Server{}, time.Hour)
+	if r.changed() {
+		t.Error("fresh reloader reports a change")
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if !r.changed() {
+		t.Error("mtime change not detected")
+	}
+}
+
+func TestCORS(t *testing.T) {
+	h := CORS([]string{"https://admin.example.com"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		method     string
+		origin     string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"allowed origin", http.MethodGet, "https://admin.example.com", http.StatusOK, "https://admin.example.com"},
+		{"other origin", http.MethodGet, "https://evil.example.com", http.StatusOK, ""},
+		{"preflight", http.MethodOptions, "https://admin.example.com", http.StatusNoContent, "https://admin.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/users", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Allow-Origin = %q; want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestCORS_PreflightAllows(t *testing.T) {
+	h := CORS([]string{"*"})(http.NotFoundHandler())
+
+	tests := []struct {
+		name    string
+		method  string
+		headers string // Access-Control-Request-Headers
+	}{
+		{"PUT", http.MethodPut, "content-type"},
+		{"tenant header", http.MethodGet, "x-tenant-id"},
+		{"bearer token", http.MethodPost, "authorization,content-type"},
+		{"trace context", http.MethodDelete, "traceparent,tracestate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodOptions, "/v1/users/1", nil)
+			req.Header.Set("Origin", "https://app.example.com")
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			req.Header.Set("Access-Control-Request-Headers", tt.headers)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != http.StatusNoContent {
+				t.Fatalf("status = %d; want 204", rr.Code)
+			}
+			methods := strings.Split(rr.Header().Get("Access-Control-Allow-Methods"), ", ")
+			if !slices.Contains(methods, tt.method) {
+				t.Errorf("Allow-Methods = %v; lacks %s", methods, tt.method)
+			}
+			allowed := strings.ToLower(rr.Header().Get("Access-Control-Allow-Headers"))
+			for _, h := range strings.Split(tt.headers, ",") {
+				if !slices.Contains(strings.Split(allowed, ", "), h) {
+					t.Errorf("Allow-Headers = %q; lacks %s", allowed, h)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 27. Encryption at Rest
+//
+// WHY?
+// The event log, its snapshot and the Raft state hold every user's name and
+// age. Anyone who can read the disk (or a backup of it) can read them.
+//
+// ENVELOPE ENCRYPTION:
+//
+//	keyfile:  KEK "2026-10"  (key-encryption key, 32 bytes, never on disk
+//	                          next to the data)
+//	   |
+//	   | wraps (AES-256-GCM)
+//	   v
+//	file header: {"enc":"aes-256-gcm","kid":"2026-10","dek":"<wrapped DEK>"}
+//	   |
+//	   | DEK (data-encryption key, random per file) encrypts
+//	   v
+//	records:  base64(nonce | ciphertext | tag)    one per line
+//
+// The header names the KEK by its ID, so a file says which key it needs
+// and the keyfile can hold old and new keys at the same time.
+// GCM authenticates as well as encrypts: a flipped bit or a wrong key
+// fails loudly instead of decoding garbage.
+//
+// KEY ROTATION:
+//  1. add a new key to the keyfile and make it "active"
+//  2. POST /admin/keys/rotate reloads the keyfile and, in the background,
+//     re-encrypts every file still under an older key with a fresh DEK
+//  3. once GET /admin/keys shows every file under the new key, the old
+//     key can be deleted from the keyfile
+//
+// New files and rewrites always use the active key. The event log is
+// rewritten while it keeps accepting appends (see EventLog.reencrypt).
+//
+// Plaintext files from before -keyfile are read as they are and encrypted
+// on their next rewrite; an encrypted file without -keyfile is an error.
+
+// encAlgorithm is the only algorithm so far; the header leaves room for more.
+const encAlgorithm = "aes-256-gcm"
+
+var (
+	// ErrEncrypted: the file is encrypted but no keyfile was given.
+	ErrEncrypted = errors.New("file is encrypted")
+	// ErrUnknownKey: the file names a key ID the keyfile doesn't have.
+	ErrUnknownKey = errors.New("file was encrypted with a key that is not in the keyfile")
+	// ErrWrongKey: the keyfile has the key ID, but not the key the file was
+	// encrypted with (the key behind an ID must never change).
+	ErrWrongKey = errors.New("file was encrypted with a different key")
+)
+
+// keyfile is the JSON layout of -keyfile:
+//
+//	{"active": "2026-10", "keys": {"2026-09": "<base64>", "2026-10": "<base64>"}}
+//
+// Generate a key with: openssl rand -base64 32
+type keyfile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// Keyring holds the KEKs and the files encrypted with them.
+type Keyring struct {
+	path string
+
+	mu     sync.RWMutex
+	active string
+	keys   map[string][]byte
+	files  []encryptedFile // registered by their owners, see track
+
+	// background rotation
+	rotating   bool
+	lastRotate time.Time
+	lastErr    string
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// encryptedFile is a file the keyring can re-encrypt.
+type encryptedFile struct {
+	name      string
+	keyID     func() string // "" = plaintext
+	reencrypt func() error  // rewrites the file under the active key
+}
+
+// KeyringStatus is served by GET /admin/keys.
+type KeyringStatus struct {
+	Active     string            `json:"active"`
+	Keys       []string          `json:"keys"`
+	Files      map[string]string `json:"files"` // file -> key ID ("" = plaintext)
+	Rotating   bool              `json:"rotating"`
+	LastRotate *time.Time        `json:"last_rotate,omitempty"`
+	LastError  string            `json:"last_error,omitempty"`
+}
+
+// LoadKeyring reads a keyfile.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path, keys: make(map[string][]byte)}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload re-reads the keyfile. Keys that disappeared from it are kept in
+// memory until restart, so files still under them can be re-encrypted.
+func (k *Keyring) Reload() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return fmt.Errorf("keyfile: %w", err)
+	}
+	var kf keyfile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return fmt.Errorf("keyfile %s: %w", k.path, err)
+	}
+	keys := make(map[string][]byte, len(kf.Keys))
+	for id, b64 := range kf.Keys {
+		key, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("keyfile %s: key %q must be 32 bytes, base64-encoded", k.path, id)
+		}
+		keys[id] = key
+	}
+	if _, ok := keys[kf.Active]; !ok {
+		return fmt.Errorf("keyfile %s: active key %q is not in keys", k.path, kf.Active)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for id, key := range keys {
+		if old, ok := k.keys[id]; ok && !bytes.Equal(old, key) {
+			return fmt.Errorf("keyfile %s: key %q changed; give a new key a new ID", k.path, id)
+		}
+	}
+	maps.Copy(k.keys, keys)
+	k.active = kf.Active
+	return nil
+}
+
+// Active returns the ID of the key new files are encrypted with.
+func (k *Keyring) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+func (k *Keyring) key(id string) ([]byte, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// track registers a file for rotation and GET /admin/keys.
+func (k *Keyring) track(f encryptedFile) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.files = append(k.files, f)
+}
+
+// Status reports the keys and which key each file is under.
+func (k *Keyring) Status() KeyringStatus {
+	k.mu.RLock()
+	files := slices.Clone(k.files)
+	st := KeyringStatus{
+		Active:    k.active,
+		Keys:      slices.Sorted(maps.Keys(k.keys)),
+		Files:     make(map[string]string, len(files)),
+		Rotating:  k.rotating,
+		LastError: k.lastErr,
+	}
+	if !k.lastRotate.IsZero() {
+		t := k.lastRotate
+		st.LastRotate = &t
+	}
+	k.mu.RUnlock()
+	for _, f := range files { // keyID takes the file owner's lock
+		st.Files[f.name] = f.keyID()
+	}
+	return st
+}
+
+// Rotate reloads the keyfile and starts re-encrypting, in the background,
+// every file that isn't under the active key yet.
+func (k *Keyring) Rotate() error {
+	if err := k.Reload(); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.rotating {
+		return errors.New("a rotation is already running")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.rotating, k.cancel, k.done = true, cancel, make(chan struct{})
+	go k.reencryptAll(ctx, k.done)
+	return nil
+}
+
+func (k *Keyring) reencryptAll(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	k.mu.RLock()
+	files := slices.Clone(k.files)
+	k.mu.RUnlock()
+
+	var errs []error
+	for _, f := range files {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		if f.keyID() == k.Active() {
+			continue
+		}
+		if err := f.reencrypt(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+			continue
+		}
+		log.Printf("keys: re-encrypted %s with key %q", f.name, k.Active())
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.rotating, k.lastRotate, k.lastErr = false, time.Now().UTC(), ""
+	if err := errors.Join(errs...); err != nil {
+		k.lastErr = err.Error()
+		log.Printf("keys: rotation: %v", err)
+	}
+}
+
+// Close stops a running rotation between two files and waits for it
+// (register it as a lifecycle stop hook, before the files are closed).
+func (k *Keyring) Close() error {
+	k.mu.Lock()
+	cancel, done := k.cancel, k.done
+	k.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// File format
+
+// encHeader is the first line of an encrypted file.
+type encHeader struct {
+	Enc string `json:"enc"`
+	Kid string `json:"kid"`
+	DEK []byte `json:"dek"` // wrapped by the KEK; base64 in JSON
+}
+
+// fileCipher encrypts and decrypts the records of one file.
+type fileCipher struct {
+	kid    string
+	aead   cipher.AEAD
+	header []byte // the file's first line, without '\n'
+}
+
+func newGCM(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err) // only on a key length other than 16/24/32
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// newFileCipher creates a fresh DEK, wrapped with the active key.
+func (k *Keyring) newFileCipher() (*fileCipher, error) {
+	kid := k.Active()
+	kek, _ := k.key(kid)
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	wrapped := seal(newGCM(kek), dek, []byte(kid)) // the ID is authenticated too
+	header, err := json.Marshal(encHeader{Enc: encAlgorithm, Kid: kid, DEK: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipher{kid: kid, aead: newGCM(dek), header: header}, nil
+}
+
+// parseEncHeader reports whether line is an encryption header.
+func parseEncHeader(line []byte) (encHeader, bool) {
+	var h encHeader
+	if json.Unmarshal(line, &h) != nil || h.Enc == "" {
+		return encHeader{}, false
+	}
+	return h, true
+}
+
+// openFileCipher unwraps the DEK of a file header. k may be nil (no
+// keyfile), which is an error for an encrypted file.
+func (k *Keyring) openFileCipher(h encHeader) (*fileCipher, error) {
+	if h.Enc != encAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", h.Enc)
+	}
+	if k == nil {
+		return nil, fmt.Errorf("%w with key %q; start with -keyfile", ErrEncrypted, h.Kid)
+	}
+	kek, ok := k.key(h.Kid)
+	if !ok {
+		return nil, fmt.Errorf("%w: it needs key %q", ErrUnknownKey, h.Kid)
+	}
+	dek, err := open(newGCM(kek), h.DEK, []byte(h.Kid))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q in the keyfile doesn't decrypt it", ErrWrongKey, h.Kid)
+	}
+	header, _ := json.Marshal(h)
+	return &fileCipher{kid: h.Kid, aead: newGCM(dek), header: header}, nil
+}
+
+// seal returns nonce | ciphertext | tag.
+func seal(aead cipher.AEAD, plain, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	rand.Read(nonce) // random 96-bit nonces: safe for 2^32 records per DEK
+	return aead.Seal(nonce, nonce, plain, aad)
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("record too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// sealRecord encrypts one record into a line (without '\n').
+func (c *fileCipher) sealRecord(plain []byte) []byte {
+	sealed := seal(c.aead, plain, nil)
+	line := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(line, sealed)
+	return line
+}
+
+func (c *fileCipher) openRecord(line []byte) ([]byte, error) {
+	damaged := errors.New("decrypt: record damaged or not from this file")
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(line)))
+	if err != nil {
+		return nil, damaged
+	}
+	plain, err := open(c.aead, sealed, nil)
+	if err != nil {
+		return nil, damaged
+	}
+	return plain, nil
+}
+
+// Event log
+
+// OpenEncryptedEventLog is OpenEventLog for a log encrypted with keys. A
+// plaintext log is encrypted right away; a new one starts with a header.
+func OpenEncryptedEventLog(path string, keys *Keyring) (*EventLog, error) {
+	l, err := openEventLog(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	if l.cipher == nil {
+		if err := l.reencrypt(); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("event log %s: encrypt: %w", path, err)
+		}
+	}
+	keys.track(encryptedFile{name: path, keyID: l.keyID, reencrypt: l.reencrypt})
+	return l, nil
+}
+
+func (l *EventLog) keyID() string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.cipher == nil {
+		return ""
+	}
+	return l.cipher.kid
+}
+
+// reencrypt rewrites the log with a new DEK under the active key, next to
+// the old file, and then renames it over it. Appends go on meanwhile: the
+// events up to now are copied under the read lock only, and just the ones
+// appended during the copy under the write lock, right before the swap.
+func (l *EventLog) reencrypt() error {
+	c, err := l.keys.newFileCipher()
+	if err != nil {
+		return err
+	}
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	bw.Write(append(c.header, '\n'))
+
+	l.mu.RLock()
+	copied := l.events[:len(l.events):len(l.events)] // events never change once added
+	l.mu.RUnlock()
+	for _, ev := range copied {
+		if err := encodeEvent(bw, c, ev); err != nil {
+			return fail(err)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ev := range l.events[len(copied):] {
+		if err := encodeEvent(bw, c, ev); err != nil {
+			return fail(err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fail(err)
+	}
+	l.f.Close()
+	l.f, l.cipher = f, c // f's offset is at its end: appends continue there
+	return nil
+}
+
+// Whole files (snapshots, raft state)
+
+// sealFile returns data as an encrypted file, or data itself if k is nil.
+func (k *Keyring) sealFile(data []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+	c, err := k.newFileCipher()
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat(c.header, []byte{'\n'}, c.sealRecord(data), []byte{'\n'}), nil
+}
+
+// openFile reverses sealFile; plaintext files are returned as they are.
+func (k *Keyring) openFile(data []byte) ([]byte, error) {
+	first, rest, _ := bytes.Cut(data, []byte{'\n'})
+	h, ok := parseEncHeader(first)
+	if !ok {
+		return data, nil
+	}
+	c, err := k.openFileCipher(h)
+	if err != nil {
+		return nil, err
+	}
+	return c.openRecord(rest)
+}
+
+// fileKeyID returns the key ID in the header of the file at path ("" for
+// plaintext or a missing file).
+func fileKeyID(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadBytes('\n')
+	h, _ := parseEncHeader(bytes.TrimSpace(line))
+	return h.Kid
+}
+
+// HTTP handlers (admin listener)
+
+// handleKeyStatus serves GET /admin/keys.
+func (s *Server) handleKeyStatus(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		writeProblem(w, http.StatusNotImplemented, "encryption at rest is off (start the server with -keyfile)")
+		return
+	}
+	st := s.keys.Status()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// handleKeyRotate serves POST /admin/keys/rotate.
+func (s *Server) handleKeyRotate(w http.ResponseWriter, r *http.Request) {
+	if s.keys == nil {
+		writeProblem(w, http.StatusNotImplemented, "encryption at rest is off (start the server with -keyfile)")
+		return
+	}
+	if err := s.keys.Rotate(); err != nil {
+		writeProblem(w, http.StatusConflict, err.Error())
+		return
+	}
+	st := s.keys.Status()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testKey returns a deterministic 32-byte key.
+func testKey(b byte) []byte { return bytes.Repeat([]byte{b}, 32) }
+
+// writeKeyfile writes a keyfile with the given active key and keys.
+func writeKeyfile(t *testing.T, path, active string, keys map[string][]byte) {
+	t.Helper()
+	kf := keyfile{Active: active, Keys: make(map[string]string)}
+	for id, key := range keys {
+		kf.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	data, _ := json.Marshal(kf)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func loadKeys(t *testing.T, active string, keys map[string][]byte) *Keyring {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keys.json")
+	writeKeyfile(t, path, active, keys)
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestLoadKeyring_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"not json", `active=k1`, "invalid character"},
+		{"short key", `{"active":"k1","keys":{"k1":"` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}`, "must be 32 bytes"},
+		{"bad base64", `{"active":"k1","keys":{"k1":"%%%"}}`, "must be 32 bytes"},
+		{"active missing", `{"active":"k2","keys":{"k1":"` + base64.StdEncoding.EncodeToString(testKey(1)) + `"}}`, `active key "k2" is not in keys`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			os.WriteFile(path, []byte(tt.content), 0o600)
+			if _, err := LoadKeyring(path); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadKeyring = %v; want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the key behind an ID must never change: files under it would be lost
+	k := loadKeys(t, "k1", map[string][]byte{"k1": testKey(1)})
+	writeKeyfile(t, k.path, "k1", map[string][]byte{"k1": testKey(2)})
+	if err := k.Reload(); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("Reload with a changed key = %v; want an error", err)
+	}
+}
+
+func TestEncryptedEventLog_RoundTripAndKeyErrors(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	keys := loadKeys(t, "k1", map[string][]byte{"k1": testKey(1)})
+
+	events, err := OpenEncryptedEventLog(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us, _ := NewEventSourcedStore(events, path+".snapshot")
+	us.Create(ctx, User{ID: "1", Name: "Alice", Age: 30})
+	us.Update(ctx, User{ID: "1", Name: "Alice", Age: 31})
+	us.Snapshot()
+	events.Close()
+
+	for _, file := range []string{path, path + ".snapshot"} {
+		data, _ := os.ReadFile(file)
+		if bytes.Contains(data, []byte("Alice")) {
+			t.Errorf("%s holds a name in plaintext", filepath.Base(file))
+		}
+	}
+
+	events, err = OpenEncryptedEventLog(path, keys)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	us, _ = NewEventSourcedStore(events, path+".snapshot")
+	if u, err := us.Get(ctx, "1"); err != nil || u.Age != 31 || events.LastSeq() != 2 {
+		t.Errorf("after reopen Get = %+v, %v (seq %d); want age 31 at seq 2", u, err, events.LastSeq())
+	}
+	events.Close()
+
+	tests := []struct {
+		name    string
+		keys    *Keyring
+		wantErr error
+	}{
+		{"no keyfile", nil, ErrEncrypted},
+		{"keyfile without the key", loadKeys(t, "k2", map[string][]byte{"k2": testKey(2)}), ErrUnknownKey},
+		{"same id, other key", loadKeys(t, "k1", map[string][]byte{"k1": testKey(9)}), ErrWrongKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := openEventLog(path, tt.keys)
+			if err == nil {
+				l.Close()
+			}
+			if !errors.Is(err, tt.wantErr) || !strings.Contains(err.Error(), `"k1"`) {
+				t.Errorf("open = %v; want %v naming key k1", err, tt.wantErr)
+			}
+		})
+	}
+
+	// a flipped byte in a record fails authentication
+	data, _ := os.ReadFile(path)
+	lines := bytes.Split(data, []byte("\n"))
+	if lines[1][10] == 'A' {
+		lines[1][10] = 'B'
+	} else {
+		lines[1][10] = 'A'
+	}
+	os.WriteFile(path, bytes.Join(lines, []byte("\n")), 0o600)
+	if _, err := OpenEncryptedEventLog(path, keys); err == nil || !strings.Contains(err.Error(), "line 2: decrypt") {
+		t.Errorf("open tampered log = %v; want a decrypt error on line 2", err)
+	}
+}
+
+func TestEncryptedEventLog_EncryptsPlaintextLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+	events, _ := OpenEventLog(path)
+	us, _ := NewEventSourcedStore(events, "")
+	us.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+	events.Close()
+
+	keys := loadKeys(t, "k1", map[string][]byte{"k1": testKey(1)})
+	events, err := OpenEncryptedEventLog(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	if data, _ := os.ReadFile(path); bytes.Contains(data, []byte("Alice")) || events.keyID() != "k1" || events.LastSeq() != 1 {
+		t.Errorf("plaintext log not encrypted on open: key %q, seq %d", events.keyID(), events.LastSeq())
+	}
+}
+
+func TestKeyring_RotateWhileWriting(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.ndjson")
+	keys := loadKeys(t, "k1", map[string][]byte{"k1": testKey(1)})
+	events, err := OpenEncryptedEventLog(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us, _ := NewEventSourcedStore(events, path+".snapshot")
+	for i := range 500 {
+		us.Create(ctx, User{ID: fmt.Sprint(i), Name: "User", Age: 20})
+	}
+	us.Snapshot()
+
+	// appends keep going while the log is re-encrypted
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 500; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			us.Create(ctx, User{ID: fmt.Sprint(i), Name: "User", Age: 20})
+		}
+	}()
+
+	writeKeyfile(t, keys.path, "k2", map[string][]byte{"k1": testKey(1), "k2": testKey(2)})
+	if err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "the rotation to finish", func() bool { return !keys.Status().Rotating })
+	close(stop)
+	wg.Wait()
+	if err := keys.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := keys.Status()
+	if st.Active != "k2" || st.LastError != "" || st.Files[path] != "k2" || st.Files[path+".snapshot"] != "k2" {
+		t.Fatalf("status after rotation = %+v; want every file under k2", st)
+	}
+	want := events.LastSeq()
+	events.Close()
+
+	// k1 is no longer needed
+	onlyK2 := loadKeys(t, "k2", map[string][]byte{"k2": testKey(2)})
+	events, err = OpenEncryptedEventLog(path, onlyK2)
+	if err != nil {
+		t.Fatalf("open with only the new key: %v", err)
+	}
+	defer events.Close()
+	if events.LastSeq() != want {
+		t.Errorf("log after rotation has %d events; want %d (appends during the rotation lost?)", events.LastSeq(), want)
+	}
+	if _, err := NewEventSourcedStore(events, path+".snapshot"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRaftState_Encrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft-n1.json")
+	keys := loadKeys(t, "k1", map[string][]byte{"k1": testKey(1)})
+	start := func(keys *Keyring) (*raftCluster, error) {
+		c := &raftCluster{t: t, nw: NewMemNetwork(), ids: []string{"n1"}, stores: make(map[string]*UserStore)}
+		us, err := NewRaftStore(RaftConfig{ID: "n1", Peers: c.ids, Transport: c.nw, StatePath: path, Keys: keys})
+		if err != nil {
+			return nil, err
+		}
+		c.stores["n1"] = us
+		c.nw.Add(us.raft)
+		return c, nil
+	}
+
+	c, err := start(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.leader("n1")
+	if err := c.write("n1", createCmd("secret")); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{path, path + ".wal"} {
+		if data, _ := os.ReadFile(f); bytes.Contains(data, []byte("User secret")) || fileKeyID(f) != "k1" {
+			t.Errorf("%s not encrypted under k1 (key %q)", filepath.Base(f), fileKeyID(f))
+		}
+	}
+
+	if _, err := start(nil); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("restart without keys = %v; want ErrEncrypted", err)
+	}
+	c, err = start(keys)
+	if err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	c.leader("n1")
+	c.converged(1, "n1")
+}
+
+func TestKeyAdminEndpoints(t *testing.T) {
+	keys := loadKeys(t, "k1", map[string][]byte{"k1": testKey(1)})
+	tests := []struct {
+		name       string
+		keys       *Keyring
+		method     string
+		path       string
+		wantStatus int
+	}{
+		{"off", nil, http.MethodGet, "/admin/keys", http.StatusNotImplemented},
+		{"status", keys, http.MethodGet, "/admin/keys", http.StatusOK},
+		{"rotate", keys, http.MethodPost, "/admin/keys/rotate", http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{store: NewUserStore(), keys: tt.keys}
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.RemoteAddr = "127.0.0.1:50000" // admin routes are loopback-only without a token
+			s.adminRoutes("").ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+		})
+	}
+	keys.Close()
+
+	// a broken keyfile is reported, and the loaded keys stay in use
+	os.WriteFile(keys.path, []byte("{"), 0o600)
+	s := &Server{store: NewUserStore(), keys: keys}
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/admin/keys/rotate", nil)
+	req.RemoteAddr = "127.0.0.1:50000"
+	s.adminRoutes("").ServeHTTP(rr, req)
+	if rr.Code != http.StatusConflict || keys.Active() != "k1" {
+		t.Errorf("rotate with a broken keyfile = %d, active %q; want 409 and k1", rr.Code, keys.Active())
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 22. Event Sourcing and Time-Travel Queries
+//
+// WHY?
+// The users map only knows the present. Support asks "what did user 7 look
+// like last Tuesday?" and "who changed their age?", and the answer is gone
+// as soon as the map entry is overwritten.
+//
+// HOW:
+// With an event log (server -event-log users.ndjson) every Create, Update
+// and Delete first appends an immutable event:
+//
+//	{"seq":3,"type":"user.updated","time":"...","user_id":"7","user":{...}}
+//
+// and only then applies it to the map and indexes. The map is therefore a
+// PROJECTION of the log: replaying the log from the start always rebuilds
+// exactly the same state (UserStore.Rebuild).
+//
+//	GET /v1/users/{id}?as_of=2024-05-01T12:00:00Z   state at that instant
+//	GET /v1/users/{id}/history                      every event of the user
+//
+// SNAPSHOTS:
+// Replaying years of events on every start is slow. A snapshot stores the
+// projection together with the seq of the last event it contains; startup
+// loads it and applies only the newer events. Snapshots are written on
+// shutdown and by POST /admin/events/snapshot. A snapshot that is missing,
+// unreadable or ahead of the log is ignored and the projection is rebuilt
+// from the log instead. The events themselves stay in memory, because
+// history and as_of queries read them.
+//
+// Tenant stores (see tenant.go) stay plain in-memory stores.
+
+// ErrNoEventLog is returned by history queries on a store without a log.
+var ErrNoEventLog = errors.New("store has no event log (start the server with -event-log)")
+
+// StoredEvent is one immutable entry of the event log. User is the user's
+// state after the event (for deletes: the last state before it).
+type StoredEvent struct {
+	Seq    uint64    `json:"seq" xml:"seq"`
+	Type   string    `json:"type" xml:"type"`
+	Time   time.Time `json:"time" xml:"time"`
+	UserID string    `json:"user_id" xml:"user_id"`
+	User   User      `json:"user" xml:"user"`
+}
+
+// EventLog is an append-only list of events, optionally persisted as NDJSON.
+type EventLog struct {
+	mu     sync.RWMutex
+	events []StoredEvent
+	byUser map[string][]int // user ID -> positions in events
+
+	f    *os.File // nil = memory only
+	path string
+
+	// encryption at rest (see crypt.go); nil = plaintext
+	keys   *Keyring
+	cipher *fileCipher
+
+	// changed is closed (and replaced) whenever an event is added, waking
+	// replication streams (see replication.go)
+	changed chan struct{}
+
+	now func() time.Time // clock, replaceable in tests
+}
+
+// NewEventLog returns an empty in-memory log.
+func NewEventLog() *EventLog {
+	return &EventLog{byUser: make(map[string][]int), changed: make(chan struct{}), now: time.Now}
+}
+
+// OpenEventLog loads the events in path (creating the file if needed) and
+// appends new ones to it. A torn last line - the process died mid-write -
+// is cut off; any other damage is an error.
+func OpenEventLog(path string) (*EventLog, error) {
+	return openEventLog(path, nil)
+}
+
+func openEventLog(path string, keys *Keyring) (*EventLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := NewEventLog()
+	l.path, l.keys = path, keys
+	valid, err := l.load(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("event log %s: %w", path, err)
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > valid {
+		log.Printf("event log %s: dropping %d bytes of a torn last write", path, fi.Size()-valid)
+		if err := f.Truncate(valid); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f = f
+	return l, nil
+}
+
+// load reads events from r and returns the length of the well-formed part.
+func (l *EventLog) load(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var valid int64
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// no trailing newline: a write that never finished
+			return valid, nil
+		}
+		if err != nil {
+			return valid, err
+		}
+		if line == 1 {
+			if h, ok := parseEncHeader(bytes.TrimSpace(b)); ok {
+				if l.cipher, err = l.keys.openFileCipher(h); err != nil {
+					return valid, err
+				}
+				valid += int64(len(b))
+				continue
+			}
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			rec := b
+			if l.cipher != nil {
+				if rec, err = l.cipher.openRecord(b); err != nil {
+					return valid, fmt.Errorf("line %d: %w", line, err)
+				}
+			}
+			var ev StoredEvent
+			if err := json.Unmarshal(rec, &ev); err != nil {
+				return valid, fmt.Errorf("line %d: %w", line, err)
+			}
+			if ev.Seq != uint64(len(l.events))+1 {
+				return valid, fmt.Errorf("line %d: seq %d, want %d", line, ev.Seq, len(l.events)+1)
+			}
+			l.add(ev)
+		}
+		valid += int64(len(b))
+	}
+}
+
+// add must be called with l.mu held for writing (or before l is shared).
+func (l *EventLog) add(ev StoredEvent) {
+	l.byUser[ev.UserID] = append(l.byUser[ev.UserID], len(l.events))
+	l.events = append(l.events, ev)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// append writes a new event and returns it. It is only called with the
+// owning store's lock held, so log order is the order changes are applied.
+func (l *EventLog) append(typ string, u User) (StoredEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ev := StoredEvent{Seq: uint64(len(l.events)) + 1, Type: typ, Time: l.now().UTC(), UserID: u.ID, User: u}
+	if err := l.write(ev); err != nil {
+		return StoredEvent{}, err
+	}
+	return ev, nil
+}
+
+// appendEvent stores an event that was numbered elsewhere (a leader's, see
+// replication.go), keeping its Seq and Time.
+func (l *EventLog) appendEvent(ev StoredEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ev.Seq != uint64(len(l.events))+1 {
+		return fmt.Errorf("event log: got seq %d, want %d", ev.Seq, len(l.events)+1)
+	}
+	return l.write(ev)
+}
+
+// write must be called with l.mu held for writing.
+func (l *EventLog) write(ev StoredEvent) error {
+	if l.f != nil {
+		// on disk first: an event that isn't persisted must not be applied
+		if err := encodeEvent(l.f, l.cipher, ev); err != nil {
+			return fmt.Errorf("event log: %w", err)
+		}
+	}
+	l.add(ev)
+	return nil
+}
+
+// encodeEvent writes ev as one line, encrypted when c is set.
+func encodeEvent(w io.Writer, c *fileCipher, ev StoredEvent) error {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if c != nil {
+		line = c.sealRecord(line)
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// since returns the events with Seq > seq.
+func (l *EventLog) since(seq uint64) []StoredEvent {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if seq >= uint64(len(l.events)) {
+		return nil
+	}
+	return append([]StoredEvent(nil), l.events[seq:]...)
+}
+
+// notify returns a channel that is closed when the next event is added.
+func (l *EventLog) notify() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.changed
+}
+
+// History returns the events of one user, oldest first.
+func (l *EventLog) History(id string) []StoredEvent {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]StoredEvent, 0, len(l.byUser[id]))
+	for _, i := range l.byUser[id] {
+		out = append(out, l.events[i])
+	}
+	return out
+}
+
+// LastSeq returns the Seq of the newest event (0 for an empty log).
+func (l *EventLog) LastSeq() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return uint64(len(l.events))
+}
+
+// Close flushes and closes the file (register it as a lifecycle stop hook).
+func (l *EventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// Projection
+
+// commit makes one change: append it to the log (if any), apply it to the
+// projection and tell subscribers. Must be called with us.mu held for
+// writing.
+func (us *UserStore) commit(typ string, u User) error {
+	ev := StoredEvent{Type: typ, UserID: u.ID, User: u}
+	if us.events != nil {
+		var err error
+		if ev, err = us.events.append(typ, u); err != nil {
+			return err
+		}
+	}
+	us.apply(ev)
+	us.emit(typ, u)
+	return nil
+}
+
+// apply updates the map and indexes for one event. Must be called with
+// us.mu held for writing.
+func (us *UserStore) apply(ev StoredEvent) {
+	if old, exists := us.users[ev.UserID]; exists {
+		us.unindexUser(old)
+		delete(us.users, ev.UserID)
+	}
+	if ev.Type != EventUserDeleted {
+		us.users[ev.UserID] = ev.User
+		us.indexUser(ev.User)
+	}
+	if ev.Seq > 0 {
+		us.applied = ev.Seq
+	}
+}
+
+// NewEventSourcedStore returns a store whose state is the projection of
+// events, starting from the snapshot at snapshotPath when it is usable.
+func NewEventSourcedStore(events *EventLog, snapshotPath string) (*UserStore, error) {
+	us := NewUserStore()
+	us.events = events
+	us.snapshotPath = snapshotPath
+
+	if snapshotPath != "" && events.keys != nil {
+		// rotating the snapshot's key = writing a fresh one (see crypt.go)
+		events.keys.track(encryptedFile{
+			name:      snapshotPath,
+			keyID:     func() string { return fileKeyID(snapshotPath) },
+			reencrypt: func() error { _, err := us.Snapshot(); return err },
+		})
+	}
+	if snapshotPath != "" {
+		if err := us.loadSnapshot(); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("snapshot %s unusable, rebuilding from the event log: %v", snapshotPath, err)
+			}
+			us.reset()
+		}
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for _, ev := range events.since(us.applied) {
+		us.apply(ev)
+	}
+	return us, nil
+}
+
+// reset empties the projection. Must be called with us.mu held for writing
+// (or before us is shared).
+func (us *UserStore) reset() {
+	us.users = make(map[string]User)
+	us.byAge = sortedIndex[int]{}
+	us.byName = sortedIndex[string]{}
+	us.byGram = make(map[string]map[string]struct{})
+	us.applied = 0
+}
+
+// Rebuild throws the projection away and replays the whole log. It returns
+// the number of events applied.
+func (us *UserStore) Rebuild() (int, error) {
+	if us.events == nil {
+		return 0, ErrNoEventLog
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.reset()
+	events := us.events.since(0)
+	for _, ev := range events {
+		us.apply(ev)
+	}
+	return len(events), nil
+}
+
+// snapshot is the on-disk form of a projection.
+type snapshot struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Users []User    `json:"users"`
+}
+
+// Snapshot writes the current projection to us.snapshotPath. The file is
+// replaced durably (see writeFileSync), so a crash mid-write leaves the
+// previous snapshot. Snapshots are taken one at a time, so an older one
+// never replaces a newer one.
+func (us *UserStore) Snapshot() (uint64, error) {
+	if us.events == nil || us.snapshotPath == "" {
+		return 0, ErrNoEventLog
+	}
+	us.snapshotMu.Lock()
+	defer us.snapshotMu.Unlock()
+	us.mu.RLock()
+	snap := snapshot{Seq: us.applied, Time: time.Now().UTC(), Users: make([]User, 0, len(us.users))}
+	for _, u := range us.users {
+		snap.Users = append(snap.Users, u)
+	}
+	us.mu.RUnlock()
+	sort.Slice(snap.Users, func(i, j int) bool { return snap.Users[i].ID < snap.Users[j].ID })
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return 0, err
+	}
+	if data, err = us.events.keys.sealFile(data); err != nil {
+		return 0, err
+	}
+	if err := writeFileSync(us.snapshotPath, data); err != nil {
+		return 0, err
+	}
+	return snap.Seq, nil
+}
+
+// loadSnapshot fills the projection from us.snapshotPath.
+func (us *UserStore) loadSnapshot() error {
+	data, err := os.ReadFile(us.snapshotPath)
+	if err != nil {
+		return err
+	}
+	if data, err = us.events.keys.openFile(data); err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	if snap.Seq > us.events.LastSeq() {
+		return fmt.Errorf("snapshot is at seq %d but the log ends at %d", snap.Seq, us.events.LastSeq())
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for _, u := range snap.Users {
+		us.users[u.ID] = u
+		us.indexUser(u)
+	}
+	us.applied = snap.Seq
+	return nil
+}
+
+// Time travel
+
+// GetAsOf returns the user as it was at t.
+func (us *UserStore) GetAsOf(ctx context.Context, id string, t time.Time) (_ User, err error) {
+	_, span := StartSpan(ctx, "UserStore.GetAsOf")
+	defer func() { span.SetError(err); span.End() }()
+	span.SetAttr("user.id", id)
+
+	if us.events == nil {
+		return User{}, ErrNoEventLog
+	}
+	var state *StoredEvent
+	for _, ev := range us.events.History(id) {
+		if ev.Time.After(t) {
+			break
+		}
+		state = &ev
+	}
+	if state == nil || state.Type == EventUserDeleted {
+		return User{}, fmt.Errorf("%w at %s", ErrUserNotFound, t.Format(time.RFC3339))
+	}
+	return state.User, nil
+}
+
+// History returns every event of one user, oldest first.
+func (us *UserStore) History(ctx context.Context, id string) (_ []StoredEvent, err error) {
+	_, span := StartSpan(ctx, "UserStore.History")
+	defer func() { span.SetError(err); span.End() }()
+	span.SetAttr("user.id", id)
+
+	if us.events == nil {
+		return nil, ErrNoEventLog
+	}
+	events := us.events.History(id)
+	if len(events) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return events, nil
+}
+
+// HTTP handlers
+
+// historyStatus maps GetAsOf/History errors to status codes.
+func historyStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNoEventLog):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// handleUserAsOf serves GET /users/{id}?as_of=<RFC 3339 time>.
+func (s *Server) handleUserAsOf(w http.ResponseWriter, r *http.Request, asOf string) {
+	t, err := time.Parse(time.RFC3339Nano, asOf)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "as_of must be an RFC 3339 time like 2024-05-01T12:00:00Z")
+		return
+	}
+	user, err := s.storeFor(r).GetAsOf(r.Context(), r.PathValue("id"), t)
+	if err != nil {
+		writeProblem(w, historyStatus(err), err.Error())
+		return
+	}
+	respond(w, r, http.StatusOK, user)
+}
+
+// handleUserHistory serves GET /users/{id}/history.
+func (s *Server) handleUserHistory(w http.ResponseWriter, r *http.Request) {
+	events, err := s.storeFor(r).History(r.Context(), r.PathValue("id"))
+	if err != nil {
+		writeProblem(w, historyStatus(err), err.Error())
+		return
+	}
+	respond(w, r, http.StatusOK, events)
+}
+
+// handleSnapshot serves POST /admin/events/snapshot.
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	seq, err := s.store.Snapshot()
+	if err != nil {
+		writeProblem(w, historyStatus(err), err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]uint64{"seq": seq})
+}
+
+// handleRebuild serves POST /admin/events/rebuild.
+func (s *Server) handleRebuild(w http.ResponseWriter, r *http.Request) {
+	n, err := s.store.Rebuild()
+	if err != nil {
+		writeProblem(w, historyStatus(err), err.Error())
+		return
+	}
+	s.invalidateAll() // cached responses may predate the rebuild
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"events": n})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock returns t0, t0+1s, t0+2s, ... on successive calls.
+func fakeClock(t0 time.Time) func() time.Time {
+	n := 0
+	return func() time.Time {
+		n++
+		return t0.Add(time.Duration(n-1) * time.Second)
+	}
+}
+
+func TestEventSourcedStore_HistoryAndAsOf(t *testing.T) {
+	ctx := context.Background()
+	t0 := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	events := NewEventLog()
+	events.now = fakeClock(t0)
+	us, err := NewEventSourcedStore(events, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	us.Create(ctx, User{ID: "1", Name: "Alice", Age: 30}) // t0
+	us.Update(ctx, User{ID: "1", Name: "Alice", Age: 31}) // t0+1s
+	us.Delete(ctx, "1")                                   // t0+2s
+
+	history, err := us.History(ctx, "1")
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	var types []string
+	for _, ev := range history {
+		types = append(types, ev.Type)
+	}
+	if got := strings.Join(types, ","); got != "user.created,user.updated,user.deleted" {
+		t.Errorf("history = %s", got)
+	}
+
+	tests := []struct {
+		name    string
+		at      time.Time
+		wantAge int // 0 = not found
+	}{
+		{"before creation", t0.Add(-time.Second), 0},
+		{"at creation", t0, 30},
+		{"between create and update", t0.Add(500 * time.Millisecond), 30},
+		{"after update", t0.Add(1500 * time.Millisecond), 31},
+		{"after delete", t0.Add(time.Hour), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := us.GetAsOf(ctx, "1", tt.at)
+			if tt.wantAge == 0 {
+				if err == nil {
+					t.Errorf("GetAsOf = %+v; want not found", u)
+				}
+				return
+			}
+			if err != nil || u.Age != tt.wantAge {
+				t.Errorf("GetAsOf = %+v, %v; want age %d", u, err, tt.wantAge)
+			}
+		})
+	}
+
+	if _, err := us.Get(ctx, "1"); err == nil {
+		t.Error("deleted user still in the projection")
+	}
+}
+
+func TestEventLog_ReopenSnapshotAndRebuild(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.ndjson")
+	snapPath := path + ".snapshot"
+
+	events, err := OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("OpenEventLog failed: %v", err)
+	}
+	us, _ := NewEventSourcedStore(events, snapPath)
+	us.Create(ctx, User{ID: "1", Name: "Alice", Age: 30})
+	us.Create(ctx, User{ID: "2", Name: "Bob", Age: 25})
+	if seq, err := us.Snapshot(); err != nil || seq != 2 {
+		t.Fatalf("Snapshot = %d, %v; want seq 2", seq, err)
+	}
+	us.Update(ctx, User{ID: "2", Name: "Bob", Age: 26}) // only in the log
+	events.Close()
+
+	// a crash in the middle of the next write
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.WriteString(`{"seq":4,"type":"user.cre`)
+	f.Close()
+
+	events, err = OpenEventLog(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer events.Close()
+	if events.LastSeq() != 3 {
+		t.Fatalf("LastSeq = %d; want 3 (torn line dropped)", events.LastSeq())
+	}
+	us, _ = NewEventSourcedStore(events, snapPath)
+	if u, err := us.Get(ctx, "2"); err != nil || u.Age != 26 {
+		t.Errorf("after snapshot + log: Get(2) = %+v, %v; want age 26", u, err)
+	}
+	// the next event continues the sequence after the cut
+	us.Create(ctx, User{ID: "3", Name: "Carol", Age: 40})
+	if events.LastSeq() != 4 {
+		t.Errorf("LastSeq = %d; want 4", events.LastSeq())
+	}
+
+	// a snapshot from the future (e.g. of another log) is not trusted
+	os.WriteFile(snapPath, []byte(`{"seq":99,"users":[{"id":"ghost","name":"G","age":1}]}`), 0o600)
+	us, _ = NewEventSourcedStore(events, snapPath)
+	if _, err := us.Get(ctx, "ghost"); err == nil {
+		t.Error("user from a snapshot ahead of the log was loaded")
+	}
+	if users, _ := us.List(ctx); len(users) != 3 {
+		t.Errorf("projection has %d users; want 3", len(users))
+	}
+
+	// Rebuild recovers a projection that drifted from the log
+	us.mu.Lock()
+	delete(us.users, "1")
+	us.mu.Unlock()
+	if n, err := us.Rebuild(); err != nil || n != 4 {
+		t.Fatalf("Rebuild = %d, %v; want 4 events", n, err)
+	}
+	if _, err := us.Get(ctx, "1"); err != nil {
+		t.Errorf("Get(1) after rebuild: %v", err)
+	}
+	if got, _ := us.Search(ctx, "car", 0); len(got) != 1 {
+		t.Errorf("name index after rebuild found %d users; want 1", len(got))
+	}
+}
+
+func TestEventLog_ConcurrentSnapshots(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.ndjson")
+	events, err := OpenEventLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	us, _ := NewEventSourcedStore(events, path+".snapshot")
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		us.Create(ctx, User{ID: fmt.Sprint(i), Name: "U", Age: 20})
+		wg.Go(func() {
+			if _, err := us.Snapshot(); err != nil {
+				t.Errorf("Snapshot: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+	if _, err := us.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("directory holds %v; want only the log and the snapshot", names)
+	}
+	var snap snapshot
+	data, _ := os.ReadFile(path + ".snapshot")
+	if err := json.Unmarshal(data, &snap); err != nil || snap.Seq != 20 || len(snap.Users) != 20 {
+		t.Errorf("snapshot at seq %d with %d users (%v); want 20 and 20", snap.Seq, len(snap.Users), err)
+	}
+}
+
+func TestOpenEventLog_RejectsGaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.ndjson")
+	os.WriteFile(path, []byte(`{"seq":1,"type":"user.created","user_id":"1"}`+"\n"+`{"seq":3,"type":"user.created","user_id":"2"}`+"\n"), 0o600)
+	if l, err := OpenEventLog(path); err == nil {
+		l.Close()
+		t.Fatal("log with a missing seq accepted")
+	}
+}
+
+func TestEventSourcing_HTTP(t *testing.T) {
+	events := NewEventLog()
+	store, _ := NewEventSourcedStore(events, "")
+	s := &Server{store: store}
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	defer s.stopCurrentLimiter(context.Background())
+
+	send := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	send(http.MethodPost, "/v1/users", `{"id":"1","name":"Alice","age":30}`)
+	created := time.Now().UTC()
+	time.Sleep(5 * time.Millisecond)
+
+	tests := []struct {
+		name       string
+		method     string
+		path, body string
+		wantStatus int
+		wantBody   string
+	}{
+		{"update", http.MethodPut, "/v1/users/1", `{"name":"Alice","age":31}`, http.StatusOK, `"age":31`},
+		{"update unknown user", http.MethodPut, "/v1/users/2", `{"name":"Bob","age":25}`, http.StatusNotFound, ""},
+		{"id mismatch", http.MethodPut, "/v1/users/1", `{"id":"2","name":"Bob","age":25}`, http.StatusBadRequest, ""},
+		{"current state", http.MethodGet, "/v1/users/1", "", http.StatusOK, `"age":31`},
+		{"as_of before the update", http.MethodGet, "/v1/users/1?as_of=" + created.Format(time.RFC3339Nano), "", http.StatusOK, `"age":30`},
+		{"as_of before creation", http.MethodGet, "/v1/users/1?as_of=2000-01-01T00:00:00Z", "", http.StatusNotFound, ""},
+		{"bad as_of", http.MethodGet, "/v1/users/1?as_of=yesterday", "", http.StatusBadRequest, ""},
+		{"history", http.MethodGet, "/v1/users/1/history", "", http.StatusOK, `"type":"user.updated"`},
+		{"history of unknown user", http.MethodGet, "/v1/users/9/history", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := send(tt.method, tt.path, tt.body)
+			if status != tt.wantStatus || !strings.Contains(body, tt.wantBody) {
+				t.Errorf("%s %s = %d %s; want %d containing %q", tt.method, tt.path, status, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+
+	var history []StoredEvent
+	_, body := send(http.MethodGet, "/v1/users/1/history", "")
+	if err := json.Unmarshal([]byte(body), &history); err != nil || len(history) != 2 || history[1].Seq != 2 {
+		t.Errorf("history = %+v (err=%v); want 2 events", history, err)
+	}
+}
+
+func TestEventSourcing_WithoutLog(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	s.store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	for _, path := range []string{"/v1/users/1/history", "/v1/users/1?as_of=2024-01-01T00:00:00Z"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusNotImplemented {
+			t.Errorf("GET %s = %d; want 501", path, rr.Code)
+		}
+	}
+	// plain stores still support updates
+	if err := s.store.Update(context.Background(), User{ID: "1", Name: "Alice", Age: 31}); err != nil {
+		t.Errorf("Update failed: %v", err)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 30. Gateway
+//
+// WHY?
+// Several day5 instances need one address for clients. -gateway turns this
+// binary into a reverse proxy in front of them:
+//
+//	go run . -gateway http://10.0.0.1:8080,http://10.0.0.2:8080 -gateway-balance least-conn
+//
+// The usual middleware chain (config.go) runs at the edge: rate limit,
+// CORS, request timeout, logging, tracing, recording and fault injection
+// all apply to proxied requests, configured with -config as before. Only
+// the response cache is left out: writes pass through to the backends, so
+// the gateway would never learn when to invalidate.
+//
+// BALANCING (-gateway-balance):
+//
+//	round-robin  each healthy backend in turn
+//	least-conn   the healthy backend with the fewest requests in flight
+//	hash         by user ID (from the path, or the body of POST /users) on
+//	             a HashRing (shard.go), so one user's requests always reach
+//	             the same instance; requests without an ID go round-robin
+//
+// HEALTH CHECKS:
+// Every 2s each backend's /healthz is probed. Two failed probes in a row
+// eject it; two passed probes re-admit it. An ejected backend leaves the
+// hash ring, so only its own users move to other backends.
+//
+// RETRIES:
+// A request that could not reach its backend (connection refused, reset,
+// or a 503 from a backend shedding load) is sent to a backend not yet tried
+// - but only if it is idempotent (GET, HEAD, OPTIONS, PUT, DELETE): a POST
+// that failed halfway may already have created its user. The body is
+// buffered so it can be sent again.
+
+// GatewayOptions configures a Gateway.
+type GatewayOptions struct {
+	Backends       []string      // base URLs of the day5 servers
+	Balance        string        // round-robin (default), least-conn or hash
+	Retries        int           // other backends an idempotent request may try
+	HealthPath     string        // probed on every backend (default /healthz)
+	HealthInterval time.Duration // between probes (default 2s)
+	HealthTimeout  time.Duration // per probe (default 1s)
+	EjectAfter     int           // failed probes in a row that eject (default 2)
+	AdmitAfter     int           // passed probes in a row that re-admit (default 2)
+
+	// Transport carries proxied requests and probes (nil = http.DefaultTransport).
+	Transport http.RoundTripper
+}
+
+// gatewayBalances are the valid GatewayOptions.Balance values.
+var gatewayBalances = []string{"round-robin", "least-conn", "hash"}
+
+// errBackendBusy turns a backend's 503 into a retry.
+var errBackendBusy = errors.New("backend answered 503")
+
+// backend is one proxied server.
+type backend struct {
+	name     string // the base URL, also its name on the hash ring
+	url      *url.URL
+	inflight atomic.Int64
+	requests atomic.Uint64
+
+	// guarded by Gateway.mu
+	healthy       bool
+	fails, passes int
+	lastErr       string
+}
+
+// BackendStatus is one backend in GET /admin/gateway.
+type BackendStatus struct {
+	URL       string `json:"url"`
+	Healthy   bool   `json:"healthy"`
+	InFlight  int64  `json:"in_flight"`
+	Requests  uint64 `json:"requests"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Gateway proxies requests to healthy backends.
+type Gateway struct {
+	opts     GatewayOptions
+	backends []*backend
+	proxy    *httputil.ReverseProxy
+	client   *http.Client // health probes
+	next     atomic.Uint64
+
+	mu   sync.RWMutex // guards ring and the backends' health fields
+	ring *HashRing    // healthy backends only
+}
+
+// proxyAttempt carries the chosen backend into the ReverseProxy hooks and
+// the outcome back out.
+type proxyAttempt struct {
+	backend  *backend
+	retrying bool // another backend may be tried: a 503 becomes an error
+	err      error
+}
+
+type proxyAttemptKey struct{}
+
+// NewGateway checks opts and returns a gateway that starts with every
+// backend healthy; Run probes them.
+func NewGateway(opts GatewayOptions) (*Gateway, error) {
+	if opts.Balance == "" {
+		opts.Balance = "round-robin"
+	}
+	if !slices.Contains(gatewayBalances, opts.Balance) {
+		return nil, fmt.Errorf("unknown balance %q (want one of %v)", opts.Balance, gatewayBalances)
+	}
+	if len(opts.Backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	if opts.Retries < 0 {
+		return nil, errors.New("retries can't be negative")
+	}
+	if opts.HealthPath == "" {
+		opts.HealthPath = "/healthz"
+	}
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = 2 * time.Second
+	}
+	if opts.HealthTimeout <= 0 {
+		opts.HealthTimeout = time.Second
+	}
+	if opts.EjectAfter <= 0 {
+		opts.EjectAfter = 2
+	}
+	if opts.AdmitAfter <= 0 {
+		opts.AdmitAfter = 2
+	}
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport
+	}
+
+	g := &Gateway{
+		opts:   opts,
+		client: &http.Client{Transport: opts.Transport},
+		ring:   NewHashRing(defaultVirtualNodes),
+	}
+	for _, raw := range opts.Backends {
+		u, err := url.Parse(strings.TrimSpace(raw))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("backend %q: want a URL like http://host:port", raw)
+		}
+		for _, b := range g.backends {
+			if b.name == u.String() {
+				return nil, fmt.Errorf("backend %s listed twice", u)
+			}
+		}
+		b := &backend{name: u.String(), url: u, healthy: true}
+		g.backends = append(g.backends, b)
+		g.ring = g.ring.with(b.name)
+	}
+	g.proxy = &httputil.ReverseProxy{
+		Transport: opts.Transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			at := pr.In.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+			pr.SetURL(at.backend.url)
+			pr.SetXForwarded()
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			at := resp.Request.Context().Value(proxyAttemptKey{}).(*proxyAttempt)
+			if resp.StatusCode == http.StatusServiceUnavailable && at.retrying {
+				return errBackendBusy
+			}
+			return nil
+		},
+		// Called before anything was written to the client: record the
+		// error and let ServeHTTP decide between a retry and a 502.
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			r.Context().Value(proxyAttemptKey{}).(*proxyAttempt).err = err
+		},
+	}
+	return g, nil
+}
+
+// isIdempotent reports whether a request may be sent twice.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// userKey returns the user ID a request is about, or "".
+func userKey(r *http.Request, body []byte) string {
+	path := unversioned(r.URL.Path)
+	if rest, ok := strings.CutPrefix(path, "/users/"); ok {
+		id, _, _ := strings.Cut(rest, "/")
+		if id != "search" {
+			return id
+		}
+		return ""
+	}
+	if path == "/users" && r.Method == http.MethodPost {
+		// any body format the backends accept (see negotiate.go)
+		peek := r.Clone(r.Context())
+		peek.Body = io.NopCloser(bytes.NewReader(body))
+		var u User
+		if decodeBody(peek, &u) == nil {
+			return u.ID
+		}
+	}
+	return ""
+}
+
+// pick chooses a healthy backend not in tried; nil if there is none.
+// more reports whether another one would be left for a retry.
+func (g *Gateway) pick(key string, tried []*backend) (b *backend, more bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	var candidates []*backend
+	for _, b := range g.backends {
+		if b.healthy && !slices.Contains(tried, b) {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	more = len(candidates) > 1
+
+	if g.opts.Balance == "hash" && key != "" {
+		owner := g.ring.Owner(key)
+		for _, b := range candidates {
+			if b.name == owner {
+				return b, more
+			}
+		}
+		// the owner was tried already: any other backend will do
+	}
+	start := int(g.next.Add(1) % uint64(len(candidates)))
+	if g.opts.Balance == "least-conn" {
+		// scan from a rotating start so ties don't all go to the first
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			if b := candidates[(start+i)%len(candidates)]; b.inflight.Load() < best.inflight.Load() {
+				best = b
+			}
+		}
+		return best, more
+	}
+	return candidates[start], more
+}
+
+// ServeHTTP proxies r to a backend, trying others for idempotent requests
+// that could not be delivered. The body is held in memory for the retries,
+// so it is capped at maxBodyBytes like the backends' own routes (413).
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		if body, err = io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes)); err != nil {
+			writeProblem(w, bodyErrorStatus(err), err.Error())
+			return
+		}
+	}
+	key := ""
+	if g.opts.Balance == "hash" {
+		key = userKey(r, body)
+	}
+	attempts := 1
+	if isIdempotent(r.Method) {
+		attempts += g.opts.Retries
+	}
+
+	var tried []*backend
+	var lastErr error
+	for i := range attempts {
+		b, more := g.pick(key, tried)
+		if b == nil {
+			break
+		}
+		tried = append(tried, b)
+		at := &proxyAttempt{backend: b, retrying: more && i < attempts-1}
+		out := r.WithContext(context.WithValue(r.Context(), proxyAttemptKey{}, at))
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+
+		b.inflight.Add(1)
+		b.requests.Add(1)
+		g.proxy.ServeHTTP(w, out)
+		b.inflight.Add(-1)
+		if at.err == nil {
+			return
+		}
+		lastErr = fmt.Errorf("%s: %w", b.name, at.err)
+		if r.Context().Err() != nil {
+			return // the client is gone; nobody to retry for
+		}
+		logf(LevelWarn, "gateway: %s %s via %v", r.Method, r.URL.Path, lastErr)
+	}
+	if lastErr == nil {
+		writeProblem(w, http.StatusServiceUnavailable, "no healthy backend")
+		return
+	}
+	writeProblem(w, http.StatusBadGateway, fmt.Sprintf("no backend could serve the request (last: %v)", lastErr))
+}
+
+// Run probes every backend each HealthInterval until ctx is done.
+func (g *Gateway) Run(ctx context.Context) {
+	t := time.NewTicker(g.opts.HealthInterval)
+	defer t.Stop()
+	for {
+		g.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probeAll probes the backends in parallel: one hung backend must not
+// delay the verdict on the others.
+func (g *Gateway) probeAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, b := range g.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := g.probe(ctx, b)
+			if ctx.Err() == nil { // shutting down is not the backend's fault
+				g.record(b, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (g *Gateway) probe(ctx context.Context, b *backend) error {
+	ctx, cancel := context.WithTimeout(ctx, g.opts.HealthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.JoinPath(g.opts.HealthPath).String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check answered %s", resp.Status)
+	}
+	return nil
+}
+
+// record applies one probe result, ejecting or re-admitting b once the
+// threshold is reached.
+func (g *Gateway) record(b *backend, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err == nil {
+		b.fails, b.lastErr = 0, ""
+		b.passes++
+		if !b.healthy && b.passes >= g.opts.AdmitAfter {
+			b.healthy = true
+			g.ring = g.ring.with(b.name)
+			log.Printf("gateway: backend %s re-admitted", b.name)
+		}
+		return
+	}
+	b.passes, b.lastErr = 0, err.Error()
+	b.fails++
+	if b.healthy && b.fails >= g.opts.EjectAfter {
+		b.healthy = false
+		g.ring = g.ring.without(b.name)
+		log.Printf("gateway: backend %s ejected after %d failed health checks: %v", b.name, b.fails, err)
+	}
+}
+
+// Status returns every backend's health and load.
+func (g *Gateway) Status() []BackendStatus {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	out := make([]BackendStatus, 0, len(g.backends))
+	for _, b := range g.backends {
+		out = append(out, BackendStatus{
+			URL:       b.name,
+			Healthy:   b.healthy,
+			InFlight:  b.inflight.Load(),
+			Requests:  b.requests.Load(),
+			LastError: b.lastErr,
+		})
+	}
+	return out
+}
+
+// Healthy reports whether any backend is healthy.
+func (g *Gateway) Healthy() bool {
+	for _, b := range g.Status() {
+		if b.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTP handlers
+
+// handleGatewayHealthz serves the gateway's own GET /healthz: it is up
+// while at least one backend is.
+func (g *Gateway) handleGatewayHealthz(w http.ResponseWriter, r *http.Request) {
+	if !g.Healthy() {
+		writeProblem(w, http.StatusServiceUnavailable, "no healthy backend")
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// handleGatewayStatus serves GET /admin/gateway.
+func (s *Server) handleGatewayStatus(w http.ResponseWriter, r *http.Request) {
+	if s.gateway == nil {
+		writeProblem(w, http.StatusNotImplemented, "not a gateway (start the server with -gateway)")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.gateway.Status())
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// namedBackend answers every request with its name; healthy toggles its
+// /healthz.
+type namedBackend struct {
+	*httptest.Server
+	name    string
+	healthy atomic.Bool
+	hits    atomic.Int64
+}
+
+func startBackend(t *testing.T, name string, h http.HandlerFunc) *namedBackend {
+	t.Helper()
+	b := &namedBackend{name: name}
+	b.healthy.Store(true)
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			if !b.healthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		b.hits.Add(1)
+		w.Header().Set("X-Backend", name)
+		if h != nil {
+			h(w, r)
+		}
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func newTestGateway(t *testing.T, balance string, backends ...*namedBackend) *Gateway {
+	t.Helper()
+	opts := GatewayOptions{Balance: balance, Retries: 1}
+	for _, b := range backends {
+		opts.Backends = append(opts.Backends, b.URL)
+	}
+	g, err := NewGateway(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// via sends a request through g and returns the status and backend name.
+func via(g *Gateway, method, path, body string) (int, string) {
+	rr := httptest.NewRecorder()
+	g.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return rr.Code, rr.Header().Get("X-Backend")
+}
+
+func TestNewGateway_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    GatewayOptions
+		wantErr string
+	}{
+		{"no backends", GatewayOptions{}, "no backends"},
+		{"balance", GatewayOptions{Backends: []string{"http://a"}, Balance: "random"}, "unknown balance"},
+		{"not a URL", GatewayOptions{Backends: []string{"localhost:8080"}}, "want a URL"},
+		{"duplicate", GatewayOptions{Backends: []string{"http://a", " http://a"}}, "listed twice"},
+		{"retries", GatewayOptions{Backends: []string{"http://a"}, Retries: -1}, "negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewGateway(tt.opts); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewGateway = %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGateway_Balancing(t *testing.T) {
+	t.Run("round-robin", func(t *testing.T) {
+		a, b, c := startBackend(t, "a", nil), startBackend(t, "b", nil), startBackend(t, "c", nil)
+		g := newTestGateway(t, "round-robin", a, b, c)
+		for range 9 {
+			via(g, http.MethodGet, "/users", "")
+		}
+		if a.hits.Load() != 3 || b.hits.Load() != 3 || c.hits.Load() != 3 {
+			t.Errorf("hits a=%d b=%d c=%d; want 3 each", a.hits.Load(), b.hits.Load(), c.hits.Load())
+		}
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		release := make(chan struct{})
+		hold := func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/hold" {
+				<-release
+			}
+		}
+		a, b := startBackend(t, "a", hold), startBackend(t, "b", hold)
+		g := newTestGateway(t, "least-conn", a, b)
+
+		// pin a request on whichever backend gets it, then see where the rest go
+		done := make(chan string)
+		go func() { _, name := via(g, http.MethodGet, "/hold", ""); done <- name }()
+		eventually(t, "a request in flight", func() bool {
+			return g.Status()[0].InFlight+g.Status()[1].InFlight == 1
+		})
+		busy := "a"
+		if g.Status()[1].InFlight == 1 {
+			busy = "b"
+		}
+		for range 6 {
+			if _, name := via(g, http.MethodGet, "/users", ""); name == busy {
+				t.Errorf("request went to %s, which has one in flight", busy)
+			}
+		}
+		close(release)
+		<-done
+	})
+
+	t.Run("hash by user ID", func(t *testing.T) {
+		// three real servers, each with its own users: every request for a
+		// user has to land where the user was created
+		var backends []*namedBackend
+		for i := range 3 {
+			s := &Server{store: NewUserStore()}
+			h := s.routes()
+			t.Cleanup(func() { s.stopCurrentLimiter(context.Background()) })
+			backends = append(backends, startBackend(t, fmt.Sprint("s", i), h.ServeHTTP))
+		}
+		g := newTestGateway(t, "hash", backends...)
+
+		owner := make(map[string]string)
+		for i := range 8 {
+			id := fmt.Sprint("user-", i)
+			status, name := via(g, http.MethodPost, "/users", `{"id":"`+id+`","name":"U","age":20}`)
+			if status != http.StatusCreated {
+				t.Fatalf("create %s = %d", id, status)
+			}
+			owner[id] = name
+		}
+		for id, want := range owner {
+			for _, path := range []string{"/users/" + id, "/v1/users/" + id} {
+				if status, name := via(g, http.MethodGet, path, ""); status != http.StatusOK || name != want {
+					t.Errorf("GET %s = %d from %s; want 200 from %s", path, status, name, want)
+				}
+			}
+		}
+	})
+}
+
+func TestGateway_EjectAndReadmit(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := startBackend(t, "a", nil), startBackend(t, "b", nil), startBackend(t, "c", nil)
+	g := newTestGateway(t, "hash", a, b, c)
+	ownerOf := func() map[string]string {
+		m := make(map[string]string)
+		for i := range 60 {
+			_, m[fmt.Sprint(i)] = via(g, http.MethodGet, fmt.Sprint("/users/", i), "")
+		}
+		return m
+	}
+	before := ownerOf()
+
+	b.healthy.Store(false)
+	g.probeAll(ctx)
+	if !g.Status()[1].Healthy {
+		t.Fatal("ejected after one failed probe; want two")
+	}
+	g.probeAll(ctx)
+	if st := g.Status()[1]; st.Healthy || !strings.Contains(st.LastError, "503") {
+		t.Fatalf("status after two failed probes = %+v; want ejected", st)
+	}
+	for id, name := range ownerOf() {
+		if name == "b" {
+			t.Fatalf("user %s still routed to the ejected backend", id)
+		}
+		if before[id] != "b" && before[id] != name {
+			t.Errorf("user %s moved from %s to %s; only b's users should move", id, before[id], name)
+		}
+	}
+
+	b.healthy.Store(true)
+	g.probeAll(ctx)
+	g.probeAll(ctx)
+	if !g.Status()[1].Healthy {
+		t.Fatal("not re-admitted after two passed probes")
+	}
+	for id, name := range ownerOf() {
+		if before[id] != name {
+			t.Errorf("after re-admission user %s is on %s; want %s", id, name, before[id])
+		}
+	}
+
+	// the gateway itself is unhealthy only once every backend is
+	for _, nb := range []*namedBackend{a, b, c} {
+		nb.Close()
+	}
+	g.probeAll(ctx)
+	g.probeAll(ctx)
+	if g.Healthy() {
+		t.Error("healthy with every backend down")
+	}
+	if status, _ := via(g, http.MethodGet, "/users", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("with no healthy backend status = %d; want 503", status)
+	}
+}
+
+func TestGateway_Retries(t *testing.T) {
+	busy := startBackend(t, "busy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	dead := startBackend(t, "dead", nil)
+	dead.Close() // connection refused, not yet ejected by a probe
+	live := startBackend(t, "live", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	tests := []struct {
+		name       string
+		backends   []*namedBackend
+		method     string
+		wantStatus int
+		wantFrom   string
+	}{
+		{"GET skips a dead backend", []*namedBackend{dead, live}, http.MethodGet, http.StatusOK, "live"},
+		{"PUT skips a busy backend", []*namedBackend{busy, live}, http.MethodPut, http.StatusOK, "live"},
+		{"POST is not retried", []*namedBackend{dead}, http.MethodPost, http.StatusBadGateway, ""},
+		{"last attempt passes the 503 on", []*namedBackend{busy}, http.MethodGet, http.StatusServiceUnavailable, "busy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestGateway(t, "round-robin", tt.backends...)
+			for range 4 { // both orders of the round robin
+				rr := httptest.NewRecorder()
+				g.ServeHTTP(rr, httptest.NewRequest(tt.method, "/users/1", strings.NewReader(`{"name":"A","age":1}`)))
+				if rr.Code != tt.wantStatus || rr.Header().Get("X-Backend") != tt.wantFrom {
+					t.Fatalf("%s = %d from %q; want %d from %q", tt.method, rr.Code, rr.Header().Get("X-Backend"), tt.wantStatus, tt.wantFrom)
+				}
+				if tt.wantFrom == "live" && rr.Body.String() != `{"name":"A","age":1}` {
+					t.Errorf("retried body = %q; want it resent in full", rr.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestGateway_BodyLimit(t *testing.T) {
+	b := startBackend(t, "b", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+	g := newTestGateway(t, "round-robin", b)
+
+	tests := []struct {
+		name       string
+		size       int
+		wantStatus int
+		wantHits   int64
+	}{
+		{"at the limit", maxBodyBytes, http.StatusOK, 1},
+		{"over the limit", maxBodyBytes + 1, http.StatusRequestEntityTooLarge, 1}, // never proxied
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, _ := via(g, http.MethodPost, "/users", strings.Repeat("x", tt.size))
+			if status != tt.wantStatus || b.hits.Load() != tt.wantHits {
+				t.Errorf("status = %d after %d backend hits; want %d after %d", status, b.hits.Load(), tt.wantStatus, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestGateway_EdgeChain(t *testing.T) {
+	backend := startBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Header().Set("X-Seen-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+	})
+	s := &Server{store: NewUserStore(), gateway: newTestGateway(t, "round-robin", backend)}
+	cfg := DefaultConfig()
+	cfg.RequestTimeout = Duration{50 * time.Millisecond}
+	s.config = &cfg
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/users/1", http.StatusOK},
+		{"/slow", http.StatusGatewayTimeout}, // the edge's request timeout applies
+		{"/healthz", http.StatusOK},          // the gateway's own
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+			if tt.path == "/users/1" && rr.Header().Get("X-Seen-Forwarded-For") == "" {
+				t.Error("backend saw no X-Forwarded-For")
+			}
+		})
+	}
+	if got := backend.hits.Load(); got != 2 {
+		t.Errorf("backend got %d requests; want 2 (healthz is answered at the edge)", got)
+	}
+
+	for _, tt := range []struct {
+		server     *Server
+		wantStatus int
+	}{{s, http.StatusOK}, {&Server{store: NewUserStore()}, http.StatusNotImplemented}} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/admin/gateway", nil)
+		req.RemoteAddr = "127.0.0.1:50000" // admin routes are loopback-only without a token
+		tt.server.adminRoutes("").ServeHTTP(rr, req)
+		if rr.Code != tt.wantStatus {
+			t.Errorf("GET /admin/gateway = %d; want %d", rr.Code, tt.wantStatus)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 6. Secondary Indexes
+//
+// WHY INDEXES?
+// The users map only answers "give me user X" quickly. Any other question
+// ("who is 30?", "whose name starts with al?") used to scan every user.
+// A secondary index keeps the same data sorted by another field, so those
+// questions become a tree search plus a short in-order walk.
+//
+// Both indexes below live inside UserStore and are updated under the SAME
+// lock as the users map, so a reader never sees a user in the map but not in
+// an index (or the other way round).
+
+// indexEntry pairs an indexed key with the user ID it points to.
+// The ID is part of the sort order so duplicate keys (two users aged 30)
+// still have a single, deterministic position in the index.
+type indexEntry[K cmp.Ordered] struct {
+	key K
+	id  string
+}
+
+func compareEntries[K cmp.Ordered](a, b indexEntry[K]) int {
+	if c := cmp.Compare(a.key, b.key); c != 0 {
+		return c
+	}
+	return strings.Compare(a.id, b.id)
+}
+
+// WHY A B-TREE?
+// A sorted slice is the simplest index, but every insert or remove shifts
+// all entries after it: O(n) per write, which at a million users turns
+// each Create into a multi-megabyte memmove. A B-tree keeps the entries in
+// small sorted nodes, so a write touches O(log n) nodes of at most
+// btreeMaxItems entries each.
+//
+// Each node also records how many entries its subtree holds. That makes it
+// an "order-statistic" tree: the position of a key (how many entries sort
+// before it) is found on the way down, so range sizes are still two
+// searches and the query planner below can keep comparing them cheaply.
+
+const (
+	btreeMaxItems = 63
+	btreeMinItems = btreeMaxItems / 2
+)
+
+type btreeNode[K cmp.Ordered] struct {
+	items    []indexEntry[K]
+	children []*btreeNode[K] // nil in leaves; else len(items)+1
+	size     int             // entries in this subtree
+}
+
+func (n *btreeNode[K]) leaf() bool { return n.children == nil }
+
+// find returns the position of the first item >= e and whether it equals e.
+func (n *btreeNode[K]) find(e indexEntry[K]) (int, bool) {
+	return slices.BinarySearchFunc(n.items, e, compareEntries[K])
+}
+
+// split moves everything after items[i] into a new right sibling and
+// returns items[i], which the caller puts in the parent.
+func (n *btreeNode[K]) split(i int) (indexEntry[K], *btreeNode[K]) {
+	mid := n.items[i]
+	right := &btreeNode[K]{items: slices.Clone(n.items[i+1:])}
+	clear(n.items[i:])
+	n.items = n.items[:i]
+	right.size = len(right.items)
+	if !n.leaf() {
+		right.children = slices.Clone(n.children[i+1:])
+		clear(n.children[i+1:])
+		n.children = n.children[:i+1]
+		for _, c := range right.children {
+			right.size += c.size
+		}
+	}
+	n.size -= right.size + 1
+	return mid, right
+}
+
+// insert adds e below n, which must not be full. It reports whether e was new.
+func (n *btreeNode[K]) insert(e indexEntry[K]) bool {
+	i, found := n.find(e)
+	if found {
+		return false
+	}
+	if n.leaf() {
+		n.items = slices.Insert(n.items, i, e)
+		n.size++
+		return true
+	}
+	if len(n.children[i].items) >= btreeMaxItems {
+		mid, right := n.children[i].split(btreeMaxItems / 2)
+		n.items = slices.Insert(n.items, i, mid)
+		n.children = slices.Insert(n.children, i+1, right)
+		switch c := compareEntries(e, mid); {
+		case c == 0:
+			return false
+		case c > 0:
+			i++
+		}
+	}
+	if n.children[i].insert(e) {
+		n.size++
+		return true
+	}
+	return false
+}
+
+// remove deletes e from below n. Before stepping into a child it makes sure
+// the child can lose an entry without underflowing, so nothing has to be
+// fixed on the way back up.
+func (n *btreeNode[K]) remove(e indexEntry[K]) bool {
+	i, found := n.find(e)
+	if n.leaf() {
+		if !found {
+			return false
+		}
+		n.items = slices.Delete(n.items, i, i+1)
+		n.size--
+		return true
+	}
+	if len(n.children[i].items) <= btreeMinItems {
+		n.growChild(i)
+		return n.remove(e)
+	}
+	if found {
+		// replace e by its predecessor, the largest entry left of it
+		n.items[i] = n.children[i].removeMax()
+		n.size--
+		return true
+	}
+	if n.children[i].remove(e) {
+		n.size--
+		return true
+	}
+	return false
+}
+
+func (n *btreeNode[K]) removeMax() indexEntry[K] {
+	if n.leaf() {
+		last := len(n.items) - 1
+		e := n.items[last]
+		n.items = slices.Delete(n.items, last, last+1)
+		n.size--
+		return e
+	}
+	i := len(n.children) - 1
+	if len(n.children[i].items) <= btreeMinItems {
+		n.growChild(i)
+		return n.removeMax()
+	}
+	n.size--
+	return n.children[i].removeMax()
+}
+
+// growChild gives children[i] at least one more item, by borrowing through
+// the parent from a sibling that can spare one or by merging with a sibling.
+func (n *btreeNode[K]) growChild(i int) {
+	child := n.children[i]
+	switch {
+	case i > 0 && len(n.children[i-1].items) > btreeMinItems:
+		left := n.children[i-1]
+		last := len(left.items) - 1
+		child.items = slices.Insert(child.items, 0, n.items[i-1])
+		n.items[i-1] = left.items[last]
+		left.items = slices.Delete(left.items, last, last+1)
+		moved := 1
+		if !left.leaf() {
+			c := left.children[len(left.children)-1]
+			left.children = slices.Delete(left.children, len(left.children)-1, len(left.children))
+			child.children = slices.Insert(child.children, 0, c)
+			moved += c.size
+		}
+		left.size -= moved
+		child.size += moved
+	case i < len(n.items) && len(n.children[i+1].items) > btreeMinItems:
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.items = slices.Delete(right.items, 0, 1)
+		moved := 1
+		if !right.leaf() {
+			c := right.children[0]
+			right.children = slices.Delete(right.children, 0, 1)
+			child.children = append(child.children, c)
+			moved += c.size
+		}
+		right.size -= moved
+		child.size += moved
+	default:
+		if i == len(n.items) {
+			i--
+			child = n.children[i]
+		}
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+		child.size += 1 + right.size
+		n.items = slices.Delete(n.items, i, i+1)
+		n.children = slices.Delete(n.children, i+1, i+2)
+	}
+}
+
+// ascend calls fn on the entries of n in order, skipping the first skip of
+// them, until fn returns false.
+func (n *btreeNode[K]) ascend(skip int, fn func(indexEntry[K]) bool) bool {
+	for i := 0; i <= len(n.items); i++ {
+		if !n.leaf() {
+			if c := n.children[i]; skip >= c.size {
+				skip -= c.size
+			} else {
+				if !c.ascend(skip, fn) {
+					return false
+				}
+				skip = 0
+			}
+		}
+		if i == len(n.items) {
+			break
+		}
+		if skip > 0 {
+			skip--
+		} else if !fn(n.items[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortedIndex keeps entries ordered by (key, id) in a B-tree. Positions
+// (as returned by search, between and prefixBounds) are ranks: the number
+// of entries that sort before.
+type sortedIndex[K cmp.Ordered] struct {
+	root *btreeNode[K]
+}
+
+func (ix *sortedIndex[K]) len() int {
+	if ix.root == nil {
+		return 0
+	}
+	return ix.root.size
+}
+
+// rank returns the number of entries for which after is false. after must
+// be false for a prefix of the entries and true for the rest.
+func (ix *sortedIndex[K]) rank(after func(indexEntry[K]) bool) int {
+	pos := 0
+	for n := ix.root; n != nil; {
+		i := sort.Search(len(n.items), func(j int) bool { return after(n.items[j]) })
+		pos += i
+		if n.leaf() {
+			break
+		}
+		for _, c := range n.children[:i] {
+			pos += c.size
+		}
+		n = n.children[i]
+	}
+	return pos
+}
+
+// search returns the position of the first entry >= (key, id).
+func (ix *sortedIndex[K]) search(key K, id string) int {
+	e := indexEntry[K]{key: key, id: id}
+	return ix.rank(func(x indexEntry[K]) bool { return compareEntries(x, e) >= 0 })
+}
+
+func (ix *sortedIndex[K]) insert(key K, id string) {
+	if ix.root == nil {
+		ix.root = &btreeNode[K]{}
+	}
+	if len(ix.root.items) >= btreeMaxItems {
+		old := ix.root
+		mid, right := old.split(btreeMaxItems / 2)
+		ix.root = &btreeNode[K]{
+			items:    []indexEntry[K]{mid},
+			children: []*btreeNode[K]{old, right},
+			size:     old.size + 1 + right.size,
+		}
+	}
+	ix.root.insert(indexEntry[K]{key: key, id: id})
+}
+
+func (ix *sortedIndex[K]) remove(key K, id string) {
+	if ix.root == nil {
+		return
+	}
+	ix.root.remove(indexEntry[K]{key: key, id: id})
+	if len(ix.root.items) == 0 {
+		if ix.root.leaf() {
+			ix.root = nil
+		} else {
+			ix.root = ix.root.children[0]
+		}
+	}
+}
+
+// between returns the [start, end) positions of entries with lo <= key <= hi.
+func (ix *sortedIndex[K]) between(lo, hi K) (int, int) {
+	start := ix.rank(func(e indexEntry[K]) bool { return e.key >= lo })
+	end := ix.rank(func(e indexEntry[K]) bool { return e.key > hi })
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+func (ix *sortedIndex[K]) ids(start, end int) []string {
+	ids := make([]string, 0, end-start)
+	if ix.root == nil || end <= start {
+		return ids
+	}
+	ix.root.ascend(start, func(e indexEntry[K]) bool {
+		ids = append(ids, e.id)
+		return len(ids) < end-start
+	})
+	return ids
+}
+
+// prefixBounds returns the [start, end) positions of keys starting with prefix.
+// Keys sharing a prefix are contiguous in sort order, so two searches are
+// enough.
+func prefixBounds(ix *sortedIndex[string], prefix string) (int, int) {
+	start := ix.rank(func(e indexEntry[string]) bool { return e.key >= prefix })
+	end := ix.rank(func(e indexEntry[string]) bool {
+		return e.key >= prefix && !strings.HasPrefix(e.key, prefix)
+	})
+	return start, end
+}
+
+// foldName normalizes a name for case-insensitive lookups.
+func foldName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// indexUser / unindexUser must be called with us.mu held for writing.
+func (us *UserStore) indexUser(u User) {
+	us.byAge.insert(u.Age, u.ID)
+	us.byName.insert(foldName(u.Name), u.ID)
+	us.indexGrams(u)
+}
+
+func (us *UserStore) unindexUser(u User) {
+	us.byAge.remove(u.Age, u.ID)
+	us.byName.remove(foldName(u.Name), u.ID)
+	us.unindexGrams(u)
+}
+
+// Query API
+
+// PredicateOp says how a Predicate compares a field.
+type PredicateOp int
+
+const (
+	OpEquals PredicateOp = iota
+	OpRange
+	OpPrefix
+)
+
+// Predicate is one filter condition on an indexed field ("name" or "age").
+// Build them with NameEquals, NamePrefix, AgeEquals and AgeBetween.
+type Predicate struct {
+	Field string
+	Op    PredicateOp
+	Text  string // name value for OpEquals/OpPrefix
+	Min   int    // inclusive age bounds for OpEquals/OpRange
+	Max   int
+}
+
+func NameEquals(name string) Predicate {
+	return Predicate{Field: "name", Op: OpEquals, Text: foldName(name)}
+}
+
+func NamePrefix(prefix string) Predicate {
+	return Predicate{Field: "name", Op: OpPrefix, Text: foldName(prefix)}
+}
+
+func AgeEquals(age int) Predicate {
+	return Predicate{Field: "age", Op: OpEquals, Min: age, Max: age}
+}
+
+func AgeBetween(min, max int) Predicate {
+	return Predicate{Field: "age", Op: OpRange, Min: min, Max: max}
+}
+
+func (p Predicate) validate() error {
+	switch {
+	case p.Field == "name" && (p.Op == OpEquals || p.Op == OpPrefix):
+		return nil
+	case p.Field == "age" && (p.Op == OpEquals || p.Op == OpRange):
+		return nil
+	}
+	return fmt.Errorf("unsupported predicate on field %q", p.Field)
+}
+
+// matches checks a user directly (used after the index narrowed candidates).
+func (p Predicate) matches(u User) bool {
+	switch p.Field {
+	case "name":
+		name := foldName(u.Name)
+		if p.Op == OpPrefix {
+			return strings.HasPrefix(name, p.Text)
+		}
+		return name == p.Text
+	case "age":
+		return u.Age >= p.Min && u.Age <= p.Max
+	}
+	return false
+}
+
+// bounds finds the slice of the matching index covered by the predicate.
+// Must be called with us.mu held.
+func (us *UserStore) bounds(p Predicate) (start, end int) {
+	if p.Field == "age" {
+		return us.byAge.between(p.Min, p.Max)
+	}
+	if p.Op == OpPrefix {
+		return prefixBounds(&us.byName, p.Text)
+	}
+	return us.byName.between(p.Text, p.Text)
+}
+
+// query evaluates preds using the most selective index and then checks the
+// remaining predicates on each candidate. Must be called with us.mu held.
+//
+// WHY PICK THE SMALLEST?
+// Counting matches in a sorted index is just two binary searches, so we can
+// cheaply ask every predicate "how many users would you return?" and only
+// walk the shortest list.
+func (us *UserStore) query(preds []Predicate) []User {
+	best, bestStart, bestEnd := -1, 0, 0
+	for i, p := range preds {
+		start, end := us.bounds(p)
+		if best == -1 || end-start < bestEnd-bestStart {
+			best, bestStart, bestEnd = i, start, end
+		}
+	}
+
+	var ids []string
+	if preds[best].Field == "age" {
+		ids = us.byAge.ids(bestStart, bestEnd)
+	} else {
+		ids = us.byName.ids(bestStart, bestEnd)
+	}
+
+	users := []User{}
+	for _, id := range ids {
+		u := us.users[id]
+		ok := true
+		for i, p := range preds {
+			if i != best && !p.matches(u) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// parseListFilters turns GET /users query parameters into predicates:
+//
+//	?name=alice  ?name_prefix=al  ?age=30  ?min_age=18&max_age=65
+func parseListFilters(q url.Values) ([]Predicate, error) {
+	var preds []Predicate
+	if v := q.Get("name"); v != "" {
+		preds = append(preds, NameEquals(v))
+	}
+	if v := q.Get("name_prefix"); v != "" {
+		preds = append(preds, NamePrefix(v))
+	}
+	if v := q.Get("age"); v != "" {
+		age, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid age %q", v)
+		}
+		preds = append(preds, AgeEquals(age))
+	}
+	minAge, maxAge := q.Get("min_age"), q.Get("max_age")
+	if minAge != "" || maxAge != "" {
+		lo, hi := 0, int(^uint(0)>>1)
+		var err error
+		if minAge != "" {
+			if lo, err = strconv.Atoi(minAge); err != nil {
+				return nil, fmt.Errorf("invalid min_age %q", minAge)
+			}
+		}
+		if maxAge != "" {
+			if hi, err = strconv.Atoi(maxAge); err != nil {
+				return nil, fmt.Errorf("invalid max_age %q", maxAge)
+			}
+		}
+		preds = append(preds, AgeBetween(lo, hi))
+	}
+	return preds, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func seedIndexStore(t *testing.T) *UserStore {
+	t.Helper()
+	store := NewUserStore()
+	users := []User{
+		{ID: "1", Name: "Alice", Age: 30},
+		{ID: "2", Name: "alice", Age: 25},
+		{ID: "3", Name: "Albert", Age: 41},
+		{ID: "4", Name: "Bob", Age: 30},
+		{ID: "5", Name: "Carol", Age: 17},
+	}
+	for _, u := range users {
+		if err := store.Create(context.Background(), u); err != nil {
+			t.Fatalf("Create(%s) failed: %v", u.ID, err)
+		}
+	}
+	return store
+}
+
+func userIDs(users []User) []string {
+	ids := make([]string, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestUserStore_ListFilters(t *testing.T) {
+	store := seedIndexStore(t)
+
+	tests := []struct {
+		name    string
+		filters []Predicate
+		want    string
+	}{
+		{"name equals is case-insensitive", []Predicate{NameEquals("ALICE")}, "[1 2]"},
+		{"name prefix", []Predicate{NamePrefix("al")}, "[1 2 3]"},
+		{"age equals", []Predicate{AgeEquals(30)}, "[1 4]"},
+		{"age range", []Predicate{AgeBetween(18, 35)}, "[1 2 4]"},
+		{"combined", []Predicate{NamePrefix("al"), AgeBetween(26, 50)}, "[1 3]"},
+		{"no match", []Predicate{NameEquals("zed")}, "[]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := store.List(context.Background(), tt.filters...)
+			if err != nil {
+				t.Fatalf("List failed: %v", err)
+			}
+			if got := fmt.Sprint(userIDs(users)); got != tt.want {
+				t.Errorf("List = %s; want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserStore_IndexesFollowDelete(t *testing.T) {
+	store := seedIndexStore(t)
+	if err := store.Delete(context.Background(), "1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	users, _ := store.List(context.Background(), AgeEquals(30))
+	if got := fmt.Sprint(userIDs(users)); got != "[4]" {
+		t.Errorf("age index after delete = %s; want [4]", got)
+	}
+	if n := store.byName.len(); n != 4 {
+		t.Errorf("name index has %d entries; want 4", n)
+	}
+}
+
+func TestHandleListUsers_Filters(t *testing.T) {
+	s := &Server{store: seedIndexStore(t)}
+
+	req := httptest.NewRequest(http.MethodGet, "/users?name_prefix=al&min_age=26", nil)
+	rr := httptest.NewRecorder()
+	s.handleListUsers(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var users []User
+	if err := json.NewDecoder(rr.Body).Decode(&users); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if got := fmt.Sprint(userIDs(users)); got != "[1 3]" {
+		t.Errorf("filtered list = %s; want [1 3]", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/users?min_age=abc", nil)
+	rr = httptest.NewRecorder()
+	s.handleListUsers(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for bad min_age, got %d", rr.Code)
+	}
+}
+
+func TestSortedIndex_MatchesSortedSlice(t *testing.T) {
+	// random inserts and removes, checked against a plain sorted slice;
+	// enough entries for a three-level tree, so splits, borrows and merges
+	// all happen
+	rng := rand.New(rand.NewPCG(1, 2))
+	var ix sortedIndex[int]
+	var want []indexEntry[int]
+	check := func(step int) {
+		t.Helper()
+		if ix.len() != len(want) {
+			t.Fatalf("step %d: len = %d; want %d", step, ix.len(), len(want))
+		}
+		got := ix.ids(0, ix.len())
+		for i, e := range want {
+			if got[i] != e.id {
+				t.Fatalf("step %d: entry %d = %s; want %s", step, i, got[i], e.id)
+			}
+		}
+		lo, hi := rng.IntN(200), rng.IntN(200)
+		start, end := ix.between(lo, hi)
+		wantStart, _ := slices.BinarySearchFunc(want, indexEntry[int]{key: lo}, compareEntries[int])
+		wantEnd := wantStart
+		for wantEnd < len(want) && want[wantEnd].key <= hi {
+			wantEnd++
+		}
+		if lo > hi {
+			wantEnd = wantStart
+		}
+		if start != wantStart || end != wantEnd {
+			t.Fatalf("step %d: between(%d, %d) = [%d, %d); want [%d, %d)", step, lo, hi, start, end, wantStart, wantEnd)
+		}
+	}
+
+	for step := range 40000 {
+		e := indexEntry[int]{key: rng.IntN(200), id: fmt.Sprint(rng.IntN(50))}
+		i, found := slices.BinarySearchFunc(want, e, compareEntries[int])
+		if rng.IntN(3) > 0 || len(want) < 3000 && step < 20000 {
+			ix.insert(e.key, e.id)
+			if !found {
+				want = slices.Insert(want, i, e)
+			}
+		} else {
+			ix.remove(e.key, e.id)
+			if found {
+				want = slices.Delete(want, i, i+1)
+			}
+		}
+		if step%997 == 0 {
+			check(step)
+		}
+	}
+	check(-1)
+	for len(want) > 0 {
+		e := want[rng.IntN(len(want))]
+		ix.remove(e.key, e.id)
+		want = slices.DeleteFunc(want, func(x indexEntry[int]) bool { return x == e })
+	}
+	check(-2)
+	if ix.root != nil {
+		t.Errorf("empty index still has a root node")
+	}
+}
+
+// millionUsers is a store of 1M users, built once and shared by the
+// benchmarks (which leave it as they found it).
+var millionUsers = sync.OnceValue(func() *UserStore {
+	store := NewUserStore()
+	for i := range 1_000_000 {
+		store.Create(context.Background(), User{ID: fmt.Sprint(i), Name: fmt.Sprintf("user%d", i), Age: i%100 + 1})
+	}
+	return store
+})
+
+func BenchmarkUserStore_ListByAge(b *testing.B) {
+	store := millionUsers()
+	for b.Loop() {
+		store.List(context.Background(), AgeEquals(42), NamePrefix("user4"))
+	}
+}
+
+// BenchmarkUserStore_Write is a Create and a Delete at 1M users; with a
+// sorted slice index each one moved megabytes of entries.
+func BenchmarkUserStore_Write(b *testing.B) {
+	ctx := context.Background()
+	store := millionUsers()
+	i := 0
+	for b.Loop() {
+		id := fmt.Sprint("bench-", i)
+		store.Create(ctx, User{ID: id, Name: fmt.Sprint("bench user ", i), Age: i%100 + 1})
+		store.Delete(ctx, id)
+		i++
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 8. Lifecycle Manager (ordered start/stop hooks)
+//
+// WHY?
+// srv.Shutdown(ctx) only drains HTTP connections. Background goroutines
+// (like the RateLimiter refill ticker) were never told to stop, and nothing
+// got a chance to flush state. Components now register a Hook and the
+// Lifecycle runs them in a predictable order:
+//
+//   Start: lowest Priority first   (store, limiter ... then the HTTP server)
+//   Stop:  reverse of start order  (HTTP server drains first, then the rest)
+//
+// Stopping shares one global deadline; each hook may also have its own,
+// shorter Timeout. Hooks that miss their deadline are reported, not waited
+// for forever. A second SIGINT/SIGTERM during shutdown forces exit.
+
+// Hook is one component's start/stop callbacks. Either callback may be nil.
+type Hook struct {
+	Name     string
+	Priority int           // lower starts earlier and stops later
+	Timeout  time.Duration // per-hook stop timeout (0 = only the global deadline)
+	OnStart  func(ctx context.Context) error
+	OnStop   func(ctx context.Context) error
+}
+
+// StopReport says how each hook behaved during Stop.
+type StopReport struct {
+	Stopped  []string         // hooks that returned in time without error
+	TimedOut []string         // hooks still running when their deadline passed
+	Failed   map[string]error // hooks that returned an error
+}
+
+// OK reports whether every hook stopped cleanly and in time.
+func (r StopReport) OK() bool {
+	return len(r.TimedOut) == 0 && len(r.Failed) == 0
+}
+
+// Lifecycle owns the registered hooks and runs them in priority order.
+type Lifecycle struct {
+	mu              sync.Mutex
+	hooks           []Hook
+	started         []Hook // hooks whose OnStart succeeded, in start order
+	shutdownTimeout time.Duration
+
+	exit func(code int) // os.Exit, replaceable in tests
+}
+
+// NewLifecycle creates a Lifecycle whose Stop phase may take at most
+// shutdownTimeout in total.
+func NewLifecycle(shutdownTimeout time.Duration) *Lifecycle {
+	return &Lifecycle{
+		shutdownTimeout: shutdownTimeout,
+		exit:            os.Exit,
+	}
+}
+
+// Register adds a hook. Hooks with equal Priority keep registration order.
+func (lc *Lifecycle) Register(h Hook) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.hooks = append(lc.hooks, h)
+}
+
+// Start runs every OnStart in priority order. If one fails, the hooks that
+// already started are stopped again (in reverse) and the error is returned.
+func (lc *Lifecycle) Start(ctx context.Context) error {
+	lc.mu.Lock()
+	hooks := append([]Hook(nil), lc.hooks...)
+	lc.mu.Unlock()
+
+	sort.SliceStable(hooks, func(i, j int) bool { return hooks[i].Priority < hooks[j].Priority })
+
+	for _, h := range hooks {
+		if h.OnStart != nil {
+			if err := h.OnStart(ctx); err != nil {
+				lc.Stop(context.Background())
+				return fmt.Errorf("start %s: %w", h.Name, err)
+			}
+		}
+		lc.mu.Lock()
+		lc.started = append(lc.started, h)
+		lc.mu.Unlock()
+	}
+	return nil
+}
+
+// Stop runs OnStop for every started hook in reverse start order. The whole
+// phase is bounded by the shutdown timeout (and ctx); each hook additionally
+// by its own Timeout.
+func (lc *Lifecycle) Stop(ctx context.Context) StopReport {
+	lc.mu.Lock()
+	started := lc.started
+	lc.started = nil
+	lc.mu.Unlock()
+
+	if lc.shutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, lc.shutdownTimeout)
+		defer cancel()
+	}
+
+	report := StopReport{Failed: make(map[string]error)}
+	for i := len(started) - 1; i >= 0; i-- {
+		h := started[i]
+		if h.OnStop == nil {
+			report.Stopped = append(report.Stopped, h.Name)
+			continue
+		}
+		switch err := runStopHook(ctx, h); {
+		case err == context.DeadlineExceeded:
+			log.Printf("lifecycle: %s did not stop in time", h.Name)
+			report.TimedOut = append(report.TimedOut, h.Name)
+		case err != nil:
+			log.Printf("lifecycle: %s stop error: %v", h.Name, err)
+			report.Failed[h.Name] = err
+		default:
+			report.Stopped = append(report.Stopped, h.Name)
+		}
+	}
+	return report
+}
+
+// runStopHook calls h.OnStop but gives up once its deadline passes.
+// A hook that ignores ctx keeps running in its goroutine; we just stop
+// waiting for it so the remaining hooks still get their turn.
+func runStopHook(ctx context.Context, h Hook) error {
+	if h.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1) // buffered: a late hook must not block forever
+	go func() { done <- h.OnStop(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return context.DeadlineExceeded
+	}
+}
+
+// Run starts all hooks, waits for SIGINT/SIGTERM (or ctx cancellation) and
+// then stops them. A second signal while stopping exits the process with
+// status 1 immediately.
+func (lc *Lifecycle) Run(ctx context.Context) (StopReport, error) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	return lc.run(ctx, sigs)
+}
+
+func (lc *Lifecycle) run(ctx context.Context, sigs <-chan os.Signal) (StopReport, error) {
+	if err := lc.Start(ctx); err != nil {
+		return StopReport{}, err
+	}
+
+	select {
+	case sig := <-sigs:
+		log.Printf("received %v, shutting down ...", sig)
+	case <-ctx.Done():
+		log.Println("context canceled, shutting down ...")
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("received second %v, forcing exit", sig)
+			lc.exit(1)
+		case <-stopped:
+		}
+	}()
+
+	report := lc.Stop(context.Background())
+	if !report.OK() {
+		log.Printf("shutdown incomplete: timed out=%v failed=%v", report.TimedOut, report.Failed)
+	}
+	return report, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// recordingHooks registers one hook per priority and records start/stop order.
+func recordingHooks(lc *Lifecycle, priorities ...int) *[]string {
+	var mu sync.Mutex
+	events := &[]string{}
+	record := func(e string) {
+		mu.Lock()
+		defer mu.Unlock()
+		*events = append(*events, e)
+	}
+	for _, p := range priorities {
+		name := fmt.Sprintf("p%d", p)
+		lc.Register(Hook{
+			Name:     name,
+			Priority: p,
+			OnStart:  func(ctx context.Context) error { record("start " + name); return nil },
+			OnStop:   func(ctx context.Context) error { record("stop " + name); return nil },
+		})
+	}
+	return events
+}
+
+func TestLifecycle_Order(t *testing.T) {
+	lc := NewLifecycle(time.Second)
+	events := recordingHooks(lc, 20, 10, 30)
+
+	if err := lc.Start(context.Background()); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	report := lc.Stop(context.Background())
+	if !report.OK() {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	want := []string{"start p10", "start p20", "start p30", "stop p30", "stop p20", "stop p10"}
+	if !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %v; want %v", *events, want)
+	}
+}
+
+func TestLifecycle_StartFailureRollsBack(t *testing.T) {
+	lc := NewLifecycle(time.Second)
+	events := recordingHooks(lc, 10)
+	lc.Register(Hook{
+		Name:     "broken",
+		Priority: 20,
+		OnStart:  func(ctx context.Context) error { return errors.New("boom") },
+	})
+
+	if err := lc.Start(context.Background()); err == nil {
+		t.Fatal("expected Start to fail")
+	}
+	want := []string{"start p10", "stop p10"}
+	if !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %v; want %v", *events, want)
+	}
+}
+
+func TestLifecycle_StopTimeouts(t *testing.T) {
+	lc := NewLifecycle(time.Second)
+	lc.Register(Hook{Name: "fast", Priority: 1, OnStop: func(ctx context.Context) error { return nil }})
+	lc.Register(Hook{
+		Name:     "slow",
+		Priority: 2,
+		Timeout:  20 * time.Millisecond,
+		OnStop: func(ctx context.Context) error {
+			time.Sleep(200 * time.Millisecond) // ignores ctx on purpose
+			return nil
+		},
+	})
+	lc.Register(Hook{Name: "failing", Priority: 3, OnStop: func(ctx context.Context) error { return errors.New("flush failed") }})
+	lc.Start(context.Background())
+
+	start := time.Now()
+	report := lc.Stop(context.Background())
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Stop waited %v for a timed out hook", elapsed)
+	}
+	if !reflect.DeepEqual(report.TimedOut, []string{"slow"}) {
+		t.Errorf("TimedOut = %v; want [slow]", report.TimedOut)
+	}
+	if report.Failed["failing"] == nil {
+		t.Errorf("expected failing hook in Failed, got %v", report.Failed)
+	}
+	if !reflect.DeepEqual(report.Stopped, []string{"fast"}) {
+		t.Errorf("Stopped = %v; want [fast]", report.Stopped)
+	}
+}
+
+func TestLifecycle_SecondSignalForcesExit(t *testing.T) {
+	lc := NewLifecycle(5 * time.Second)
+	exited := make(chan int, 1)
+	lc.exit = func(code int) { exited <- code }
+
+	release := make(chan struct{})
+	lc.Register(Hook{
+		Name: "stuck",
+		OnStop: func(ctx context.Context) error {
+			<-release
+			return nil
+		},
+	})
+	defer close(release)
+
+	sigs := make(chan os.Signal, 2)
+	go lc.run(context.Background(), sigs)
+
+	sigs <- syscall.SIGTERM
+	sigs <- syscall.SIGINT
+
+	select {
+	case code := <-exited:
+		if code != 1 {
+			t.Errorf("exit code = %d; want 1", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second signal did not force exit")
+	}
+}
+
+func TestRateLimiterWithStop(t *testing.T) {
+	_, stop := RateLimiterWithStop(1000, 1)
+	stop()
+	stop() // safe to call twice
+}
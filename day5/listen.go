@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 20. Listeners: Unix Sockets and Socket Activation
+//
+// WHY?
+// Behind a local sidecar proxy, TCP :8080 is exposure nobody needs. A Unix
+// socket is only reachable through the filesystem, and its file mode decides
+// who may connect:
+//
+//	"addr": "unix:/run/users-api/http.sock", "socket_mode": "0660"
+//
+// SOCKET ACTIVATION (systemd):
+// With a .socket unit, systemd opens the sockets itself and passes them to
+// the service as fd 3, 4, ... and sets LISTEN_PID=<our pid>, LISTEN_FDS=<n>
+// and LISTEN_FDNAMES=http:admin (FileDescriptorName= in the unit). During a
+// restart systemd keeps the sockets open and the kernel queues new
+// connections in the backlog, so clients see a slow answer instead of
+// "connection refused". Inherited sockets win over addr/admin_addr.
+//
+// STALE SOCKET FILES:
+// A process that crashed leaves its socket file behind, and the next bind
+// fails with "address already in use". Before binding we dial the file:
+// if nobody answers, it is stale and gets removed. A graceful shutdown
+// removes the file itself (srv.Shutdown closes the listener, see
+// unixListener.Close).
+//
+// NO WINDOW AT THE DEFAULT MODE:
+// bind(2) creates the socket file with the process umask (often 0755 for a
+// socket: anyone may connect), and only then can we chmod it. Clients over
+// the socket count as local admins (isUnixConn), so even that short window
+// matters. Changing the umask would affect every goroutine creating files,
+// so instead the socket is bound inside a fresh 0700 directory, where
+// nobody else can reach it, chmod'ed there and then linked to its real
+// path. The link fails if the path is taken, just like bind would.
+
+// listenFDsStart is the first fd systemd passes (SD_LISTEN_FDS_START).
+const listenFDsStart = 3
+
+// FileMode is an os.FileMode written as an octal string in JSON ("0660").
+type FileMode struct {
+	os.FileMode
+}
+
+func (m FileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%04o", uint32(m.FileMode)))
+}
+
+func (m *FileMode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("file mode must be an octal string like \"0660\": %w", err)
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return fmt.Errorf("file mode %q: %w", s, err)
+	}
+	m.FileMode = os.FileMode(v)
+	return nil
+}
+
+// Listeners holds the sockets inherited through socket activation until
+// the servers take them.
+type Listeners struct {
+	mu        sync.Mutex
+	inherited []namedListener
+}
+
+type namedListener struct {
+	name string
+	net.Listener
+}
+
+// InheritedListeners returns the sockets systemd passed to this process
+// (none when it wasn't socket-activated). The LISTEN_* variables are
+// unset so child processes don't mistake the sockets for theirs.
+func InheritedListeners() (*Listeners, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return inheritListeners(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid(), listenFDsStart)
+}
+
+// inheritListeners turns fds firstFD..firstFD+LISTEN_FDS-1 into listeners.
+func inheritListeners(pidEnv, fdsEnv, namesEnv string, pid, firstFD int) (*Listeners, error) {
+	ls := &Listeners{}
+	if fdsEnv == "" {
+		return ls, nil
+	}
+	// LISTEN_PID guards against variables meant for another process
+	// (e.g. our parent) leaking into our environment
+	if p, err := strconv.Atoi(pidEnv); err != nil || p != pid {
+		return ls, nil
+	}
+	n, err := strconv.Atoi(fdsEnv)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fdsEnv)
+	}
+	names := strings.Split(namesEnv, ":")
+	for i := 0; i < n; i++ {
+		name := "unknown" // systemd's name for sockets without FileDescriptorName
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(firstFD+i), name)
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener works on a dup of the fd
+		if err != nil {
+			ls.Close()
+			return nil, fmt.Errorf("inherited socket %d (%s): %w", firstFD+i, name, err)
+		}
+		ls.inherited = append(ls.inherited, namedListener{name: name, Listener: ln})
+	}
+	return ls, nil
+}
+
+// take removes and returns the first inherited listener called one of
+// names, or nil. ls may be nil.
+func (ls *Listeners) take(names ...string) net.Listener {
+	if ls == nil {
+		return nil
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for i, nl := range ls.inherited {
+		for _, name := range names {
+			if nl.name == name {
+				ls.inherited = append(ls.inherited[:i], ls.inherited[i+1:]...)
+				return nl.Listener
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the inherited listeners no server took.
+func (ls *Listeners) Close() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	var errs []error
+	for _, nl := range ls.inherited {
+		log.Printf("closing unused inherited socket %q (%s)", nl.name, nl.Addr())
+		errs = append(errs, nl.Listener.Close())
+	}
+	ls.inherited = nil
+	return errors.Join(errs...)
+}
+
+// Listen listens on addr: "unix:/path/to.sock" for a Unix socket with
+// file mode mode, anything else is a TCP address.
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	private, err := os.MkdirTemp(filepath.Dir(path), ".sock-") // mode 0700
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(private)
+	tmp := filepath.Join(private, "s")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := ln.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false) // unixListener.Close removes it, see below
+	if err := os.Chmod(tmp, mode); err != nil {
+		ul.Close()
+		return nil, fmt.Errorf("chmod %s: %w", path, err)
+	}
+	if err := os.Link(tmp, path); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ul, path: path}, nil
+}
+
+// unixListener removes its socket file when closed.
+type unixListener struct {
+	*net.UnixListener
+	path string
+	once sync.Once
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() {
+		if rmErr := os.Remove(l.path); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) {
+			err = errors.Join(err, rmErr)
+		}
+	})
+	return err
+}
+
+// removeStaleSocket deletes path if it is a socket nobody listens on.
+// Regular files and live sockets are left alone.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: another process is listening on it", path)
+	}
+	log.Printf("removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// listen returns the listener for one of the servers: the inherited socket
+// with one of names if systemd passed one, otherwise a new one on addr.
+func (s *Server) listen(addr string, names ...string) (net.Listener, error) {
+	if ln := s.listeners.take(names...); ln != nil {
+		return ln, nil
+	}
+	return Listen(addr, s.Config().SocketMode.FileMode)
+}
+
+// isUnixConn reports whether r arrived over a Unix socket. Only processes
+// allowed by the socket's file mode can connect, so it counts as local.
+func isUnixConn(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
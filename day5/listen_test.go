@@ -0,0 +1,213 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestListen_UnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "http.sock")
+	ln, err := Listen("unix:"+path, 0o600)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	// bound in a private directory first; nothing of it is left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %v; want just the socket", entries)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("socket file missing: %v", err)
+	}
+	if fi.Mode()&fs.ModeSocket == 0 || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %s; want a 0600 socket", fi.Mode())
+	}
+
+	s := &Server{store: NewUserStore()}
+	srv := &http.Server{Handler: s.routes()}
+	defer s.stopCurrentLimiter(context.Background())
+	go srv.Serve(ln)
+
+	resp, err := unixClient(path).Get("http://unix/v1/users")
+	if err != nil {
+		t.Fatalf("GET over unix socket failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "[]" {
+		t.Errorf("GET /v1/users = %d %q; want 200 []", resp.StatusCode, body)
+	}
+
+	// graceful shutdown closes the listener, which removes the file
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after shutdown (err=%v)", err)
+	}
+}
+
+func TestListen_StaleSocketFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// a crashed process leaves its socket file behind
+	stale := filepath.Join(dir, "stale.sock")
+	old, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.(*net.UnixListener).SetUnlinkOnClose(false)
+	old.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		setup   func(path string) func()
+		wantErr string
+	}{
+		{"stale socket is replaced", stale, nil, ""},
+		{"live socket is kept", filepath.Join(dir, "live.sock"), func(path string) func() {
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return func() { ln.Close() }
+		}, "another process is listening"},
+		{"regular file is kept", filepath.Join(dir, "file"), func(path string) func() {
+			os.WriteFile(path, []byte("data"), 0o600)
+			return func() {}
+		}, "not a socket"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				defer tt.setup(tt.path)()
+			}
+			ln, err := Listen("unix:"+tt.path, 0o660)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Listen failed: %v", err)
+				}
+				ln.Close()
+				return
+			}
+			if err == nil {
+				ln.Close()
+				t.Fatal("Listen succeeded; want an error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v; want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestInheritListeners(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	f, err := tcp.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, pid := int(f.Fd()), os.Getpid()
+
+	// meant for another process: ignored
+	ls, err := inheritListeners(strconv.Itoa(pid+1), "1", "http", pid, fd)
+	if err != nil || ls.take("http") != nil {
+		t.Fatalf("LISTEN_PID of another process was used (err=%v)", err)
+	}
+	if _, err := inheritListeners(strconv.Itoa(pid), "x", "", pid, fd); err == nil {
+		t.Error("invalid LISTEN_FDS accepted")
+	}
+
+	// inheritListeners closes the fd it was given (like systemd's, it
+	// belongs to nobody else), so hand it a raw dup
+	dup, err := syscall.Dup(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err = inheritListeners(strconv.Itoa(pid), "1", "http", pid, dup)
+	if err != nil {
+		t.Fatalf("inheritListeners failed: %v", err)
+	}
+	if ls.take("admin") != nil {
+		t.Error(`take("admin") returned the "http" socket`)
+	}
+	ln := ls.take("http", "unknown")
+	if ln == nil {
+		t.Fatal(`take("http") returned nil`)
+	}
+	defer ln.Close()
+	if ln.Addr().String() != tcp.Addr().String() {
+		t.Errorf("inherited addr = %s; want %s", ln.Addr(), tcp.Addr())
+	}
+	if ls.take("http") != nil {
+		t.Error("the same socket was taken twice")
+	}
+}
+
+func TestFileMode_JSON(t *testing.T) {
+	var cfg struct {
+		Mode FileMode `json:"mode"`
+	}
+	if err := json.Unmarshal([]byte(`{"mode":"0640"}`), &cfg); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if cfg.Mode.FileMode != 0o640 {
+		t.Errorf("mode = %o; want 640", cfg.Mode.FileMode)
+	}
+	out, _ := json.Marshal(cfg)
+	if string(out) != `{"mode":"0640"}` {
+		t.Errorf("marshal = %s", out)
+	}
+	for _, bad := range []string{`{"mode":"rw-"}`, `{"mode":640}`} {
+		if err := json.Unmarshal([]byte(bad), &cfg); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestAdminAuth_UnixSocketIsLocal(t *testing.T) {
+	h := adminAuth("")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/debug/stats", nil)
+	req.RemoteAddr = "@"
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, &net.UnixAddr{Name: "/run/admin.sock", Net: "unix"}))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("status = %d; want 200 for a unix socket client", rr.Code)
+	}
+
+	cfg := DefaultConfig()
+	cfg.AdminAddr = "unix:/run/admin.sock"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("unix admin_addr without token rejected: %v", err)
+	}
+}
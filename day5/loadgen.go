@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 28. Load Generator
+//
+// WHY?
+// "How many req/s does it take, with the rate limiter on and off?" needs a
+// number, not a guess. `-load http://localhost:8080` sends a mix of
+// create/get/list/delete and reports throughput, errors by status and
+// latency percentiles.
+//
+// TWO MODELS:
+//
+//	closed (-load-concurrency 32): 32 workers, each sends its next request
+//	    when the previous one returned. A slow server slows the load down,
+//	    so it measures "how fast can it go".
+//	open (-load-rate 500): a request every 2ms no matter what, like real
+//	    users who don't wait for each other. It measures "what latency do
+//	    users see at 500 req/s".
+//
+// COORDINATED OMISSION:
+// In the open model, latency is measured from when a request SHOULD have
+// been sent. If the generator itself falls behind (all workers busy), that
+// wait is part of what a user would have seen; measuring from the actual
+// send would hide exactly the stalls we're looking for.
+//
+// HISTOGRAM (HDR-style):
+// Keeping every latency is too much for long runs; averaging loses the
+// tail. Buckets that are linear within each power of two keep every value
+// to within 1% using a few thousand counters, from 1µs to hours.
+
+// loadOps are the operations a mix can contain.
+var loadOps = []string{"create", "get", "list", "delete"}
+
+// LoadOptions configures a run.
+type LoadOptions struct {
+	Target      string
+	Client      *http.Client   // nil = a client with Concurrency idle connections
+	Mix         map[string]int // op -> weight, e.g. create=2,get=6,list=1,delete=1
+	Rate        float64        // > 0: open model, requests per second
+	Concurrency int            // closed model: workers; open model: max in flight (1)
+	Duration    time.Duration  // stop after this long (0 = until Requests)
+	Requests    int            // stop after this many (0 = until Duration)
+	CSV         io.Writer      // per-request results; nil = none
+	Seed        uint64         // 0 = random
+}
+
+// LoadResult is one request.
+type LoadResult struct {
+	Start   time.Duration // since the run began (intended start, open model)
+	Op      string
+	Status  int    // 0 = no response
+	Error   string // transport error kind: "timeout", "refused", ...
+	Latency time.Duration
+}
+
+// LoadReport summarizes a run.
+type LoadReport struct {
+	Model    string
+	Elapsed  time.Duration
+	Requests int
+	Errors   int            // non-2xx or no response
+	Statuses map[string]int // "200", "429", "timeout", ...
+	Latency  *Histogram
+	Ops      map[string]*OpReport
+}
+
+// OpReport is the part of a LoadReport for one operation.
+type OpReport struct {
+	Requests int
+	Errors   int
+	Latency  *Histogram
+}
+
+// Throughput returns the completed requests per second.
+func (r LoadReport) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// ParseLoadMix parses "create=2,get=6,list=1,delete=1".
+func ParseLoadMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	for part := range strings.SplitSeq(s, ",") {
+		op, w, ok := strings.Cut(strings.TrimSpace(part), "=")
+		n, err := strconv.Atoi(w)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid mix entry %q (want op=weight)", part)
+		}
+		if !slices.Contains(loadOps, op) {
+			return nil, fmt.Errorf("unknown op %q (want one of %s)", op, strings.Join(loadOps, ", "))
+		}
+		mix[op] = n
+	}
+	total := 0
+	for _, n := range mix {
+		total += n
+	}
+	if total == 0 {
+		return nil, errors.New("mix has no weight")
+	}
+	return mix, nil
+}
+
+// Histogram
+
+// histSubBits: 2^7 = 128 linear buckets per power of two, so a recorded
+// value is off by less than 1/128 of itself.
+const histSubBits = 7
+
+// Histogram counts durations (in µs) in log-linear buckets.
+type Histogram struct {
+	counts []uint64
+	total  uint64
+	min    int64
+	max    int64
+}
+
+func histIndex(v int64) int {
+	if v < 1<<histSubBits {
+		return int(v) // exact below 128µs
+	}
+	exp := bits.Len64(uint64(v)) - 1 - histSubBits
+	return (exp+1)<<histSubBits + int(v>>exp) - 1<<histSubBits
+}
+
+// histHighest is the largest value that lands in bucket i.
+func histHighest(i int) int64 {
+	block := i >> histSubBits
+	if block == 0 {
+		return int64(i)
+	}
+	exp := block - 1
+	sub := int64(i&(1<<histSubBits-1)) + 1<<histSubBits
+	return (sub+1)<<exp - 1
+}
+
+// Record adds one duration.
+func (h *Histogram) Record(d time.Duration) {
+	v := max(d.Microseconds(), 0)
+	i := histIndex(v)
+	if i >= len(h.counts) {
+		h.counts = slices.Grow(h.counts, i+1-len(h.counts))[:i+1]
+	}
+	h.counts[i]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	h.max = max(h.max, v)
+	h.total++
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() uint64 { return h.total }
+
+// Percentile returns the value below which q percent of the values are
+// (q in 0..100), rounded up to its bucket.
+func (h *Histogram) Percentile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(q / 100 * float64(h.total)))
+	target = max(target, 1)
+	var seen uint64
+	for i, n := range h.counts {
+		seen += n
+		if seen >= target {
+			return time.Duration(min(histHighest(i), h.max)) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+// Min and Max return the exact extremes.
+func (h *Histogram) Min() time.Duration { return time.Duration(h.min) * time.Microsecond }
+func (h *Histogram) Max() time.Duration { return time.Duration(h.max) * time.Microsecond }
+
+// Running a load
+
+// loadState is shared by the workers: the IDs created so far, so gets and
+// deletes hit users that exist.
+type loadState struct {
+	mu     sync.Mutex
+	rng    *rand.Rand
+	ids    []string
+	prefix string
+	next   int
+	ops    []string // one entry per weight unit
+}
+
+func (st *loadState) pick() (op, id string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	op = st.ops[st.rng.IntN(len(st.ops))]
+	if (op == "get" || op == "delete") && len(st.ids) == 0 {
+		op = "create" // nothing to get or delete yet
+	}
+	switch op {
+	case "create":
+		st.next++
+		id = st.prefix + strconv.Itoa(st.next)
+		st.ids = append(st.ids, id) // a failed create makes a later get 404: that's reported too
+	case "get":
+		id = st.ids[st.rng.IntN(len(st.ids))]
+	case "delete":
+		i := st.rng.IntN(len(st.ids))
+		id = st.ids[i]
+		st.ids[i] = st.ids[len(st.ids)-1]
+		st.ids = st.ids[:len(st.ids)-1]
+	}
+	return op, id
+}
+
+// loadRequest sends one operation and returns its status (0 and an error
+// kind when there was no response).
+func loadRequest(ctx context.Context, client *http.Client, target, op, id string) (int, string) {
+	method, path := http.MethodGet, "/v1/users/"+id
+	var body io.Reader
+	switch op {
+	case "create":
+		b, _ := json.Marshal(User{ID: id, Name: "Load " + id, Age: 20 + len(id)%50})
+		method, path, body = http.MethodPost, "/v1/users", bytes.NewReader(b)
+	case "list":
+		path = "/v1/users"
+	case "delete":
+		method = http.MethodDelete
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target+path, body)
+	if err != nil {
+		return 0, "request"
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, loadErrorKind(err)
+	}
+	io.Copy(io.Discard, resp.Body) // read to the end so the connection is reused
+	resp.Body.Close()
+	return resp.StatusCode, ""
+}
+
+// loadErrorKind names a transport error for the status breakdown.
+func loadErrorKind(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "reset"
+	}
+	return "error"
+}
+
+// RunLoad drives the target until Duration or Requests is reached, or ctx
+// ends, and reports what it saw.
+func RunLoad(ctx context.Context, opts LoadOptions) (LoadReport, error) {
+	if opts.Duration <= 0 && opts.Requests <= 0 {
+		return LoadReport{}, errors.New("load: set a duration or a number of requests")
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.Mix == nil {
+		opts.Mix = map[string]int{"create": 1, "get": 6, "list": 1, "delete": 1}
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{MaxIdleConnsPerHost: opts.Concurrency}}
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	// the seed fixes the sequence of ops; IDs are unique per run, so runs
+	// against the same server don't collide
+	st := &loadState{rng: rand.New(rand.NewPCG(seed, 0)), prefix: fmt.Sprintf("load-%06x-", rand.Uint32()&0xffffff)}
+	for _, op := range loadOps { // fixed order: the same seed gives the same run
+		for range opts.Mix[op] {
+			st.ops = append(st.ops, op)
+		}
+	}
+	target := strings.TrimRight(opts.Target, "/")
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	report := LoadReport{Model: "closed", Statuses: make(map[string]int), Latency: &Histogram{}, Ops: make(map[string]*OpReport)}
+	if opts.Rate > 0 {
+		report.Model = "open"
+	}
+
+	// one collector owns the report and the CSV: no locks on the hot path
+	results := make(chan LoadResult, 1024)
+	collected := make(chan error)
+	go func() { collected <- collectLoad(results, &report, opts.CSV) }()
+
+	begin := time.Now()
+	var sent sync.WaitGroup
+	send := func(intended time.Time) {
+		op, id := st.pick()
+		status, kind := loadRequest(ctx, opts.Client, target, op, id)
+		if kind == "canceled" || (kind == "timeout" && ctx.Err() != nil) {
+			return // cut off by the end of the run, not by the server
+		}
+		results <- LoadResult{Start: intended.Sub(begin), Op: op, Status: status, Error: kind, Latency: time.Since(intended)}
+	}
+
+	var remaining atomic.Int64 // requests left to send (with Requests set)
+	remaining.Store(int64(opts.Requests))
+	take := func() bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		return opts.Requests <= 0 || remaining.Add(-1) >= 0
+	}
+
+	if opts.Rate > 0 {
+		// open model: request i is due at begin + i/Rate
+		interval := time.Duration(float64(time.Second) / opts.Rate)
+		inflight := make(chan struct{}, opts.Concurrency)
+		for i := 0; take(); i++ {
+			due := begin.Add(time.Duration(i) * interval)
+			if d := time.Until(due); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
+			// all slots busy: wait. The request is late now, and its
+			// latency (from due) says so.
+			select {
+			case inflight <- struct{}{}:
+			case <-ctx.Done():
+				continue // take() ends the loop
+			}
+			sent.Go(func() {
+				defer func() { <-inflight }()
+				send(due)
+			})
+		}
+	} else {
+		for range opts.Concurrency {
+			sent.Go(func() {
+				for take() {
+					send(time.Now())
+				}
+			})
+		}
+	}
+	sent.Wait()
+	report.Elapsed = time.Since(begin)
+	close(results)
+	return report, <-collected
+}
+
+// collectLoad folds results into report and writes them to w as CSV.
+func collectLoad(results <-chan LoadResult, report *LoadReport, w io.Writer) error {
+	var cw *csv.Writer
+	if w != nil {
+		cw = csv.NewWriter(w)
+		cw.Write([]string{"start_ms", "op", "status", "error", "latency_ms"})
+	}
+	for r := range results {
+		op := report.Ops[r.Op]
+		if op == nil {
+			op = &OpReport{Latency: &Histogram{}}
+			report.Ops[r.Op] = op
+		}
+		report.Requests++
+		op.Requests++
+		key := r.Error
+		if r.Status != 0 {
+			key = strconv.Itoa(r.Status)
+		}
+		report.Statuses[key]++
+		if r.Status < 200 || r.Status > 299 {
+			report.Errors++
+			op.Errors++
+		}
+		report.Latency.Record(r.Latency)
+		op.Latency.Record(r.Latency)
+		if cw != nil {
+			cw.Write([]string{
+				strconv.FormatFloat(float64(r.Start.Microseconds())/1000, 'f', 3, 64),
+				r.Op, strconv.Itoa(r.Status), r.Error,
+				strconv.FormatFloat(float64(r.Latency.Microseconds())/1000, 'f', 3, 64),
+			})
+		}
+	}
+	if cw == nil {
+		return nil
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Print writes the report as a table.
+func (r LoadReport) Print(w io.Writer) {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 2, 64) + "ms"
+	}
+	errPct := 0.0
+	if r.Requests > 0 {
+		errPct = 100 * float64(r.Errors) / float64(r.Requests)
+	}
+	fmt.Fprintf(w, "%s model: %d requests in %s, %.1f req/s, %d errors (%.2f%%)\n",
+		r.Model, r.Requests, r.Elapsed.Round(time.Millisecond), r.Throughput(), r.Errors, errPct)
+
+	keys := make([]string, 0, len(r.Statuses))
+	for k := range r.Statuses {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprint(w, "status:")
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s=%d", k, r.Statuses[k])
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintf(w, "%-8s %9s %7s %9s %9s %9s %9s %9s %9s\n", "op", "requests", "errors", "min", "p50", "p90", "p99", "p99.9", "max")
+	row := func(name string, n, errs int, h *Histogram) {
+		fmt.Fprintf(w, "%-8s %9d %7d %9s %9s %9s %9s %9s %9s\n", name, n, errs,
+			ms(h.Min()), ms(h.Percentile(50)), ms(h.Percentile(90)), ms(h.Percentile(99)), ms(h.Percentile(99.9)), ms(h.Max()))
+	}
+	for _, op := range loadOps {
+		if o := r.Ops[op]; o != nil {
+			row(op, o.Requests, o.Errors, o.Latency)
+		}
+	}
+	row("all", r.Requests, r.Errors, r.Latency)
+}
+
+// runLoad is the -load command; it returns the exit code.
+func runLoad(opts LoadOptions, csvPath string) int {
+	if csvPath != "" {
+		f, err := os.Create(csvPath)
+		if err != nil {
+			log.Printf("load: %v", err)
+			return 1
+		}
+		defer f.Close()
+		opts.CSV = f
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	report, err := RunLoad(ctx, opts)
+	report.Print(os.Stdout)
+	if err != nil {
+		log.Printf("load: %v", err)
+		return 1
+	}
+	return 0
+}
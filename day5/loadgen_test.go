@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLoadMix(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]int
+		wantErr string
+	}{
+		{"create=1,get=6", map[string]int{"create": 1, "get": 6}, ""},
+		{" list=2 , delete=0", map[string]int{"list": 2, "delete": 0}, ""},
+		{"update=1", nil, "unknown op"},
+		{"get", nil, "want op=weight"},
+		{"get=-1", nil, "want op=weight"},
+		{"get=0", nil, "no weight"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLoadMix(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseLoadMix(%q) error = %v; want %q", tt.in, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(got) != len(tt.want) {
+				t.Fatalf("ParseLoadMix(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+			}
+			for op, w := range tt.want {
+				if got[op] != w {
+					t.Errorf("weight of %s = %d; want %d", op, got[op], w)
+				}
+			}
+		})
+	}
+}
+
+func TestHistogram_Percentiles(t *testing.T) {
+	h := &Histogram{}
+	for i := 1; i <= 10000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond) // 1µs .. 10ms, uniform
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Microsecond},
+		{50, 5 * time.Millisecond},
+		{90, 9 * time.Millisecond},
+		{99, 9900 * time.Microsecond},
+		{100, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := h.Percentile(tt.q)
+		if diff := got - tt.want; diff < 0 || float64(diff) > float64(tt.want)/100 {
+			t.Errorf("p%v = %v; want %v (at most 1%% above)", tt.q, got, tt.want)
+		}
+	}
+	if h.Min() != time.Microsecond || h.Max() != 10*time.Millisecond || h.Count() != 10000 {
+		t.Errorf("min/max/count = %v/%v/%d", h.Min(), h.Max(), h.Count())
+	}
+
+	// every bucket boundary maps back into its own bucket
+	for v := int64(0); v < 1<<20; v += 97 {
+		if i := histIndex(v); histHighest(i) < v || (i > 0 && histHighest(i-1) >= v) {
+			t.Fatalf("value %d in bucket %d covering up to %d", v, i, histHighest(i))
+		}
+	}
+}
+
+func TestRunLoad_AgainstServer(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	defer s.stopCurrentLimiter(context.Background())
+	cfg := DefaultConfig() // measure the server, not the default 20 req/s limit
+	cfg.RateLimit, cfg.RateBurst = 100000, 100000
+	if err := s.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		opts      LoadOptions
+		wantModel string
+	}{
+		{"closed model, request count", LoadOptions{Concurrency: 4, Requests: 200}, "closed"},
+		{"open model, duration", LoadOptions{Rate: 400, Concurrency: 8, Duration: 300 * time.Millisecond}, "open"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tt.opts.Target = srv.URL
+			tt.opts.Seed = 1
+			tt.opts.CSV = &out
+			report, err := RunLoad(context.Background(), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Model != tt.wantModel || report.Requests == 0 || report.Throughput() <= 0 {
+				t.Fatalf("report = %+v", report)
+			}
+			if tt.opts.Requests > 0 && report.Requests != tt.opts.Requests {
+				t.Errorf("sent %d requests; want %d", report.Requests, tt.opts.Requests)
+			}
+			if tt.opts.Rate > 0 {
+				// ~400/s for 0.3s
+				if report.Requests < 60 || report.Requests > 130 {
+					t.Errorf("open model sent %d requests; want about 120", report.Requests)
+				}
+			}
+			if report.Statuses["201"] == 0 || report.Statuses["200"] == 0 || report.Ops["create"].Latency.Count() == 0 {
+				t.Errorf("statuses %v; want creates and reads", report.Statuses)
+			}
+			rows, err := csv.NewReader(&out).ReadAll()
+			if err != nil || len(rows) != report.Requests+1 || rows[0][0] != "start_ms" {
+				t.Errorf("CSV has %d rows (%v); want a header and %d rows", len(rows), err, report.Requests)
+			}
+			var table bytes.Buffer
+			report.Print(&table)
+			if !strings.Contains(table.String(), "p99.9") || !strings.Contains(table.String(), "status:") {
+				t.Errorf("report table:\n%s", table.String())
+			}
+		})
+	}
+}
+
+func TestRunLoad_ErrorBreakdown(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls%2 == 0 {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	report, err := RunLoad(context.Background(), LoadOptions{Target: srv.URL, Mix: map[string]int{"create": 1}, Concurrency: 1, Requests: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Statuses["429"] != 5 || report.Statuses["201"] != 5 || report.Errors != 5 || report.Ops["create"].Errors != 5 {
+		t.Errorf("statuses %v, errors %d; want five 201s and five 429s", report.Statuses, report.Errors)
+	}
+
+	srv.Close()
+	report, _ = RunLoad(context.Background(), LoadOptions{Target: srv.URL, Concurrency: 1, Requests: 3})
+	if report.Statuses["refused"] != 3 {
+		t.Errorf("against a closed server: %v; want 3 refused", report.Statuses)
+	}
+}
@@ -7,14 +7,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"maps"
 	"os"
-	"syscall"
+	"slices"
 
 	"net/http"
-	"os/signal"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,9 +27,44 @@ import (
 // TODO: Define User struct (ID, Name, Age)
 
 type User struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Age  int    `json:"age"`
+	ID   string `json:"id" xml:"id"`
+	Name string `json:"name" xml:"name"`
+	Age  int    `json:"age" xml:"age"`
+}
+
+// ErrUserNotFound is returned for IDs the store doesn't hold.
+var ErrUserNotFound = errors.New("user not found")
+
+// ValidationErrors says what is wrong with each field of a User ("id",
+// "name", "age"). UserStore.Create and Update reject invalid users; the
+// API, backups and the admin UI (see ui.go) check the same rules up front
+// to answer with a field-by-field message.
+type ValidationErrors map[string]string
+
+func (v ValidationErrors) Error() string {
+	var parts []string
+	for _, field := range slices.Sorted(maps.Keys(v)) {
+		parts = append(parts, field+" "+v[field])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Validate returns ValidationErrors if u breaks a rule, nil otherwise.
+func (u User) Validate() error {
+	errs := ValidationErrors{}
+	if u.ID == "" {
+		errs["id"] = "is required"
+	}
+	if u.Name == "" {
+		errs["name"] = "is required"
+	}
+	if u.Age <= 0 {
+		errs["age"] = "must be a positive number"
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
 // TODO: Define UserStore struct with RWMutex and map
@@ -32,22 +72,67 @@ type User struct {
 type UserStore struct {
 	users map[string]User
 	mu    sync.RWMutex
+
+	// Secondary indexes (see index.go), guarded by mu together with users
+	byAge  sortedIndex[int]
+	byName sortedIndex[string]
+	byGram map[string]map[string]struct{} // trigram -> user IDs (see search.go)
+
+	maxUsers int    // 0 = unlimited; set per tenant (see tenant.go)
+	tenant   string // "" for the shared store
+
+	// onEvent receives every change (see webhook.go); called under mu.
+	onEvent func(UserEvent)
+
+	// Event sourcing (see eventsource.go): with a log, every change is
+	// appended to it first and the fields above are its projection.
+	events       *EventLog  // nil = plain in-memory store
+	applied      uint64     // Seq of the last event in the projection
+	snapshotPath string     // where Snapshot writes ("" = no snapshots)
+	snapshotMu   sync.Mutex // one Snapshot at a time
+
+	// raft (see raft.go) replicates Create/Update/Delete through a cluster
+	// before they are applied; nil = writes apply locally.
+	raft *RaftNode
+
+	// shards (see shard.go) holds the users instead of the fields above,
+	// spread over several UserStores; nil = not sharded.
+	shards *ShardedStore
 }
 
 func NewUserStore() *UserStore {
 	return &UserStore{
-		users: make(map[string]User),
+		users:  make(map[string]User),
+		byGram: make(map[string]map[string]struct{}),
 	}
 }
 
 // TODO: Implement Create, Get, List, Delete methods (context-aware)
-func (us *UserStore) Create(ctx context.Context, user User) error {
+func (us *UserStore) Create(ctx context.Context, user User) (err error) {
+	_, span := StartSpan(ctx, "UserStore.Create")
+	defer func() { span.SetError(err); span.End() }()
+	span.SetAttr("user.id", user.ID)
+
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
+	if err := user.Validate(); err != nil {
+		return err
+	}
+	if us.raft != nil {
+		// clustered: the change is applied once a majority has it (see raft.go)
+		return us.propose(ctx, raftCommand{Op: "create", User: user})
+	}
+	if us.shards != nil {
+		return us.shards.Create(ctx, user)
+	}
+	return us.create(user)
+}
 
+// create adds user to the store (the state-changing half of Create).
+func (us *UserStore) create(user User) error {
 	// ANSWER: If you forget to unlock:
 	// 1. DEADLOCK: The mutex stays locked forever
 	// 2. Other goroutines trying Lock() or RLock() will block indefinitely
@@ -62,37 +147,66 @@ func (us *UserStore) Create(ctx context.Context, user User) error {
 	if _, exists := us.users[user.ID]; exists {
 		return fmt.Errorf("User ID already Exists!")
 	}
-	us.users[user.ID] = user
+	if us.maxUsers > 0 && len(us.users) >= us.maxUsers {
+		return fmt.Errorf("%w (max %d users)", ErrQuotaExceeded, us.maxUsers)
+	}
+	// commit applies the change (and appends it to the event log when the
+	// store is event-sourced, see eventsource.go)
+	if err := us.commit(EventUserCreated, user); err != nil {
+		return err
+	}
 	fmt.Println("User Created:", user.ID)
 	return nil
 }
 
-func (us *UserStore) Get(ctx context.Context, id string) (User, error) {
+func (us *UserStore) Get(ctx context.Context, id string) (_ User, err error) {
+	_, span := StartSpan(ctx, "UserStore.Get")
+	defer func() { span.SetError(err); span.End() }()
+	span.SetAttr("user.id", id)
 
 	select {
 	case <-ctx.Done():
 		return User{}, ctx.Err()
 	default:
 	}
+	if us.shards != nil {
+		return us.shards.Get(ctx, id)
+	}
 
 	us.mu.RLock()
 	defer us.mu.RUnlock()
 	user, exists := us.users[id]
 	if !exists {
-		return User{}, fmt.Errorf("user not found")
+		return User{}, ErrUserNotFound
 	}
 	return user, nil
 }
 
-func (us *UserStore) List(ctx context.Context) ([]User, error) {
+// List returns all users, or only those matching every filter.
+// Filters are answered from the secondary indexes instead of a full scan.
+func (us *UserStore) List(ctx context.Context, filters ...Predicate) (_ []User, err error) {
+	_, span := StartSpan(ctx, "UserStore.List")
+	defer func() { span.SetError(err); span.End() }()
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
 	}
 
+	for _, p := range filters {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if us.shards != nil {
+		return us.shards.List(ctx, filters...) // scatter-gather
+	}
+
 	us.mu.RLock()
 	defer us.mu.RUnlock()
+	if len(filters) > 0 {
+		return us.query(filters), nil
+	}
 	users := []User{}
 	for _, user := range us.users {
 		users = append(users, user)
@@ -100,26 +214,74 @@ func (us *UserStore) List(ctx context.Context) ([]User, error) {
 	return users, nil
 }
 
-func (us *UserStore) Delete(ctx context.Context, id string) error {
+func (us *UserStore) Delete(ctx context.Context, id string) (err error) {
+	_, span := StartSpan(ctx, "UserStore.Delete")
+	defer func() { span.SetError(err); span.End() }()
+	span.SetAttr("user.id", id)
 
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
 	}
+	if us.raft != nil {
+		return us.propose(ctx, raftCommand{Op: "delete", User: User{ID: id}})
+	}
+	if us.shards != nil {
+		return us.shards.Delete(ctx, id)
+	}
+	return us.delete(id)
+}
 
+func (us *UserStore) delete(id string) error {
 	us.mu.Lock()
 	defer us.mu.Unlock()
 
-	if _, exists := us.users[id]; !exists {
-		return fmt.Errorf("User with id %s not found", id)
+	user, exists := us.users[id]
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, id)
 	}
 
-	delete(us.users, id)
+	if err := us.commit(EventUserDeleted, user); err != nil {
+		return err
+	}
 	fmt.Printf("User Deleted with id %s\n", id)
 	return nil
 }
 
+// Update replaces an existing user (matched by user.ID).
+func (us *UserStore) Update(ctx context.Context, user User) (err error) {
+	_, span := StartSpan(ctx, "UserStore.Update")
+	defer func() { span.SetError(err); span.End() }()
+	span.SetAttr("user.id", user.ID)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if err := user.Validate(); err != nil {
+		return err
+	}
+	if us.raft != nil {
+		return us.propose(ctx, raftCommand{Op: "update", User: user})
+	}
+	if us.shards != nil {
+		return us.shards.Update(ctx, user)
+	}
+	return us.update(user)
+}
+
+func (us *UserStore) update(user User) error {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+
+	if _, exists := us.users[user.ID]; !exists {
+		return fmt.Errorf("%w: %s", ErrUserNotFound, user.ID)
+	}
+	return us.commit(EventUserUpdated, user)
+}
+
 // 2. HTTP Handlers
 
 type Server struct {
@@ -133,17 +295,107 @@ type Server struct {
 	//   - All handlers share the SAME store instance (not copies)
 	//   - Memory efficient: passing pointer (8 bytes) vs entire struct
 	store *UserStore
+
+	// lifecycle receives stop hooks for background goroutines started by
+	// routes() (e.g. the rate limiter's refill ticker). nil in most tests.
+	lifecycle *Lifecycle
+
+	// config is the initial configuration (nil = DefaultConfig()).
+	// After routes() the live settings are in current (see config.go).
+	config *Config
+	mux    *http.ServeMux
+
+	// reserved holds the concurrency slots kept back for health probes
+	// (see concurrency.go); created in routes().
+	reserved *Semaphore
+
+	// tracer (optional) records spans for every middleware, handler and
+	// store call; nil disables tracing.
+	tracer *Tracer
+
+	// tenants holds one isolated UserStore per tenant (see tenant.go);
+	// only used when multi_tenant is on. Created in routes().
+	tenants *TenantRegistry
+
+	// cacheGens tells the response cache which misses ran across a write
+	// (see cache.go).
+	cacheGens cacheGenerations
+
+	// webhooks delivers user events to subscribers (see webhook.go).
+	// Created in routes() unless a test set its own.
+	webhooks *WebhookDispatcher
+
+	// recorder writes request/response pairs for later replay
+	// (see traffic.go); nil = not recording.
+	recorder *TrafficRecorder
+
+	// listeners holds sockets inherited via systemd socket activation
+	// (see listen.go); nil = always bind addr/admin_addr.
+	listeners *Listeners
+
+	// follower replicates the store from a leader and keeps this server
+	// read-only (see replication.go); nil on a leader.
+	follower *Follower
+	// followers counts the replication streams this server is serving.
+	followers atomic.Int64
+
+	// keys encrypts the persisted store files (see crypt.go); nil = plaintext
+	keys *Keyring
+
+	// faults injects latency, errors, cancellations and panics into
+	// requests and store calls (see chaos.go); nil = off.
+	faults *FaultInjector
+
+	// gateway, when set, replaces the API: every request is proxied to a
+	// backend day5 server (see gateway.go).
+	gateway *Gateway
+
+	cfgMu   sync.Mutex            // serializes ApplyConfig
+	current atomic.Pointer[chain] // middleware chain serving requests
 }
 
 func (s *Server) routes() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/users", s.handleUsers)
-	mux.HandleFunc("/users/", s.handleUserByID)
-	mux.HandleFunc("/healthz", s.handleHealthz)
-
-	var h http.Handler = mux
+	// Patterns carry the method and path ("GET /v1/users/{id}", see
+	// routes.go), so the mux answers 404 for /users/1/extra and 405 + Allow
+	// for a known path with the wrong method.
+	if s.gateway != nil {
+		// GATEWAY MODE: the middleware chain below runs at the edge
+		mux.Handle("/", s.gateway)
+		mux.HandleFunc("GET /healthz", s.gateway.handleGatewayHealthz)
+	} else {
+		v1 := s.apiV1()
+		registerAPI(mux, "/v1", v1)
+		registerAPI(mux, "", v1) // unversioned aliases for existing clients
+		mux.HandleFunc("GET /healthz", s.handleHealthz)
+	}
+	s.mux = mux
+	s.reserved = NewSemaphore(4)
+	if s.webhooks == nil {
+		s.webhooks = NewWebhookDispatcher(nil, 5, time.Second)
+	}
+	if s.tenants == nil {
+		s.tenants = NewTenantRegistry()
+	}
+	s.store.OnEvent(s.webhooks.Publish)
+	s.tenants.onEvent = s.webhooks.Publish
+	if s.follower != nil {
+		s.follower.onApply = func(ev StoredEvent) { s.invalidateUser(s.store.tenant, ev.UserID) }
+	}
+	if s.store.raft != nil {
+		// every node applies commits, not just the one whose handler made them
+		s.store.raft.OnApply(func(data []byte) {
+			var cmd raftCommand
+			if data == nil || json.Unmarshal(data, &cmd) != nil {
+				s.invalidateAll()
+				return
+			}
+			s.invalidateUser(s.store.tenant, cmd.User.ID)
+		})
+	}
 
-	h = Logging(h)
+	// The middleware chain is built by ApplyConfig (config.go):
+	//   CORS -> RateLimiter -> [Tenancy] -> ConcurrencyLimit -> RequestTimeout -> Logging -> [ResponseCache] -> mux
 	// SYNTAX EXPLANATION: RequestTimeout(1 * time.Second)(h)
 	// Step 1: RequestTimeout(1 * time.Second) -> returns a Middleware function
 	// Step 2: That Middleware function is called with (h) -> returns wrapped Handler
@@ -151,86 +403,174 @@ func (s *Server) routes() http.Handler {
 	// Equivalent to:
 	//   middleware := RequestTimeout(1 * time.Second)
 	//   h = middleware(h)
-	h = RequestTimeout(1 * time.Second)(h)
-	h = RateLimiter(20, 10)(h)
-	return h
+	cfg := DefaultConfig()
+	if s.config != nil {
+		cfg = *s.config
+	}
+	if err := s.ApplyConfig(cfg); err != nil {
+		log.Printf("invalid config, using defaults: %v", err)
+		s.ApplyConfig(DefaultConfig())
+	}
+
+	if s.lifecycle != nil {
+		s.lifecycle.Register(Hook{
+			Name:     "rate-limiter",
+			Priority: 10,
+			OnStop:   s.stopCurrentLimiter,
+		})
+		s.lifecycle.Register(Hook{
+			Name:     "tenant-limiters",
+			Priority: 10,
+			OnStop:   s.tenants.Close,
+		})
+		// after the HTTP server (100) so the last requests' events are
+		// still queued; undelivered ones end up as dead letters
+		s.lifecycle.Register(Hook{
+			Name:     "webhooks",
+			Priority: 15,
+			Timeout:  5 * time.Second,
+			OnStop:   s.webhooks.Close,
+		})
+	}
+
+	// WHY A FUNCTION INSTEAD OF THE CHAIN ITSELF?
+	// A config reload swaps s.current; looking it up per request means new
+	// requests pick up the new chain without restarting the server.
+	return http.HandlerFunc(s.serveCurrent)
 }
 
 // TODO: Implement handler for POST /users (create user)
-// TODO: Implement handler for GET /users (list users)
-func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodPost:
-		var u User
-		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	// the body may be JSON, XML, CSV or MessagePack (see negotiate.go)
+	var u User
+	if err := decodeBody(r, &u); err != nil {
+		if status := bodyErrorStatus(err); status != http.StatusBadRequest {
+			writeProblem(w, status, err.Error())
 			return
 		}
-		if u.ID == "" || u.Name == "" || u.Age <= 0 {
-			http.Error(w, "id, name, age required", http.StatusBadRequest)
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := u.Validate(); err != nil {
+		http.Error(w, "invalid user: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	// WHY THIS BLOCK?
+	// 1. s.store.Create() can return errors (duplicate ID, context timeout)
+	// 2. We need to handle those errors and send appropriate HTTP response
+	// 3. If create fails, client should know (409 Conflict for duplicate)
+	// 4. Without this check, errors would be silently ignored
+	if err := s.storeFor(r).Create(r.Context(), u); err != nil {
+		if raftWriteError(w, err) {
 			return
 		}
-		// WHY THIS BLOCK?
-		// 1. s.store.Create() can return errors (duplicate ID, context timeout)
-		// 2. We need to handle those errors and send appropriate HTTP response
-		// 3. If create fails, client should know (409 Conflict for duplicate)
-		// 4. Without this check, errors would be silently ignored
-		if err := s.store.Create(r.Context(), u); err != nil {
-			http.Error(w, err.Error(), http.StatusConflict)
+		if errors.Is(err, ErrQuotaExceeded) {
+			writeProblem(w, http.StatusForbidden, err.Error())
 			return
 		}
-		// time.Sleep(100 * time.Second)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		// WHAT IT RETURNS?
-		// json.NewEncoder(w).Encode(u) returns an error (or nil)
-		// We use _ to explicitly ignore it (acceptable for simple demos)
-		// In production, you'd log/handle: if err := json.NewEncoder(w).Encode(u); err != nil {...}
-		_ = json.NewEncoder(w).Encode(u)
-	case http.MethodGet:
-		users, err := s.store.List(r.Context())
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusRequestTimeout)
-		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(users)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	s.invalidateUsers(r, u.ID) // cached lists/searches are stale now (see cache.go)
+	// time.Sleep(100 * time.Second)
+	// respond picks JSON, XML or MessagePack from the Accept header
+	// (see negotiate.go) and sends 406 if none of them is acceptable.
+	respond(w, r, http.StatusCreated, u)
+}
 
-	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+// TODO: Implement handler for GET /users (list users)
+// GET /users also accepts ?name=, ?name_prefix=, ?age=, ?min_age= and ?max_age=
+// filters, answered from the store's secondary indexes.
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	filters, err := parseListFilters(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	users, err := s.storeFor(r).List(r.Context(), filters...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestTimeout)
+		return
 	}
+	respond(w, r, http.StatusOK, users)
 }
 
 // TODO: Implement handler for GET /users/{id} (get user)
-// TODO: Implement handler for DELETE /users/{id} (delete user)
-func (s *Server) handleUserByID(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Path[len("/users/"):]
-	// print r in console with all its formatting
-	// fmt.Printf("%+v\n", r.Context())
-	if id == "" {
-		http.NotFound(w, r)
+// {id} matches exactly one path segment, so /users/1/extra never gets here.
+// ?as_of=<time> asks for an earlier state (see eventsource.go).
+func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		s.handleUserAsOf(w, r, asOf)
 		return
 	}
-	switch r.Method {
-	case http.MethodGet:
-		users, err := s.store.Get(r.Context(), id)
-		if err != nil {
-			if err == context.DeadlineExceeded {
-				http.Error(w, err.Error(), http.StatusRequestTimeout)
-			} else {
-				http.Error(w, err.Error(), http.StatusNotFound)
-			}
+	user, err := s.storeFor(r).Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			http.Error(w, err.Error(), http.StatusRequestTimeout)
+		} else {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+		return
+	}
+	respond(w, r, http.StatusOK, user)
+}
+
+// handleUpdateUser serves PUT /users/{id}; the body's id may be left out
+// but must match the path if given.
+func (s *Server) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+	var u User
+	if err := decodeBody(r, &u); err != nil {
+		if status := bodyErrorStatus(err); status != http.StatusBadRequest {
+			writeProblem(w, status, err.Error())
 			return
 		}
-		_ = json.NewEncoder(w).Encode(users)
-	case http.MethodDelete:
-		if err := s.store.Delete(r.Context(), id); err != nil {
-			http.Error(w, err.Error(), http.StatusRequestTimeout)
+		http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	if u.ID != "" && u.ID != id {
+		http.Error(w, "id in body does not match the path", http.StatusBadRequest)
+		return
+	}
+	u.ID = id
+	if err := u.Validate(); err != nil {
+		http.Error(w, "invalid user: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.storeFor(r).Update(r.Context(), u); err != nil {
+		if raftWriteError(w, err) {
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
-	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrUserNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, context.DeadlineExceeded):
+			status = http.StatusRequestTimeout
+		}
+		http.Error(w, err.Error(), status)
+		return
 	}
+	s.invalidateUsers(r, id)
+	respond(w, r, http.StatusOK, u)
+}
+
+// TODO: Implement handler for DELETE /users/{id} (delete user)
+func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.storeFor(r).Delete(r.Context(), id); err != nil {
+		if raftWriteError(w, err) {
+			return
+		}
+		status := http.StatusRequestTimeout
+		if errors.Is(err, ErrUserNotFound) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.invalidateUsers(r, id)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // TODO: Implement handler for GET /healthz (simulate dependency check with context)
@@ -265,6 +605,12 @@ func (w *statusWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer
+// (e.g. to Flush on streaming routes).
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 // TODO: Implement Logging middleware
 func Logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -279,19 +625,16 @@ func Logging(next http.Handler) http.Handler {
 		// time.Since(start) internally does time.Now().Sub(start)
 		dur := time.Since(start)
 		// 5. Log everything (method, path, status captured by wrapper, duration)
-		log.Printf("%s %s -> %d (%s)", r.Method, r.URL.Path, ww.status, dur)
+		// (info level - silenced when log_level is warn or error)
+		logf(LevelInfo, "%s %s -> %d (%s)", r.Method, r.URL.Path, ww.status, dur)
 	})
 }
 
 // TODO: Implement RequestTimeout middleware
+// Besides attaching a deadline to the context, the response is buffered and
+// replaced by a 504 if the handler doesn't finish in time (see timeout.go).
 func RequestTimeout(timeout time.Duration) Middleware {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx, cancel := context.WithTimeout(r.Context(), timeout)
-			defer cancel()
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
-	}
+	return RequestTimeoutPolicy(func(*http.Request) time.Duration { return timeout })
 }
 
 // TODO: Implement RateLimiter middleware
@@ -306,10 +649,17 @@ func RequestTimeout(timeout time.Duration) Middleware {
 // LINE-BY-LINE EXPLANATION:
 
 func RateLimiter(rate int, burst int) Middleware {
+	mw, _ := RateLimiterWithStop(rate, burst)
+	return mw
+}
+
+// RateLimiterWithStop is RateLimiter plus a stop function that ends the
+// refill goroutine (register it with the Lifecycle so it doesn't leak).
+func RateLimiterWithStop(rate int, burst int) (Middleware, func()) {
 	// FUNCTION SIGNATURE:
 	// - Takes: rate (tokens/second), burst (max simultaneous requests)
-	// - Returns: Middleware (a function that wraps handlers)
-	// - Example: RateLimiter(20, 10) means 20 req/sec with burst of 10
+	// - Returns: Middleware (a function that wraps handlers) and a stop func
+	// - Example: RateLimiterWithStop(20, 10) means 20 req/sec with burst of 10
 
 	// VALIDATION: Ensure positive values
 	if rate <= 0 {
@@ -340,8 +690,15 @@ func RateLimiter(rate int, burst int) Middleware {
 		tokens <- struct{}{} // Send 'burst' tokens into channel
 	}
 
+	// STOP SIGNAL:
+	// Closing 'stop' ends the refill goroutine. sync.Once makes the stop
+	// function safe to call more than once.
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopFunc := func() { stopOnce.Do(func() { close(stop) }) }
+
 	// START REFILL GOROUTINE:
-	// This goroutine runs in background for the lifetime of the server
+	// This goroutine runs in background until stopFunc is called
 	go func() {
 		// CREATE TICKER:
 		// t := time.NewTicker(time.Second / time.Duration(rate))
@@ -352,11 +709,16 @@ func RateLimiter(rate int, burst int) Middleware {
 		defer t.Stop() // Clean up ticker when function exits
 
 		// REFILL LOOP:
-		// for range t.C {...}
 		// - Executes every time ticker fires
 		// - t.C is a channel that receives time.Time values on each tick
 		// - We ignore the time value (don't need it)
-		for range t.C {
+		// - Returns as soon as 'stop' is closed
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
 			// TRY TO ADD TOKEN:
 			select {
 			case tokens <- struct{}{}:
@@ -383,7 +745,12 @@ func RateLimiter(rate int, burst int) Middleware {
 				http.Error(w, r.Context().Err().Error(), http.StatusGatewayTimeout)
 				return
 
-			// CASE 2: Token available (proceed with request)
+			// CASE 2: Limiter stopped (shutdown or replaced by a config
+			// reload) - don't strand the request, just let it through
+			case <-stop:
+				next.ServeHTTP(w, r)
+
+			// CASE 3: Token available (proceed with request)
 			case <-tokens:
 				// TOKEN CONSUMED: Remove one token from bucket
 				// - If bucket has tokens: proceeds immediately
@@ -392,7 +759,7 @@ func RateLimiter(rate int, burst int) Middleware {
 				next.ServeHTTP(w, r) // Forward to next handler
 			}
 		})
-	}
+	}, stopFunc
 }
 
 // FLOW EXAMPLE (rate=20, burst=10):
@@ -410,6 +777,7 @@ func RateLimiter(rate int, burst int) Middleware {
 
 // 4. Graceful Shutdown
 // TODO: Set up signal handling and call Server.Shutdown with context
+// Signal handling and ordered shutdown now live in lifecycle.go (Lifecycle.Run).
 
 // 5. Client & Tests (Extra Challenge)
 // TODO: Write a client function that calls your server with context timeout
@@ -467,51 +835,375 @@ func main() {
 
 	// TODO: Set up HTTP server and routes
 
+	// LIFECYCLE:
+	// Every component registers start/stop hooks; Run starts them in
+	// priority order, waits for SIGINT/SIGTERM and stops them in reverse
+	// within a 10s global deadline (a second signal forces exit).
+	lc := NewLifecycle(10 * time.Second)
+
+	// CONFIG:
+	// -config points at a JSON file (see config.go). Without it the
+	// built-in defaults are used and there is nothing to reload.
+	configPath := flag.String("config", "", "path to JSON config file (reloaded on SIGHUP)")
+	traceFile := flag.String("trace-file", "", "append finished trace spans as JSON lines to this file")
+	recordFile := flag.String("record", "", "append sanitized request/response pairs as JSON lines to this file")
+	replayFile := flag.String("replay", "", "replay a -record file against -target, report differences and exit")
+	replayTarget := flag.String("target", "http://localhost:8080", "server to replay against")
+	replaySpeed := flag.Float64("speed", 0, "replay pace: 0 = as fast as possible, 1 = as recorded, 2 = twice as fast")
+	replayIgnore := flag.String("ignore", "", "comma-separated JSON fields to ignore when comparing replayed bodies")
+	loadTarget := flag.String("load", "", "send load to the server at this URL, print a report and exit (see loadgen.go)")
+	loadRate := flag.Float64("load-rate", 0, "load: requests per second (open model); 0 = closed model")
+	loadConcurrency := flag.Int("load-concurrency", 16, "load: workers (closed model) or max requests in flight (open model)")
+	loadDuration := flag.Duration("load-duration", 0, "load: how long to run (default 10s unless -load-requests is set)")
+	loadRequests := flag.Int("load-requests", 0, "load: stop after this many requests (0 = run for -load-duration)")
+	loadMix := flag.String("load-mix", "create=1,get=6,list=1,delete=1", "load: weights of the operations")
+	loadCSV := flag.String("load-csv", "", "load: write every request's result to this CSV file")
+	verifyBackup := flag.String("verify-backup", "", "check a backup file from POST /admin/backup offline and exit")
+	follow := flag.String("follow", "", "run as a read-only follower of the leader whose admin listener is at this URL")
+	followAPI := flag.String("follow-api", "", "leader's public URL; a follower forwards writes there instead of rejecting them")
+	raftID := flag.String("raft-id", "", "run as this node of a raft cluster (see raft.go)")
+	raftPeers := flag.String("raft-peers", "", "raft cluster: comma-separated id=admin-url of every node, e.g. n1=http://10.0.0.1:6060,n2=...")
+	raftState := flag.String("raft-state", "", "raft cluster: file for term, vote, log and snapshot (default raft-<id>.json)")
+	shards := flag.Int("shards", 0, "spread users over this many partitions by consistent hashing (see shard.go)")
+	keyFile := flag.String("keyfile", "", "encrypt the event log, snapshot and raft state with the keys in this JSON file (see crypt.go)")
+	gatewayBackends := flag.String("gateway", "", "run as a gateway: proxy to these comma-separated day5 server URLs (see gateway.go)")
+	gatewayBalance := flag.String("gateway-balance", "round-robin", "gateway: round-robin, least-conn or hash (by user ID)")
+	gatewayRetries := flag.Int("gateway-retries", 1, "gateway: other backends an idempotent request may be retried on")
+	faultsFile := flag.String("faults", "", "inject latency, errors, cancellations and panics per the rules in this JSON file; change them at /admin/faults (see chaos.go)")
+	webhookAllowFlag := flag.String("webhook-allow", "", "comma-separated CIDRs webhooks may deliver to although they are loopback, private or link-local, e.g. 10.1.0.0/16")
+	eventLog := flag.String("event-log", "", "event-source users: append every change to this NDJSON file (snapshot in <file>.snapshot)")
+	flag.Parse()
+
+	// REPLAY MODE (see traffic.go): no server, just a regression run.
+	if *replayFile != "" {
+		os.Exit(runReplay(*replayFile, ReplayOptions{
+			Target: *replayTarget,
+			Speed:  *replaySpeed,
+			Ignore: strings.Split(*replayIgnore, ","),
+		}))
+	}
+	// LOAD MODE (see loadgen.go): no server, just a benchmark client.
+	if *loadTarget != "" {
+		mix, err := ParseLoadMix(*loadMix)
+		if err != nil {
+			log.Fatalf("load: %v", err)
+		}
+		duration := *loadDuration
+		if duration == 0 && *loadRequests == 0 {
+			duration = 10 * time.Second
+		}
+		os.Exit(runLoad(LoadOptions{
+			Target:      *loadTarget,
+			Mix:         mix,
+			Rate:        *loadRate,
+			Concurrency: *loadConcurrency,
+			Duration:    duration,
+			Requests:    *loadRequests,
+		}, *loadCSV))
+	}
+	// VERIFY MODE (see backup.go): checks a backup file without a server.
+	if *verifyBackup != "" {
+		os.Exit(runVerifyBackup(*verifyBackup))
+	}
+	cfg := DefaultConfig()
+	if *configPath != "" {
+		loaded, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		cfg = loaded
+	}
+	// SOCKET ACTIVATION (see listen.go): sockets systemd opened for us
+	// are used instead of binding addr/admin_addr.
+	inherited, err := InheritedListeners()
+	if err != nil {
+		log.Fatalf("socket activation: %v", err)
+	}
+	// ENCRYPTION AT REST (optional, see crypt.go): the event log, its
+	// snapshot and the raft state are encrypted under the keyfile's active
+	// key. A running key rotation stops before those files are closed.
+	var keys *Keyring
+	if *keyFile != "" {
+		if keys, err = LoadKeyring(*keyFile); err != nil {
+			log.Fatalf("keys: %v", err)
+		}
+		lc.Register(Hook{
+			Name:     "keyring",
+			Priority: 3,
+			OnStop:   func(context.Context) error { return keys.Close() },
+		})
+	}
+	// EVENT SOURCING (optional, see eventsource.go): the store becomes a
+	// projection of the log. On shutdown a snapshot is written for a fast
+	// next start, then the log is closed - after the HTTP server stopped,
+	// so no change is lost.
+	if *eventLog != "" {
+		open := OpenEventLog
+		if keys != nil {
+			open = func(path string) (*EventLog, error) { return OpenEncryptedEventLog(path, keys) }
+		}
+		events, err := open(*eventLog)
+		if err != nil {
+			log.Fatalf("event log: %v", err)
+		}
+		if us, err = NewEventSourcedStore(events, *eventLog+".snapshot"); err != nil {
+			log.Fatalf("event log: %v", err)
+		}
+		lc.Register(Hook{
+			Name:     "event-log",
+			Priority: 1,
+			OnStop: func(ctx context.Context) error {
+				_, snapErr := us.Snapshot()
+				return errors.Join(snapErr, events.Close())
+			},
+		})
+	}
+	// RAFT (optional, see raft.go): writes commit on a majority of the
+	// nodes before they are applied. Peers talk through the admin listener.
+	if *raftID != "" {
+		if *eventLog != "" || *follow != "" {
+			log.Fatal("raft: -raft-id can't be combined with -event-log or -follow")
+		}
+		if cfg.AdminAddr == "" {
+			log.Fatal("raft: peers connect to the admin listener; set admin_addr")
+		}
+		peers := make(map[string]string)
+		ids := []string{}
+		for _, p := range strings.Split(*raftPeers, ",") {
+			id, u, ok := strings.Cut(p, "=")
+			if !ok {
+				log.Fatalf("raft: invalid peer %q (want id=url)", p)
+			}
+			ids = append(ids, id)
+			if id != *raftID {
+				peers[id] = u
+			}
+		}
+		statePath := *raftState
+		if statePath == "" {
+			statePath = "raft-" + *raftID + ".json"
+		}
+		transport := NewHTTPTransport(peers, cfg.AdminToken)
+		if us, err = NewRaftStore(RaftConfig{ID: *raftID, Peers: ids, Transport: transport, StatePath: statePath, Keys: keys}); err != nil {
+			log.Fatalf("raft: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		lc.Register(Hook{
+			Name:     "raft",
+			Priority: 2,
+			OnStart: func(context.Context) error {
+				go us.raft.Run(ctx, 50*time.Millisecond)
+				return nil
+			},
+			OnStop: func(context.Context) error {
+				cancel()
+				return transport.Close()
+			},
+		})
+	}
+	// SHARDING (optional, see shard.go): users are spread over -shards
+	// in-memory partitions; GET/POST/DELETE /admin/shards rebalance online.
+	if *shards > 0 {
+		if *eventLog != "" || *follow != "" || *raftID != "" {
+			log.Fatal("shards: -shards can't be combined with -event-log, -follow or -raft-id")
+		}
+		us = NewShardedUserStore(*shards)
+	}
+
+	// REPLICATION (optional, see replication.go): a follower needs its own
+	// log to resume from, an in-memory one if -event-log wasn't given. It
+	// stops streaming before the event log hook closes the log.
+	var follower *Follower
+	if *follow != "" {
+		if us.events == nil {
+			if us, err = NewEventSourcedStore(NewEventLog(), ""); err != nil {
+				log.Fatalf("follow: %v", err)
+			}
+		}
+		if follower, err = NewFollower(us, *follow, *followAPI, cfg.AdminToken); err != nil {
+			log.Fatalf("follow: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		lc.Register(Hook{
+			Name:     "replication",
+			Priority: 2,
+			OnStart: func(context.Context) error {
+				go func() { defer close(done); follower.Run(ctx) }()
+				return nil
+			},
+			OnStop: func(stopCtx context.Context) error {
+				cancel()
+				select {
+				case <-done:
+					return nil
+				case <-stopCtx.Done():
+					return stopCtx.Err()
+				}
+			},
+		})
+	}
+	// GATEWAY (optional, see gateway.go): no users here, requests go to
+	// the backends. Probing stops after the HTTP server has drained.
+	var gateway *Gateway
+	if *gatewayBackends != "" {
+		if *eventLog != "" || *follow != "" || *raftID != "" || *shards > 0 {
+			log.Fatal("gateway: -gateway can't be combined with -event-log, -follow, -raft-id or -shards")
+		}
+		gateway, err = NewGateway(GatewayOptions{
+			Backends: strings.Split(*gatewayBackends, ","),
+			Balance:  *gatewayBalance,
+			Retries:  *gatewayRetries,
+		})
+		if err != nil {
+			log.Fatalf("gateway: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		lc.Register(Hook{
+			Name:     "gateway",
+			Priority: 2,
+			OnStart: func(context.Context) error {
+				go func() { defer close(done); gateway.Run(ctx) }()
+				return nil
+			},
+			OnStop: func(stopCtx context.Context) error {
+				cancel()
+				select {
+				case <-done:
+					return nil
+				case <-stopCtx.Done():
+					return stopCtx.Err()
+				}
+			},
+		})
+	}
+	// FAULT INJECTION (optional, see chaos.go): for chaos tests. The seed
+	// is logged so a run that found a bug can be repeated.
+	var faults *FaultInjector
+	if *faultsFile != "" {
+		fcfg, err := LoadFaultConfig(*faultsFile)
+		if err != nil {
+			log.Fatalf("faults: %v", err)
+		}
+		if faults, err = NewFaultInjector(fcfg); err != nil {
+			log.Fatalf("faults: %v", err)
+		}
+		log.Printf("faults: %d rules, seed %d", len(fcfg.Rules), faults.Status().Seed)
+	}
+	// WEBHOOKS (see webhook.go) only reach public addresses, plus the
+	// networks listed here.
+	var webhookAllow []netip.Prefix
+	for _, cidr := range strings.Split(*webhookAllowFlag, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Fatalf("webhook-allow: %v", err)
+		}
+		webhookAllow = append(webhookAllow, p)
+	}
+	webhooks := NewWebhookDispatcher(nil, 5, cfg.WebhookBackoff.Duration, webhookAllow...)
+	app := &Server{store: us, lifecycle: lc, config: &cfg, listeners: inherited, follower: follower, keys: keys, faults: faults, gateway: gateway, webhooks: webhooks}
+
+	// TRACING (optional, see tracing.go): spans go to an NDJSON file that is
+	// closed last on shutdown (priority 0) so no span is lost.
+	if *traceFile != "" {
+		exporter, err := NewJSONFileExporter(*traceFile)
+		if err != nil {
+			log.Fatalf("trace file: %v", err)
+		}
+		app.tracer = NewTracer(exporter)
+		lc.Register(Hook{
+			Name:     "trace-exporter",
+			Priority: 0,
+			OnStop:   func(ctx context.Context) error { return exporter.Close() },
+		})
+	}
+
+	// TRAFFIC RECORDING (optional, see traffic.go): closed last like the
+	// trace file so the final requests are on disk.
+	if *recordFile != "" {
+		recorder, err := NewTrafficRecorder(*recordFile)
+		if err != nil {
+			log.Fatalf("record file: %v", err)
+		}
+		app.recorder = recorder
+		lc.Register(Hook{
+			Name:     "traffic-recorder",
+			Priority: 0,
+			OnStop:   func(ctx context.Context) error { return recorder.Close() },
+		})
+	}
+
 	// EXPLAIN THIS LINE BY EACH WORD:
 	// srv :=
 	//   Create and assign to variable 'srv'
 	// &http.Server{...}
 	//   Create a pointer to http.Server struct (& means "address of")
-	// Addr: ":8080"
+	// Addr: cfg.Addr (default ":8080")
 	//   Server listens on all interfaces (0.0.0.0) on port 8080
 	//   Empty string before : means "all network interfaces"
-	// Handler: (&Server{store: us}).routes()
-	//   Step 1: &Server{store: us} -> create Server instance with our UserStore
+	//   "unix:/path.sock" listens on a Unix socket instead (see listen.go)
+	// Handler: app.routes()
+	//   Step 1: app = &Server{...} -> Server instance with our UserStore
 	//   Step 2: .routes() -> call routes() method which returns middleware-wrapped handler
 	//   This handler processes ALL incoming HTTP requests
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: (&Server{store: us}).routes(),
+		Addr:    cfg.Addr,
+		Handler: app.routes(),
 	}
 
-	// TODO: Wrap handlers with middleware
+	if *configPath != "" {
+		lc.Register(NewConfigReloader(*configPath, app, 2*time.Second).Hook())
+	}
+
+	// ADMIN LISTENER (optional, see admin.go):
+	// pprof/expvar/stats on a separate address, never on the public mux.
+	if cfg.AdminAddr != "" {
+		lc.Register(app.AdminHook(cfg.AdminAddr, cfg.AdminToken))
+	}
 
 	// TODO: Start server in goroutine
-	// Start server
-	go func() {
-		log.Printf("Server listening on %s", srv.Addr)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %v", err)
-		}
-	}()
+	// app.listen runs in OnStart so a busy port fails Start right away;
+	// Serve then runs in its own goroutine. A socket systemd passed as
+	// "http" (or unnamed) is used instead of binding srv.Addr.
+	// Priority 100 = started last, stopped first (stop taking traffic
+	// before the rate limiter and other components go away).
+	lc.Register(Hook{
+		Name:     "http-server",
+		Priority: 100,
+		Timeout:  5 * time.Second,
+		OnStart: func(ctx context.Context) error {
+			ln, err := app.listen(srv.Addr, "http", "unknown")
+			if err != nil {
+				return err
+			}
+			// sockets passed by systemd that no server took
+			inherited.Close()
+			log.Printf("Server listening on %s", ln.Addr())
+			go func() {
+				if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+					log.Printf("serve: %v", err)
+				}
+			}()
+			return nil
+		},
+		// srv.Shutdown stops accepting new connections and waits for
+		// in-flight requests until ctx (the hook's 5s timeout) expires.
+		// Closing a unix: listener also removes its socket file.
+		OnStop: srv.Shutdown,
+	})
 
 	// TODO: Wait for signal and gracefully shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
-	<-stop
-	log.Println("shutting down server ...")
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	// WHAT defer cancel() DOES:
-	// 1. context.WithTimeout creates a context that auto-cancels after 5 seconds
-	// 2. It returns (ctx, cancel) where cancel is a function to release resources
-	// 3. defer cancel() ensures cleanup happens when main() exits
-	// 4. Why needed? Prevents resource leaks (timers, goroutines)
-	// 5. Always call cancel() for contexts you create with With* functions
-	// 6. defer ensures it runs even if srv.Shutdown panics
-	defer cancel()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("server shutdown error: %v", err)
+	report, err := lc.Run(context.Background())
+	if err != nil {
+		log.Fatalf("startup failed: %v", err)
+	}
+	if !report.OK() {
+		log.Printf("server stopped with errors: timed out=%v", report.TimedOut)
+		os.Exit(1)
 	}
 	log.Println("server stopped")
 }
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// MessagePack (https://msgpack.org) - a compact binary JSON.
+//
+// HOW:
+// Instead of a full reflection-based encoder, values go through encoding/json
+// first and the generic result (map, slice, string, number, bool, nil) is
+// written as MessagePack. That way the json struct tags are the single
+// source of field names for every format. Decoding runs the same way in
+// reverse.
+//
+// Format cheat sheet (first byte):
+//
+//	0x00-0x7f positive fixint   0x80-0x8f fixmap    0x90-0x9f fixarray
+//	0xa0-0xbf fixstr            0xc0 nil  0xc2/0xc3 false/true
+//	0xcb float64  0xcc-0xcf uint8..64  0xd0-0xd3 int8..64
+//	0xd9-0xdb str8..32  0xdc/0xdd array16/32  0xde/0xdf map16/32
+//	0xe0-0xff negative fixint
+
+// maxMsgpackDepth stops deeply nested input from exhausting the stack.
+const maxMsgpackDepth = 100
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+func msgpackMarshal(v any) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber() // keep integers exact instead of float64
+	var generic any
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := msgpackWrite(&buf, generic); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgpackUnmarshal(data []byte, v any) error {
+	d := &msgpackDecoder{data: data}
+	generic, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d trailing bytes", len(d.data)-d.pos)
+	}
+	j, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// msgpackWrite encodes one generic JSON value.
+func msgpackWrite(b *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if v {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			msgpackWriteInt(b, i)
+		} else if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			b.WriteByte(0xcf)
+			binary.Write(b, binary.BigEndian, u)
+		} else {
+			f, err := v.Float64()
+			if err != nil {
+				return err
+			}
+			b.WriteByte(0xcb)
+			binary.Write(b, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			b.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			b.WriteByte(0xd9)
+			b.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			b.WriteByte(0xda)
+			binary.Write(b, binary.BigEndian, uint16(n))
+		default:
+			b.WriteByte(0xdb)
+			binary.Write(b, binary.BigEndian, uint32(n))
+		}
+		b.WriteString(v)
+	case []any:
+		msgpackWriteLen(b, len(v), 0x90, 0xdc, 0xdd)
+		for _, e := range v {
+			if err := msgpackWrite(b, e); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		msgpackWriteLen(b, len(v), 0x80, 0xde, 0xdf)
+		// sorted keys: the same value always encodes to the same bytes
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msgpackWrite(b, k)
+			if err := msgpackWrite(b, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+	return nil
+}
+
+// msgpackWriteInt uses the smallest encoding that holds i.
+func msgpackWriteInt(b *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		b.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		b.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		b.WriteByte(0xd0)
+		b.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		b.WriteByte(0xd1)
+		binary.Write(b, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		b.WriteByte(0xd2)
+		binary.Write(b, binary.BigEndian, int32(i))
+	default:
+		b.WriteByte(0xd3)
+		binary.Write(b, binary.BigEndian, i)
+	}
+}
+
+// msgpackWriteLen writes an array/map header: fix (n < 16), 16- or 32-bit.
+func msgpackWriteLen(b *bytes.Buffer, n int, fix, code16, code32 byte) {
+	switch {
+	case n < 16:
+		b.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		b.WriteByte(code16)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(code32)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	}
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads an n-byte big-endian unsigned integer (n = 1, 2, 4 or 8).
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+// value decodes one value into the generic JSON shapes.
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+	head, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := head[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xca:
+		u, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), err
+	case 0xcb:
+		u, err := d.uint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		u, err := d.uint(n)
+		// sign-extend from n bytes
+		shift := 64 - 8*n
+		return int64(u<<shift) >> shift, err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6: // str8..32 and bin8..32
+		code := c - 0xd9
+		if c <= 0xc6 {
+			code = c - 0xc4
+		}
+		n, err := d.uint(1 << code)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(n), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) arrayOf(n int, depth int) (any, error) {
+	// every element takes at least one byte: reject impossible lengths
+	// before allocating
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	arr := make([]any, n)
+	for i := range arr {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = v
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int, depth int) (any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key must be a string, got %T", k)
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// msgpackDecode reads the whole body and unmarshals it into v.
+func msgpackDecode(r io.Reader, v any) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return msgpackUnmarshal(data, v)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackMarshal_KnownBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		in   any
+		want []byte
+	}{
+		// the example from msgpack.org
+		{"spec example", map[string]any{"compact": true, "schema": 0},
+			append(append([]byte{0x82, 0xa7}, "compact"...), append([]byte{0xc3, 0xa6}, append([]byte("schema"), 0x00)...)...)},
+		{"nil", nil, []byte{0xc0}},
+		{"negative fixint", -1, []byte{0xff}},
+		{"int8", -100, []byte{0xd0, 0x9c}},
+		{"int16", 300, []byte{0xd1, 0x01, 0x2c}},
+		{"float64", 1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"fixarray", []int{1, 2}, []byte{0x92, 0x01, 0x02}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := msgpackMarshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got % x; want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgpack_RoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	many := make([]int, 20)
+	for i := range many {
+		many[i] = i * 1000
+	}
+	type payload struct {
+		Users   []User            `json:"users"`
+		Big     int64             `json:"big"`
+		Neg     int64             `json:"neg"`
+		Float   float64           `json:"float"`
+		Short   string            `json:"short"`
+		Long    string            `json:"long"`
+		Many    []int             `json:"many"`
+		Labels  map[string]string `json:"labels"`
+		Missing *User             `json:"missing"`
+	}
+	in := payload{
+		Users:  []User{{ID: "1", Name: "Alice", Age: 30}, {ID: "2", Name: "Bob", Age: 25}},
+		Big:    1 << 40,
+		Neg:    -1 << 33,
+		Float:  3.25,
+		Short:  "hi",
+		Long:   long,
+		Many:   many,
+		Labels: map[string]string{"team": "core"},
+	}
+
+	b, err := msgpackMarshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out payload
+	if err := msgpackUnmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", out, in)
+	}
+}
+
+func TestMsgpackUnmarshal_Malformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x91}, maxMsgpackDepth+5)
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"truncated string", []byte{0xa5, 'a', 'b'}},
+		{"huge array length", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{"huge map length", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}},
+		{"non-string key", []byte{0x81, 0x01, 0x02}},
+		{"trailing bytes", []byte{0x01, 0x02}},
+		{"unsupported ext", []byte{0xd4, 0x01, 0x02}},
+		{"too deep", deep},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v any
+			if err := msgpackUnmarshal(tt.in, &v); err == nil {
+				t.Errorf("expected error, got %v", v)
+			}
+		})
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 16. Content Negotiation
+//
+// WHY?
+// Handlers used to call json.NewEncoder(w) no matter what the client asked
+// for. Now respond() picks the format:
+//  1. ?format=json|xml|csv|msgpack wins if present (handy in a browser)
+//  2. otherwise the Accept header, honouring q-values and wildcards:
+//     "Accept: text/csv;q=0.9, application/xml" -> XML
+//  3. no Accept header (or */*) -> JSON, as before
+//
+// If nothing acceptable can be produced the answer is 406 Not Acceptable.
+// CSV only exists for lists (a table needs rows), so "Accept: text/csv" on
+// GET /users/{id} is a 406 too.
+//
+// Request bodies go the other way: decodeBody() picks the decoder from the
+// Content-Type header (missing = JSON) and unknown types get 415.
+
+// ErrUnsupportedMediaType is returned by decodeBody for unknown Content-Types.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// codec is one wire format.
+type codec struct {
+	format      string   // ?format= name
+	contentType string   // sent in responses
+	aliases     []string // other media types that select this codec
+	listsOnly   bool     // can only encode slices
+	encode      func(w io.Writer, v any) error
+	decode      func(r io.Reader, v any) error
+}
+
+// codecs in order of preference when the client likes several equally.
+var codecs = []*codec{
+	{
+		format:      "json",
+		contentType: "application/json",
+		encode:      func(w io.Writer, v any) error { return json.NewEncoder(w).Encode(v) },
+		decode:      func(r io.Reader, v any) error { return json.NewDecoder(r).Decode(v) },
+	},
+	{
+		format:      "xml",
+		contentType: "application/xml",
+		aliases:     []string{"text/xml"},
+		encode:      xmlEncode,
+		decode:      func(r io.Reader, v any) error { return xml.NewDecoder(r).Decode(v) },
+	},
+	{
+		format:      "csv",
+		contentType: "text/csv",
+		listsOnly:   true,
+		encode:      csvEncode,
+		decode:      csvDecode,
+	},
+	{
+		format:      "msgpack",
+		contentType: "application/msgpack",
+		aliases:     []string{"application/x-msgpack", "application/vnd.msgpack"},
+		encode: func(w io.Writer, v any) error {
+			b, err := msgpackMarshal(v)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(b)
+			return err
+		},
+		decode: msgpackDecode,
+	},
+}
+
+// mediaTypes returns every media type the codec answers to.
+func (c *codec) mediaTypes() []string {
+	return append([]string{c.contentType}, c.aliases...)
+}
+
+func isList(v any) bool {
+	k := reflect.TypeOf(v).Kind()
+	return k == reflect.Slice || k == reflect.Array
+}
+
+// acceptRange is one entry of an Accept header, e.g. "text/*;q=0.5".
+type acceptRange struct {
+	typ, sub string
+	q        float64
+}
+
+// parseAccept splits an Accept header into ranges. Malformed entries are
+// skipped rather than failing the whole request.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		typ, sub, ok := strings.Cut(mt, "/")
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{typ: typ, sub: sub, q: q})
+	}
+	return ranges
+}
+
+// quality returns how much the client wants mediaType: the q of the most
+// specific matching range (exact > type/* > */*), or 0.
+func quality(ranges []acceptRange, mediaType string) float64 {
+	typ, sub, _ := strings.Cut(mediaType, "/")
+	best, bestSpecificity := 0.0, -1
+	for _, r := range ranges {
+		specificity := -1
+		switch {
+		case r.typ == typ && r.sub == sub:
+			specificity = 2
+		case r.typ == typ && r.sub == "*":
+			specificity = 1
+		case r.typ == "*" && r.sub == "*":
+			specificity = 0
+		}
+		if specificity > bestSpecificity {
+			best, bestSpecificity = r.q, specificity
+		}
+	}
+	return best
+}
+
+// negotiate picks the codec for sending v in response to r.
+func negotiate(r *http.Request, v any) (*codec, error) {
+	list := isList(v)
+	if format := r.URL.Query().Get("format"); format != "" {
+		for _, c := range codecs {
+			if c.format == format {
+				if c.listsOnly && !list {
+					return nil, fmt.Errorf("format %q is only available for lists", format)
+				}
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown format %q (want one of %s)", format, strings.Join(supportedFormats(), ", "))
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return codecs[0], nil
+	}
+	ranges := parseAccept(accept)
+	var best *codec
+	bestQ := 0.0
+	for _, c := range codecs {
+		if c.listsOnly && !list {
+			continue
+		}
+		for _, mt := range c.mediaTypes() {
+			// strictly greater: on a tie the earlier codec wins
+			if q := quality(ranges, mt); q > bestQ {
+				best, bestQ = c, q
+			}
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("none of %q can be produced for this resource", accept)
+	}
+	return best, nil
+}
+
+// respond encodes v in the negotiated format. The body is encoded into a
+// buffer first so an encoding error can still become a 500.
+func respond(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Add("Vary", "Accept")
+	c, err := negotiate(r, v)
+	if err != nil {
+		writeProblem(w, http.StatusNotAcceptable, err.Error())
+		return
+	}
+	var buf bytes.Buffer
+	if err := c.encode(&buf, v); err != nil {
+		writeProblem(w, http.StatusInternalServerError, "encode response: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", c.contentType)
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// decodeBody decodes the request body according to its Content-Type.
+func decodeBody(r *http.Request, v any) error {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return codecs[0].decode(r.Body, v)
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrUnsupportedMediaType, ct)
+	}
+	if c := codecFor(mt); c != nil {
+		return c.decode(r.Body, v)
+	}
+	return fmt.Errorf("%w: %q", ErrUnsupportedMediaType, mt)
+}
+
+// codecFor returns the codec answering to media type mt, or nil.
+func codecFor(mt string) *codec {
+	for _, c := range codecs {
+		for _, t := range c.mediaTypes() {
+			if t == mt {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// XML
+
+// xmlName turns a Go type name into an element name: SearchResult -> search_result.
+func xmlName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	var b strings.Builder
+	for i, r := range t.Name() {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() == 0 {
+		return "item"
+	}
+	return b.String()
+}
+
+// xmlEncode writes v as an XML document. Slices, which have no single root
+// element, are wrapped: []User -> <users><user>...</user>...</users>.
+func xmlEncode(w io.Writer, v any) error {
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	rv := reflect.ValueOf(v)
+	if !isList(v) {
+		return enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: xmlName(rv.Type())}})
+	}
+
+	item := xmlName(rv.Type().Elem())
+	root := xml.StartElement{Name: xml.Name{Local: item + "s"}}
+	if err := enc.EncodeToken(root); err != nil {
+		return err
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := enc.EncodeElement(rv.Index(i).Interface(), xml.StartElement{Name: xml.Name{Local: item}}); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+// CSV
+
+// csvColumn is one flattened struct field: nested structs become
+// "parent.child" columns (SearchResult -> user.id, user.name, ..., score).
+//
+// Structs that know how to print themselves (encoding.TextMarshaler, such
+// as time.Time) stay one column: their fields are unexported, so flattening
+// would silently drop them. Slices are one column with the items joined by
+// csvListSep ("user.created;user.deleted").
+type csvColumn struct {
+	name  string
+	index []int
+}
+
+const csvListSep = ";"
+
+var (
+	textMarshalerType   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// csvLeaf reports whether values of t are written as a single cell.
+func csvLeaf(t reflect.Type) bool {
+	return t.Kind() != reflect.Struct || t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType)
+}
+
+func csvColumns(t reflect.Type, prefix string, index []int) []csvColumn {
+	var cols []csvColumn
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		idx := append(append([]int(nil), index...), i)
+		if !csvLeaf(f.Type) {
+			cols = append(cols, csvColumns(f.Type, prefix+name+".", idx)...)
+			continue
+		}
+		cols = append(cols, csvColumn{name: prefix + name, index: idx})
+	}
+	return cols
+}
+
+// csvEncode writes a slice of structs as a header row plus one row each.
+func csvEncode(w io.Writer, v any) error {
+	rv := reflect.ValueOf(v)
+	elem := rv.Type().Elem()
+	if elem.Kind() != reflect.Struct {
+		return fmt.Errorf("csv: can't encode %s", rv.Type())
+	}
+	cols := csvColumns(elem, "", nil)
+
+	cw := csv.NewWriter(w)
+	header := make([]string, len(cols))
+	for i, c := range cols {
+		header[i] = c.name
+	}
+	cw.Write(header)
+	for i := 0; i < rv.Len(); i++ {
+		row := make([]string, len(cols))
+		for j, c := range cols {
+			cell, err := csvCell(rv.Index(i).FieldByIndex(c.index))
+			if err != nil {
+				return fmt.Errorf("csv: column %q: %w", c.name, err)
+			}
+			row[j] = cell
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvCell formats one field.
+func csvCell(f reflect.Value) (string, error) {
+	v := f.Interface()
+	if f.Kind() != reflect.Pointer && f.CanAddr() {
+		v = f.Addr().Interface() // finds pointer-receiver MarshalText too
+	}
+	if m, ok := v.(encoding.TextMarshaler); ok {
+		if f.Kind() == reflect.Pointer && f.IsNil() {
+			return "", nil
+		}
+		text, err := m.MarshalText()
+		return string(text), err
+	}
+	if f.Kind() == reflect.Slice {
+		items := make([]string, f.Len())
+		for i := range items {
+			item, err := csvCell(f.Index(i))
+			if err != nil {
+				return "", err
+			}
+			items[i] = item
+		}
+		return strings.Join(items, csvListSep), nil
+	}
+	return fmt.Sprint(f.Interface()), nil
+}
+
+// csvDecode reads a header row plus data rows into a *struct (exactly one
+// row) or a *[]struct. Columns are matched by name, in any order.
+func csvDecode(r io.Reader, v any) error {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return errors.New("csv: missing header row")
+	}
+
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return errors.New("csv: decode target must be a non-nil pointer")
+	}
+	target = target.Elem()
+	elem := target.Type()
+	if target.Kind() == reflect.Slice {
+		elem = elem.Elem()
+	} else if len(rows) != 2 {
+		return fmt.Errorf("csv: want exactly one data row, got %d", len(rows)-1)
+	}
+	if elem.Kind() != reflect.Struct {
+		return fmt.Errorf("csv: can't decode into %s", target.Type())
+	}
+
+	byName := map[string]csvColumn{}
+	for _, c := range csvColumns(elem, "", nil) {
+		byName[c.name] = c
+	}
+	header := rows[0]
+	for _, name := range header {
+		if _, ok := byName[name]; !ok {
+			return fmt.Errorf("csv: unknown column %q", name)
+		}
+	}
+
+	decodeRow := func(row []string) (reflect.Value, error) {
+		out := reflect.New(elem).Elem()
+		for i, name := range header {
+			if err := setCSVField(out.FieldByIndex(byName[name].index), row[i]); err != nil {
+				return out, fmt.Errorf("csv: column %q: %w", name, err)
+			}
+		}
+		return out, nil
+	}
+
+	if target.Kind() != reflect.Slice {
+		out, err := decodeRow(rows[1])
+		if err != nil {
+			return err
+		}
+		target.Set(out)
+		return nil
+	}
+	list := reflect.MakeSlice(target.Type(), 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		out, err := decodeRow(row)
+		if err != nil {
+			return err
+		}
+		list = reflect.Append(list, out)
+	}
+	target.Set(list)
+	return nil
+}
+
+func setCSVField(f reflect.Value, s string) error {
+	if f.CanAddr() && f.Addr().Type().Implements(textUnmarshalerType) {
+		if s == "" {
+			return nil // an empty cell leaves the zero value
+		}
+		return f.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+	switch f.Kind() {
+	case reflect.Slice:
+		if s == "" {
+			f.SetZero()
+			return nil
+		}
+		items := strings.Split(s, csvListSep)
+		list := reflect.MakeSlice(f.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setCSVField(list.Index(i), item); err != nil {
+				return err
+			}
+		}
+		f.Set(list)
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", f.Type())
+	}
+	return nil
+}
+
+// supportedFormats lists the ?format= names (for error messages and docs).
+func supportedFormats() []string {
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.format
+	}
+	return names
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		list   bool
+		want   string // format; "" = 406
+	}{
+		{"no accept", "/users", "", true, "json"},
+		{"wildcard", "/users", "*/*", true, "json"},
+		{"exact xml", "/users", "application/xml", true, "xml"},
+		{"text/xml alias", "/users", "text/xml", true, "xml"},
+		{"q-values", "/users", "text/csv;q=0.5, application/msgpack;q=0.9", true, "msgpack"},
+		{"specific beats wildcard", "/users", "*/*;q=0.1, text/csv", true, "csv"},
+		{"type wildcard", "/users", "application/*", true, "json"},
+		{"q=0 excludes", "/users", "application/json;q=0, application/xml;q=0.2", true, "xml"},
+		{"csv for single object", "/users/1", "text/csv", false, ""},
+		{"nothing acceptable", "/users", "image/png", true, ""},
+		{"format overrides accept", "/users?format=csv", "application/json", true, "csv"},
+		{"unknown format", "/users?format=yaml", "", true, ""},
+		{"csv format for single object", "/users/1?format=csv", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			var v any = User{}
+			if tt.list {
+				v = []User{}
+			}
+			c, err := negotiate(req, v)
+			got := ""
+			if err == nil {
+				got = c.format
+			}
+			if got != tt.want {
+				t.Errorf("negotiate = %q (err %v); want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func newNegotiationServer(t *testing.T) http.Handler {
+	t.Helper()
+	s := &Server{store: NewUserStore()}
+	h := s.routes()
+	t.Cleanup(func() { s.stopCurrentLimiter(context.Background()) })
+	for _, u := range []User{{ID: "1", Name: "Alice", Age: 30}, {ID: "2", Name: "Bob, Jr.", Age: 25}} {
+		s.store.Create(context.Background(), u)
+	}
+	return h
+}
+
+func TestRespond_Formats(t *testing.T) {
+	h := newNegotiationServer(t)
+	get := func(target, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/users?name=Alice", "application/xml")
+	var xmlList struct {
+		Users []User `xml:"user"`
+	}
+	if err := xml.Unmarshal(rr.Body.Bytes(), &xmlList); err != nil || len(xmlList.Users) != 1 || xmlList.Users[0].Name != "Alice" {
+		t.Errorf("xml list = %+v (err %v): %s", xmlList, err, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "<users><user><id>1</id>") {
+		t.Errorf("xml body = %s; want <users><user>... wrapper", rr.Body.String())
+	}
+
+	rr = get("/users?min_age=20", "text/csv")
+	rows, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || len(rows) != 3 || strings.Join(rows[0], ",") != "id,name,age" {
+		t.Errorf("csv rows = %q (err %v)", rows, err)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("csv Content-Type = %q", ct)
+	}
+
+	rr = get("/users/search?q=bob", "text/csv")
+	rows, _ = csv.NewReader(rr.Body).ReadAll()
+	if len(rows) != 2 || strings.Join(rows[0], ",") != "user.id,user.name,user.age,score,highlight" || rows[1][1] != "Bob, Jr." {
+		t.Errorf("search csv rows = %q", rows)
+	}
+
+	rr = get("/users/1", "application/msgpack")
+	var u User
+	if err := msgpackUnmarshal(rr.Body.Bytes(), &u); err != nil || u.Name != "Alice" {
+		t.Errorf("msgpack user = %+v (err %v)", u, err)
+	}
+
+	rr = get("/users/1", "text/csv")
+	if rr.Code != http.StatusNotAcceptable {
+		t.Errorf("csv single user status = %d; want 406", rr.Code)
+	}
+	if v := rr.Header().Get("Vary"); v != "Accept" {
+		t.Errorf("Vary = %q; want Accept", v)
+	}
+}
+
+func TestCSV_TimesAndLists(t *testing.T) {
+	events := NewEventLog()
+	store, _ := NewEventSourcedStore(events, "")
+	s := &Server{store: store}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+	store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+	store.Update(context.Background(), User{ID: "1", Name: "Alice", Age: 31})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/1/history", nil)
+	req.Header.Set("Accept", "text/csv")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	rows, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil || len(rows) != 3 || strings.Join(rows[0], ",") != "seq,type,time,user_id,user.id,user.name,user.age" {
+		t.Fatalf("history csv = %q (err %v)", rows, err)
+	}
+	for _, row := range rows[1:] {
+		if at, err := time.Parse(time.RFC3339Nano, row[2]); err != nil || at.IsZero() {
+			t.Errorf("time cell %q is not a timestamp", row[2])
+		}
+	}
+
+	// a time and a list survive a round trip
+	created := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	hooks := []Webhook{
+		{ID: "wh1", URL: "https://example.com/hook", Events: []string{"user.created", "user.deleted"}, CreatedAt: created},
+		{ID: "wh2", URL: "https://example.com/all"},
+	}
+	var buf bytes.Buffer
+	if err := csvEncode(&buf, hooks); err != nil {
+		t.Fatal(err)
+	}
+	rows, _ = csv.NewReader(bytes.NewReader(buf.Bytes())).ReadAll()
+	if got := rows[1]; got[2] != "user.created;user.deleted" || got[5] != "2024-05-01T12:30:00Z" {
+		t.Errorf("webhook row = %q", got)
+	}
+	var back []Webhook
+	if err := csvDecode(&buf, &back); err != nil || !reflect.DeepEqual(back, hooks) {
+		t.Errorf("decoded %+v (err %v); want %+v", back, err, hooks)
+	}
+}
+
+func TestDecodeBody_ContentTypes(t *testing.T) {
+	msgpackBody, _ := msgpackMarshal(User{ID: "m", Name: "Mia", Age: 41})
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantName    string
+	}{
+		{"json default", "", `{"id":"j","name":"Jo","age":20}`, http.StatusCreated, "Jo"},
+		{"json with charset", "application/json; charset=utf-8", `{"id":"j","name":"Jo","age":20}`, http.StatusCreated, "Jo"},
+		{"xml", "application/xml", `<user><id>x</id><name>Xi</name><age>33</age></user>`, http.StatusCreated, "Xi"},
+		{"csv", "text/csv", "name,age,id\nCy,22,c\n", http.StatusCreated, "Cy"},
+		{"msgpack", "application/msgpack", string(msgpackBody), http.StatusCreated, "Mia"},
+		{"csv unknown column", "text/csv", "id,nick\nc,Cy\n", http.StatusBadRequest, ""},
+		{"csv two rows", "text/csv", "id,name,age\na,A,1\nb,B,2\n", http.StatusBadRequest, ""},
+		{"unsupported", "text/plain", "hello", http.StatusUnsupportedMediaType, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newNegotiationServer(t)
+			req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d; want %d (%s)", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if tt.wantName != "" {
+				var u User
+				json.NewDecoder(rr.Body).Decode(&u)
+				if u.Name != tt.wantName {
+					t.Errorf("created %+v; want name %q", u, tt.wantName)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,1228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 24. Consensus with Raft
+//
+// WHY?
+// Replication (section 23) is asynchronous: a write the leader acknowledged
+// is lost if the leader dies before a follower streamed it, and nobody takes
+// over writes automatically. For writes that must survive losing a node we
+// need a majority to agree on every change BEFORE it is acknowledged.
+//
+// HOW (Raft, https://raft.github.io/raft.pdf):
+// 3 or 5 nodes. Every node is a follower, a candidate or the leader.
+//
+//  1. ELECTION: a follower that hears nothing from a leader for a random
+//     number of ticks becomes a candidate, increments the term and asks
+//     for votes. A node votes once per term, and only for candidates whose
+//     log is at least as up to date as its own. A majority makes a leader.
+//  2. LOG REPLICATION: the leader appends each command to its log and sends
+//     it to the followers (append). An entry stored on a majority is
+//     COMMITTED; every node applies committed entries in log order to its
+//     state machine - here the UserStore.
+//  3. SNAPSHOTS: every snapshotEvery applied entries the state machine is
+//     serialized and the log before it is thrown away. A follower that
+//     needs a discarded entry gets the snapshot instead.
+//
+//	client --POST /users--> leader: log[7] = create{...}
+//	                        leader --append 7--> followers
+//	                        leader <--ok------- one follower (2 of 3 = majority)
+//	                        commit = 7, apply -> 201 Created
+//
+// The node is a plain state machine driven by two calls: Tick (time passes)
+// and Step (a message arrived). Messages go out through a RaftTransport:
+// HTTPTransport between processes, MemNetwork in tests, where the test
+// decides when time passes and which messages arrive - partitions and
+// failover run deterministically in one process.
+//
+// Term, vote, log and snapshot are fsynced to the state file and its WAL
+// before any message that depends on them leaves the node, so a restarted
+// node never votes twice in a term or forgets an entry it acknowledged.
+//
+// Reads are served from each node's local store: a follower may lag the
+// leader by a heartbeat. Webhooks and cached responses stay per node.
+
+// Raft roles.
+const (
+	raftFollower  = "follower"
+	raftCandidate = "candidate"
+	raftLeader    = "leader"
+)
+
+// Raft message types.
+const (
+	msgVote       = "vote"
+	msgVoteResp   = "vote_resp"
+	msgAppend     = "append"
+	msgAppendResp = "append_resp"
+	msgSnapshot   = "snapshot"
+)
+
+// raftMaxBatch caps the entries per append message.
+const raftMaxBatch = 64
+
+var (
+	// ErrNotLeader is returned by Propose on followers and candidates.
+	ErrNotLeader = errors.New("raft: not the leader")
+	// ErrProposalDropped means a new leader overwrote the proposed entry:
+	// the command was NOT applied and may be retried.
+	ErrProposalDropped = errors.New("raft: proposal dropped by a leader change")
+)
+
+// RaftEntry is one log entry. A nil Command is a no-op.
+type RaftEntry struct {
+	Index   uint64          `json:"index"`
+	Term    uint64          `json:"term"`
+	Command json.RawMessage `json:"command,omitempty"`
+}
+
+// RaftSnapshot is the state machine as of entry Index.
+type RaftSnapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+// RaftMessage is everything nodes say to each other.
+type RaftMessage struct {
+	Type string `json:"type"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	Term uint64 `json:"term"`
+
+	// vote: the candidate's last entry; vote_resp: the answer
+	LastIndex uint64 `json:"last_index,omitempty"`
+	LastTerm  uint64 `json:"last_term,omitempty"`
+	Granted   bool   `json:"granted,omitempty"`
+
+	// append: Entries follow the entry at PrevIndex/PrevTerm
+	PrevIndex uint64      `json:"prev_index,omitempty"`
+	PrevTerm  uint64      `json:"prev_term,omitempty"`
+	Entries   []RaftEntry `json:"entries,omitempty"`
+	Commit    uint64      `json:"commit,omitempty"`
+
+	// append_resp: Match is the last index known to agree with the leader
+	// (on failure: where the leader should retry from)
+	Success bool   `json:"success,omitempty"`
+	Match   uint64 `json:"match,omitempty"`
+
+	Snapshot *RaftSnapshot `json:"snapshot,omitempty"`
+}
+
+// RaftStateMachine is what the log is applied to. Apply's error is handed
+// back to the proposer; it must be deterministic (same on every node).
+type RaftStateMachine interface {
+	Apply(cmd []byte) error
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
+}
+
+// RaftTransport delivers messages to other nodes. Send must not block and
+// may drop messages: Raft retries on the next tick.
+type RaftTransport interface {
+	Send(msg RaftMessage)
+}
+
+// RaftConfig configures a node. Zero values get the defaults noted.
+type RaftConfig struct {
+	ID            string
+	Peers         []string // IDs of all nodes, including ID
+	Transport     RaftTransport
+	StateMachine  RaftStateMachine
+	StatePath     string   // "" = memory only
+	Keys          *Keyring // encrypts the state file (see crypt.go); nil = plaintext
+	SnapshotEvery uint64   // applied entries between snapshots (1000)
+	// ElectionTicks is the minimum election timeout; each node picks one
+	// at random in [ElectionTicks, 2*ElectionTicks) (10).
+	ElectionTicks  int
+	HeartbeatTicks int    // (2)
+	Seed           uint64 // seeds the election timeouts; 0 = random
+}
+
+// RaftStatus is a node's view of the cluster (GET /admin/raft).
+type RaftStatus struct {
+	ID            string `json:"id"`
+	Role          string `json:"role"`
+	Leader        string `json:"leader"`
+	Term          uint64 `json:"term"`
+	Commit        uint64 `json:"commit"`
+	Applied       uint64 `json:"applied"`
+	LastIndex     uint64 `json:"last_index"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+}
+
+// RaftNode is one member of a Raft cluster.
+type RaftNode struct {
+	mu             sync.Mutex
+	id             string
+	peers          []string // the other nodes
+	tr             RaftTransport
+	sm             RaftStateMachine
+	path           string
+	keys           *Keyring
+	rng            *rand.Rand
+	snapshotEvery  uint64
+	electionTicks  int
+	heartbeatTicks int
+
+	// persistent state (see raftState)
+	term     uint64
+	votedFor string
+	log      []RaftEntry // log[0] holds index/term of the last snapshotted entry
+	snapshot []byte
+
+	role    string
+	leader  string
+	commit  uint64
+	applied uint64
+	elapsed int // ticks since the last heartbeat (leader: since the last broadcast)
+	timeout int // election timeout in ticks
+	votes   map[string]bool
+
+	// leader only
+	next, match  map[string]uint64
+	active       map[string]bool // peers heard from since the last quorum check
+	checkElapsed int
+	waiters      map[uint64]raftWaiter
+
+	// what the next flush writes (see Persistence)
+	dirty     bool   // term or vote changed
+	unsaved   uint64 // first log index that differs from the WAL
+	compacted bool   // the snapshot changed: rewrite the checkpoint
+	wal       *os.File
+	walCipher *fileCipher // nil = plaintext
+	walGen    uint64
+	walSize   int64
+
+	outbox []RaftMessage // sent by flush, after persisting
+
+	// onApply runs after each applied command, and with nil after a
+	// snapshot from the leader replaced the whole state (the server drops
+	// cached responses); set with OnApply.
+	onApply func(cmd []byte)
+}
+
+// OnApply registers fn to run, with the node locked, after every command
+// the state machine applies, and with nil after a snapshot replaced the
+// state. fn must not call back into the node.
+func (n *RaftNode) OnApply(fn func(cmd []byte)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onApply = fn
+}
+
+type raftWaiter struct {
+	term uint64
+	done chan error
+}
+
+// NewRaftNode creates a follower, restoring StatePath if it exists.
+func NewRaftNode(cfg RaftConfig) (*RaftNode, error) {
+	if cfg.Transport == nil || cfg.StateMachine == nil {
+		return nil, errors.New("raft: transport and state machine required")
+	}
+	if !slices.Contains(cfg.Peers, cfg.ID) {
+		return nil, fmt.Errorf("raft: peers %v don't include this node %q", cfg.Peers, cfg.ID)
+	}
+	n := &RaftNode{
+		id:             cfg.ID,
+		tr:             cfg.Transport,
+		sm:             cfg.StateMachine,
+		path:           cfg.StatePath,
+		keys:           cfg.Keys,
+		snapshotEvery:  cfg.SnapshotEvery,
+		electionTicks:  cfg.ElectionTicks,
+		heartbeatTicks: cfg.HeartbeatTicks,
+		log:            []RaftEntry{{}},
+		unsaved:        1,
+		role:           raftFollower,
+		waiters:        make(map[uint64]raftWaiter),
+	}
+	for _, p := range cfg.Peers {
+		if p != cfg.ID {
+			n.peers = append(n.peers, p)
+		}
+	}
+	if n.snapshotEvery == 0 {
+		n.snapshotEvery = 1000
+	}
+	if n.electionTicks == 0 {
+		n.electionTicks = 10
+	}
+	if n.heartbeatTicks == 0 {
+		n.heartbeatTicks = 2
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+	var idHash uint64
+	for _, c := range cfg.ID {
+		idHash = idHash*31 + uint64(c)
+	}
+	n.rng = rand.New(rand.NewPCG(seed, idHash))
+	if err := n.load(); err != nil {
+		return nil, err
+	}
+	if n.keys != nil && n.path != "" {
+		n.keys.track(encryptedFile{
+			name:  n.path,
+			keyID: func() string { return fileKeyID(n.path) },
+			reencrypt: func() error {
+				n.mu.Lock()
+				defer n.mu.Unlock()
+				return n.checkpoint() // always under the active key
+			},
+		})
+	}
+	n.resetTimer()
+	return n, nil
+}
+
+// Persistence
+//
+// Two files:
+//
+//	<path>      checkpoint: term, vote, the log since the snapshot and the
+//	            snapshot itself
+//	<path>.wal  one record per flush: term, vote and the log entries that
+//	            changed since the previous flush
+//
+// A flush appends one small record to the WAL and fsyncs it, so a proposal
+// doesn't rewrite every entry and the snapshot. The checkpoint is rewritten
+// (tmp file, fsync, rename, fsync of the directory) only when the snapshot
+// changes or the WAL outgrows raftMaxWAL; the WAL then starts over.
+//
+// Each checkpoint starts a new WAL generation. Records of an older one -
+// left by a crash between writing the checkpoint and emptying the WAL -
+// are already in the checkpoint and skipped on load. A torn last record
+// is dropped: the messages that depended on it were never sent.
+
+// raftMaxWAL is the WAL size past which the next flush checkpoints.
+const raftMaxWAL = 16 << 20
+
+// raftState is the content of the checkpoint file.
+type raftState struct {
+	Term     uint64      `json:"term"`
+	VotedFor string      `json:"voted_for"`
+	Log      []RaftEntry `json:"log"`
+	Snapshot []byte      `json:"snapshot,omitempty"`
+	WALGen   uint64      `json:"wal_gen,omitempty"`
+}
+
+// raftWALRecord is one WAL line: the hard state, and Entries replacing
+// everything in the log after entry After.
+type raftWALRecord struct {
+	Gen      uint64      `json:"gen"`
+	Term     uint64      `json:"term"`
+	VotedFor string      `json:"voted_for"`
+	After    uint64      `json:"after"`
+	Entries  []RaftEntry `json:"entries,omitempty"`
+}
+
+func (n *RaftNode) load() error {
+	if n.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(n.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return n.checkpoint() // a new node: create both files
+	}
+	if err != nil {
+		return err
+	}
+	if data, err = n.keys.openFile(data); err != nil {
+		return fmt.Errorf("raft state %s: %w", n.path, err)
+	}
+	var st raftState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("raft state %s: %w", n.path, err)
+	}
+	if len(st.Log) == 0 {
+		return fmt.Errorf("raft state %s: empty log", n.path)
+	}
+	if st.Snapshot != nil {
+		if err := n.sm.Restore(st.Snapshot); err != nil {
+			return fmt.Errorf("raft state %s: restore snapshot: %w", n.path, err)
+		}
+	}
+	n.term, n.votedFor, n.log, n.snapshot = st.Term, st.VotedFor, st.Log, st.Snapshot
+	n.walGen = st.WALGen
+	if err := n.replayWAL(); err != nil {
+		return fmt.Errorf("raft wal %s.wal: %w", n.path, err)
+	}
+	// entries after the snapshot are re-applied once a leader says they
+	// are committed
+	n.commit, n.applied = n.firstIndex(), n.firstIndex()
+	n.unsaved = n.lastIndex() + 1
+	if n.keys != nil && n.walCipher == nil {
+		// a plaintext WAL from before -keyfile: encrypt both files now,
+		// before anything is appended to it
+		return n.checkpoint()
+	}
+	return nil
+}
+
+// replayWAL applies the current generation's records on top of the
+// checkpoint and leaves the WAL open for appending after the last whole one.
+func (n *RaftNode) replayWAL() error {
+	f, err := os.OpenFile(n.path+".wal", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	n.wal = f
+	br := bufio.NewReader(f)
+	var valid int64
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break // no trailing newline: a write that never finished
+		}
+		if err != nil {
+			return err
+		}
+		if line == 1 {
+			if h, ok := parseEncHeader(bytes.TrimSpace(b)); ok {
+				if n.walCipher, err = n.keys.openFileCipher(h); err != nil {
+					return err
+				}
+				valid += int64(len(b))
+				continue
+			}
+		}
+		rec := b
+		if n.walCipher != nil {
+			if rec, err = n.walCipher.openRecord(b); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		var r raftWALRecord
+		if err := json.Unmarshal(rec, &r); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		valid += int64(len(b))
+		if r.Gen != n.walGen {
+			continue // already in the checkpoint
+		}
+		if r.After < n.firstIndex() || r.After > n.lastIndex() {
+			return fmt.Errorf("line %d: entries after %d don't fit the log %d..%d", line, r.After, n.firstIndex(), n.lastIndex())
+		}
+		n.term, n.votedFor = r.Term, r.VotedFor
+		n.log = append(n.log[:r.After-n.firstIndex()+1], r.Entries...)
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() > valid {
+		log.Printf("raft wal %s: dropping %d bytes of a torn last write", f.Name(), fi.Size()-valid)
+		if err := f.Truncate(valid); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		return err
+	}
+	n.walSize = valid
+	return nil
+}
+
+// save makes everything changed since the last flush durable.
+func (n *RaftNode) save() error {
+	if n.compacted || n.wal == nil || n.unsaved <= n.firstIndex() || n.walSize > raftMaxWAL {
+		return n.checkpoint()
+	}
+	rec := raftWALRecord{Gen: n.walGen, Term: n.term, VotedFor: n.votedFor, After: n.unsaved - 1}
+	if n.unsaved <= n.lastIndex() {
+		rec.Entries = n.log[n.unsaved-n.firstIndex():]
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if n.walCipher != nil {
+		line = n.walCipher.sealRecord(line)
+	}
+	if _, err := n.wal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := n.wal.Sync(); err != nil {
+		return err
+	}
+	n.walSize += int64(len(line)) + 1
+	return nil
+}
+
+// checkpoint writes the whole state to the checkpoint file under the
+// active key and starts a new, empty WAL generation.
+func (n *RaftNode) checkpoint() error {
+	gen := n.walGen + 1
+	data, err := json.Marshal(raftState{Term: n.term, VotedFor: n.votedFor, Log: n.log, Snapshot: n.snapshot, WALGen: gen})
+	if err != nil {
+		return err
+	}
+	if data, err = n.keys.sealFile(data); err != nil {
+		return err
+	}
+	if err := writeFileSync(n.path, data); err != nil {
+		return err
+	}
+	n.walGen = gen
+	if n.wal == nil {
+		if n.wal, err = os.OpenFile(n.path+".wal", os.O_RDWR|os.O_CREATE, 0o600); err != nil {
+			return err
+		}
+	}
+	if err := n.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := n.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	n.walSize, n.walCipher = 0, nil
+	if n.keys != nil {
+		c, err := n.keys.newFileCipher()
+		if err != nil {
+			return err
+		}
+		if _, err := n.wal.Write(append(c.header, '\n')); err != nil {
+			return err
+		}
+		n.walSize, n.walCipher = int64(len(c.header))+1, c
+	}
+	return n.wal.Sync()
+}
+
+// writeFileSync replaces path with data durably: a temp file of its own
+// (concurrent writers never share one) is fsynced before the rename, and
+// the directory after it, so a crash leaves either the old file or the
+// new one - never an empty or half-written one.
+func writeFileSync(path string, data []byte) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*") // mode 0600
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// flush ends every entry point (Tick, Step, propose) with n.mu held: first
+// persist, THEN send - a vote or an ack must not leave the node before the
+// state behind it is on disk.
+func (n *RaftNode) flush() {
+	if n.path != "" && (n.dirty || n.compacted || n.unsaved <= n.lastIndex()) {
+		if err := n.save(); err != nil {
+			// stay silent rather than promise what we can't keep; the
+			// peers retry and the next flush checkpoints, since the WAL
+			// may now end in a partial record
+			log.Printf("raft %s: persist: %v; dropping %d messages", n.id, err, len(n.outbox))
+			n.compacted = true
+			n.outbox = nil
+			return
+		}
+	}
+	n.dirty, n.compacted, n.unsaved = false, false, n.lastIndex()+1
+	for _, m := range n.outbox {
+		n.tr.Send(m)
+	}
+	n.outbox = nil
+}
+
+// Log helpers (n.mu held)
+
+func (n *RaftNode) firstIndex() uint64 { return n.log[0].Index }
+func (n *RaftNode) lastIndex() uint64  { return n.log[len(n.log)-1].Index }
+func (n *RaftNode) lastTerm() uint64   { return n.log[len(n.log)-1].Term }
+
+// termAt returns the term of entry i, if the log (or snapshot) still has it.
+func (n *RaftNode) termAt(i uint64) (uint64, bool) {
+	if i < n.firstIndex() || i > n.lastIndex() {
+		return 0, false
+	}
+	return n.log[i-n.firstIndex()].Term, true
+}
+
+func (n *RaftNode) quorum(k int) bool { return k > (len(n.peers)+1)/2 }
+
+func (n *RaftNode) send(m RaftMessage) {
+	m.From, m.Term = n.id, n.term
+	n.outbox = append(n.outbox, m)
+}
+
+func (n *RaftNode) resetTimer() {
+	n.elapsed = 0
+	n.timeout = n.electionTicks + n.rng.IntN(n.electionTicks)
+}
+
+// Roles
+
+func (n *RaftNode) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term, n.votedFor, n.dirty = term, "", true
+	}
+	n.role, n.leader = raftFollower, leader
+	n.resetTimer()
+}
+
+func (n *RaftNode) campaign() {
+	n.role, n.leader = raftCandidate, ""
+	n.term++
+	n.votedFor, n.dirty = n.id, true
+	n.votes = map[string]bool{n.id: true}
+	n.resetTimer()
+	if n.quorum(len(n.votes)) {
+		n.becomeLeader() // a cluster of one
+		return
+	}
+	for _, p := range n.peers {
+		n.send(RaftMessage{Type: msgVote, To: p, LastIndex: n.lastIndex(), LastTerm: n.lastTerm()})
+	}
+}
+
+func (n *RaftNode) becomeLeader() {
+	n.role, n.leader, n.elapsed, n.checkElapsed = raftLeader, n.id, 0, 0
+	n.next, n.match = make(map[string]uint64), make(map[string]uint64)
+	n.active = make(map[string]bool)
+	for _, p := range n.peers {
+		n.next[p] = n.lastIndex() + 1
+	}
+	// an entry of the new term: entries of earlier terms are only
+	// committed together with one of the current term (Raft paper 5.4.2)
+	n.appendEntry(nil)
+	n.broadcastAppend()
+}
+
+func (n *RaftNode) appendEntry(cmd []byte) uint64 {
+	e := RaftEntry{Index: n.lastIndex() + 1, Term: n.term, Command: cmd}
+	n.log = append(n.log, e)
+	n.unsaved = min(n.unsaved, e.Index)
+	return e.Index
+}
+
+// Driving the node
+
+// Tick advances the node's clock by one tick.
+func (n *RaftNode) Tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer n.flush()
+
+	n.elapsed++
+	if n.role != raftLeader {
+		if n.elapsed >= n.timeout {
+			n.campaign()
+		}
+		return
+	}
+	// entries proposed since the last tick are on disk now (flush), so a
+	// one-node cluster may count itself as the majority
+	n.maybeCommit()
+	if n.elapsed >= n.heartbeatTicks {
+		n.elapsed = 0
+		n.broadcastAppend()
+	}
+	// CHECK QUORUM: a leader cut off from the majority steps down instead
+	// of accepting writes it can never commit
+	if n.checkElapsed++; n.checkElapsed >= n.electionTicks {
+		n.checkElapsed = 0
+		if !n.quorum(len(n.active) + 1) {
+			log.Printf("raft %s: lost contact with the majority, stepping down in term %d", n.id, n.term)
+			n.becomeFollower(n.term, "")
+			return
+		}
+		n.active = make(map[string]bool)
+	}
+}
+
+// Run ticks the node every interval until ctx is done.
+func (n *RaftNode) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			n.Tick()
+		}
+	}
+}
+
+// Step handles a message from another node.
+func (n *RaftNode) Step(m RaftMessage) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer n.flush()
+
+	if m.Term > n.term {
+		leader := ""
+		if m.Type == msgAppend || m.Type == msgSnapshot {
+			leader = m.From
+		}
+		n.becomeFollower(m.Term, leader)
+	}
+	if m.Term < n.term {
+		// a stale leader or candidate: our answer carries the newer term,
+		// which makes it step down
+		switch m.Type {
+		case msgAppend, msgSnapshot:
+			n.send(RaftMessage{Type: msgAppendResp, To: m.From})
+		case msgVote:
+			n.send(RaftMessage{Type: msgVoteResp, To: m.From})
+		}
+		return
+	}
+
+	switch m.Type {
+	case msgVote:
+		upToDate := m.LastTerm > n.lastTerm() || (m.LastTerm == n.lastTerm() && m.LastIndex >= n.lastIndex())
+		grant := (n.votedFor == "" || n.votedFor == m.From) && upToDate
+		if grant {
+			n.votedFor, n.dirty = m.From, true
+			n.resetTimer()
+		}
+		n.send(RaftMessage{Type: msgVoteResp, To: m.From, Granted: grant})
+	case msgVoteResp:
+		if n.role == raftCandidate && m.Granted {
+			n.votes[m.From] = true
+			if n.quorum(len(n.votes)) {
+				n.becomeLeader()
+			}
+		}
+	case msgAppend:
+		n.handleAppend(m)
+	case msgAppendResp:
+		n.handleAppendResp(m)
+	case msgSnapshot:
+		n.handleSnapshot(m)
+	}
+}
+
+func (n *RaftNode) handleAppend(m RaftMessage) {
+	n.role, n.leader = raftFollower, m.From
+	n.resetTimer()
+
+	prev, entries := m.PrevIndex, m.Entries
+	if prev < n.firstIndex() {
+		// the start is already in our snapshot (and committed): skip it
+		skip := n.firstIndex() - prev
+		if skip >= uint64(len(entries)) {
+			n.send(RaftMessage{Type: msgAppendResp, To: m.From, Success: true, Match: n.firstIndex()})
+			return
+		}
+		entries, prev = entries[skip:], n.firstIndex()
+	} else if t, ok := n.termAt(prev); !ok || t != m.PrevTerm {
+		// we don't have the entry the new ones follow: ask for older ones
+		n.send(RaftMessage{Type: msgAppendResp, To: m.From, Match: min(prev-1, n.lastIndex())})
+		return
+	}
+	for i, e := range entries {
+		if t, ok := n.termAt(e.Index); ok {
+			if t == e.Term {
+				continue // already have it
+			}
+			// conflict: this entry and all after it were never committed
+			n.log = n.log[:e.Index-n.firstIndex()]
+		}
+		n.log = append(n.log, entries[i:]...)
+		n.unsaved = min(n.unsaved, e.Index)
+		break
+	}
+	last := prev + uint64(len(entries))
+	if c := min(m.Commit, last); c > n.commit {
+		n.commit = c
+		n.applyCommitted()
+	}
+	n.send(RaftMessage{Type: msgAppendResp, To: m.From, Success: true, Match: last})
+}
+
+func (n *RaftNode) handleAppendResp(m RaftMessage) {
+	if n.role != raftLeader {
+		return
+	}
+	n.active[m.From] = true
+	if !m.Success {
+		// back up to the follower's hint and try again
+		n.next[m.From] = max(n.match[m.From]+1, min(n.next[m.From]-1, m.Match+1))
+		n.sendAppend(m.From)
+		return
+	}
+	if m.Match > n.match[m.From] {
+		n.match[m.From] = m.Match
+	}
+	n.next[m.From] = max(n.next[m.From], n.match[m.From]+1)
+	n.maybeCommit()
+	if n.next[m.From] <= n.lastIndex() {
+		n.sendAppend(m.From) // the follower is behind: keep going
+	}
+}
+
+func (n *RaftNode) handleSnapshot(m RaftMessage) {
+	n.role, n.leader = raftFollower, m.From
+	n.resetTimer()
+	snap := m.Snapshot
+	if snap == nil || snap.Index <= n.commit {
+		n.send(RaftMessage{Type: msgAppendResp, To: m.From, Success: true, Match: n.commit})
+		return
+	}
+	if err := n.sm.Restore(snap.Data); err != nil {
+		log.Printf("raft %s: restore snapshot %d: %v", n.id, snap.Index, err)
+		return
+	}
+	n.log = []RaftEntry{{Index: snap.Index, Term: snap.Term}}
+	n.snapshot, n.compacted = snap.Data, true
+	n.commit, n.applied = snap.Index, snap.Index
+	if n.onApply != nil {
+		n.onApply(nil)
+	}
+	for i, w := range n.waiters {
+		if i <= snap.Index {
+			// replaced by a snapshot: we can't tell whether it made it
+			w.done <- fmt.Errorf("raft: outcome of entry %d unknown (replaced by a snapshot)", i)
+			delete(n.waiters, i)
+		}
+	}
+	n.send(RaftMessage{Type: msgAppendResp, To: m.From, Success: true, Match: snap.Index})
+}
+
+// Leader helpers
+
+func (n *RaftNode) broadcastAppend() {
+	for _, p := range n.peers {
+		n.sendAppend(p)
+	}
+}
+
+// sendAppend sends p the entries from n.next[p] on - or the snapshot, when
+// they were already compacted away.
+func (n *RaftNode) sendAppend(p string) {
+	prev := n.next[p] - 1
+	if prev < n.firstIndex() {
+		n.send(RaftMessage{Type: msgSnapshot, To: p, Snapshot: &RaftSnapshot{Index: n.firstIndex(), Term: n.log[0].Term, Data: n.snapshot}})
+		return
+	}
+	prevTerm, _ := n.termAt(prev)
+	entries := n.log[prev-n.firstIndex()+1:]
+	if len(entries) > raftMaxBatch {
+		entries = entries[:raftMaxBatch]
+	}
+	n.send(RaftMessage{
+		Type: msgAppend, To: p,
+		PrevIndex: prev, PrevTerm: prevTerm,
+		Entries: slices.Clone(entries), Commit: n.commit,
+	})
+}
+
+// maybeCommit moves the commit index to the newest entry of the current
+// term that a majority stores.
+func (n *RaftNode) maybeCommit() {
+	for i := n.lastIndex(); i > n.commit; i-- {
+		if t, _ := n.termAt(i); t != n.term {
+			break
+		}
+		count := 1 // the leader itself
+		for _, p := range n.peers {
+			if n.match[p] >= i {
+				count++
+			}
+		}
+		if n.quorum(count) {
+			n.commit = i
+			n.applyCommitted()
+			return
+		}
+	}
+}
+
+// applyCommitted applies entries up to the commit index, answers waiting
+// proposers and snapshots when the log has grown enough.
+func (n *RaftNode) applyCommitted() {
+	for n.applied < n.commit {
+		n.applied++
+		e := n.log[n.applied-n.firstIndex()]
+		var err error
+		if e.Command != nil {
+			err = n.sm.Apply(e.Command)
+			if n.onApply != nil {
+				n.onApply(e.Command)
+			}
+		}
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				err = ErrProposalDropped // another leader's entry took the slot
+			}
+			w.done <- err
+		}
+	}
+	if n.applied-n.firstIndex() < n.snapshotEvery {
+		return
+	}
+	data, err := n.sm.Snapshot()
+	if err != nil {
+		log.Printf("raft %s: snapshot: %v", n.id, err)
+		return
+	}
+	t, _ := n.termAt(n.applied)
+	rest := n.log[n.applied-n.firstIndex()+1:]
+	n.log = append([]RaftEntry{{Index: n.applied, Term: t}}, rest...)
+	n.snapshot, n.compacted = data, true
+}
+
+// Proposals
+
+// Propose replicates cmd and waits until it is applied; the result is the
+// state machine's Apply error. Only the leader accepts proposals.
+func (n *RaftNode) Propose(ctx context.Context, cmd []byte) error {
+	done, err := n.propose(cmd)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// the entry may still commit later; the caller just stops waiting
+		return ctx.Err()
+	}
+}
+
+// propose appends cmd to the leader's log and returns a channel that
+// receives the outcome.
+func (n *RaftNode) propose(cmd []byte) (<-chan error, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	defer n.flush()
+	if n.role != raftLeader {
+		if n.leader == "" {
+			return nil, fmt.Errorf("%w: no leader elected", ErrNotLeader)
+		}
+		return nil, fmt.Errorf("%w: the leader is %s", ErrNotLeader, n.leader)
+	}
+	i := n.appendEntry(cmd)
+	done := make(chan error, 1)
+	n.waiters[i] = raftWaiter{term: n.term, done: done}
+	n.broadcastAppend()
+	return done, nil
+}
+
+// Status reports the node's role and progress.
+func (n *RaftNode) Status() RaftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return RaftStatus{
+		ID: n.id, Role: n.role, Leader: n.leader, Term: n.term,
+		Commit: n.commit, Applied: n.applied,
+		LastIndex: n.lastIndex(), SnapshotIndex: n.firstIndex(),
+	}
+}
+
+// Transports
+
+// MemNetwork connects nodes in one process. Messages wait in a queue until
+// Deliver, so a test controls exactly when (and whether) they arrive.
+type MemNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*RaftNode
+	queue []RaftMessage
+	group map[string]int // partition group per node; nil = fully connected
+}
+
+func NewMemNetwork() *MemNetwork {
+	return &MemNetwork{nodes: make(map[string]*RaftNode)}
+}
+
+// Add attaches a node (created with the network as its transport).
+func (nw *MemNetwork) Add(n *RaftNode) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[n.id] = n
+}
+
+// Remove detaches a node, as if it crashed.
+func (nw *MemNetwork) Remove(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.nodes, id)
+}
+
+// Send implements RaftTransport.
+func (nw *MemNetwork) Send(m RaftMessage) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.queue = append(nw.queue, m)
+}
+
+// Partition splits the network: nodes only reach nodes in their group.
+func (nw *MemNetwork) Partition(groups ...[]string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.group = make(map[string]int)
+	for i, g := range groups {
+		for _, id := range g {
+			nw.group[id] = i + 1
+		}
+	}
+}
+
+// Heal reconnects all nodes.
+func (nw *MemNetwork) Heal() {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.group = nil
+}
+
+// Deliver hands queued messages (and the ones they trigger) to their
+// nodes until the network is quiet. Messages across a partition are lost.
+func (nw *MemNetwork) Deliver() {
+	for {
+		nw.mu.Lock()
+		batch := nw.queue
+		nw.queue = nil
+		nw.mu.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+		for _, m := range batch {
+			nw.mu.Lock()
+			to, ok := nw.nodes[m.To]
+			_, fromUp := nw.nodes[m.From]
+			reachable := nw.group == nil || nw.group[m.From] == nw.group[m.To]
+			nw.mu.Unlock()
+			if ok && fromUp && reachable {
+				to.Step(m)
+			}
+		}
+	}
+}
+
+// Tick ticks every attached node once (in ID order) and delivers.
+func (nw *MemNetwork) Tick() {
+	nw.mu.Lock()
+	ids := make([]string, 0, len(nw.nodes))
+	for id := range nw.nodes {
+		ids = append(ids, id)
+	}
+	nodes := nw.nodes
+	nw.mu.Unlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		nodes[id].Tick()
+		nw.Deliver()
+	}
+}
+
+// HTTPTransport posts messages to POST /admin/raft on the peers' admin
+// listeners, one queue and sender goroutine per peer.
+type HTTPTransport struct {
+	client *http.Client
+	token  string
+	queues map[string]chan RaftMessage
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHTTPTransport starts senders for peers (node ID -> admin base URL).
+func NewHTTPTransport(peers map[string]string, token string) *HTTPTransport {
+	t := &HTTPTransport{
+		client: &http.Client{Timeout: time.Second},
+		token:  token,
+		queues: make(map[string]chan RaftMessage),
+		stop:   make(chan struct{}),
+	}
+	for id, base := range peers {
+		q := make(chan RaftMessage, 256)
+		t.queues[id] = q
+		t.wg.Add(1)
+		go t.sender(base+"/admin/raft", q)
+	}
+	return t
+}
+
+// Send implements RaftTransport; a full queue (peer down) drops the message.
+func (t *HTTPTransport) Send(m RaftMessage) {
+	select {
+	case t.queues[m.To] <- m:
+	default:
+	}
+}
+
+func (t *HTTPTransport) sender(url string, q chan RaftMessage) {
+	defer t.wg.Done()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case m := <-q:
+			body, err := json.Marshal(m)
+			if err != nil {
+				continue
+			}
+			req, _ := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if t.token != "" {
+				req.Header.Set("Authorization", "Bearer "+t.token)
+			}
+			if resp, err := t.client.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}
+}
+
+// Close stops the senders.
+func (t *HTTPTransport) Close() error {
+	close(t.stop)
+	t.wg.Wait()
+	return nil
+}
+
+// The UserStore as state machine
+
+// raftCommand is a replicated UserStore change.
+type raftCommand struct {
+	Op   string `json:"op"` // "create", "update" or "delete"
+	User User   `json:"user"`
+}
+
+// NewRaftStore returns a store whose writes go through a Raft node built
+// from cfg (cfg.StateMachine is set to the store).
+func NewRaftStore(cfg RaftConfig) (*UserStore, error) {
+	us := NewUserStore()
+	cfg.StateMachine = userStateMachine{us}
+	node, err := NewRaftNode(cfg)
+	if err != nil {
+		return nil, err
+	}
+	us.raft = node
+	return us, nil
+}
+
+func (us *UserStore) propose(ctx context.Context, cmd raftCommand) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return us.raft.Propose(ctx, data)
+}
+
+// userStateMachine applies committed commands to a UserStore.
+type userStateMachine struct{ us *UserStore }
+
+func (m userStateMachine) Apply(data []byte) error {
+	var cmd raftCommand
+	if err := json.Unmarshal(data, &cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case "create":
+		return m.us.create(cmd.User)
+	case "update":
+		return m.us.update(cmd.User)
+	case "delete":
+		return m.us.delete(cmd.User.ID)
+	}
+	return fmt.Errorf("raft: unknown command %q", cmd.Op)
+}
+
+func (m userStateMachine) Snapshot() ([]byte, error) {
+	m.us.mu.RLock()
+	users := make([]User, 0, len(m.us.users))
+	for _, u := range m.us.users {
+		users = append(users, u)
+	}
+	m.us.mu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return json.Marshal(users)
+}
+
+func (m userStateMachine) Restore(data []byte) error {
+	var users []User
+	if err := json.Unmarshal(data, &users); err != nil {
+		return err
+	}
+	m.us.mu.Lock()
+	defer m.us.mu.Unlock()
+	m.us.reset()
+	for _, u := range users {
+		m.us.users[u.ID] = u
+		m.us.indexUser(u)
+	}
+	return nil
+}
+
+// HTTP
+
+// raftWriteError answers a write that failed because this node can't
+// accept it (ErrNotLeader) and reports whether it did.
+func raftWriteError(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrProposalDropped) {
+		return false
+	}
+	// clients retry against the leader named in the detail
+	w.Header().Set("Retry-After", "1")
+	writeProblem(w, http.StatusServiceUnavailable, err.Error())
+	return true
+}
+
+// handleRaftMessage serves POST /admin/raft (peer-to-peer traffic).
+func (s *Server) handleRaftMessage(w http.ResponseWriter, r *http.Request) {
+	if s.store.raft == nil {
+		writeProblem(w, http.StatusNotImplemented, "this server is not a raft node (start it with -raft-id)")
+		return
+	}
+	var m RaftMessage
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.store.raft.Step(m)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRaftStatus serves GET /admin/raft.
+func (s *Server) handleRaftStatus(w http.ResponseWriter, r *http.Request) {
+	if s.store.raft == nil {
+		writeProblem(w, http.StatusNotImplemented, "this server is not a raft node (start it with -raft-id)")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.store.raft.Status())
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// raftCluster runs nodes on a MemNetwork; time only passes in tick.
+type raftCluster struct {
+	t      *testing.T
+	nw     *MemNetwork
+	ids    []string
+	stores map[string]*UserStore
+}
+
+func newRaftCluster(t *testing.T, snapshotEvery uint64, ids ...string) *raftCluster {
+	c := &raftCluster{t: t, nw: NewMemNetwork(), ids: ids, stores: make(map[string]*UserStore)}
+	for _, id := range ids {
+		us, err := NewRaftStore(RaftConfig{ID: id, Peers: ids, Transport: c.nw, SnapshotEvery: snapshotEvery, Seed: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.stores[id] = us
+		c.nw.Add(us.raft)
+	}
+	return c
+}
+
+func (c *raftCluster) node(id string) *RaftNode { return c.stores[id].raft }
+
+// tickUntil ticks the cluster until cond holds (at most 500 ticks).
+func (c *raftCluster) tickUntil(what string, cond func() bool) {
+	c.t.Helper()
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		c.nw.Tick()
+	}
+	c.t.Fatalf("gave up waiting for %s", what)
+}
+
+// leader waits for a leader among ids that all of them agree on.
+func (c *raftCluster) leader(ids ...string) string {
+	c.t.Helper()
+	var leader string
+	c.tickUntil("a leader", func() bool {
+		leader = c.node(ids[0]).Status().Leader
+		if !slices.Contains(ids, leader) {
+			return false
+		}
+		for _, id := range ids {
+			st := c.node(id).Status()
+			if st.Leader == "" || st.Leader != leader {
+				return false
+			}
+		}
+		return c.node(leader).Status().Role == raftLeader
+	})
+	return leader
+}
+
+// propose submits cmd on node id; the outcome arrives as the cluster ticks.
+func (c *raftCluster) propose(id string, cmd raftCommand) (<-chan error, error) {
+	data, _ := json.Marshal(cmd)
+	return c.node(id).propose(data)
+}
+
+// write proposes cmd on node id and ticks until it is applied.
+func (c *raftCluster) write(id string, cmd raftCommand) error {
+	c.t.Helper()
+	done, err := c.propose(id, cmd)
+	if err != nil {
+		return err
+	}
+	var result error
+	c.tickUntil("the write to apply", func() bool {
+		select {
+		case result = <-done:
+			return true
+		default:
+			return false
+		}
+	})
+	return result
+}
+
+func createCmd(id string) raftCommand {
+	return raftCommand{Op: "create", User: User{ID: id, Name: "User " + id, Age: 30}}
+}
+
+// converged waits until every store in ids holds exactly want users.
+func (c *raftCluster) converged(want int, ids ...string) {
+	c.t.Helper()
+	c.tickUntil(fmt.Sprintf("%v to hold %d users", ids, want), func() bool {
+		for _, id := range ids {
+			users, _ := c.stores[id].List(context.Background())
+			if len(users) != want {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestRaft_ElectsLeaderAndReplicates(t *testing.T) {
+	c := newRaftCluster(t, 0, "n1", "n2", "n3")
+	leader := c.leader("n1", "n2", "n3")
+
+	if err := c.write(leader, createCmd("1")); err != nil {
+		t.Fatalf("write on the leader: %v", err)
+	}
+	c.converged(1, "n1", "n2", "n3")
+
+	// Apply's error comes back to the proposer, the same on every node
+	if err := c.write(leader, createCmd("1")); err == nil || !strings.Contains(err.Error(), "already Exists") {
+		t.Errorf("duplicate create = %v; want the store's error", err)
+	}
+
+	for _, id := range c.ids {
+		if id == leader {
+			continue
+		}
+		err := c.stores[id].Create(context.Background(), User{ID: "2", Name: "Bob", Age: 25})
+		if !errors.Is(err, ErrNotLeader) || !strings.Contains(err.Error(), leader) {
+			t.Errorf("Create on follower %s = %v; want ErrNotLeader naming %s", id, err, leader)
+		}
+	}
+}
+
+func TestRaft_LeaderFailover(t *testing.T) {
+	c := newRaftCluster(t, 0, "n1", "n2", "n3")
+	old := c.leader("n1", "n2", "n3")
+	if err := c.write(old, createCmd("1")); err != nil {
+		t.Fatal(err)
+	}
+	oldTerm := c.node(old).Status().Term
+
+	var rest []string
+	for _, id := range c.ids {
+		if id != old {
+			rest = append(rest, id)
+		}
+	}
+	c.nw.Partition([]string{old}, rest)
+
+	// the isolated leader accepts a write it can never commit...
+	lost, err := c.propose(old, createCmd("lost"))
+	if err != nil {
+		t.Fatalf("propose on the isolated leader: %v", err)
+	}
+	// ...while the majority elects a new leader and keeps working
+	leader := c.leader(rest...)
+	if st := c.node(leader).Status(); st.Term <= oldTerm {
+		t.Errorf("new leader's term %d; want > %d", st.Term, oldTerm)
+	}
+	if err := c.write(leader, createCmd("2")); err != nil {
+		t.Fatalf("write on the new leader: %v", err)
+	}
+	c.tickUntil("the old leader to step down", func() bool { return c.node(old).Status().Role != raftLeader })
+
+	c.nw.Heal()
+	c.tickUntil("the lost proposal to be dropped", func() bool {
+		select {
+		case err := <-lost:
+			if !errors.Is(err, ErrProposalDropped) {
+				t.Errorf("lost proposal = %v; want ErrProposalDropped", err)
+			}
+			return true
+		default:
+			return false
+		}
+	})
+	c.converged(2, c.ids...)
+	if _, err := c.stores[old].Get(context.Background(), "lost"); err == nil {
+		t.Error("uncommitted write of the old leader survived")
+	}
+}
+
+func TestRaft_SnapshotCatchesUpLaggingFollower(t *testing.T) {
+	c := newRaftCluster(t, 5, "n1", "n2", "n3")
+	leader := c.leader("n1", "n2", "n3")
+	var lagging string
+	var others []string
+	for _, id := range c.ids {
+		if id != leader && lagging == "" {
+			lagging = id
+		} else {
+			others = append(others, id)
+		}
+	}
+	c.nw.Partition([]string{lagging}, others)
+
+	for i := range 12 {
+		if err := c.write(leader, createCmd(fmt.Sprint(i))); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	if st := c.node(leader).Status(); st.SnapshotIndex == 0 {
+		t.Fatalf("leader never compacted its log: %+v", st)
+	}
+
+	c.nw.Heal()
+	c.converged(12, c.ids...)
+	if st := c.node(lagging).Status(); st.SnapshotIndex == 0 {
+		t.Errorf("lagging follower caught up without a snapshot: %+v", st)
+	}
+}
+
+func TestRaft_StateSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft-n1.json")
+	start := func() (*raftCluster, *UserStore) {
+		c := &raftCluster{t: t, nw: NewMemNetwork(), ids: []string{"n1"}, stores: make(map[string]*UserStore)}
+		us, err := NewRaftStore(RaftConfig{ID: "n1", Peers: c.ids, Transport: c.nw, StatePath: path, SnapshotEvery: 3})
+		if err != nil {
+			t.Fatalf("NewRaftStore: %v", err)
+		}
+		c.stores["n1"] = us
+		c.nw.Add(us.raft)
+		return c, us
+	}
+
+	c, _ := start()
+	c.leader("n1")
+	for _, id := range []string{"1", "2", "3", "4"} {
+		if err := c.write("n1", createCmd(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	term := c.node("n1").Status().Term
+
+	c, us := start()
+	if st := us.raft.Status(); st.Term != term || st.SnapshotIndex == 0 {
+		t.Errorf("after restart: %+v; want term %d and a snapshot", st, term)
+	}
+	c.leader("n1")
+	c.converged(4, "n1")
+}
+
+// nopStateMachine applies nothing; the WAL tests only look at the log.
+type nopStateMachine struct{}
+
+func (nopStateMachine) Apply([]byte) error        { return nil }
+func (nopStateMachine) Snapshot() ([]byte, error) { return nil, nil }
+func (nopStateMachine) Restore([]byte) error      { return nil }
+
+// sentMessages is a RaftTransport that keeps what it is given.
+type sentMessages []RaftMessage
+
+func (s *sentMessages) Send(m RaftMessage) { *s = append(*s, m) }
+
+func TestRaft_WALAppendsAndReplays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft-n2.json")
+	start := func() (*RaftNode, *sentMessages) {
+		t.Helper()
+		sent := &sentMessages{}
+		n, err := NewRaftNode(RaftConfig{ID: "n2", Peers: []string{"n1", "n2"}, Transport: sent, StateMachine: nopStateMachine{}, StatePath: path})
+		if err != nil {
+			t.Fatalf("NewRaftNode: %v", err)
+		}
+		return n, sent
+	}
+	entry := func(i, term uint64) RaftEntry { return RaftEntry{Index: i, Term: term} }
+	logOf := func(n *RaftNode) []RaftEntry {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return slices.Clone(n.log[1:])
+	}
+
+	n, sent := start()
+	checkpoint, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("no checkpoint for a new node: %v", err)
+	}
+	n.Step(RaftMessage{Type: msgAppend, From: "n1", To: "n2", Term: 1,
+		Entries: []RaftEntry{entry(1, 1), entry(2, 1), entry(3, 1)}})
+	// a new leader overwrites entries 2 and 3
+	n.Step(RaftMessage{Type: msgAppend, From: "n1", To: "n2", Term: 2,
+		PrevIndex: 1, PrevTerm: 1, Entries: []RaftEntry{entry(2, 2)}})
+	if len(*sent) != 2 || !(*sent)[1].Success {
+		t.Fatalf("sent %+v; want two acks", *sent)
+	}
+	if data, _ := os.ReadFile(path); string(data) != string(checkpoint) {
+		t.Error("appends rewrote the checkpoint")
+	}
+	want := []RaftEntry{entry(1, 1), entry(2, 2)}
+
+	tests := []struct {
+		name string
+		tail string // appended to the WAL before the restart
+	}{
+		{"clean restart", ""},
+		{"torn last record", `{"gen":1,"term":3,"after":2,"entr`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wal := path + ".wal"
+			before, _ := os.Stat(wal)
+			if tt.tail != "" {
+				f, _ := os.OpenFile(wal, os.O_APPEND|os.O_WRONLY, 0)
+				f.WriteString(tt.tail)
+				f.Close()
+			}
+			n, _ := start()
+			if got := logOf(n); !slices.EqualFunc(got, want, func(a, b RaftEntry) bool { return a.Index == b.Index && a.Term == b.Term }) {
+				t.Errorf("log after restart = %v; want %v", got, want)
+			}
+			if st := n.Status(); st.Term != 2 {
+				t.Errorf("term after restart = %d; want 2", st.Term)
+			}
+			if after, _ := os.Stat(wal); after.Size() != before.Size() {
+				t.Errorf("WAL is %d bytes; want %d", after.Size(), before.Size())
+			}
+		})
+	}
+}
+
+func TestRaft_WritesOnFollowerOverHTTP(t *testing.T) {
+	c := newRaftCluster(t, 0, "n1", "n2", "n3")
+	leader := c.leader("n1", "n2", "n3")
+	follower := "n1"
+	if leader == follower {
+		follower = "n2"
+	}
+	s := &Server{store: c.stores[follower]}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(`{"id":"1","name":"Alice","age":30}`))
+	req.Header.Set("Content-Type", "application/json")
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" || !strings.Contains(rr.Body.String(), leader) {
+		t.Errorf("POST on follower = %d %s; want 503 naming leader %s", rr.Code, rr.Body, leader)
+	}
+}
+
+func TestRaft_CommitsInvalidateFollowerCache(t *testing.T) {
+	c := newRaftCluster(t, 0, "n1", "n2", "n3")
+	leader := c.leader("n1", "n2", "n3")
+	follower := "n1"
+	if leader == follower {
+		follower = "n2"
+	}
+	cfg := DefaultConfig()
+	cfg.CacheTTL = Duration{time.Minute}
+	s := &Server{store: c.stores[follower], config: &cfg}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	if err := c.write(leader, createCmd("1")); err != nil {
+		t.Fatal(err)
+	}
+	c.converged(1, follower)
+	cachedGet(h, "/users/1")
+	if got := cachedGet(h, "/users/1").Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("second GET X-Cache = %q; want HIT", got)
+	}
+
+	// the delete commits through the leader; the follower's handlers never see it
+	if err := c.write(leader, raftCommand{Op: "delete", User: User{ID: "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	c.converged(0, follower)
+	if rr := cachedGet(h, "/users/1"); rr.Code != http.StatusNotFound {
+		t.Errorf("GET after a committed delete = %d X-Cache=%q; want a fresh 404", rr.Code, rr.Header().Get("X-Cache"))
+	}
+}
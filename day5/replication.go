@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 23. Leader-Follower Replication
+//
+// WHY?
+// One instance is a single point of failure: when it restarts, nobody can
+// even read users. Followers keep a copy of the data and serve reads while
+// the leader is down (or just busy).
+//
+// HOW:
+// The leader's event log (see eventsource.go) is already an ordered list of
+// every mutation, so replication is "ship the log":
+//
+//	follower                                   leader (admin listener)
+//	GET /admin/replication/stream?since=41 -->
+//	                                       <-- {"event":{"seq":42,...},"leader_seq":42}
+//	                                       <-- {"leader_seq":42}      heartbeat
+//	                                       <-- {"event":{"seq":43,...},"leader_seq":43}
+//
+// The response never ends: after the backlog the leader waits for new
+// events and sends a heartbeat every replicationHeartbeat. The follower
+// appends each event to its OWN log with the leader's seq and applies it,
+// so after a reconnect (or a restart with -event-log) it asks for
+// since=<last applied seq> and continues exactly where it stopped.
+//
+// ASYNCHRONOUS: the leader answers a write before any follower has it, so a
+// follower may serve slightly old data. GET /admin/replication reports how
+// far behind it is (lag_events, last_contact).
+//
+// WRITES on a follower are forwarded to the leader's public address
+// (-follow-api) or, without one, rejected with 421 Misdirected Request.
+// Only the default store replicates; tenant stores stay per instance.
+//
+// The stream is an admin route, so followers authenticate with the
+// cluster's shared admin_token.
+
+// replicationHeartbeat is how often an idle stream proves it is alive. A
+// follower that hears nothing for 3 heartbeats reconnects.
+var replicationHeartbeat = time.Second
+
+// replicationFrame is one line of the stream. Heartbeats carry no event.
+type replicationFrame struct {
+	Event     *StoredEvent `json:"event,omitempty"`
+	LeaderSeq uint64       `json:"leader_seq"`
+}
+
+// ReplicationStatus is the body of GET /admin/replication.
+type ReplicationStatus struct {
+	Role        string     `json:"role"` // "leader" or "follower"
+	Leader      string     `json:"leader,omitempty"`
+	Connected   bool       `json:"connected"`
+	Followers   int64      `json:"followers"` // streams the leader is serving
+	AppliedSeq  uint64     `json:"applied_seq"`
+	LeaderSeq   uint64     `json:"leader_seq"`
+	LagEvents   uint64     `json:"lag_events"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+// Leader side
+
+// handleReplicationStream serves GET /admin/replication/stream?since=N.
+func (s *Server) handleReplicationStream(w http.ResponseWriter, r *http.Request) {
+	events := s.store.events
+	if events == nil {
+		writeProblem(w, http.StatusNotImplemented, ErrNoEventLog.Error())
+		return
+	}
+	var since uint64
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "since must be an event seq")
+			return
+		}
+		since = n
+	}
+	if last := events.LastSeq(); since > last {
+		// the follower has events this leader never wrote (e.g. it was
+		// replaced with an empty one); replaying on top would mix histories
+		writeProblem(w, http.StatusConflict, fmt.Sprintf("follower is at seq %d but the leader's log ends at %d", since, last))
+		return
+	}
+
+	s.followers.Add(1)
+	defer s.followers.Add(-1)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	send := func(f replicationFrame) error {
+		if err := enc.Encode(f); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+
+	// the first heartbeat tells the follower the leader's position at once
+	if send(replicationFrame{LeaderSeq: events.LastSeq()}) != nil {
+		return
+	}
+	for {
+		// take the channel BEFORE reading: an event added in between
+		// closes it, so the select below can't miss it
+		changed := events.notify()
+		for _, ev := range events.since(since) {
+			if send(replicationFrame{Event: &ev, LeaderSeq: events.LastSeq()}) != nil {
+				return
+			}
+			since = ev.Seq
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-changed:
+		case <-heartbeat.C:
+			if send(replicationFrame{LeaderSeq: events.LastSeq()}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleReplicationStatus serves GET /admin/replication.
+func (s *Server) handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	var st ReplicationStatus
+	if s.follower != nil {
+		st = s.follower.Status()
+	} else if s.store.events != nil {
+		seq := s.store.events.LastSeq()
+		st = ReplicationStatus{Role: "leader", Connected: true, AppliedSeq: seq, LeaderSeq: seq}
+	} else {
+		writeProblem(w, http.StatusNotImplemented, ErrNoEventLog.Error())
+		return
+	}
+	st.Followers = s.followers.Load()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// Follower side
+
+// Follower keeps a store in sync with a leader.
+type Follower struct {
+	store  *UserStore
+	leader string // leader admin URL, e.g. http://leader:6060
+	token  string
+	client *http.Client
+	proxy  *httputil.ReverseProxy // nil = reject writes
+
+	// onApply runs after each replicated event (the server drops cached
+	// responses there).
+	onApply func(StoredEvent)
+
+	connected   atomic.Bool
+	leaderSeq   atomic.Uint64
+	lastContact atomic.Int64 // unix nanoseconds
+}
+
+// NewFollower replicates leaderURL's log into store, which must have an
+// event log of its own. api is the leader's public URL that writes are
+// forwarded to ("" = reject them).
+func NewFollower(store *UserStore, leaderURL, api, token string) (*Follower, error) {
+	if store.events == nil {
+		return nil, ErrNoEventLog
+	}
+	if _, err := url.Parse(leaderURL); err != nil {
+		return nil, fmt.Errorf("leader url: %w", err)
+	}
+	f := &Follower{store: store, leader: leaderURL, token: token, client: &http.Client{}}
+	if api != "" {
+		target, err := url.Parse(api)
+		if err != nil {
+			return nil, fmt.Errorf("leader api url: %w", err)
+		}
+		f.proxy = httputil.NewSingleHostReverseProxy(target)
+	}
+	return f, nil
+}
+
+// Run streams from the leader until ctx is done, reconnecting with
+// exponential backoff (100ms .. 30s) whenever the stream breaks.
+func (f *Follower) Run(ctx context.Context) {
+	const minBackoff, maxBackoff = 100 * time.Millisecond, 30 * time.Second
+	backoff := minBackoff
+	for {
+		before := f.store.appliedSeq()
+		err := f.stream(ctx)
+		f.connected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		if f.store.appliedSeq() > before {
+			backoff = minBackoff // we made progress: the leader is fine
+		}
+		log.Printf("replication from %s: %v; reconnecting in %s", f.leader, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// stream runs one connection to the leader.
+func (f *Follower) stream(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	// a leader that vanished without closing the connection sends nothing
+	// at all; give up after 3 missed heartbeats
+	silence := time.AfterFunc(3*replicationHeartbeat, cancel)
+	defer silence.Stop()
+
+	u := fmt.Sprintf("%s/admin/replication/stream?since=%d", f.leader, f.store.appliedSeq())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("leader answered %s: %s", resp.Status, body)
+	}
+
+	f.connected.Store(true)
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var frame replicationFrame
+		if err := dec.Decode(&frame); err != nil {
+			if ctx.Err() != nil && parent.Err() == nil {
+				return fmt.Errorf("no heartbeat for %s", 3*replicationHeartbeat)
+			}
+			return err
+		}
+		silence.Reset(3 * replicationHeartbeat)
+		f.leaderSeq.Store(frame.LeaderSeq)
+		f.lastContact.Store(time.Now().UnixNano())
+		if frame.Event == nil {
+			continue
+		}
+		applied, err := f.store.replicate(*frame.Event)
+		if err != nil {
+			return err
+		}
+		if applied && f.onApply != nil {
+			f.onApply(*frame.Event)
+		}
+	}
+}
+
+// Status reports the follower's position relative to the leader.
+func (f *Follower) Status() ReplicationStatus {
+	st := ReplicationStatus{
+		Role:       "follower",
+		Leader:     f.leader,
+		Connected:  f.connected.Load(),
+		AppliedSeq: f.store.appliedSeq(),
+		LeaderSeq:  f.leaderSeq.Load(),
+	}
+	if st.LeaderSeq > st.AppliedSeq {
+		st.LagEvents = st.LeaderSeq - st.AppliedSeq
+	}
+	if ns := f.lastContact.Load(); ns != 0 {
+		t := time.Unix(0, ns).UTC()
+		st.LastContact = &t
+	}
+	return st
+}
+
+// FollowerWrites keeps a follower read-only: writes go to the leader (or
+// are rejected), everything else is served locally.
+func FollowerWrites(f *Follower) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			if f.proxy == nil {
+				writeProblem(w, http.StatusMisdirectedRequest, "this server is a read-only follower; send writes to the leader")
+				return
+			}
+			f.proxy.ServeHTTP(w, r)
+		})
+	}
+}
+
+// replicate applies an event received from the leader. Events the store
+// already has are skipped (a reconnect may resend them); a gap is an error.
+// Followers don't emit webhook events: the leader delivers those.
+func (us *UserStore) replicate(ev StoredEvent) (bool, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if ev.Seq <= us.applied {
+		return false, nil
+	}
+	if err := us.events.appendEvent(ev); err != nil {
+		return false, err
+	}
+	us.apply(ev)
+	return true, nil
+}
+
+// appliedSeq returns the seq of the last event in the projection.
+func (us *UserStore) appliedSeq() uint64 {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	return us.applied
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replicationCluster is a leader (public + admin listener) and helpers to
+// start followers against it, all in this process.
+type replicationCluster struct {
+	t      *testing.T
+	leader *Server
+	api    *httptest.Server
+	admin  *httptest.Server
+
+	mu     sync.Mutex
+	sinces []string // since= of every stream request the leader got
+}
+
+func newReplicationCluster(t *testing.T) *replicationCluster {
+	old := replicationHeartbeat
+	replicationHeartbeat = 50 * time.Millisecond
+	t.Cleanup(func() { replicationHeartbeat = old })
+
+	c := &replicationCluster{t: t}
+	store, _ := NewEventSourcedStore(NewEventLog(), "")
+	c.leader = &Server{store: store}
+	c.api = httptest.NewServer(c.leader.routes())
+	admin := c.leader.adminRoutes("")
+	c.admin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/replication/stream" {
+			c.mu.Lock()
+			c.sinces = append(c.sinces, r.URL.Query().Get("since"))
+			c.mu.Unlock()
+		}
+		admin.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		c.admin.CloseClientConnections()
+		c.admin.Close()
+		c.api.Close()
+		c.leader.stopCurrentLimiter(context.Background())
+	})
+	return c
+}
+
+// follow starts a follower of the leader; stop it with the returned func.
+func (c *replicationCluster) follow(store *UserStore, forward bool) (*Server, *Follower, func()) {
+	api := ""
+	if forward {
+		api = c.api.URL
+	}
+	f, err := NewFollower(store, c.admin.URL, api, "")
+	if err != nil {
+		c.t.Fatalf("NewFollower failed: %v", err)
+	}
+	s := &Server{store: store, follower: f}
+	s.routes()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() { defer close(done); f.Run(ctx) }()
+	stop := func() {
+		cancel()
+		<-done
+		s.stopCurrentLimiter(context.Background())
+	}
+	return s, f, stop
+}
+
+func TestReplication_FollowersCatchUpAndResume(t *testing.T) {
+	ctx := context.Background()
+	c := newReplicationCluster(t)
+	leader := c.leader.store
+	leader.Create(ctx, User{ID: "1", Name: "Alice", Age: 30})
+
+	store, _ := NewEventSourcedStore(NewEventLog(), "")
+	_, f, stop := c.follow(store, false)
+	other, _ := NewEventSourcedStore(NewEventLog(), "")
+	_, _, stopOther := c.follow(other, false)
+	defer stopOther()
+
+	// backlog first, then live events
+	leader.Create(ctx, User{ID: "2", Name: "Bob", Age: 25})
+	leader.Update(ctx, User{ID: "2", Name: "Bob", Age: 26})
+	for _, s := range []*UserStore{store, other} {
+		eventually(t, "followers to apply 3 events", func() bool { return s.appliedSeq() == 3 })
+	}
+	if u, err := store.Get(ctx, "2"); err != nil || u.Age != 26 {
+		t.Errorf("follower Get(2) = %+v, %v; want age 26", u, err)
+	}
+	eventually(t, "a heartbeat", func() bool { return f.Status().LagEvents == 0 && f.Status().LeaderSeq == 3 })
+	if st := f.Status(); !st.Connected || st.LastContact == nil {
+		t.Errorf("status = %+v; want connected with a last contact", st)
+	}
+
+	// the follower goes away, the leader moves on, the follower comes back
+	stop()
+	leader.Delete(ctx, "1")
+	leader.Create(ctx, User{ID: "3", Name: "Carol", Age: 40})
+	_, f, stop = c.follow(store, false)
+	defer stop()
+	eventually(t, "follower to resume", func() bool { return store.appliedSeq() == 5 })
+	if _, err := store.Get(ctx, "1"); err == nil {
+		t.Error("user deleted on the leader still on the follower")
+	}
+	// the follower's log mirrors the leader's, seq for seq
+	if got, want := store.events.since(0), leader.events.since(0); len(got) != len(want) || got[4].Time != want[4].Time {
+		t.Errorf("follower log has %d events; want the leader's %d", len(got), len(want))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !slices.Contains(c.sinces, "3") {
+		t.Errorf("stream requests asked for since=%v; want a resume from 3", c.sinces)
+	}
+}
+
+func TestReplication_FollowerWrites(t *testing.T) {
+	c := newReplicationCluster(t)
+
+	tests := []struct {
+		name       string
+		forward    bool
+		wantStatus int
+	}{
+		{"rejected without a leader api", false, http.StatusMisdirectedRequest},
+		{"forwarded to the leader", true, http.StatusCreated},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _ := NewEventSourcedStore(NewEventLog(), "")
+			s, _, stop := c.follow(store, tt.forward)
+			defer stop()
+			h := s.current.Load().handler
+
+			id := []string{"10", "11"}[i]
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(`{"id":"`+id+`","name":"Dave","age":50}`))
+			req.Header.Set("Content-Type", "application/json")
+			h.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("POST on follower = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+			if !tt.forward {
+				if _, err := c.leader.store.Get(context.Background(), id); err == nil {
+					t.Error("rejected write reached the leader")
+				}
+				return
+			}
+			// the write lands on the leader and comes back through the stream
+			eventually(t, "the forwarded write to replicate", func() bool {
+				_, err := store.Get(context.Background(), id)
+				return err == nil
+			})
+
+			// reads stay local
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/users/"+id, nil))
+			if rr.Code != http.StatusOK {
+				t.Errorf("GET on follower = %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestReplication_StreamErrors(t *testing.T) {
+	c := newReplicationCluster(t)
+	c.leader.store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+
+	plain := &Server{store: NewUserStore()}
+	tests := []struct {
+		name       string
+		server     *Server
+		query      string
+		wantStatus int
+	}{
+		{"leader without event log", plain, "", http.StatusNotImplemented},
+		{"bad since", c.leader, "?since=x", http.StatusBadRequest},
+		{"follower ahead of the leader", c.leader, "?since=7", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/admin/replication/stream"+tt.query, nil)
+			req.RemoteAddr = "127.0.0.1:50000" // admin routes are loopback-only without a token
+			tt.server.adminRoutes("").ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+		})
+	}
+
+	// a follower ahead of the leader keeps retrying and reports it
+	store, _ := NewEventSourcedStore(NewEventLog(), "")
+	for seq := uint64(1); seq <= 2; seq++ {
+		store.replicate(StoredEvent{Seq: seq, Type: EventUserCreated, UserID: "x", User: User{ID: "x", Name: "X", Age: 1}})
+	}
+	s, _, stop := c.follow(store, false)
+	defer stop()
+	time.Sleep(150 * time.Millisecond)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/replication", nil)
+	req.RemoteAddr = "127.0.0.1:50000"
+	s.adminRoutes("").ServeHTTP(rr, req)
+	var st ReplicationStatus
+	json.NewDecoder(rr.Body).Decode(&st)
+	if st.Role != "follower" || st.Connected || st.AppliedSeq != 2 {
+		t.Errorf("status = %+v; want a disconnected follower at seq 2", st)
+	}
+}
+
+func TestUserStore_ReplicateSkipsDuplicatesAndRejectsGaps(t *testing.T) {
+	store, _ := NewEventSourcedStore(NewEventLog(), "")
+	ev := func(seq uint64) StoredEvent {
+		return StoredEvent{Seq: seq, Type: EventUserCreated, UserID: "u", User: User{ID: "u", Name: "U", Age: int(seq)}}
+	}
+	tests := []struct {
+		name        string
+		ev          StoredEvent
+		wantApplied bool
+		wantErr     bool
+	}{
+		{"first", ev(1), true, false},
+		{"resent after a reconnect", ev(1), false, false},
+		{"next", ev(2), true, false},
+		{"gap", ev(4), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			applied, err := store.replicate(tt.ev)
+			if applied != tt.wantApplied || (err != nil) != tt.wantErr {
+				t.Errorf("replicate(seq %d) = %v, %v; want %v, err=%v", tt.ev.Seq, applied, err, tt.wantApplied, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// 19. Routing with Method and Path Patterns
+//
+// WHY?
+// handleUserByID used to slice r.URL.Path[len("/users/"):], so
+// /users/1/extra was looked up as user "1/extra", and every handler switched
+// on r.Method by hand and answered 405 without the Allow header HTTP
+// requires.
+//
+// Since Go 1.22 ServeMux patterns carry the method and named wildcards:
+//
+//	"GET /v1/users/{id}"  -> r.PathValue("id") == "1"
+//
+//   - {id} matches exactly one segment: /v1/users/1/extra is a 404
+//   - a path registered for other methods answers 405 with
+//     "Allow: DELETE, GET, HEAD, PUT" built by the mux itself
+//   - "GET" also matches HEAD
+//
+// VERSIONING:
+// Every endpoint lives under /v1. A /v2 is another []route registered next
+// to it with registerAPI(mux, "/v2", ...); both versions share handlers
+// wherever they agree. The unversioned paths (/users, ...) stay registered as
+// aliases of v1 so clients written before the prefix keep working.
+//
+// PER-ROUTE MIDDLEWARE:
+// The global chain (ApplyConfig) runs for every request; a route's own mw
+// runs only after the mux matched it, e.g. a body size limit on writes.
+
+// maxBodyBytes caps request bodies on routes that accept one.
+const maxBodyBytes = 1 << 20
+
+// route is one endpoint of an API version.
+type route struct {
+	method  string
+	path    string // without the version prefix, e.g. "/users/{id}"
+	handler http.HandlerFunc
+	mw      []Middleware // outermost first
+}
+
+// apiV1 lists the v1 endpoints.
+func (s *Server) apiV1() []route {
+	limitBody := MaxBodySize(maxBodyBytes)
+	return []route{
+		{method: "GET", path: "/users", handler: s.handleListUsers},
+		{method: "POST", path: "/users", handler: s.handleCreateUser, mw: []Middleware{limitBody}},
+		{method: "GET", path: "/users/search", handler: s.handleUserSearch},
+		{method: "GET", path: "/users/{id}", handler: s.handleGetUser},
+		{method: "PUT", path: "/users/{id}", handler: s.handleUpdateUser, mw: []Middleware{limitBody}},
+		{method: "DELETE", path: "/users/{id}", handler: s.handleDeleteUser},
+		{method: "GET", path: "/users/{id}/history", handler: s.handleUserHistory},
+
+		{method: "GET", path: "/webhooks", handler: s.handleListWebhooks},
+		{method: "POST", path: "/webhooks", handler: s.handleCreateWebhook, mw: []Middleware{limitBody}},
+		{method: "DELETE", path: "/webhooks/{id}", handler: s.handleDeleteWebhook},
+		{method: "GET", path: "/webhooks/dead-letters", handler: s.handleDeadLetters},
+		{method: "POST", path: "/webhooks/dead-letters/{id}/redeliver", handler: s.handleRedeliver},
+	}
+}
+
+// registerAPI adds routes to mux under version ("/v1", or "" for the
+// unversioned aliases), each wrapped in its own middleware.
+func registerAPI(mux *http.ServeMux, version string, routes []route) {
+	for _, rt := range routes {
+		var h http.Handler = rt.handler
+		for i := len(rt.mw) - 1; i >= 0; i-- {
+			h = rt.mw[i](h)
+		}
+		mux.Handle(rt.method+" "+version+rt.path, h)
+	}
+}
+
+// apiVersions are the path prefixes registered by routes().
+var apiVersions = []string{"/v1"}
+
+// unversioned strips the API version prefix: /v1/users/1 -> /users/1.
+// Cache keys and route timeouts use it so every version (and the
+// unversioned alias) shares them.
+func unversioned(path string) string {
+	for _, v := range apiVersions {
+		if rest, ok := strings.CutPrefix(path, v); ok && (rest == "" || rest[0] == '/') {
+			return rest
+		}
+	}
+	return path
+}
+
+// routeKey turns a matched mux pattern into the key of Config.RouteTimeouts:
+// "GET /v1/users/{id}" -> "/users/{id}".
+func routeKey(pattern string) string {
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	return unversioned(pattern)
+}
+
+// MaxBodySize rejects request bodies larger than n bytes. Reads past the
+// limit fail with *http.MaxBytesError (see bodyErrorStatus).
+func MaxBodySize(n int64) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bodyErrorStatus maps a decodeBody error to its status code.
+func bodyErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRoutedServer(t *testing.T) (*Server, http.Handler) {
+	t.Helper()
+	s := &Server{store: NewUserStore()}
+	h := s.routes()
+	t.Cleanup(func() { s.stopCurrentLimiter(context.Background()) })
+	s.store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+	return s, h
+}
+
+func TestRoutes_StatusAndAllow(t *testing.T) {
+	_, h := newRoutedServer(t)
+
+	tests := []struct {
+		method, target string
+		wantCode       int
+		wantAllow      string
+	}{
+		{http.MethodGet, "/v1/users/1", http.StatusOK, ""},
+		{http.MethodGet, "/users/1", http.StatusOK, ""},
+		{http.MethodGet, "/v1/users/1/extra", http.StatusNotFound, ""},
+		{http.MethodGet, "/users/1/extra", http.StatusNotFound, ""},
+		{http.MethodGet, "/v2/users/1", http.StatusNotFound, ""},
+		{http.MethodPatch, "/v1/users/1", http.StatusMethodNotAllowed, "DELETE, GET, HEAD, PUT"},
+		{http.MethodPatch, "/users", http.StatusMethodNotAllowed, "GET, HEAD, POST"},
+		{http.MethodPost, "/healthz", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodGet, "/v1/webhooks/dead-letters/x/redeliver", http.StatusMethodNotAllowed, "POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.target, nil))
+			if rr.Code != tt.wantCode {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantCode)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q; want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestRoutes_VersionAndAliasShareState(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CacheTTL = Duration{time.Minute}
+	s := &Server{store: NewUserStore(), config: &cfg}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(`{"id":"2","name":"Bob","age":40}`)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("POST /v1/users = %d; want 201", rr.Code)
+	}
+	if rr := cachedGet(h, "/users/2"); rr.Code != http.StatusOK || rr.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("GET /users/2 = %d %s; want 200 MISS", rr.Code, rr.Header().Get("X-Cache"))
+	}
+	// the alias filled the cache entry the versioned path reads...
+	if got := cachedGet(h, "/v1/users/2").Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("GET /v1/users/2 X-Cache = %q; want HIT", got)
+	}
+	// ...and a delete through one path invalidates both
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/users/2", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /users/2 = %d; want 204", rr.Code)
+	}
+	if rr := cachedGet(h, "/v1/users/2"); rr.Code != http.StatusNotFound {
+		t.Errorf("GET /v1/users/2 after delete = %d; want 404", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/v1/users/2", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("second DELETE /v1/users/2 = %d; want 404", rr.Code)
+	}
+}
+
+func TestRoutes_BodyLimit(t *testing.T) {
+	_, h := newRoutedServer(t)
+
+	body := `{"id":"2","name":"` + strings.Repeat("x", maxBodyBytes) + `","age":40}`
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(body)))
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized POST = %d; want 413", rr.Code)
+	}
+}
+
+func TestRouteKey(t *testing.T) {
+	tests := map[string]string{
+		"GET /v1/users/{id}":   "/users/{id}",
+		"POST /users":          "/users",
+		"GET /healthz":         "/healthz",
+		"/stream":              "/stream",
+		"GET /v1":              "",
+		"GET /v1beta/users":    "/v1beta/users",
+		"GET /v1/users/search": "/users/search",
+	}
+	for pattern, want := range tests {
+		if got := routeKey(pattern); got != want {
+			t.Errorf("routeKey(%q) = %q; want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestServer_RouteTimeoutsApplyToEveryVersion(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	cfg := DefaultConfig()
+	cfg.RouteTimeouts = map[string]Duration{"/users/{id}": {5 * time.Second}}
+	policy := s.timeoutPolicy(cfg)
+	for _, target := range []string{"/users/1", "/v1/users/1"} {
+		if got := policy(httptest.NewRequest(http.MethodGet, target, nil)); got != 5*time.Second {
+			t.Errorf("timeout for %s = %v; want 5s", target, got)
+		}
+	}
+	if got := policy(httptest.NewRequest(http.MethodGet, "/v1/users", nil)); got != DefaultConfig().RequestTimeout.Duration {
+		t.Errorf("timeout for /v1/users = %v; want the default", got)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 7. Fuzzy Name Search (trigram index)
+//
+// HOW IT WORKS:
+// A name is split into overlapping 3-letter pieces ("trigrams"):
+//   "alice" -> "  a", " al", "ali", "lic", "ice", "ce "
+// The padding spaces make the start and end of the name count too.
+// Two spellings that share most trigrams are probably the same name, so a
+// typo ("alcie") or a fragment ("ali") still finds "Alice".
+//
+// The store keeps gram -> set of user IDs, updated in indexUser/unindexUser
+// under the store's write lock, so Search never sees half a Create/Delete.
+
+// minSearchScore is the fraction of query trigrams a name must share to match.
+const minSearchScore = 0.3
+
+// SearchResult is one ranked hit returned by UserStore.Search.
+type SearchResult struct {
+	User      User    `json:"user" xml:"user"`
+	Score     float64 `json:"score" xml:"score"`
+	Highlight string  `json:"highlight" xml:"highlight"` // HTML: the escaped name with matched parts wrapped in <em></em>
+}
+
+// gramRunes lower-cases a name rune by rune so positions still line up with
+// the original name when we build highlights.
+func gramRunes(name string) []rune {
+	runes := []rune(strings.TrimSpace(name))
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// trigrams returns the distinct trigrams of name mapped to the padded
+// positions where they start.
+func trigrams(name string) map[string][]int {
+	padded := append([]rune("  "), gramRunes(name)...)
+	padded = append(padded, ' ')
+	grams := make(map[string][]int)
+	for i := 0; i+3 <= len(padded); i++ {
+		g := string(padded[i : i+3])
+		grams[g] = append(grams[g], i)
+	}
+	return grams
+}
+
+// indexGrams / unindexGrams must be called with us.mu held for writing.
+func (us *UserStore) indexGrams(u User) {
+	if us.byGram == nil {
+		us.byGram = make(map[string]map[string]struct{})
+	}
+	for g := range trigrams(u.Name) {
+		ids, ok := us.byGram[g]
+		if !ok {
+			ids = make(map[string]struct{})
+			us.byGram[g] = ids
+		}
+		ids[u.ID] = struct{}{}
+	}
+}
+
+func (us *UserStore) unindexGrams(u User) {
+	for g := range trigrams(u.Name) {
+		ids := us.byGram[g]
+		delete(ids, u.ID)
+		if len(ids) == 0 {
+			delete(us.byGram, g)
+		}
+	}
+}
+
+// Search returns up to limit users whose names resemble q, best match first.
+//
+// Score = shared trigrams / query trigrams, so a short fragment of a long
+// name still scores well. Ties are broken by the Jaccard similarity (closer
+// overall length wins) and then by name.
+func (us *UserStore) Search(ctx context.Context, q string, limit int) (_ []SearchResult, err error) {
+	_, span := StartSpan(ctx, "UserStore.Search")
+	defer func() { span.SetError(err); span.End() }()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	qGrams := trigrams(q)
+	if len(gramRunes(q)) == 0 {
+		return []SearchResult{}, nil
+	}
+	if us.shards != nil {
+		return us.shards.Search(ctx, q, limit)
+	}
+
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+
+	shared := make(map[string]int)
+	for g := range qGrams {
+		for id := range us.byGram[g] {
+			shared[id]++
+		}
+	}
+
+	type hit struct {
+		result  SearchResult
+		jaccard float64
+	}
+	hits := []hit{}
+	for id, n := range shared {
+		score := float64(n) / float64(len(qGrams))
+		if score < minSearchScore {
+			continue
+		}
+		u := us.users[id]
+		uGrams := trigrams(u.Name)
+		hits = append(hits, hit{
+			result: SearchResult{
+				User:      u,
+				Score:     score,
+				Highlight: highlight(u.Name, uGrams, qGrams),
+			},
+			jaccard: float64(n) / float64(len(qGrams)+len(uGrams)-n),
+		})
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		a, b := hits[i], hits[j]
+		if a.result.Score != b.result.Score {
+			return a.result.Score > b.result.Score
+		}
+		if a.jaccard != b.jaccard {
+			return a.jaccard > b.jaccard
+		}
+		return a.result.User.Name < b.result.User.Name
+	})
+
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	results := make([]SearchResult, len(hits))
+	for i, h := range hits {
+		results[i] = h.result
+	}
+	return results, nil
+}
+
+// highlight wraps every part of name covered by a trigram shared with the
+// query in <em></em>, and HTML-escapes the rest.
+func highlight(name string, nameGrams, qGrams map[string][]int) string {
+	runes := []rune(strings.TrimSpace(name))
+	marked := make([]bool, len(runes))
+	for g, positions := range nameGrams {
+		if _, ok := qGrams[g]; !ok {
+			continue
+		}
+		for _, p := range positions {
+			// padded position p covers name runes p-2 .. p
+			for i := p - 2; i <= p; i++ {
+				if i >= 0 && i < len(runes) && !unicode.IsSpace(runes[i]) {
+					marked[i] = true
+				}
+			}
+		}
+	}
+
+	// The result is HTML, so the name's own text is escaped: a user named
+	// "<script>" must not become markup in whatever renders the highlight.
+	var b strings.Builder
+	for start := 0; start < len(runes); {
+		end := start + 1
+		for end < len(runes) && marked[end] == marked[start] {
+			end++
+		}
+		text := html.EscapeString(string(runes[start:end]))
+		if marked[start] {
+			text = "<em>" + text + "</em>"
+		}
+		b.WriteString(text)
+		start = end
+	}
+	return b.String()
+}
+
+// handleUserSearch serves GET /users/search?q=<text>&limit=<n>
+func (s *Server) handleUserSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		http.Error(w, "q required", http.StatusBadRequest)
+		return
+	}
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	results, err := s.storeFor(r).Search(r.Context(), q, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestTimeout)
+		return
+	}
+	respond(w, r, http.StatusOK, results)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestUserStore_Search(t *testing.T) {
+	store := NewUserStore()
+	for _, u := range []User{
+		{ID: "1", Name: "Alice Smith", Age: 30},
+		{ID: "2", Name: "Alicia Keys", Age: 40},
+		{ID: "3", Name: "Bob Stone", Age: 25},
+	} {
+		store.Create(context.Background(), u)
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		wantFirst string
+	}{
+		{"exact fragment", "alice", "1"},
+		{"typo", "alcie smith", "1"},
+		{"other name", "alicia", "2"},
+		{"case-insensitive", "BOB", "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := store.Search(context.Background(), tt.query, 10)
+			if err != nil {
+				t.Fatalf("Search failed: %v", err)
+			}
+			if len(results) == 0 {
+				t.Fatalf("Search(%q) returned no results", tt.query)
+			}
+			if results[0].User.ID != tt.wantFirst {
+				t.Errorf("Search(%q) top hit = %s; want %s", tt.query, results[0].User.ID, tt.wantFirst)
+			}
+			for i := 1; i < len(results); i++ {
+				if results[i].Score > results[i-1].Score {
+					t.Errorf("results not sorted by score: %v", results)
+				}
+			}
+		})
+	}
+
+	if results, _ := store.Search(context.Background(), "zzzz", 10); len(results) != 0 {
+		t.Errorf("expected no results for unrelated query, got %v", results)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		name, query, want string
+	}{
+		{"Alice", "ali", "<em>Ali</em>ce"},
+		{"Tom & Jerry", "jerry", "Tom &amp; <em>Jerry</em>"},
+		{"<script>alert(1)</script>", "script", "&lt;<em>script</em>&gt;alert(1)&lt;/<em>script</em>&gt;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewUserStore()
+			store.Create(context.Background(), User{ID: "1", Name: tt.name, Age: 30})
+			results, _ := store.Search(context.Background(), tt.query, 1)
+			if len(results) != 1 {
+				t.Fatalf("expected 1 result, got %d", len(results))
+			}
+			if got := results[0].Highlight; got != tt.want {
+				t.Errorf("highlight = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserStore_SearchConcurrentWrites(t *testing.T) {
+	store := NewUserStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprint(i)
+			store.Create(context.Background(), User{ID: id, Name: "Searchable " + id, Age: 20})
+			store.Delete(context.Background(), id)
+		}(i)
+		go func() {
+			defer wg.Done()
+			store.Search(context.Background(), "searchable", 5)
+		}()
+	}
+	wg.Wait()
+
+	if n := len(store.byGram); n != 0 {
+		t.Errorf("trigram index should be empty after all deletes, has %d grams", n)
+	}
+}
+
+func TestHandleUserSearch(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	s.store.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+	h := s.routes()
+
+	req := httptest.NewRequest(http.MethodGet, "/users/search?q=alise", nil)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	var results []SearchResult
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(results) != 1 || results[0].User.ID != "1" {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/users/search", nil)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without q, got %d", rr.Code)
+	}
+}
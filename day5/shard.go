@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 25. Sharding with a Consistent-Hash Ring
+//
+// WHY?
+// All users live in one map behind one RWMutex: every write waits for every
+// other write, and one map has to fit everything. Splitting the users over
+// N partitions (shards), each a UserStore with its own lock and indexes,
+// lets writes to different shards run in parallel.
+//
+// WHICH SHARD?
+// hash(id) % N would move almost every user when N changes. A consistent-
+// hash RING places each shard at many pseudo-random points (virtual nodes)
+// on a circle of uint64 hashes; a user belongs to the first shard point
+// clockwise from hash(id):
+//
+//	   shard-a#7      user 42
+//	 ----|--------------x--------|---------------|---->  (wraps around)
+//	                          shard-b#3       shard-a#90
+//	                          owns user 42
+//
+// Adding shard-c only claims the arcs in front of its new points, so only
+// ~1/N of the users move - and only TO the new shard. Virtual nodes (128
+// per shard) even out the arc lengths.
+//
+// ONLINE REBALANCING:
+// AddShard/RemoveShard switch to the new ring at once and keep the old one
+// until every user sits on its new owner. Meanwhile:
+//
+//   - writes go to the new owner; Create also checks the old owner
+//   - reads look at the old owner first, then the new one: a move copies
+//     to the new shard before deleting from the old, so the user is always
+//     found in one of them
+//   - a per-ID lock makes a write and the move of that ID take turns
+//   - List/Search don't run during a single move (s.moving)
+//
+// Moves don't emit webhook events: nobody created or deleted the user.
+//
+// With -shards N the server's store delegates Create/Get/List/Update/
+// Delete/Search to a ShardedStore (like it delegates writes to Raft).
+
+// defaultVirtualNodes is the number of ring points per shard.
+const defaultVirtualNodes = 128
+
+// HashRing maps keys to shards. It is immutable: with/without return a
+// new ring, so readers never see one half-changed.
+type HashRing struct {
+	vnodes int
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash  uint64
+	shard string
+}
+
+// NewHashRing returns a ring with vnodes points per shard.
+func NewHashRing(vnodes int, shards ...string) *HashRing {
+	r := &HashRing{vnodes: vnodes}
+	for _, s := range shards {
+		r = r.with(s)
+	}
+	return r
+}
+
+// ringHash is FNV-1a with a final mix: FNV alone clusters similar strings
+// like "shard-1#7" and "shard-1#8" on the ring.
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (r *HashRing) with(shard string) *HashRing {
+	next := &HashRing{vnodes: r.vnodes, points: append([]ringPoint(nil), r.points...)}
+	for i := 0; i < r.vnodes; i++ {
+		next.points = append(next.points, ringPoint{hash: ringHash(shard + "#" + strconv.Itoa(i)), shard: shard})
+	}
+	sort.Slice(next.points, func(i, j int) bool { return next.points[i].hash < next.points[j].hash })
+	return next
+}
+
+func (r *HashRing) without(shard string) *HashRing {
+	next := &HashRing{vnodes: r.vnodes}
+	for _, p := range r.points {
+		if p.shard != shard {
+			next.points = append(next.points, p)
+		}
+	}
+	return next
+}
+
+// Owner returns the shard key belongs to ("" for an empty ring).
+func (r *HashRing) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0 // past the last point: wrap around to the first
+	}
+	return r.points[i].shard
+}
+
+// ShardedStore spreads users over UserStores by consistent hashing.
+type ShardedStore struct {
+	mu     sync.RWMutex // guards ring, old and shards; held (R) by every operation
+	ring   *HashRing
+	old    *HashRing // the ring before a rebalance that is still moving users
+	shards map[string]*UserStore
+
+	rebalancing sync.Mutex      // one AddShard/RemoveShard at a time
+	moving      sync.RWMutex    // held by a single move; List/Search hold R
+	keyLocks    [256]sync.Mutex // a write and the move of the same ID take turns
+	onEvent     func(UserEvent) // handed to every shard (see webhook.go)
+}
+
+// ShardInfo describes one shard (GET /admin/shards).
+type ShardInfo struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+}
+
+// NewShardedStore creates a store with the named shards.
+func NewShardedStore(names ...string) *ShardedStore {
+	s := &ShardedStore{ring: NewHashRing(defaultVirtualNodes, names...), shards: make(map[string]*UserStore)}
+	for _, name := range names {
+		s.shards[name] = NewUserStore()
+	}
+	return s
+}
+
+// NewShardedUserStore returns a UserStore that delegates to n shards named
+// shard-0 ... shard-<n-1>.
+func NewShardedUserStore(n int) *UserStore {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = "shard-" + strconv.Itoa(i)
+	}
+	us := NewUserStore()
+	us.shards = NewShardedStore(names...)
+	return us
+}
+
+func (s *ShardedStore) keyLock(id string) *sync.Mutex {
+	return &s.keyLocks[ringHash(id)%uint64(len(s.keyLocks))]
+}
+
+// owners returns the shard id belongs to and, during a rebalance, the shard
+// it belonged to before (nil when that's the same). Called with s.mu held.
+func (s *ShardedStore) owners(id string) (cur, prev *UserStore) {
+	cur = s.shards[s.ring.Owner(id)]
+	if s.old != nil {
+		if p := s.shards[s.old.Owner(id)]; p != cur {
+			prev = p
+		}
+	}
+	return cur, prev
+}
+
+// OnEvent registers fn on every shard, current and future.
+func (s *ShardedStore) OnEvent(fn func(UserEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onEvent = fn
+	for _, shard := range s.shards {
+		shard.OnEvent(fn)
+	}
+}
+
+func (s *ShardedStore) Create(ctx context.Context, u User) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l := s.keyLock(u.ID)
+	l.Lock()
+	defer l.Unlock()
+
+	cur, prev := s.owners(u.ID)
+	if prev != nil {
+		if _, err := prev.Get(ctx, u.ID); err == nil {
+			return fmt.Errorf("User ID already Exists!")
+		}
+	}
+	return cur.Create(ctx, u)
+}
+
+func (s *ShardedStore) Get(ctx context.Context, id string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cur, prev := s.owners(id)
+	if prev != nil {
+		// old owner first: a move adds to cur before it removes from prev
+		if u, err := prev.Get(ctx, id); err == nil {
+			return u, nil
+		}
+	}
+	return cur.Get(ctx, id)
+}
+
+func (s *ShardedStore) Update(ctx context.Context, u User) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l := s.keyLock(u.ID)
+	l.Lock()
+	defer l.Unlock()
+
+	cur, prev := s.owners(u.ID)
+	if prev != nil {
+		if _, err := prev.Get(ctx, u.ID); err == nil {
+			return prev.Update(ctx, u) // not moved yet; the move takes the new version
+		}
+	}
+	return cur.Update(ctx, u)
+}
+
+func (s *ShardedStore) Delete(ctx context.Context, id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l := s.keyLock(id)
+	l.Lock()
+	defer l.Unlock()
+
+	cur, prev := s.owners(id)
+	if prev != nil {
+		if _, err := prev.Get(ctx, id); err == nil {
+			return prev.Delete(ctx, id)
+		}
+	}
+	return cur.Delete(ctx, id)
+}
+
+// gather runs fn on every shard in parallel and returns the results in
+// shard-name order.
+func gather[T any](ctx context.Context, s *ShardedStore, fn func(context.Context, *UserStore) ([]T, error)) ([]T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.moving.RLock()
+	defer s.moving.RUnlock()
+
+	names := make([]string, 0, len(s.shards))
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	results := make([][]T, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = fn(ctx, s.shards[name])
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	var all []T
+	for _, r := range results {
+		all = append(all, r...)
+	}
+	return all, nil
+}
+
+// List scatters the query to every shard and merges the answers by ID.
+func (s *ShardedStore) List(ctx context.Context, filters ...Predicate) ([]User, error) {
+	users, err := gather(ctx, s, func(ctx context.Context, shard *UserStore) ([]User, error) {
+		return shard.List(ctx, filters...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if users == nil {
+		users = []User{}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// Search asks every shard for its best limit matches and keeps the best
+// limit overall (ties by name).
+func (s *ShardedStore) Search(ctx context.Context, q string, limit int) ([]SearchResult, error) {
+	results, err := gather(ctx, s, func(ctx context.Context, shard *UserStore) ([]SearchResult, error) {
+		return shard.Search(ctx, q, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if results == nil {
+		results = []SearchResult{}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].User.Name < results[j].User.Name
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// Shards lists the shards and their sizes.
+func (s *ShardedStore) Shards() []ShardInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]ShardInfo, 0, len(s.shards))
+	for name, shard := range s.shards {
+		shard.mu.RLock()
+		infos = append(infos, ShardInfo{Name: name, Users: len(shard.users)})
+		shard.mu.RUnlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Stats adds up the shards' sizes. Each shard indexes its own users, so
+// a trigram found in two shards counts twice.
+func (s *ShardedStore) Stats() StoreStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var total StoreStats
+	for _, shard := range s.shards {
+		st := shard.Stats()
+		total.Users += st.Users
+		total.AgeIndexEntries += st.AgeIndexEntries
+		total.NameIndexEntries += st.NameIndexEntries
+		total.Trigrams += st.Trigrams
+	}
+	return total
+}
+
+// Rebalancing
+
+// AddShard adds an empty shard and moves the users it now owns into it.
+// It returns the number of users moved.
+func (s *ShardedStore) AddShard(ctx context.Context, name string) (int, error) {
+	s.rebalancing.Lock()
+	defer s.rebalancing.Unlock()
+	if _, err := s.migrate(ctx); err != nil { // an earlier, interrupted rebalance
+		return 0, err
+	}
+
+	s.mu.Lock()
+	if _, exists := s.shards[name]; exists {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("shard %q already exists", name)
+	}
+	shard := NewUserStore()
+	if s.onEvent != nil {
+		shard.OnEvent(s.onEvent)
+	}
+	s.shards[name] = shard
+	s.old, s.ring = s.ring, s.ring.with(name)
+	s.mu.Unlock()
+	return s.migrate(ctx)
+}
+
+// RemoveShard moves a shard's users to the remaining shards and drops it.
+func (s *ShardedStore) RemoveShard(ctx context.Context, name string) (int, error) {
+	s.rebalancing.Lock()
+	defer s.rebalancing.Unlock()
+	if _, err := s.migrate(ctx); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	if _, exists := s.shards[name]; !exists {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("%w: shard %q", ErrShardNotFound, name)
+	}
+	if len(s.shards) == 1 {
+		s.mu.Unlock()
+		return 0, errors.New("can't remove the last shard")
+	}
+	s.old, s.ring = s.ring, s.ring.without(name)
+	s.mu.Unlock()
+
+	moved, err := s.migrate(ctx)
+	if err != nil {
+		return moved, err
+	}
+	s.mu.Lock()
+	delete(s.shards, name)
+	s.mu.Unlock()
+	return moved, nil
+}
+
+// ErrShardNotFound is returned for unknown shard names.
+var ErrShardNotFound = errors.New("no such shard")
+
+// migrate moves every user not on its owner under the current ring, then
+// retires the old ring. If ctx ends first the old ring stays, so reads
+// still find everything; the next rebalance finishes the job.
+func (s *ShardedStore) migrate(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	if s.old == nil {
+		s.mu.RUnlock()
+		return 0, nil
+	}
+	shards := make(map[string]*UserStore, len(s.shards))
+	for name, shard := range s.shards {
+		shards[name] = shard
+	}
+	s.mu.RUnlock()
+
+	moved := 0
+	for name, shard := range shards {
+		shard.mu.RLock()
+		ids := make([]string, 0, len(shard.users))
+		for id := range shard.users {
+			ids = append(ids, id)
+		}
+		shard.mu.RUnlock()
+
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return moved, err
+			}
+			s.mu.RLock()
+			to := s.ring.Owner(id)
+			s.mu.RUnlock()
+			if to != name && s.move(id, shard, shards[to]) {
+				moved++
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.old = nil
+	s.mu.Unlock()
+	return moved, nil
+}
+
+// move transfers one user between shards; false if it was deleted meanwhile.
+func (s *ShardedStore) move(id string, from, to *UserStore) bool {
+	l := s.keyLock(id)
+	l.Lock()
+	defer l.Unlock()
+	s.moving.Lock()
+	defer s.moving.Unlock()
+
+	from.mu.RLock()
+	u, ok := from.users[id]
+	from.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	to.put(u) // copy first, then delete: readers check from before to
+	from.take(id)
+	return true
+}
+
+// put stores u without emitting an event (see move).
+func (us *UserStore) put(u User) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if old, exists := us.users[u.ID]; exists {
+		us.unindexUser(old)
+	}
+	us.users[u.ID] = u
+	us.indexUser(u)
+}
+
+// take removes a user without emitting an event (see move).
+func (us *UserStore) take(id string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if u, exists := us.users[id]; exists {
+		us.unindexUser(u)
+		delete(us.users, id)
+	}
+}
+
+// HTTP handlers (admin listener)
+
+// handleListShards serves GET /admin/shards.
+func (s *Server) handleListShards(w http.ResponseWriter, r *http.Request) {
+	if s.store.shards == nil {
+		writeProblem(w, http.StatusNotImplemented, "the store is not sharded (start the server with -shards N)")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.store.shards.Shards())
+}
+
+// handleAddShard serves POST /admin/shards {"name": "shard-4"}.
+func (s *Server) handleAddShard(w http.ResponseWriter, r *http.Request) {
+	if s.store.shards == nil {
+		writeProblem(w, http.StatusNotImplemented, "the store is not sharded (start the server with -shards N)")
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+		writeProblem(w, http.StatusBadRequest, `body must be {"name": "<shard>"}`)
+		return
+	}
+	moved, err := s.store.shards.AddShard(r.Context(), req.Name)
+	if err != nil {
+		writeProblem(w, http.StatusConflict, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]int{"moved": moved})
+}
+
+// handleRemoveShard serves DELETE /admin/shards/{name}.
+func (s *Server) handleRemoveShard(w http.ResponseWriter, r *http.Request) {
+	if s.store.shards == nil {
+		writeProblem(w, http.StatusNotImplemented, "the store is not sharded (start the server with -shards N)")
+		return
+	}
+	moved, err := s.store.shards.RemoveShard(r.Context(), r.PathValue("name"))
+	if err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, ErrShardNotFound) {
+			status = http.StatusNotFound
+		}
+		writeProblem(w, status, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"moved": moved})
+}
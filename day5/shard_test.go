@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHashRing_SpreadsKeysEvenly(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards []string
+	}{
+		{"two shards", []string{"a", "b"}},
+		{"four shards", []string{"a", "b", "c", "d"}},
+		{"eight shards", []string{"a", "b", "c", "d", "e", "f", "g", "h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewHashRing(defaultVirtualNodes, tt.shards...)
+			counts := make(map[string]int)
+			const keys = 20000
+			for i := range keys {
+				counts[ring.Owner(fmt.Sprint(i))]++
+			}
+			want := float64(keys) / float64(len(tt.shards))
+			for _, s := range tt.shards {
+				if dev := math.Abs(float64(counts[s])-want) / want; dev > 0.25 {
+					t.Errorf("shard %s owns %d keys; want %.0f +-25%%", s, counts[s], want)
+				}
+			}
+		})
+	}
+}
+
+func TestHashRing_AddingAShardOnlyMovesKeysToIt(t *testing.T) {
+	before := NewHashRing(defaultVirtualNodes, "a", "b", "c")
+	after := before.with("d")
+	const keys = 10000
+	moved := 0
+	for i := range keys {
+		k := fmt.Sprint(i)
+		if from, to := before.Owner(k), after.Owner(k); from != to {
+			moved++
+			if to != "d" {
+				t.Fatalf("key %s moved %s -> %s; only moves to the new shard are allowed", k, from, to)
+			}
+		}
+	}
+	// ~1/4 of the keys belong to the fourth shard
+	if moved < keys/6 || moved > keys/3 {
+		t.Errorf("%d of %d keys moved; want about %d", moved, keys, keys/4)
+	}
+	if back := after.without("d"); back.Owner("42") != before.Owner("42") {
+		t.Error("removing the shard again didn't restore the old owners")
+	}
+}
+
+func TestShardedStore_AddAndRemoveShardOnline(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedStore("shard-0", "shard-1", "shard-2")
+	const users = 600
+	for i := range users {
+		if err := s.Create(ctx, User{ID: fmt.Sprint(i), Name: fmt.Sprint("User ", i), Age: 20 + i%50}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// writers keep going while the shards change underneath them
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	for w := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := fmt.Sprint(i % users)
+				var err error
+				if w%2 == 0 {
+					_, err = s.Get(ctx, id)
+				} else {
+					err = s.Update(ctx, User{ID: id, Name: fmt.Sprint("User ", id), Age: 99})
+				}
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("worker %d on %s: %w", w, id, err):
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	moved, err := s.AddShard(ctx, "shard-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved < users/6 || moved > users/3 {
+		t.Errorf("AddShard moved %d of %d users; want about %d", moved, users, users/4)
+	}
+	if _, err := s.RemoveShard(ctx, "shard-0"); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		t.Fatalf("user went missing during the rebalance: %v", err)
+	default:
+	}
+
+	total := 0
+	for _, info := range s.Shards() {
+		if info.Name == "shard-0" {
+			t.Error("removed shard still listed")
+		}
+		total += info.Users
+	}
+	if total != users {
+		t.Errorf("shards hold %d users; want %d", total, users)
+	}
+	// every user sits on its owner (so Get no longer needs the old ring)
+	for name, shard := range s.shards {
+		shard.mu.RLock()
+		for id := range shard.users {
+			if owner := s.ring.Owner(id); owner != name {
+				t.Errorf("user %s on %s; owner is %s", id, name, owner)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+func TestShardedUserStore_ScatterGather(t *testing.T) {
+	ctx := context.Background()
+	us := NewShardedUserStore(4)
+	names := []string{"Alice", "Alicia", "Bob", "Carol", "Dave", "Alina", "Eve", "Mallory"}
+	for i, name := range names {
+		if err := us.Create(ctx, User{ID: fmt.Sprintf("u%02d", i), Name: name, Age: 20 + i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := us.Create(ctx, User{ID: "u00", Name: "Dup", Age: 1}); err == nil {
+		t.Error("duplicate ID accepted")
+	}
+
+	tests := []struct {
+		name    string
+		filters []Predicate
+		wantIDs string
+	}{
+		{"all users sorted by ID", nil, "u00,u01,u02,u03,u04,u05,u06,u07"},
+		{"filtered on every shard", []Predicate{AgeBetween(25, 100)}, "u05,u06,u07"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := us.List(ctx, tt.filters...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, u := range users {
+				ids = append(ids, u.ID)
+			}
+			if got := strings.Join(ids, ","); got != tt.wantIDs {
+				t.Errorf("List = %s; want %s", got, tt.wantIDs)
+			}
+		})
+	}
+
+	results, err := us.Search(ctx, "Ali", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || !strings.HasPrefix(results[0].User.Name, "Ali") || !strings.HasPrefix(results[1].User.Name, "Ali") {
+		t.Errorf("Search(Ali, 2) = %+v; want the 2 best of the Ali* users across shards", results)
+	}
+}
+
+func TestShardAdminEndpoints(t *testing.T) {
+	sharded := &Server{store: NewShardedUserStore(2)}
+	for i := range 50 {
+		sharded.store.Create(context.Background(), User{ID: fmt.Sprint(i), Name: "User", Age: 30})
+	}
+	plain := &Server{store: NewUserStore()}
+
+	tests := []struct {
+		name       string
+		server     *Server
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"not sharded", plain, http.MethodGet, "/admin/shards", "", http.StatusNotImplemented},
+		{"list", sharded, http.MethodGet, "/admin/shards", "", http.StatusOK},
+		{"add", sharded, http.MethodPost, "/admin/shards", `{"name":"shard-2"}`, http.StatusCreated},
+		{"add existing", sharded, http.MethodPost, "/admin/shards", `{"name":"shard-2"}`, http.StatusConflict},
+		{"add without name", sharded, http.MethodPost, "/admin/shards", `{}`, http.StatusBadRequest},
+		{"remove", sharded, http.MethodDelete, "/admin/shards/shard-0", "", http.StatusOK},
+		{"remove unknown", sharded, http.MethodDelete, "/admin/shards/nope", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.RemoteAddr = "127.0.0.1:50000" // admin routes are loopback-only without a token
+			tt.server.adminRoutes("").ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d %s; want %d", rr.Code, rr.Body, tt.wantStatus)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/shards", nil)
+	req.RemoteAddr = "127.0.0.1:50000"
+	sharded.adminRoutes("").ServeHTTP(rr, req)
+	var infos []ShardInfo
+	json.NewDecoder(rr.Body).Decode(&infos)
+	total := 0
+	for _, info := range infos {
+		total += info.Users
+	}
+	if len(infos) != 2 || total != 50 {
+		t.Errorf("after add and remove: %+v; want 2 shards holding 50 users", infos)
+	}
+}
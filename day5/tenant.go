@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 15. Multi-Tenancy
+//
+// WHY?
+// Several teams share one deployment but must never see each other's users.
+// Each tenant gets its own UserStore - its own map, indexes and trigrams - so
+// user "1" of tenant a and user "1" of tenant b are different users and no
+// query can cross the boundary. Tenants also get a user quota and, optionally,
+// their own rate limit on top of the global one.
+//
+// RESOLVING THE TENANT:
+//   - with tenant_token_secret set, ONLY from the token: "Authorization:
+//     Bearer <JWT>" signed with HS256; the tenant is the "tenant" claim.
+//     A request without a valid token is rejected (401) - otherwise anyone
+//     could skip the token and name another tenant in the header.
+//   - without it, from the header ("X-Tenant-ID: acme") or else the
+//     subdomain (acme.<tenant_domain>). Both are taken on trust, which is
+//     fine for internal callers behind a gateway; untrusted callers need
+//     the secret and signed tokens.
+//
+// Tenants are managed on the admin listener (see admin.go):
+//
+//	POST   /admin/tenants        {"id":"acme","max_users":1000,"rate_limit":5}
+//	GET    /admin/tenants
+//	DELETE /admin/tenants/{id}
+
+var (
+	ErrTenantExists   = errors.New("tenant already exists")
+	ErrTenantNotFound = errors.New("tenant not found")
+	ErrQuotaExceeded  = errors.New("user quota exceeded")
+)
+
+// Tenant IDs are DNS labels so every tenant can also be a subdomain.
+var validTenantID = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Tenant describes one tenant's limits (0 = unlimited).
+type Tenant struct {
+	ID        string `json:"id"`
+	MaxUsers  int    `json:"max_users"`
+	RateLimit int    `json:"rate_limit"` // requests/second, on top of the global limit
+	RateBurst int    `json:"rate_burst"` // defaults to rate_limit
+}
+
+// TenantInfo is a Tenant plus its current usage.
+type TenantInfo struct {
+	Tenant
+	Users int `json:"users"`
+}
+
+type tenantState struct {
+	Tenant
+	store   *UserStore
+	limiter Middleware // nil = only the global rate limit applies
+	stop    func()
+}
+
+// TenantRegistry holds every tenant and its store.
+type TenantRegistry struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenantState
+
+	// onEvent is handed to every new tenant store (see webhook.go).
+	onEvent func(UserEvent)
+}
+
+func NewTenantRegistry() *TenantRegistry {
+	return &TenantRegistry{tenants: make(map[string]*tenantState)}
+}
+
+// Create adds a tenant with an empty store.
+func (tr *TenantRegistry) Create(t Tenant) error {
+	if !validTenantID.MatchString(t.ID) {
+		return fmt.Errorf("invalid tenant id %q (want lower-case letters, digits and '-')", t.ID)
+	}
+	if t.MaxUsers < 0 || t.RateLimit < 0 || t.RateBurst < 0 {
+		return fmt.Errorf("max_users, rate_limit and rate_burst must be >= 0")
+	}
+	if t.RateLimit > 0 && t.RateBurst == 0 {
+		t.RateBurst = t.RateLimit
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if _, exists := tr.tenants[t.ID]; exists {
+		return fmt.Errorf("%w: %s", ErrTenantExists, t.ID)
+	}
+	st := &tenantState{Tenant: t, store: NewUserStore(), stop: func() {}}
+	st.store.maxUsers = t.MaxUsers
+	st.store.tenant = t.ID
+	st.store.onEvent = tr.onEvent
+	if t.RateLimit > 0 {
+		st.limiter, st.stop = RateLimiterWithStop(t.RateLimit, t.RateBurst)
+	}
+	tr.tenants[t.ID] = st
+	return nil
+}
+
+func (tr *TenantRegistry) get(id string) (*tenantState, bool) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	st, ok := tr.tenants[id]
+	return st, ok
+}
+
+// List returns all tenants sorted by ID.
+func (tr *TenantRegistry) List() []TenantInfo {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	infos := make([]TenantInfo, 0, len(tr.tenants))
+	for _, st := range tr.tenants {
+		infos = append(infos, TenantInfo{Tenant: st.Tenant, Users: st.store.Stats().Users})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Delete removes a tenant and all of its users. Requests already running
+// finish against the old store.
+func (tr *TenantRegistry) Delete(id string) error {
+	tr.mu.Lock()
+	st, ok := tr.tenants[id]
+	delete(tr.tenants, id)
+	tr.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrTenantNotFound, id)
+	}
+	st.stop()
+	return nil
+}
+
+// Close stops every tenant's rate limiter (a lifecycle stop hook).
+func (tr *TenantRegistry) Close(ctx context.Context) error {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	for _, st := range tr.tenants {
+		st.stop()
+	}
+	return nil
+}
+
+type tenantKey struct{}
+
+// storeFor returns the store of the request's tenant, or the shared store
+// when multi-tenancy is off, with the server's store faults (if any).
+func (s *Server) storeFor(r *http.Request) FaultyStore {
+	if st, ok := r.Context().Value(tenantKey{}).(*tenantState); ok {
+		return FaultyStore{st.store, s.faults}
+	}
+	return FaultyStore{s.store, s.faults}
+}
+
+// Tenancy resolves each request's tenant, rejects unknown ones and applies
+// the tenant's rate limit. Health probes don't belong to a tenant.
+func Tenancy(reg *TenantRegistry, cfg Config) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHealthProbe(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			id, err := resolveTenant(r, cfg)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tenant"`)
+				writeProblem(w, http.StatusUnauthorized, err.Error())
+				return
+			}
+			if id == "" {
+				writeProblem(w, http.StatusBadRequest, "tenant required (X-Tenant-ID header, subdomain or bearer token)")
+				return
+			}
+			st, ok := reg.get(id)
+			if !ok {
+				writeProblem(w, http.StatusNotFound, fmt.Sprintf("unknown tenant %q", id))
+				return
+			}
+
+			SpanFromContext(r.Context()).SetAttr("tenant", id)
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, st))
+			if st.limiter != nil {
+				st.limiter(next).ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// resolveTenant returns the tenant ID of r ("" if none was given). With a
+// token secret, a missing or unverifiable token is an error, never a
+// fallthrough to the header or subdomain.
+func resolveTenant(r *http.Request, cfg Config) (string, error) {
+	if cfg.TenantTokenSecret != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			return "", errors.New("token required (Authorization: Bearer <JWT>)")
+		}
+		return tenantFromToken(token, []byte(cfg.TenantTokenSecret), time.Now())
+	}
+	if id := r.Header.Get("X-Tenant-ID"); id != "" {
+		return strings.ToLower(id), nil
+	}
+	if cfg.TenantDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		sub, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(cfg.TenantDomain))
+		if ok && sub != "" && !strings.Contains(sub, ".") {
+			return sub, nil
+		}
+	}
+	return "", nil
+}
+
+// tenantFromToken verifies an HS256 JWT and returns its "tenant" claim.
+// Only HS256 is accepted: trusting the token's own "alg" would let
+// "alg":"none" tokens through unsigned.
+func tenantFromToken(token string, secret []byte, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("token: malformed")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return "", errors.New("token: unsupported algorithm (want HS256)")
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", errors.New("token: bad signature")
+	}
+
+	var claims struct {
+		Tenant string `json:"tenant"`
+		Exp    int64  `json:"exp"`
+	}
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("token: %w", err)
+	}
+	if claims.Exp != 0 && now.Unix() >= claims.Exp {
+		return "", errors.New("token: expired")
+	}
+	if claims.Tenant == "" {
+		return "", errors.New("token: no tenant claim")
+	}
+	return strings.ToLower(claims.Tenant), nil
+}
+
+func decodeTokenPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Admin endpoints
+
+// handleListTenants serves GET /admin/tenants.
+func (s *Server) handleListTenants(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.tenants.List())
+}
+
+// handleCreateTenant serves POST /admin/tenants.
+func (s *Server) handleCreateTenant(w http.ResponseWriter, r *http.Request) {
+	var t Tenant
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		writeProblem(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+	if err := s.tenants.Create(t); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrTenantExists) {
+			status = http.StatusConflict
+		}
+		writeProblem(w, status, err.Error())
+		return
+	}
+	st, _ := s.tenants.get(t.ID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(st.Tenant)
+}
+
+// handleDeleteTenant serves DELETE /admin/tenants/{id}.
+func (s *Server) handleDeleteTenant(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := s.tenants.Delete(id); err != nil {
+		writeProblem(w, http.StatusNotFound, err.Error())
+		return
+	}
+	s.invalidateTenant(id)
+	w.WriteHeader(http.StatusNoContent)
+}
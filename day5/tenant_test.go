@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken builds an HS256 JWT with the given claims.
+func signToken(t *testing.T, alg string, claims map[string]any, secret string) string {
+	t.Helper()
+	enc := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signing := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signing))
+	return signing + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newTenantServer returns a multi-tenant server with tenants a and b.
+func newTenantServer(t *testing.T, cfg Config) (*Server, http.Handler) {
+	t.Helper()
+	cfg.MultiTenant = true
+	s := &Server{store: NewUserStore(), config: &cfg}
+	h := s.routes()
+	t.Cleanup(func() {
+		s.stopCurrentLimiter(context.Background())
+		s.tenants.Close(context.Background())
+	})
+	for _, id := range []string{"a", "b"} {
+		if err := s.tenants.Create(Tenant{ID: id, MaxUsers: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, h
+}
+
+func tenantRequest(method, target, tenant, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if tenant != "" {
+		req.Header.Set("X-Tenant-ID", tenant)
+	}
+	return req
+}
+
+func TestTenancy_Isolation(t *testing.T) {
+	_, h := newTenantServer(t, DefaultConfig())
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, tenantRequest(http.MethodPost, "/users", "a", `{"id":"1","name":"Alice","age":30}`))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create in a = %d; want 201", rr.Code)
+	}
+
+	// same ID in another tenant is a different user
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, tenantRequest(http.MethodPost, "/users", "b", `{"id":"1","name":"Bob","age":25}`))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create in b = %d; want 201", rr.Code)
+	}
+
+	for tenant, want := range map[string]string{"a": "Alice", "b": "Bob"} {
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, tenantRequest(http.MethodGet, "/users/1", tenant, ""))
+		var u User
+		json.NewDecoder(rr.Body).Decode(&u)
+		if u.Name != want {
+			t.Errorf("tenant %s: user 1 = %q; want %q", tenant, u.Name, want)
+		}
+
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, tenantRequest(http.MethodGet, "/users/search?q="+want, tenant, ""))
+		var hits []SearchResult
+		json.NewDecoder(rr.Body).Decode(&hits)
+		if len(hits) != 1 || hits[0].User.Name != want {
+			t.Errorf("tenant %s: search = %+v; want only %s", tenant, hits, want)
+		}
+	}
+}
+
+func TestTenancy_Resolution(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TenantDomain = "api.example.com"
+	_, open := newTenantServer(t, cfg)
+	cfg.TenantTokenSecret = "k3y"
+	_, signed := newTenantServer(t, cfg)
+
+	tests := []struct {
+		name       string
+		h          http.Handler
+		host       string
+		header     string
+		auth       string
+		wantStatus int
+	}{
+		{"header", open, "", "a", "", http.StatusOK},
+		{"subdomain", open, "b.api.example.com:8080", "", "", http.StatusOK},
+		{"no tenant", open, "", "", "", http.StatusBadRequest},
+		{"unknown tenant", open, "", "zzz", "", http.StatusNotFound},
+		{"nested subdomain", open, "x.a.api.example.com", "", "", http.StatusBadRequest},
+		{"token", signed, "", "", "Bearer " + signToken(t, "HS256", map[string]any{"tenant": "a"}, "k3y"), http.StatusOK},
+		{"token wins over header", signed, "", "nope", "Bearer " + signToken(t, "HS256", map[string]any{"tenant": "a"}, "k3y"), http.StatusOK},
+		{"token wrong key", signed, "", "", "Bearer " + signToken(t, "HS256", map[string]any{"tenant": "a"}, "other"), http.StatusUnauthorized},
+		{"token alg none", signed, "", "", "Bearer " + signToken(t, "none", map[string]any{"tenant": "a"}, "k3y"), http.StatusUnauthorized},
+		{"token expired", signed, "", "", "Bearer " + signToken(t, "HS256", map[string]any{"tenant": "a", "exp": time.Now().Add(-time.Minute).Unix()}, "k3y"), http.StatusUnauthorized},
+		{"header without token", signed, "", "a", "", http.StatusUnauthorized},
+		{"subdomain without token", signed, "b.api.example.com", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.h
+			req := tenantRequest(http.MethodGet, "/users", tt.header, "")
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d (%s)", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestTenancy_QuotaAndHealthz(t *testing.T) {
+	_, h := newTenantServer(t, DefaultConfig())
+
+	for i, id := range []string{"1", "2", "3"} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, tenantRequest(http.MethodPost, "/users", "a", `{"id":"`+id+`","name":"U","age":20}`))
+		want := http.StatusCreated
+		if i == 2 {
+			want = http.StatusForbidden
+		}
+		if rr.Code != want {
+			t.Errorf("create %s = %d; want %d", id, rr.Code, want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("healthz without tenant = %d; want 200", rr.Code)
+	}
+}
+
+func TestAdminTenants(t *testing.T) {
+	s, h := newTenantServer(t, DefaultConfig())
+	admin := s.adminRoutes("")
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:5000"
+		rr := httptest.NewRecorder()
+		admin.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(http.MethodPost, "/admin/tenants", `{"id":"acme","max_users":10,"rate_limit":5}`); rr.Code != http.StatusCreated {
+		t.Fatalf("create = %d; want 201 (%s)", rr.Code, rr.Body.String())
+	}
+	if rr := do(http.MethodPost, "/admin/tenants", `{"id":"acme"}`); rr.Code != http.StatusConflict {
+		t.Errorf("duplicate create = %d; want 409", rr.Code)
+	}
+	if rr := do(http.MethodPost, "/admin/tenants", `{"id":"Not Valid"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid id = %d; want 400", rr.Code)
+	}
+
+	var list []TenantInfo
+	json.NewDecoder(do(http.MethodGet, "/admin/tenants", "").Body).Decode(&list)
+	if len(list) != 3 || list[0].ID != "a" || list[1].ID != "acme" || list[1].RateBurst != 5 {
+		t.Errorf("list = %+v; want a, acme, b with acme rate_burst 5", list)
+	}
+
+	if rr := do(http.MethodDelete, "/admin/tenants/acme", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("delete = %d; want 204", rr.Code)
+	}
+	if rr := do(http.MethodDelete, "/admin/tenants/acme", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("second delete = %d; want 404", rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, tenantRequest(http.MethodGet, "/users", "acme", ""))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("request for deleted tenant = %d; want 404", rr.Code)
+	}
+}
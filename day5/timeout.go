@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 11. Enforced Request Timeouts
+//
+// WHY?
+// A context deadline only helps handlers that check ctx. One that ignores it
+// (e.g. the commented-out time.Sleep(100 * time.Second) in handleCreateUser) used
+// to keep the client waiting until it finished.
+//
+// HOW:
+//  1. Run the handler in its own goroutine with a timeoutWriter that buffers
+//     headers, status and body instead of sending them.
+//  2. If the handler finishes first, copy the buffered response to the client.
+//  3. If the deadline passes first, send 504 + problem body right away and
+//     mark the writer as timed out: the handler's late writes are discarded
+//     (Write returns http.ErrHandlerTimeout) and can't corrupt the response.
+//
+// Routes can override the default with Config.RouteTimeouts. Only the first
+// maxBufferedResponse bytes are buffered: a larger body is sent as it is
+// written, and a deadline that passes after that aborts the connection -
+// the status line is already out, so a 504 can't replace it.
+
+// maxBufferedResponse is how much of a response timeoutWriter holds back.
+const maxBufferedResponse = 1 << 20
+
+// TimeoutPolicy returns the timeout for a request (<= 0 means no timeout).
+type TimeoutPolicy func(r *http.Request) time.Duration
+
+// RequestTimeoutPolicy enforces a per-request timeout chosen by policy.
+func RequestTimeoutPolicy(policy TimeoutPolicy) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := policy(r)
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{w: w, header: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan any, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				// re-panic on the server's goroutine so net/http logs it as usual
+				panic(p)
+			case <-done:
+				tw.flushTo(w)
+			case <-ctx.Done():
+				select {
+				case <-done: // finished at the same moment - its answer wins
+					tw.flushTo(w)
+					return
+				default:
+				}
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.timedOut = true
+				if tw.passthrough {
+					// part of the body is out: cut the connection so the
+					// client sees an error, not a short 200
+					panic(http.ErrAbortHandler)
+				}
+				if r.Context().Err() == context.DeadlineExceeded {
+					writeProblem(w, http.StatusGatewayTimeout, fmt.Sprintf("request did not complete within %s", timeout))
+				}
+				// otherwise the client went away; nobody is listening for a reply
+			}
+		})
+	}
+}
+
+// timeoutWriter buffers a handler's response until RequestTimeoutPolicy
+// decides whether it is sent or replaced by a timeout response. Past
+// maxBufferedResponse it switches to passthrough and writes to w directly.
+type timeoutWriter struct {
+	mu          sync.Mutex
+	w           http.ResponseWriter
+	header      http.Header
+	buf         bytes.Buffer
+	status      int
+	timedOut    bool
+	passthrough bool
+}
+
+// flushTo copies the buffered response to the real writer.
+func (tw *timeoutWriter) flushTo(w http.ResponseWriter) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !tw.passthrough {
+		tw.flushLocked(w)
+	}
+}
+
+// flushLocked sends the buffered headers, status and body; tw.mu is held.
+func (tw *timeoutWriter) flushLocked(w http.ResponseWriter) {
+	dst := w.Header()
+	for k, v := range tw.header {
+		dst[k] = v
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	w.WriteHeader(tw.status)
+	w.Write(tw.buf.Bytes())
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	if !tw.passthrough && tw.buf.Len()+len(p) > maxBufferedResponse {
+		tw.flushLocked(tw.w)
+		tw.buf = bytes.Buffer{}
+		tw.passthrough = true
+	}
+	if tw.passthrough {
+		return tw.w.Write(p)
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = code
+}
+
+// timeoutPolicy looks up the matched route (see routeKey) in
+// cfg.RouteTimeouts and falls back to the global timeout.
+func (s *Server) timeoutPolicy(cfg Config) TimeoutPolicy {
+	return func(r *http.Request) time.Duration {
+		_, pattern := s.mux.Handler(r)
+		if d, ok := cfg.RouteTimeouts[routeKey(pattern)]; ok {
+			return d.Duration
+		}
+		return cfg.RequestTimeout.Duration
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout_CutsOffSlowHandler(t *testing.T) {
+	lateWrite := make(chan error, 1)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond) // ignores ctx on purpose
+		_, err := w.Write([]byte("too late"))
+		lateWrite <- err
+	})
+	h := RequestTimeout(20 * time.Millisecond)(slow)
+
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users", nil))
+
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("response took %v; expected it to be cut off", elapsed)
+	}
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d; want 504", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q; want application/problem+json", ct)
+	}
+	var p Problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil || p.Status != http.StatusGatewayTimeout {
+		t.Errorf("bad problem body %+v (err %v)", p, err)
+	}
+
+	if err := <-lateWrite; err != http.ErrHandlerTimeout {
+		t.Errorf("late write err = %v; want http.ErrHandlerTimeout", err)
+	}
+}
+
+func TestRequestTimeout_PassesFastResponse(t *testing.T) {
+	h := RequestTimeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); !ok {
+			t.Error("handler context has no deadline")
+		}
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/users", nil))
+	if rr.Code != http.StatusCreated || rr.Body.String() != "created" || rr.Header().Get("X-Test") != "yes" {
+		t.Errorf("unexpected response %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+}
+
+func TestRequestTimeout_PanicPropagates(t *testing.T) {
+	h := RequestTimeout(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	defer func() {
+		if p := recover(); p != "boom" {
+			t.Errorf("recovered %v; want boom", p)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestRequestTimeout_LargeBodyPassesThrough(t *testing.T) {
+	body := strings.Repeat("x", maxBufferedResponse+1)
+	tests := []struct {
+		name    string
+		delay   time.Duration // after the body is written
+		wantErr bool
+	}{
+		{"finishes in time", 0, false},
+		{"times out mid-body", 200 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(RequestTimeout(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(body))
+				time.Sleep(tt.delay)
+			})))
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("status = %d; want 200 (sent before the deadline)", resp.StatusCode)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("read %d bytes without error; want the connection cut", len(got))
+				}
+				return
+			}
+			if err != nil || len(got) != len(body) {
+				t.Errorf("read %d bytes, %v; want %d", len(got), err, len(body))
+			}
+		})
+	}
+}
+
+func TestServer_RouteTimeouts(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	cfg := DefaultConfig()
+	cfg.RouteTimeouts = map[string]Duration{"/healthz": {10 * time.Millisecond}} // healthz needs 100ms
+	if err := s.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusGatewayTimeout && rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("healthz status = %d; want a timeout", rr.Code)
+	}
+
+	cfg.RouteTimeouts = map[string]Duration{"/healthz": {time.Second}}
+	if err := s.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ApplyConfig failed: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("healthz with override status = %d; want 200", rr.Code)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 12. Tracing (W3C Trace Context)
+//
+// WHY?
+// One request passes RateLimiter -> RequestTimeout -> Logging -> handler ->
+// UserStore. A trace records each of those steps as a span (name, start,
+// end, parent) so we can see where the time went.
+//
+// PROPAGATION:
+// The "traceparent" header carries the trace across processes:
+//
+//	traceparent: 00-<32 hex trace id>-<16 hex parent span id>-<2 hex flags>
+//	tracestate:  vendor=value,...   (opaque, passed along unchanged)
+//
+// Tracing() reads it from incoming requests and echoes the server span back
+// in the response; TracingTransport writes it on outgoing client requests.
+//
+// The current span lives in the context.Context, so anything that already
+// takes ctx (every UserStore method) can start a child span for free.
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	Sampled    bool
+	TraceState string
+}
+
+// Traceparent formats the context as a W3C traceparent header value.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(sc.TraceID[:]), hex.EncodeToString(sc.SpanID[:]), flags)
+}
+
+// ParseTraceparent parses a traceparent header. Unknown future versions are
+// accepted as long as the version-00 fields are readable, as the spec asks.
+func ParseTraceparent(h string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 {
+		return sc, fmt.Errorf("traceparent: want 4 fields, got %d", len(parts))
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return sc, fmt.Errorf("traceparent: bad version %q", version)
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 || strings.ToLower(h) != h {
+		return sc, fmt.Errorf("traceparent: malformed %q", h)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil {
+		return sc, fmt.Errorf("traceparent: bad trace id: %w", err)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil {
+		return sc, fmt.Errorf("traceparent: bad span id: %w", err)
+	}
+	var f [1]byte
+	if _, err := hex.Decode(f[:], []byte(flags)); err != nil {
+		return sc, fmt.Errorf("traceparent: bad flags: %w", err)
+	}
+	if sc.TraceID == [16]byte{} || sc.SpanID == [8]byte{} {
+		return sc, fmt.Errorf("traceparent: all-zero id")
+	}
+	sc.Sampled = f[0]&0x01 == 1
+	return sc, nil
+}
+
+// Span is one timed operation. Exported spans are plain JSON.
+type Span struct {
+	Name       string            `json:"name"`
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// ActiveSpan is a span that is still running. A nil *ActiveSpan is a valid
+// no-op, so callers never need to check whether tracing is enabled.
+type ActiveSpan struct {
+	tracer *Tracer
+	sc     SpanContext
+	mu     sync.Mutex
+	span   Span
+	ended  bool
+}
+
+// Context returns the span's identity (for propagation).
+func (s *ActiveSpan) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttr records a key/value on the span.
+func (s *ActiveSpan) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.span.Attributes == nil {
+		s.span.Attributes = make(map[string]string)
+	}
+	s.span.Attributes[key] = value
+}
+
+// SetError marks the span as failed (nil errors are ignored).
+func (s *ActiveSpan) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.span.Error = err.Error()
+}
+
+// End finishes the span and hands it to the exporter (once).
+func (s *ActiveSpan) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.span.End = time.Now()
+	span := s.span
+	s.mu.Unlock()
+
+	if s.sc.Sampled {
+		s.tracer.exporter.Export(span)
+	}
+}
+
+// SpanExporter receives finished spans.
+type SpanExporter interface {
+	Export(span Span) error
+}
+
+// Tracer creates spans and sends finished ones to its exporter.
+type Tracer struct {
+	exporter SpanExporter
+}
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the current span (nil if none).
+func SpanFromContext(ctx context.Context) *ActiveSpan {
+	s, _ := ctx.Value(spanKey{}).(*ActiveSpan)
+	return s
+}
+
+// Start begins a span. The parent is the span in ctx if any, else remote
+// (a parsed traceparent), else a new trace is started.
+func (t *Tracer) Start(ctx context.Context, name string, remote *SpanContext) (context.Context, *ActiveSpan) {
+	s := &ActiveSpan{tracer: t, span: Span{Name: name, Start: time.Now()}}
+
+	var parent *SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		pc := p.Context()
+		parent = &pc
+	} else if remote != nil {
+		parent = remote
+	}
+
+	if parent != nil {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+		s.sc.TraceState = parent.TraceState
+		s.span.ParentID = hex.EncodeToString(parent.SpanID[:])
+	} else {
+		putRandom(s.sc.TraceID[:])
+		s.sc.Sampled = true
+	}
+	putRandom(s.sc.SpanID[:])
+	s.span.TraceID = hex.EncodeToString(s.sc.TraceID[:])
+	s.span.SpanID = hex.EncodeToString(s.sc.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// StartSpan starts a child of the span in ctx. Without a current span it
+// returns ctx unchanged and a nil (no-op) span, so untraced callers pay
+// almost nothing.
+func StartSpan(ctx context.Context, name string) (context.Context, *ActiveSpan) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	return parent.tracer.Start(ctx, name, nil)
+}
+
+// putRandom fills b with random bytes, never all zero (invalid per spec).
+func putRandom(b []byte) {
+	for {
+		for i := range b {
+			b[i] = byte(rand.Uint32())
+		}
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
+
+// Exporters
+
+// InMemoryExporter keeps spans in a slice - handy for tests.
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+func (e *InMemoryExporter) Export(span Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+// Spans returns a copy of everything exported so far.
+func (e *InMemoryExporter) Spans() []Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Span(nil), e.spans...)
+}
+
+// JSONFileExporter appends one JSON object per span (NDJSON) to a file.
+type JSONFileExporter struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewJSONFileExporter(path string) (*JSONFileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFileExporter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (e *JSONFileExporter) Export(span Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.enc.Encode(span)
+}
+
+// Close flushes and closes the file (register it as a lifecycle stop hook).
+func (e *JSONFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.f.Sync(); err != nil {
+		e.f.Close()
+		return err
+	}
+	return e.f.Close()
+}
+
+// HTTP middleware
+
+// Tracing starts a server span per request, continuing the caller's trace
+// from traceparent/tracestate, and returns the span's traceparent in the
+// response so callers can find it.
+func Tracing(t *Tracer) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var remote *SpanContext
+			if sc, err := ParseTraceparent(r.Header.Get("traceparent")); err == nil {
+				sc.TraceState = r.Header.Get("tracestate")
+				remote = &sc
+			}
+
+			ctx, span := t.Start(r.Context(), r.Method+" "+r.URL.Path, remote)
+			defer span.End()
+			span.SetAttr("http.method", r.Method)
+			span.SetAttr("http.target", r.URL.RequestURI())
+
+			w.Header().Set("traceparent", span.Context().Traceparent())
+			if ts := span.Context().TraceState; ts != "" {
+				w.Header().Set("tracestate", ts)
+			}
+
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r.WithContext(ctx))
+			span.SetAttr("http.status_code", fmt.Sprint(sw.status))
+		})
+	}
+}
+
+// Traced wraps a middleware so the time spent in it (and everything below
+// it) shows up as its own span named name.
+func Traced(name string, mw Middleware) Middleware {
+	return func(next http.Handler) http.Handler {
+		inner := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, span := StartSpan(r.Context(), name)
+			defer span.End()
+			inner.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// tracedMux records a "handler <pattern>" span around the routed handler.
+func tracedMux(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		ctx, span := StartSpan(r.Context(), "handler "+pattern)
+		defer span.End()
+		mux.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// TracingTransport is an http.RoundTripper that starts a client span for
+// each request and injects traceparent/tracestate so the server continues
+// the same trace.
+type TracingTransport struct {
+	Base   http.RoundTripper // nil = http.DefaultTransport
+	Tracer *Tracer           // nil = only propagate the span already in ctx
+}
+
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	ctx := req.Context()
+	var span *ActiveSpan
+	if t.Tracer != nil {
+		ctx, span = t.Tracer.Start(ctx, "client "+req.Method+" "+req.URL.Path, nil)
+	} else {
+		ctx, span = StartSpan(ctx, "client "+req.Method+" "+req.URL.Path)
+	}
+	defer span.End()
+
+	if span != nil {
+		// RoundTrippers must not modify the caller's request
+		req = req.Clone(ctx)
+		req.Header.Set("traceparent", span.Context().Traceparent())
+		if ts := span.Context().TraceState; ts != "" {
+			req.Header.Set("tracestate", ts)
+		}
+	}
+
+	resp, err := base.RoundTrip(req)
+	span.SetError(err)
+	if resp != nil {
+		span.SetAttr("http.status_code", fmt.Sprint(resp.StatusCode))
+	}
+	return resp, err
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		wantErr bool
+		sampled bool
+	}{
+		{"valid sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, true},
+		{"valid not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, false},
+		{"future version with extra field", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, true},
+		{"version ff", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", true, false},
+		{"zero span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", true, false},
+		{"uppercase hex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", true, false},
+		{"short", "00-abc-def-01", true, false},
+		{"empty", "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, err := ParseTraceparent(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && sc.Sampled != tt.sampled {
+				t.Errorf("Sampled = %v; want %v", sc.Sampled, tt.sampled)
+			}
+		})
+	}
+
+	const h = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, _ := ParseTraceparent(h)
+	if got := sc.Traceparent(); got != h {
+		t.Errorf("round trip = %q; want %q", got, h)
+	}
+}
+
+func TestTracing_ServerSpans(t *testing.T) {
+	exp := &InMemoryExporter{}
+	s := &Server{store: NewUserStore(), tracer: NewTracer(exp)}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"id":"1","name":"Alice","age":30}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("tracestate", "vendor=abc")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	resp, err := ParseTraceparent(rr.Header().Get("traceparent"))
+	if err != nil {
+		t.Fatalf("response traceparent: %v", err)
+	}
+	if got := rr.Header().Get("tracestate"); got != "vendor=abc" {
+		t.Errorf("tracestate = %q; want vendor=abc", got)
+	}
+
+	spans := exp.Spans()
+	byName := map[string]Span{}
+	for _, sp := range spans {
+		if sp.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s has trace id %s", sp.Name, sp.TraceID)
+		}
+		byName[sp.Name] = sp
+	}
+
+	// each layer is the parent of the next one down
+	chain := []string{"POST /users", "CORS", "RateLimiter", "ConcurrencyLimit", "RequestTimeout", "Logging", "handler POST /users", "UserStore.Create"}
+	for i, name := range chain {
+		sp, ok := byName[name]
+		if !ok {
+			t.Fatalf("missing span %q (got %d spans)", name, len(spans))
+		}
+		if i == 0 {
+			if sp.ParentID != "00f067aa0ba902b7" {
+				t.Errorf("server span parent = %s; want remote parent", sp.ParentID)
+			}
+			if sp.SpanID != hex.EncodeToString(resp.SpanID[:]) {
+				t.Errorf("response traceparent does not point at server span")
+			}
+			continue
+		}
+		if parent := byName[chain[i-1]]; sp.ParentID != parent.SpanID {
+			t.Errorf("%s parent = %s; want %s (%s)", name, sp.ParentID, parent.SpanID, chain[i-1])
+		}
+	}
+	if byName["UserStore.Create"].Attributes["user.id"] != "1" {
+		t.Errorf("store span missing user.id: %+v", byName["UserStore.Create"])
+	}
+}
+
+func TestTracing_ClientPropagation(t *testing.T) {
+	serverExp := &InMemoryExporter{}
+	s := &Server{store: NewUserStore(), tracer: NewTracer(serverExp)}
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	defer s.stopCurrentLimiter(context.Background())
+
+	clientExp := &InMemoryExporter{}
+	c := NewClient(srv.URL, NewTracer(clientExp))
+	if _, err := c.CreateUser(context.Background(), User{ID: "1", Name: "Alice", Age: 30}); err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+
+	clientSpans := clientExp.Spans()
+	if len(clientSpans) != 1 {
+		t.Fatalf("expected 1 client span, got %d", len(clientSpans))
+	}
+	var root Span
+	for _, sp := range serverExp.Spans() {
+		if sp.Name == "POST /v1/users" {
+			root = sp
+		}
+	}
+	if root.TraceID != clientSpans[0].TraceID || root.ParentID != clientSpans[0].SpanID {
+		t.Errorf("server span %+v is not a child of client span %+v", root, clientSpans[0])
+	}
+}
+
+func TestStartSpan_NoTracer(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "noop")
+	if span != nil || ctx != context.Background() {
+		t.Error("expected no-op span without a tracer in context")
+	}
+	span.SetAttr("k", "v") // nil span methods must not panic
+	span.End()
+}
+
+func TestJSONFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exp, err := NewJSONFileExporter(path)
+	if err != nil {
+		t.Fatalf("NewJSONFileExporter: %v", err)
+	}
+	tracer := NewTracer(exp)
+	ctx, parent := tracer.Start(context.Background(), "parent", nil)
+	_, child := StartSpan(ctx, "child")
+	child.End()
+	parent.End()
+	if err := exp.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	var names []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var sp Span
+		if err := json.Unmarshal(sc.Bytes(), &sp); err != nil {
+			t.Fatalf("bad line %q: %v", sc.Text(), err)
+		}
+		names = append(names, sp.Name)
+	}
+	if strings.Join(names, ",") != "child,parent" {
+		t.Errorf("exported %v; want [child parent]", names)
+	}
+}
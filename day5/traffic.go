@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// 21. Traffic Recording and Replay
+//
+// WHY?
+// Unit tests only cover the requests someone thought of. Recording what real
+// clients send and replaying it against a new build shows every response
+// that changed before the build reaches users.
+//
+// RECORDING (server -record traffic.ndjson):
+// The Record middleware writes one JSON object per request/response pair:
+//
+//	{"time":"...","duration":"1.2ms","request":{"method":"POST","path":"/v1/users",...},
+//	 "response":{"status":201,"body":"{\"id\":\"1\",...}"}}
+//
+// Before writing, secrets are removed: credential headers (Authorization,
+// Cookie, ...) are dropped and JSON/MessagePack fields like "secret" or
+// "password" are replaced by "<redacted>". Bodies that can't be cleaned that
+// way (XML or CSV naming such a field) or are larger than maxRecordedBody
+// are left out and marked "omitted".
+//
+// REPLAY (server -replay traffic.ndjson -target http://new-build:8080):
+// Every recorded request is sent to the target, as fast as possible or
+// spread out like the original traffic (-speed 1 = recorded pace, 2 = twice
+// as fast). Status codes and JSON bodies are compared with the recording.
+// Volatile fields (timestamps, generated IDs) are ignored wherever they
+// appear in a body. Dropped credentials can be supplied again with
+// ReplayOptions.Header.
+
+// maxRecordedBody caps each recorded body so one upload can't bloat the file.
+const maxRecordedBody = 64 << 10
+
+// sensitiveHeaders are never written to a recording.
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Webhook-Signature"}
+
+// sensitiveFields are JSON object keys whose values are redacted.
+var sensitiveFields = map[string]bool{"secret": true, "password": true, "token": true, "tenant_token_secret": true, "admin_token": true}
+
+// defaultVolatileFields change between runs even when nothing is wrong.
+var defaultVolatileFields = []string{"time", "created_at", "timestamp", "request_id"}
+
+// RecordedMessage is one side of an exchange.
+type RecordedMessage struct {
+	Method     string      `json:"method,omitempty"` // requests only
+	Path       string      `json:"path,omitempty"`   // requests only, with query
+	Status     int         `json:"status,omitempty"` // responses only
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 bool        `json:"body_base64,omitempty"` // Body is base64 (binary, e.g. MessagePack)
+	Omitted    bool        `json:"omitted,omitempty"`     // body too large or not safe to record
+}
+
+// Recording is one request/response pair (a line of the NDJSON file).
+type Recording struct {
+	Time     time.Time       `json:"time"`
+	Duration Duration        `json:"duration"`
+	Request  RecordedMessage `json:"request"`
+	Response RecordedMessage `json:"response"`
+}
+
+// TrafficRecorder appends Recordings to a file (like JSONFileExporter).
+type TrafficRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewTrafficRecorder(path string) (*TrafficRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &TrafficRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (tr *TrafficRecorder) write(rec Recording) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.enc.Encode(rec)
+}
+
+// Close flushes and closes the file (register it as a lifecycle stop hook).
+func (tr *TrafficRecorder) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if err := tr.f.Sync(); err != nil {
+		tr.f.Close()
+		return err
+	}
+	return tr.f.Close()
+}
+
+// recordWriter passes the response through and keeps a copy of the body
+// (up to maxRecordedBody).
+type recordWriter struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *recordWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	keep := min(len(p), maxRecordedBody-w.body.Len())
+	w.body.Write(p[:keep])
+	w.truncated = w.truncated || keep < len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Record writes every request except health probes to tr.
+func Record(tr *TrafficRecorder) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isHealthProbe(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			// read the body up front so it can be both recorded and handled
+			var reqBody []byte
+			if r.Body != nil {
+				var err error
+				reqBody, err = io.ReadAll(io.LimitReader(r.Body, maxRecordedBody+1))
+				if err != nil {
+					http.Error(w, "Invalid body: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+			}
+
+			start := time.Now()
+			rw := &recordWriter{ResponseWriter: w}
+			next.ServeHTTP(rw, r)
+			if rw.status == 0 {
+				rw.status = http.StatusOK
+			}
+
+			rec := Recording{
+				Time:     start.UTC(),
+				Duration: Duration{time.Since(start)},
+				Request: RecordedMessage{
+					Method: r.Method,
+					Path:   r.URL.RequestURI(),
+					Header: sanitizeHeader(r.Header),
+				},
+				Response: RecordedMessage{
+					Status: rw.status,
+					Header: sanitizeHeader(w.Header()),
+				},
+			}
+			rec.Request.setBody(r.Header.Get("Content-Type"), reqBody, len(reqBody) > maxRecordedBody)
+			rec.Response.setBody(w.Header().Get("Content-Type"), rw.body.Bytes(), rw.truncated)
+			if err := tr.write(rec); err != nil {
+				logf(LevelWarn, "traffic recorder: %v", err)
+			}
+		})
+	}
+}
+
+// sanitizeHeader copies h without credentials.
+func sanitizeHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range sensitiveHeaders {
+		out.Del(name)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// setBody stores b in its recorded form: JSON and MessagePack with
+// sensitive fields redacted, other text as is unless it mentions a
+// sensitive field, binary data as base64.
+func (m *RecordedMessage) setBody(contentType string, b []byte, truncated bool) {
+	if len(b) == 0 {
+		return
+	}
+	if truncated {
+		m.Omitted = true
+		return
+	}
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if c := codecFor(mt); c != nil && c.format == "msgpack" {
+		var v any
+		if msgpackUnmarshal(b, &v) == nil {
+			if clean, err := msgpackMarshal(redactFields(v)); err == nil {
+				m.Body, m.BodyBase64 = base64.StdEncoding.EncodeToString(clean), true
+				return
+			}
+		}
+		m.Omitted = true
+		return
+	}
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if dec.Decode(&v) == nil && !dec.More() {
+		var clean bytes.Buffer
+		enc := json.NewEncoder(&clean)
+		enc.SetEscapeHTML(false) // keep "<redacted>" readable
+		if enc.Encode(redactFields(v)) == nil {
+			m.Body = strings.TrimSuffix(clean.String(), "\n")
+			return
+		}
+	}
+	lower := strings.ToLower(string(b))
+	for field := range sensitiveFields {
+		if strings.Contains(lower, field) {
+			m.Omitted = true
+			return
+		}
+	}
+	if utf8.Valid(b) {
+		m.Body = string(b)
+	} else {
+		m.Body, m.BodyBase64 = base64.StdEncoding.EncodeToString(b), true
+	}
+}
+
+// redactFields replaces the values of sensitiveFields anywhere in v.
+func redactFields(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			if sensitiveFields[strings.ToLower(k)] {
+				v[k] = redacted(fmt.Sprint(e))
+			} else {
+				v[k] = redactFields(e)
+			}
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = redactFields(e)
+		}
+	}
+	return v
+}
+
+// ReadRecordings parses an NDJSON recording.
+func ReadRecordings(r io.Reader) ([]Recording, error) {
+	var recs []Recording
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), 4*maxRecordedBody+64<<10)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var rec Recording
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, sc.Err()
+}
+
+// Replay
+
+// ReplayOptions configures Replay.
+type ReplayOptions struct {
+	Target string       // base URL of the server under test
+	Client *http.Client // nil = http.DefaultClient
+	Speed  float64      // 0 = as fast as possible, 1 = recorded pace, 2 = twice as fast
+	Ignore []string     // extra volatile JSON fields (defaultVolatileFields always apply)
+	Header http.Header  // added to every request, e.g. a fresh Authorization
+}
+
+// replaySkipHeaders are connection details the transport sets itself
+// (a copied Accept-Encoding would also stop it from decompressing).
+var replaySkipHeaders = map[string]bool{"Accept-Encoding": true, "Connection": true, "Content-Length": true}
+
+// ReplayDiff describes one request whose response differs.
+type ReplayDiff struct {
+	Index    int      `json:"index"` // position in the recording
+	Method   string   `json:"method"`
+	Path     string   `json:"path"`
+	Problems []string `json:"problems"`
+}
+
+// ReplayResult summarizes a replay.
+type ReplayResult struct {
+	Total   int          `json:"total"`
+	Matched int          `json:"matched"`
+	Diffs   []ReplayDiff `json:"diffs,omitempty"`
+}
+
+// maxDiffProblems keeps one badly broken response from flooding the report.
+const maxDiffProblems = 10
+
+// Replay sends recs to opts.Target in order and compares the answers with
+// the recorded ones. Transport errors count as differences, not failures;
+// only ctx cancellation stops the replay early.
+func Replay(ctx context.Context, recs []Recording, opts ReplayOptions) (ReplayResult, error) {
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ignore := map[string]bool{}
+	for _, f := range append(defaultVolatileFields, opts.Ignore...) {
+		ignore[f] = true
+	}
+	target := strings.TrimRight(opts.Target, "/")
+
+	var res ReplayResult
+	var start time.Time
+	for i, rec := range recs {
+		if i == 0 {
+			start = time.Now()
+		} else if opts.Speed > 0 {
+			// keep the recorded spacing, compressed by Speed
+			due := start.Add(time.Duration(float64(rec.Time.Sub(recs[0].Time)) / opts.Speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return res, ctx.Err()
+				}
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		res.Total++
+		problems := replayOne(ctx, client, target, rec, opts.Header, ignore)
+		if len(problems) == 0 {
+			res.Matched++
+			continue
+		}
+		res.Diffs = append(res.Diffs, ReplayDiff{Index: i, Method: rec.Request.Method, Path: rec.Request.Path, Problems: problems})
+	}
+	return res, nil
+}
+
+// replayOne sends one recorded request and lists how the answer differs.
+func replayOne(ctx context.Context, client *http.Client, target string, rec Recording, extra http.Header, ignore map[string]bool) []string {
+	if rec.Request.Omitted {
+		return []string{"request body was not recorded; can't replay"}
+	}
+	body, err := decodeRecordedBody(rec.Request)
+	if err != nil {
+		return []string{"request body: " + err.Error()}
+	}
+	req, err := http.NewRequestWithContext(ctx, rec.Request.Method, target+rec.Request.Path, bytes.NewReader(body))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	for k, vv := range rec.Request.Header {
+		if !replaySkipHeaders[k] {
+			req.Header[k] = vv
+		}
+	}
+	for k, vv := range extra {
+		req.Header[k] = vv
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(io.LimitReader(resp.Body, maxRecordedBody))
+	if err != nil {
+		return []string{"response body: " + err.Error()}
+	}
+
+	var problems []string
+	if resp.StatusCode != rec.Response.Status {
+		problems = append(problems, fmt.Sprintf("status: %d != recorded %d", resp.StatusCode, rec.Response.Status))
+	}
+	if rec.Response.Omitted {
+		return problems // nothing to compare the body with
+	}
+	want, err := decodeRecordedBody(rec.Response)
+	if err != nil {
+		return append(problems, "recorded body: "+err.Error())
+	}
+	return append(problems, diffBodies(resp.Header.Get("Content-Type"), want, got, ignore)...)
+}
+
+func decodeRecordedBody(m RecordedMessage) ([]byte, error) {
+	if m.BodyBase64 {
+		return base64.StdEncoding.DecodeString(m.Body)
+	}
+	return []byte(m.Body), nil
+}
+
+// diffBodies compares JSON bodies structurally (ignoring volatile fields and
+// redacted values) and anything else byte for byte.
+func diffBodies(contentType string, want, got []byte, ignore map[string]bool) []string {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt == "application/json" || strings.HasSuffix(mt, "+json") || len(got) == 0 {
+		var w, g any
+		wErr, gErr := unmarshalNumber(want, &w), unmarshalNumber(got, &g)
+		if wErr == nil && gErr == nil {
+			var problems []string
+			diffJSON("$", w, g, ignore, &problems)
+			return problems
+		}
+	}
+	if !bytes.Equal(bytes.TrimSpace(want), bytes.TrimSpace(got)) {
+		return []string{fmt.Sprintf("body: %q != recorded %q", truncateString(string(got), 80), truncateString(string(want), 80))}
+	}
+	return nil
+}
+
+func unmarshalNumber(b []byte, v any) error {
+	if len(bytes.TrimSpace(b)) == 0 {
+		return nil // both empty compares as nil == nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// diffJSON appends a line per difference between want and got at path.
+func diffJSON(path string, want, got any, ignore map[string]bool, problems *[]string) {
+	if len(*problems) >= maxDiffProblems {
+		return
+	}
+	if s, ok := want.(string); ok && s == "<redacted>" {
+		return // the recording doesn't know the real value (see redactFields)
+	}
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, seen := w[k]; !seen {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if ignore[k] {
+				continue
+			}
+			wv, inW := w[k]
+			gv, inG := g[k]
+			switch {
+			case !inG:
+				*problems = append(*problems, fmt.Sprintf("%s.%s: missing", path, k))
+			case !inW:
+				*problems = append(*problems, fmt.Sprintf("%s.%s: unexpected %s", path, k, compactJSON(gv)))
+			default:
+				diffJSON(path+"."+k, wv, gv, ignore, problems)
+			}
+		}
+		return
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			break
+		}
+		if len(w) != len(g) {
+			*problems = append(*problems, fmt.Sprintf("%s: %d elements != recorded %d", path, len(g), len(w)))
+			return
+		}
+		for i := range w {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], ignore, problems)
+		}
+		return
+	}
+	if !reflect.DeepEqual(want, got) {
+		*problems = append(*problems, fmt.Sprintf("%s: %s != recorded %s", path, compactJSON(got), compactJSON(want)))
+	}
+}
+
+func compactJSON(v any) string {
+	b, _ := json.Marshal(v)
+	return truncateString(string(b), 80)
+}
+
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// runReplay replays file with opts, prints a report and returns the exit
+// code: 0 when every response matched, 1 otherwise.
+func runReplay(file string, opts ReplayOptions) int {
+	f, err := os.Open(file)
+	if err != nil {
+		log.Printf("replay: %v", err)
+		return 1
+	}
+	recs, err := ReadRecordings(f)
+	f.Close()
+	if err != nil {
+		log.Printf("replay %s: %v", file, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	res, err := Replay(ctx, recs, opts)
+	for _, d := range res.Diffs {
+		fmt.Printf("#%d %s %s\n", d.Index, d.Method, d.Path)
+		for _, p := range d.Problems {
+			fmt.Printf("    %s\n", p)
+		}
+	}
+	fmt.Printf("replayed %d of %d requests against %s: %d matched, %d differed\n", res.Total, len(recs), opts.Target, res.Matched, len(res.Diffs))
+	if err != nil {
+		log.Printf("replay stopped: %v", err)
+		return 1
+	}
+	if len(res.Diffs) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecord_WritesSanitizedPairs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.ndjson")
+	recorder, err := NewTrafficRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{store: NewUserStore(), recorder: recorder}
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	defer s.stopCurrentLimiter(context.Background())
+
+	send := func(method, path, body string) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer top-secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		resp.Body.Close()
+	}
+	send(http.MethodPost, "/v1/users", `{"id":"1","name":"Alice","age":30,"password":"hunter2"}`)
+	send(http.MethodGet, "/v1/users/1", "")
+	send(http.MethodGet, "/healthz", "") // probes aren't recorded
+	if err := recorder.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "top-secret") || strings.Contains(string(raw), "hunter2") {
+		t.Errorf("recording leaks a secret:\n%s", raw)
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	recs, err := ReadRecordings(f)
+	if err != nil {
+		t.Fatalf("ReadRecordings failed: %v", err)
+	}
+	if len(recs) != 2 {
+		t.Fatalf("got %d recordings; want 2", len(recs))
+	}
+	create := recs[0]
+	if create.Request.Method != http.MethodPost || create.Request.Path != "/v1/users" || create.Response.Status != http.StatusCreated {
+		t.Errorf("first recording = %s %s -> %d", create.Request.Method, create.Request.Path, create.Response.Status)
+	}
+	if !strings.Contains(create.Request.Body, `"password":"<redacted>"`) {
+		t.Errorf("request body = %s; want the password redacted", create.Request.Body)
+	}
+	if !strings.Contains(recs[1].Response.Body, `"name":"Alice"`) {
+		t.Errorf("response body = %s; want the user", recs[1].Response.Body)
+	}
+
+	// the same build answers the same way
+	s2 := &Server{store: NewUserStore()}
+	target := httptest.NewServer(s2.routes())
+	defer target.Close()
+	defer s2.stopCurrentLimiter(context.Background())
+	res, err := Replay(context.Background(), recs, ReplayOptions{Target: target.URL})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if res.Total != 2 || res.Matched != 2 {
+		t.Errorf("replay = %+v; want 2 of 2 matched", res)
+	}
+}
+
+func TestReplay_ReportsDifferencesAndKeepsPace(t *testing.T) {
+	// a "new build" that renamed a field and broke one route
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/users/2" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"1","full_name":"Alice","age":30,"time":"2030-01-01T00:00:00Z"}`))
+	}))
+	defer target.Close()
+
+	t0 := time.Now()
+	body := `{"id":"1","name":"Alice","age":30,"time":"2020-01-01T00:00:00Z"}`
+	recs := []Recording{
+		{Time: t0, Request: RecordedMessage{Method: "GET", Path: "/v1/users/1"}, Response: RecordedMessage{Status: 200, Body: body}},
+		{Time: t0.Add(100 * time.Millisecond), Request: RecordedMessage{Method: "GET", Path: "/v1/users/2"}, Response: RecordedMessage{Status: 200, Body: body}},
+	}
+
+	start := time.Now()
+	res, err := Replay(context.Background(), recs, ReplayOptions{Target: target.URL, Speed: 2})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("replay at speed 2 took %s; want >= 50ms", elapsed)
+	}
+	if res.Matched != 0 || len(res.Diffs) != 2 {
+		t.Fatalf("replay = %+v; want 2 diffs", res)
+	}
+	got := strings.Join(res.Diffs[0].Problems, "\n")
+	for _, want := range []string{"$.full_name: unexpected", "$.name: missing"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("diff %q missing %q", got, want)
+		}
+	}
+	if strings.Contains(got, "$.time") {
+		t.Errorf("volatile field reported: %q", got)
+	}
+	if p := res.Diffs[1].Problems[0]; !strings.Contains(p, "status: 404 != recorded 200") {
+		t.Errorf("second diff = %q; want a status mismatch", p)
+	}
+}
+
+func TestDiffBodies(t *testing.T) {
+	ignore := map[string]bool{"time": true}
+	tests := []struct {
+		name        string
+		contentType string
+		want, got   string
+		problems    int
+	}{
+		{"equal apart from key order", "application/json", `{"a":1,"b":[1,2]}`, `{"b":[1,2],"a":1}`, 0},
+		{"ignored field", "application/json", `{"a":1,"time":"x"}`, `{"a":1,"time":"y"}`, 0},
+		{"redacted value", "application/json", `{"secret":"<redacted>"}`, `{"secret":"whsec_1"}`, 0},
+		{"changed number", "application/json", `{"a":1}`, `{"a":2}`, 1},
+		{"array length", "application/json", `[1,2]`, `[1]`, 1},
+		{"problem+json", "application/problem+json", `{"status":404}`, `{"status":410}`, 1},
+		{"plain text", "text/plain", "ok\n", "ok", 0},
+		{"plain text differs", "text/plain", "ok", "not ok", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problems := diffBodies(tt.contentType, []byte(tt.want), []byte(tt.got), ignore)
+			if len(problems) != tt.problems {
+				t.Errorf("problems = %q; want %d", problems, tt.problems)
+			}
+		})
+	}
+}
+
+func TestRecordedMessage_SetBody(t *testing.T) {
+	packed, _ := msgpackMarshal(map[string]any{"url": "http://x", "secret": "whsec_1"})
+
+	var m RecordedMessage
+	m.setBody("application/msgpack", packed, false)
+	decoded, _ := base64.StdEncoding.DecodeString(m.Body)
+	var v map[string]any
+	if err := msgpackUnmarshal(decoded, &v); err != nil || !m.BodyBase64 || v["secret"] != "<redacted>" || v["url"] != "http://x" {
+		t.Errorf("msgpack body = %v (err=%v); want secret redacted", v, err)
+	}
+
+	tests := []struct {
+		name, contentType, body string
+		truncated               bool
+		wantOmitted             bool
+	}{
+		{"xml with a secret", "application/xml", "<webhook><Secret>whsec_1</Secret></webhook>", false, true},
+		{"csv without one", "text/csv", "id,name\n1,Alice\n", false, false},
+		{"too large", "application/json", `{"a":1}`, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m RecordedMessage
+			m.setBody(tt.contentType, []byte(tt.body), tt.truncated)
+			if m.Omitted != tt.wantOmitted {
+				t.Errorf("Omitted = %v; want %v (body %q)", m.Omitted, tt.wantOmitted, m.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// 31. Admin Web UI
+//
+// WHY?
+// People who manage users shouldn't need curl. /ui/ is a plain HTML
+// interface to the same store as the API: list with paging and search,
+// details, and create/edit/delete forms.
+//
+// WHO MAY USE IT?
+// Only admins: the UI is served on the admin listener (admin.go), behind
+// adminAuth - loopback clients when no admin_token is set, otherwise
+// anyone who gives the token as the password of the browser's basic-auth
+// prompt. It manages the shared store; tenants' users go through the API.
+//
+// HOW:
+//   - html/template renders every page on the server and escapes whatever
+//     users typed, so a name like <script> shows up as text.
+//   - No JavaScript: links and <form method="post"> do everything. HTML
+//     forms can only GET and POST, so edit posts to /ui/users/{id} and
+//     delete to /ui/users/{id}/delete.
+//   - After a successful POST the browser is redirected (303 See Other) to a
+//     GET page, so reloading it doesn't submit the form again.
+//   - Validation uses User.Validate, the rules UserStore itself enforces.
+//     A rejected form is shown again with the user's input and a message
+//     next to each bad field (422).
+//
+// CSRF:
+// The browser re-sends basic-auth credentials on its own, and a page on
+// any site can POST to 127.0.0.1, so another site could make an admin's
+// browser submit one of these forms. Two checks, neither needing
+// server-side state:
+//  1. http.CrossOriginProtection rejects POSTs that modern browsers mark as
+//     cross-site (Sec-Fetch-Site / Origin).
+//  2. Double-submit token: a random value is set in a SameSite=Strict
+//     cookie and repeated in a hidden form field. Another site can't read
+//     the cookie, so it can't fill in the field.
+
+const (
+	uiPageSize    = 20
+	uiSearchLimit = 500 // search results are paged from at most this many
+	uiCSRFCookie  = "ui_csrf"
+	uiCSRFField   = "csrf"
+)
+
+var uiCrossOrigin = http.NewCrossOriginProtection()
+
+// uiNotices are the messages a redirect can ask for (?done=created);
+// fixed strings, so a link can't put arbitrary text on the page.
+var uiNotices = map[string]string{
+	"created": "User created.",
+	"updated": "User saved.",
+	"deleted": "User deleted.",
+}
+
+// uiPage is the data every template gets.
+type uiPage struct {
+	Title  string
+	Notice string
+	CSRF   string
+
+	// list
+	Users      []User
+	Query      string
+	Page       int
+	Pages      int
+	Total      int
+	PrevURL    string
+	NextURL    string
+	SearchMore bool // results were cut at uiSearchLimit
+
+	// details and forms
+	User    User
+	AgeText string           // the age as typed, so "abc" is shown back
+	Edit    bool             // edit form (else create)
+	Errors  ValidationErrors // per field
+	Error   string           // not about one field (duplicate ID, ...)
+}
+
+const uiLayout = `{{define "layout"}}<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - Users</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 50rem; margin: 2rem auto; padding: 0 1rem; }
+nav a { margin-right: 1rem; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .3rem .5rem; border-bottom: 1px solid #ddd; }
+label { display: block; margin-top: .8rem; }
+.notice { background: #e7f5e7; padding: .5rem; }
+.error, .field-error { color: #b00020; }
+.error { background: #fdecee; padding: .5rem; }
+</style>
+</head>
+<body>
+<nav><a href="/ui/users">Users</a><a href="/ui/users/new">New user</a></nav>
+<h1>{{.Title}}</h1>
+{{with .Notice}}<p class="notice" role="status">{{.}}</p>{{end}}
+{{with .Error}}<p class="error" role="alert">{{.}}</p>{{end}}
+{{template "content" .}}
+</body>
+</html>{{end}}`
+
+var uiTemplates = map[string]string{
+	"list": `{{define "content"}}
+<form method="get" action="/ui/users" role="search">
+<input type="search" name="q" value="{{.Query}}" aria-label="Search by name">
+<button>Search</button>{{if .Query}} <a href="/ui/users">Clear</a>{{end}}
+</form>
+{{if .Users}}
+<table>
+<thead><tr><th>ID</th><th>Name</th><th>Age</th></tr></thead>
+<tbody>
+{{range .Users}}<tr><td><a href="{{userURL .ID}}">{{.ID}}</a></td><td>{{.Name}}</td><td>{{.Age}}</td></tr>
+{{end}}</tbody>
+</table>
+<p>{{with .PrevURL}}<a href="{{.}}" rel="prev">&larr; Previous</a> {{end}}Page {{.Page}} of {{.Pages}} ({{.Total}} users{{if .SearchMore}}, showing the best matches{{end}}){{with .NextURL}} <a href="{{.}}" rel="next">Next &rarr;</a>{{end}}</p>
+{{else}}
+<p>{{if .Query}}No users match "{{.Query}}".{{else}}No users yet. <a href="/ui/users/new">Create one</a>.{{end}}</p>
+{{end}}
+{{end}}`,
+
+	"show": `{{define "content"}}
+<dl>
+<dt>ID</dt><dd>{{.User.ID}}</dd>
+<dt>Name</dt><dd>{{.User.Name}}</dd>
+<dt>Age</dt><dd>{{.User.Age}}</dd>
+</dl>
+<p><a href="{{userURL .User.ID}}/edit">Edit</a></p>
+<form method="post" action="{{userURL .User.ID}}/delete">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<button>Delete {{.User.Name}}</button>
+</form>
+{{end}}`,
+
+	"form": `{{define "content"}}
+<form method="post" action="{{if .Edit}}{{userURL .User.ID}}{{else}}/ui/users{{end}}" novalidate>
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label>ID
+{{if .Edit}}<input name="id" value="{{.User.ID}}" readonly>{{else}}<input name="id" value="{{.User.ID}}" required>{{end}}
+</label>
+{{with .Errors.id}}<p class="field-error">ID {{.}}</p>{{end}}
+<label>Name <input name="name" value="{{.User.Name}}" required></label>
+{{with .Errors.name}}<p class="field-error">Name {{.}}</p>{{end}}
+<label>Age <input name="age" value="{{.AgeText}}" inputmode="numeric" required></label>
+{{with .Errors.age}}<p class="field-error">Age {{.}}</p>{{end}}
+<p><button>{{if .Edit}}Save{{else}}Create{{end}}</button>
+{{if .Edit}}<a href="{{userURL .User.ID}}">Cancel</a>{{else}}<a href="/ui/users">Cancel</a>{{end}}</p>
+</form>
+{{end}}`,
+
+	"error": `{{define "content"}}<p><a href="/ui/users">Back to all users</a></p>{{end}}`,
+}
+
+// uiPages holds one parsed template per page: the layout plus its content.
+var uiPages = func() map[string]*template.Template {
+	funcs := template.FuncMap{
+		// IDs may hold any character; keep each one a single path segment
+		"userURL": func(id string) string { return "/ui/users/" + url.PathEscape(id) },
+	}
+	layout := template.Must(template.New("layout").Funcs(funcs).Parse(uiLayout))
+	pages := make(map[string]*template.Template)
+	for name, content := range uiTemplates {
+		pages[name] = template.Must(template.Must(layout.Clone()).Parse(content))
+	}
+	return pages
+}()
+
+// registerUI adds the /ui/ routes to mux.
+func (s *Server) registerUI(mux *http.ServeMux) {
+	mux.Handle("GET /ui/{$}", http.RedirectHandler("/ui/users", http.StatusSeeOther))
+	mux.HandleFunc("GET /ui/users", s.uiList)
+	mux.HandleFunc("GET /ui/users/new", s.uiNew)
+	mux.HandleFunc("POST /ui/users", s.uiCreate)
+	mux.HandleFunc("GET /ui/users/{id}", s.uiShow)
+	mux.HandleFunc("GET /ui/users/{id}/edit", s.uiEdit)
+	mux.HandleFunc("POST /ui/users/{id}", s.uiUpdate)
+	mux.HandleFunc("POST /ui/users/{id}/delete", s.uiDelete)
+}
+
+// render writes page with status.
+func (s *Server) render(w http.ResponseWriter, r *http.Request, status int, name string, p uiPage) {
+	p.CSRF = uiCSRFToken(w, r)
+	if p.Notice == "" {
+		p.Notice = uiNotices[r.URL.Query().Get("done")]
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY") // no clickjacking through a frame
+	w.WriteHeader(status)
+	if err := uiPages[name].ExecuteTemplate(w, "layout", p); err != nil {
+		log.Printf("ui: render %s: %v", name, err)
+	}
+}
+
+// uiError shows a page with just a message.
+func (s *Server) uiError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	s.render(w, r, status, "error", uiPage{Title: http.StatusText(status), Error: msg})
+}
+
+// uiCSRFToken returns the browser's token, setting the cookie on its first
+// visit.
+func uiCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(uiCSRFCookie); err == nil && len(c.Value) == 32 {
+		return c.Value
+	}
+	token := newID("") + newID("") // 128 random bits
+	http.SetCookie(w, &http.Cookie{
+		Name:     uiCSRFCookie,
+		Value:    token,
+		Path:     "/ui",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// uiCheckPost parses a form POST and rejects it unless it passed both CSRF
+// checks; false means the response was written.
+func (s *Server) uiCheckPost(w http.ResponseWriter, r *http.Request) bool {
+	if err := uiCrossOrigin.Check(r); err != nil {
+		s.uiError(w, r, http.StatusForbidden, "This form was sent from another site.")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := r.ParseForm(); err != nil {
+		s.uiError(w, r, http.StatusBadRequest, "The form could not be read.")
+		return false
+	}
+	c, err := r.Cookie(uiCSRFCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostForm.Get(uiCSRFField))) != 1 {
+		s.uiError(w, r, http.StatusForbidden, "The form has expired. Go back, reload the page and try again.")
+		return false
+	}
+	return true
+}
+
+// uiStatus maps a store error to a status and a message for the page.
+func uiStatus(err error) (int, string) {
+	var verr ValidationErrors
+	switch {
+	case errors.As(err, &verr):
+		return http.StatusUnprocessableEntity, "Please correct the fields below."
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound, "No such user."
+	case errors.Is(err, ErrQuotaExceeded):
+		return http.StatusForbidden, err.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, "The store took too long. Try again."
+	case errors.Is(err, ErrNotLeader), errors.Is(err, ErrProposalDropped):
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	return http.StatusConflict, err.Error()
+}
+
+func (s *Server) uiList(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	p := uiPage{Title: "Users", Query: q, Page: page}
+	var users []User
+	if q != "" {
+		results, err := s.storeFor(r).Search(r.Context(), q, uiSearchLimit)
+		if err != nil {
+			s.uiError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		for _, res := range results { // best match first
+			users = append(users, res.User)
+		}
+		p.Title = fmt.Sprintf("Users matching %q", q)
+		p.SearchMore = len(results) == uiSearchLimit
+	} else {
+		if users, err = s.storeFor(r).List(r.Context()); err != nil {
+			s.uiError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		slices.SortFunc(users, func(a, b User) int { return strings.Compare(a.ID, b.ID) })
+	}
+
+	p.Total = len(users)
+	p.Pages = max(1, (len(users)+uiPageSize-1)/uiPageSize)
+	p.Page = min(page, p.Pages)
+	start := (p.Page - 1) * uiPageSize
+	p.Users = users[start:min(start+uiPageSize, len(users))]
+	pageURL := func(n int) string {
+		v := url.Values{"page": {strconv.Itoa(n)}}
+		if q != "" {
+			v.Set("q", q)
+		}
+		return "/ui/users?" + v.Encode()
+	}
+	if p.Page > 1 {
+		p.PrevURL = pageURL(p.Page - 1)
+	}
+	if p.Page < p.Pages {
+		p.NextURL = pageURL(p.Page + 1)
+	}
+	s.render(w, r, http.StatusOK, "list", p)
+}
+
+func (s *Server) uiShow(w http.ResponseWriter, r *http.Request) {
+	u, err := s.storeFor(r).Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		status, msg := uiStatus(err)
+		s.uiError(w, r, status, msg)
+		return
+	}
+	s.render(w, r, http.StatusOK, "show", uiPage{Title: u.Name, User: u})
+}
+
+func (s *Server) uiNew(w http.ResponseWriter, r *http.Request) {
+	s.render(w, r, http.StatusOK, "form", uiPage{Title: "New user"})
+}
+
+func (s *Server) uiEdit(w http.ResponseWriter, r *http.Request) {
+	u, err := s.storeFor(r).Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		status, msg := uiStatus(err)
+		s.uiError(w, r, status, msg)
+		return
+	}
+	s.render(w, r, http.StatusOK, "form", uiPage{Title: "Edit " + u.Name, User: u, AgeText: strconv.Itoa(u.Age), Edit: true})
+}
+
+// uiFormUser reads a user from the form. An age that isn't a number is
+// reported like any other invalid field.
+func uiFormUser(r *http.Request, id string) (User, string, ValidationErrors) {
+	ageText := strings.TrimSpace(r.PostForm.Get("age"))
+	u := User{ID: id, Name: strings.TrimSpace(r.PostForm.Get("name"))}
+	age, ageErr := strconv.Atoi(ageText)
+	u.Age = age
+	var errs ValidationErrors
+	if err := u.Validate(); err != nil {
+		errors.As(err, &errs)
+	}
+	if ageErr != nil && ageText != "" {
+		if errs == nil {
+			errs = ValidationErrors{}
+		}
+		errs["age"] = "must be a whole number"
+	}
+	return u, ageText, errs
+}
+
+func (s *Server) uiCreate(w http.ResponseWriter, r *http.Request) {
+	if !s.uiCheckPost(w, r) {
+		return
+	}
+	u, ageText, errs := uiFormUser(r, strings.TrimSpace(r.PostForm.Get("id")))
+	p := uiPage{Title: "New user", User: u, AgeText: ageText, Errors: errs}
+	if errs != nil {
+		p.Error = "Please correct the fields below."
+		s.render(w, r, http.StatusUnprocessableEntity, "form", p)
+		return
+	}
+	if err := s.storeFor(r).Create(r.Context(), u); err != nil {
+		var status int
+		status, p.Error = uiStatus(err)
+		s.render(w, r, status, "form", p)
+		return
+	}
+	s.invalidateUsers(r, u.ID)
+	http.Redirect(w, r, "/ui/users/"+url.PathEscape(u.ID)+"?done=created", http.StatusSeeOther)
+}
+
+func (s *Server) uiUpdate(w http.ResponseWriter, r *http.Request) {
+	if !s.uiCheckPost(w, r) {
+		return
+	}
+	u, ageText, errs := uiFormUser(r, r.PathValue("id"))
+	p := uiPage{Title: "Edit " + u.ID, User: u, AgeText: ageText, Errors: errs, Edit: true}
+	if errs != nil {
+		p.Error = "Please correct the fields below."
+		s.render(w, r, http.StatusUnprocessableEntity, "form", p)
+		return
+	}
+	if err := s.storeFor(r).Update(r.Context(), u); err != nil {
+		var status int
+		status, p.Error = uiStatus(err)
+		s.render(w, r, status, "form", p)
+		return
+	}
+	s.invalidateUsers(r, u.ID)
+	http.Redirect(w, r, "/ui/users/"+url.PathEscape(u.ID)+"?done=updated", http.StatusSeeOther)
+}
+
+func (s *Server) uiDelete(w http.ResponseWriter, r *http.Request) {
+	if !s.uiCheckPost(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if err := s.storeFor(r).Delete(r.Context(), id); err != nil {
+		status, msg := uiStatus(err)
+		s.uiError(w, r, status, msg)
+		return
+	}
+	s.invalidateUsers(r, id)
+	http.Redirect(w, r, "/ui/users?done=deleted", http.StatusSeeOther)
+}
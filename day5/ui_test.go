@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// uiBrowser is a cookie-keeping client against /ui/ on a test server's
+// admin listener (a loopback client, so no token is needed).
+type uiBrowser struct {
+	t      *testing.T
+	s      *Server
+	srv    *httptest.Server
+	client *http.Client
+}
+
+func newUIBrowser(t *testing.T) *uiBrowser {
+	t.Helper()
+	s := &Server{store: NewUserStore()}
+	srv := httptest.NewServer(s.adminRoutes(""))
+	t.Cleanup(srv.Close)
+	jar, _ := cookiejar.New(nil)
+	return &uiBrowser{t: t, s: s, srv: srv, client: &http.Client{Jar: jar}}
+}
+
+// get loads a page and returns its status and body.
+func (b *uiBrowser) get(path string) (int, string) {
+	b.t.Helper()
+	resp, err := b.client.Get(b.srv.URL + path)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+var csrfField = regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`)
+
+// token returns the CSRF token on the page at path.
+func (b *uiBrowser) token(path string) string {
+	b.t.Helper()
+	_, body := b.get(path)
+	m := csrfField.FindStringSubmatch(body)
+	if m == nil {
+		b.t.Fatalf("no CSRF field on %s", path)
+	}
+	return m[1]
+}
+
+// post submits a form (redirects are followed) and returns the final
+// status and body.
+func (b *uiBrowser) post(path string, form url.Values, header http.Header) (int, string) {
+	b.t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, b.srv.URL+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestUI_CreateEditDelete(t *testing.T) {
+	ctx := context.Background()
+	b := newUIBrowser(t)
+	token := b.token("/ui/users/new")
+
+	status, body := b.post("/ui/users", url.Values{"csrf": {token}, "id": {"a/1"}, "name": {"Alice"}, "age": {"30"}}, nil)
+	if status != http.StatusOK || !strings.Contains(body, "User created.") || !strings.Contains(body, "<dd>Alice</dd>") {
+		t.Fatalf("create = %d\n%s", status, body)
+	}
+	if u, err := b.s.store.Get(ctx, "a/1"); err != nil || u.Age != 30 {
+		t.Fatalf("store has %+v, %v", u, err)
+	}
+
+	status, body = b.get("/ui/users/a%2F1/edit")
+	if status != http.StatusOK || !strings.Contains(body, `value="30"`) {
+		t.Fatalf("edit form = %d\n%s", status, body)
+	}
+	status, body = b.post("/ui/users/a%2F1", url.Values{"csrf": {token}, "name": {"Alice B"}, "age": {"31"}}, nil)
+	if status != http.StatusOK || !strings.Contains(body, "User saved.") || !strings.Contains(body, "<dd>31</dd>") {
+		t.Fatalf("update = %d\n%s", status, body)
+	}
+
+	status, body = b.post("/ui/users/a%2F1/delete", url.Values{"csrf": {token}}, nil)
+	if status != http.StatusOK || !strings.Contains(body, "User deleted.") {
+		t.Fatalf("delete = %d\n%s", status, body)
+	}
+	if _, err := b.s.store.Get(ctx, "a/1"); err == nil {
+		t.Error("user still in the store after delete")
+	}
+	if status, _ := b.get("/ui/users/a%2F1"); status != http.StatusNotFound {
+		t.Errorf("deleted user's page = %d; want 404", status)
+	}
+	if status, body := b.post("/ui/users/a%2F1/delete", url.Values{"csrf": {token}}, nil); status != http.StatusNotFound || !strings.Contains(body, "No such user.") {
+		t.Errorf("deleting it again = %d; want 404 No such user.\n%s", status, body)
+	}
+}
+
+func TestUI_Validation(t *testing.T) {
+	b := newUIBrowser(t)
+	b.s.store.Create(context.Background(), User{ID: "taken", Name: "Bob", Age: 40})
+	token := b.token("/ui/users/new")
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantStatus int
+		want       []string
+	}{
+		{"all empty", url.Values{}, http.StatusUnprocessableEntity,
+			[]string{"ID is required", "Name is required", "Age must be a positive number"}},
+		{"age not a number", url.Values{"id": {"1"}, "name": {"Al"}, "age": {"abc"}}, http.StatusUnprocessableEntity,
+			[]string{"Age must be a whole number", `value="abc"`, `value="Al"`}},
+		{"input is escaped", url.Values{"id": {"2"}, "name": {`<script>x</script>`}, "age": {"0"}}, http.StatusUnprocessableEntity,
+			[]string{"&lt;script&gt;", "Age must be a positive number"}},
+		{"duplicate id", url.Values{"id": {"taken"}, "name": {"Bo"}, "age": {"4"}}, http.StatusConflict,
+			[]string{"already Exists"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("csrf", token)
+			status, body := b.post("/ui/users", tt.form, nil)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d; want %d", status, tt.wantStatus)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("page lacks %q:\n%s", want, body)
+				}
+			}
+			if strings.Contains(body, "<script>") {
+				t.Error("input rendered unescaped")
+			}
+		})
+	}
+
+	// the API checks the same rules
+	api := b.s.routes()
+	defer b.s.stopCurrentLimiter(context.Background())
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(`{"id":"3","name":"","age":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	api.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "name is required") {
+		t.Errorf("API create = %d %s; want the same rule", rr.Code, rr.Body)
+	}
+}
+
+func TestUI_AdminOnly(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	public := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		remote     string
+		user, pass string // basic auth, if pass is set
+		wantStatus int
+	}{
+		{"not on the public listener", public, "127.0.0.1:5000", "", "", http.StatusNotFound},
+		{"loopback without token", s.adminRoutes(""), "127.0.0.1:5000", "", "", http.StatusOK},
+		{"remote without token", s.adminRoutes(""), "10.0.0.7:5000", "", "", http.StatusForbidden},
+		{"token as basic-auth password", s.adminRoutes("s3cret"), "10.0.0.7:5000", "admin", "s3cret", http.StatusOK},
+		{"wrong password", s.adminRoutes("s3cret"), "10.0.0.7:5000", "admin", "nope", http.StatusUnauthorized},
+		{"no credentials", s.adminRoutes("s3cret"), "127.0.0.1:5000", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ui/users", nil)
+			req.RemoteAddr = tt.remote
+			if tt.pass != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			rr := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d; want %d", rr.Code, tt.wantStatus)
+			}
+			if rr.Code == http.StatusUnauthorized && !slices.ContainsFunc(rr.Header().Values("WWW-Authenticate"), func(v string) bool { return strings.HasPrefix(v, "Basic ") }) {
+				t.Errorf("401 without a basic-auth challenge: %q", rr.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestUI_CSRF(t *testing.T) {
+	b := newUIBrowser(t)
+	token := b.token("/ui/users/new")
+	form := func(tok string) url.Values {
+		return url.Values{"csrf": {tok}, "id": {"1"}, "name": {"Mallory"}, "age": {"20"}}
+	}
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		header http.Header
+	}{
+		{"no token", form(""), nil},
+		{"wrong token", form(strings.Repeat("0", 32)), nil},
+		{"cross-site", form(token), http.Header{"Sec-Fetch-Site": {"cross-site"}}},
+		{"other origin", form(token), http.Header{"Origin": {"https://evil.example"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := b.post("/ui/users", tt.form, tt.header); status != http.StatusForbidden {
+				t.Errorf("status = %d; want 403", status)
+			}
+		})
+	}
+	if users, _ := b.s.store.List(context.Background()); len(users) != 0 {
+		t.Errorf("forged forms created %d users", len(users))
+	}
+
+	// another browser's token doesn't fit this browser's cookie
+	other := &http.Client{}
+	other.Jar, _ = cookiejar.New(nil)
+	b2 := &uiBrowser{t: t, s: b.s, srv: b.srv, client: other}
+	b2.token("/ui/users/new")
+	if status, _ := b2.post("/ui/users", form(token), nil); status != http.StatusForbidden {
+		t.Errorf("token from another session: status = %d; want 403", status)
+	}
+}
+
+func TestUI_ListPagingAndSearch(t *testing.T) {
+	ctx := context.Background()
+	b := newUIBrowser(t)
+	for i := range 45 {
+		b.s.store.Create(ctx, User{ID: fmt.Sprintf("u%02d", i), Name: fmt.Sprint("Person ", i), Age: 20})
+	}
+	b.s.store.Create(ctx, User{ID: "zz", Name: "Zelda <b>", Age: 33})
+
+	rows := regexp.MustCompile(`<tr><td>`)
+	tests := []struct {
+		path     string
+		wantRows int
+		want     []string
+	}{
+		{"/ui/users", 20, []string{"Page 1 of 3", "(46 users", `href="/ui/users?page=2"`, ">u00<"}},
+		{"/ui/users?page=3", 6, []string{"Page 3 of 3", `href="/ui/users?page=2"`, "Zelda &lt;b&gt;"}},
+		{"/ui/users?page=99", 6, []string{"Page 3 of 3"}},
+		{"/ui/users?q=zelda", 1, []string{"Page 1 of 1", ">zz<"}},
+		{"/ui/users?q=nobody+at+all", 0, []string{"No users match"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			status, body := b.get(tt.path)
+			if status != http.StatusOK {
+				t.Fatalf("status = %d", status)
+			}
+			if got := len(rows.FindAllString(body, -1)); got != tt.wantRows {
+				t.Errorf("%d rows; want %d", got, tt.wantRows)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("page lacks %q", want)
+				}
+			}
+		})
+	}
+}
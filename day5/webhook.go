@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 17. Outbound Webhooks
+//
+// WHY?
+// Downstream systems want to react when users are created or deleted
+// without polling GET /users. They subscribe a URL and we POST every event:
+//
+//	POST /webhooks {"url":"https://crm.example.com/hook","events":["user.created"]}
+//
+// DELIVERY:
+//  1. UserStore.Create/Update/Delete emit a UserEvent while holding the store lock,
+//     so events come out in the same order as the changes.
+//  2. Publish only queues the delivery (never blocks the store); a few
+//     worker goroutines POST it.
+//  3. Every POST is signed: X-Webhook-Signature = "sha256=" +
+//     hex(HMAC-SHA256(secret, timestamp + "." + body)). Receivers check it
+//     with VerifyWebhookSignature.
+//  4. A non-2xx answer or network error is retried with exponential backoff
+//     (base, 2*base, 4*base, ... with jitter). After maxAttempts the delivery
+//     goes to the dead-letter list, where it can be redelivered by hand:
+//
+//	GET  /webhooks/dead-letters
+//	POST /webhooks/dead-letters/{id}/redeliver
+//
+//     The list keeps the newest maxDeadLetters; older ones are dropped.
+//
+// WHO CAN WE BE MADE TO CALL?
+// Anyone who can reach POST /webhooks picks the URLs this server POSTs to.
+// Left unchecked that is server-side request forgery: a hook pointing at
+// http://127.0.0.1:6060/admin/... would reach the admin listener, which
+// trusts loopback callers, or at 169.254.169.254 a cloud metadata service.
+// So the dispatcher's client refuses to connect to loopback, private,
+// link-local and unspecified addresses. The check runs in the dialer
+// (net.Dialer.Control), on the address actually being connected to, so it
+// also covers host names, DNS answers that change after Subscribe, and
+// redirects. Networks that really host receivers can be allowed with
+// -webhook-allow 10.1.0.0/16.
+
+// Event types
+const (
+	EventUserCreated = "user.created"
+	EventUserUpdated = "user.updated"
+	EventUserDeleted = "user.deleted"
+)
+
+var webhookEventTypes = []string{EventUserCreated, EventUserUpdated, EventUserDeleted}
+
+// UserEvent is the payload POSTed to subscribers.
+type UserEvent struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	Tenant string    `json:"tenant,omitempty"`
+	User   User      `json:"data"`
+}
+
+// OnEvent registers fn to receive every change made to the store. fn runs
+// with the store locked, so it must not block or call back into the store.
+func (us *UserStore) OnEvent(fn func(UserEvent)) {
+	if us.shards != nil {
+		us.shards.OnEvent(fn)
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.onEvent = fn
+}
+
+// emit must be called with us.mu held for writing.
+func (us *UserStore) emit(typ string, u User) {
+	if us.onEvent == nil {
+		return
+	}
+	us.onEvent(UserEvent{ID: newID("evt_"), Type: typ, Time: time.Now().UTC(), Tenant: us.tenant, User: u})
+}
+
+// newID returns prefix + 16 random hex characters.
+func newID(prefix string) string {
+	var b [8]byte
+	rand.Read(b[:])
+	return prefix + hex.EncodeToString(b[:])
+}
+
+// checkWebhookAddr rejects addresses a webhook must not reach: loopback,
+// private, link-local and unspecified ones, unless allow covers them.
+func checkWebhookAddr(ip netip.Addr, allow []netip.Prefix) error {
+	ip = ip.Unmap() // ::ffff:127.0.0.1 is still loopback
+	if !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified() {
+		return nil
+	}
+	for _, p := range allow {
+		if p.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a public address (see -webhook-allow)", ip)
+}
+
+// webhookTransport is an HTTP transport whose every connection goes
+// through checkWebhookAddr. It ignores HTTP(S)_PROXY: through a proxy the
+// dialer would only ever see the proxy's address.
+func webhookTransport(allow []netip.Prefix) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return checkWebhookAddr(ap.Addr(), allow)
+		},
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// Webhook is one subscription.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`           // empty = all events
+	Secret    string    `json:"secret,omitempty"` // only returned when created
+	Tenant    string    `json:"tenant,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (wh *Webhook) wants(ev UserEvent) bool {
+	return wh.Tenant == ev.Tenant && (len(wh.Events) == 0 || slices.Contains(wh.Events, ev.Type))
+}
+
+// DeadLetter is a delivery that ran out of attempts.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	WebhookID string    `json:"webhook_id"`
+	Event     UserEvent `json:"event"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// delivery is one event on its way to one webhook.
+type delivery struct {
+	id       string
+	hook     *Webhook
+	event    UserEvent
+	attempts int
+}
+
+// maxDeadLetters caps the dead-letter list, so a receiver that is down for
+// days can't grow it without bound.
+const maxDeadLetters = 1000
+
+// WebhookDispatcher owns the subscriptions, the delivery queue and the
+// dead-letter list.
+type WebhookDispatcher struct {
+	client      *http.Client
+	allow       []netip.Prefix // non-public networks webhooks may reach anyway
+	maxAttempts int
+	backoff     time.Duration // delay before the first retry; doubles each time
+	maxBackoff  time.Duration
+	maxDead     int
+	workers     int
+
+	mu      sync.Mutex
+	hooks   map[string]*Webhook
+	dead    []DeadLetter
+	retries map[*delivery]*time.Timer // deliveries waiting for their next attempt
+	closed  bool
+
+	queue chan *delivery
+	start sync.Once
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewWebhookDispatcher creates a dispatcher. Workers start with the first
+// subscription, so servers without webhooks run no extra goroutines.
+// With a nil client it delivers only to public addresses and the networks
+// in allow.
+func NewWebhookDispatcher(client *http.Client, maxAttempts int, backoff time.Duration, allow ...netip.Prefix) *WebhookDispatcher {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second, Transport: webhookTransport(allow)}
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &WebhookDispatcher{
+		client:      client,
+		allow:       allow,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		maxBackoff:  5 * time.Minute,
+		maxDead:     maxDeadLetters,
+		workers:     4,
+		hooks:       make(map[string]*Webhook),
+		retries:     make(map[*delivery]*time.Timer),
+		queue:       make(chan *delivery, 1024),
+		stop:        make(chan struct{}),
+	}
+}
+
+// Subscribe validates and stores a webhook, generating a secret if none
+// was given. The returned copy includes the secret.
+func (d *WebhookDispatcher) Subscribe(wh Webhook) (Webhook, error) {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("invalid url %q (want http(s)://host/...)", wh.URL)
+	}
+	// the dialer has the last word; this just rejects the obvious cases early
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil {
+		if err := checkWebhookAddr(ip, d.allow); err != nil {
+			return Webhook{}, fmt.Errorf("invalid url %q: %w", wh.URL, err)
+		}
+	}
+	for _, ev := range wh.Events {
+		if !slices.Contains(webhookEventTypes, ev) {
+			return Webhook{}, fmt.Errorf("unknown event %q (want one of %s)", ev, strings.Join(webhookEventTypes, ", "))
+		}
+	}
+	if wh.Secret == "" {
+		wh.Secret = newID("whsec_")
+	}
+	wh.ID = newID("wh_")
+	wh.CreatedAt = time.Now().UTC()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return Webhook{}, errors.New("webhook dispatcher stopped")
+	}
+	d.hooks[wh.ID] = &wh
+	d.start.Do(func() {
+		for i := 0; i < d.workers; i++ {
+			d.wg.Add(1)
+			go d.worker()
+		}
+	})
+	return wh, nil
+}
+
+// Unsubscribe removes a webhook; pending retries for it are dropped.
+func (d *WebhookDispatcher) Unsubscribe(tenant, id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wh, ok := d.hooks[id]
+	if !ok || wh.Tenant != tenant {
+		return false
+	}
+	delete(d.hooks, id)
+	return true
+}
+
+// Webhooks lists a tenant's subscriptions without their secrets.
+func (d *WebhookDispatcher) Webhooks(tenant string) []Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := []Webhook{}
+	for _, wh := range d.hooks {
+		if wh.Tenant == tenant {
+			c := *wh
+			c.Secret = ""
+			list = append(list, c)
+		}
+	}
+	slices.SortFunc(list, func(a, b Webhook) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	return list
+}
+
+// DeadLetters lists a tenant's failed deliveries, oldest first.
+func (d *WebhookDispatcher) DeadLetters(tenant string) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := []DeadLetter{}
+	for _, dl := range d.dead {
+		if dl.Event.Tenant == tenant {
+			list = append(list, dl)
+		}
+	}
+	return list
+}
+
+// Redeliver takes a dead letter off the list and queues it again with a
+// fresh set of attempts.
+func (d *WebhookDispatcher) Redeliver(tenant, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := slices.IndexFunc(d.dead, func(dl DeadLetter) bool { return dl.ID == id && dl.Event.Tenant == tenant })
+	if i < 0 {
+		return fmt.Errorf("dead letter %s not found", id)
+	}
+	dl := d.dead[i]
+	wh, ok := d.hooks[dl.WebhookID]
+	if !ok {
+		return fmt.Errorf("webhook %s no longer exists", dl.WebhookID)
+	}
+	d.dead = slices.Delete(d.dead, i, i+1)
+	d.enqueueLocked(&delivery{id: dl.ID, hook: wh, event: dl.Event})
+	return nil
+}
+
+// Publish queues ev for every matching webhook. It never blocks: if the
+// queue is full the delivery goes straight to the dead-letter list.
+func (d *WebhookDispatcher) Publish(ev UserEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, wh := range d.hooks {
+		if wh.wants(ev) {
+			d.enqueueLocked(&delivery{id: newID("dlv_"), hook: wh, event: ev})
+		}
+	}
+}
+
+func (d *WebhookDispatcher) enqueueLocked(dv *delivery) {
+	if d.closed {
+		d.deadLetterLocked(dv, "webhook dispatcher stopped")
+		return
+	}
+	select {
+	case d.queue <- dv:
+	default:
+		d.deadLetterLocked(dv, "delivery queue full")
+	}
+}
+
+func (d *WebhookDispatcher) deadLetterLocked(dv *delivery, reason string) {
+	logf(LevelWarn, "webhook %s: giving up on %s after %d attempts: %s", dv.hook.ID, dv.event.ID, dv.attempts, reason)
+	d.dead = append(d.dead, DeadLetter{
+		ID:        dv.id,
+		WebhookID: dv.hook.ID,
+		Event:     dv.event,
+		Attempts:  dv.attempts,
+		LastError: reason,
+		FailedAt:  time.Now().UTC(),
+	})
+	if n := len(d.dead) - d.maxDead; n > 0 {
+		logf(LevelWarn, "webhook: dead-letter list full, dropping the %d oldest", n)
+		d.dead = slices.Delete(d.dead, 0, n)
+	}
+}
+
+func (d *WebhookDispatcher) worker() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case dv := <-d.queue:
+			d.attempt(dv)
+		}
+	}
+}
+
+// attempt POSTs once and then either finishes, schedules a retry, or
+// dead-letters the delivery.
+func (d *WebhookDispatcher) attempt(dv *delivery) {
+	d.mu.Lock()
+	_, subscribed := d.hooks[dv.hook.ID]
+	d.mu.Unlock()
+	if !subscribed {
+		return // unsubscribed while queued or waiting for a retry
+	}
+
+	dv.attempts++
+	err := d.post(dv)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err == nil {
+		return
+	}
+	if dv.attempts >= d.maxAttempts || d.closed {
+		d.deadLetterLocked(dv, err.Error())
+		return
+	}
+	delay := d.retryDelay(dv.attempts)
+	logf(LevelInfo, "webhook %s: attempt %d for %s failed (%v); retrying in %s", dv.hook.ID, dv.attempts, dv.event.ID, err, delay)
+	d.retries[dv] = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, pending := d.retries[dv]; !pending {
+			return // Close got here first
+		}
+		delete(d.retries, dv)
+		d.enqueueLocked(dv)
+	})
+}
+
+// minRetryDelay keeps a zero backoff from retrying in a tight loop.
+const minRetryDelay = time.Millisecond
+
+// retryDelay is backoff * 2^(attempts-1), clamped to [minRetryDelay,
+// maxBackoff], with "equal jitter" (50-100% of that) so receivers that come
+// back up aren't hit by every retry at the same instant.
+func (d *WebhookDispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.backoff << (attempts - 1)
+	switch {
+	case delay > d.maxBackoff || delay>>(attempts-1) != d.backoff: // too big or overflowed
+		delay = d.maxBackoff
+	case delay < minRetryDelay:
+		delay = minRetryDelay
+	}
+	return delay/2 + mrand.N(delay/2+1)
+}
+
+func (d *WebhookDispatcher) post(dv *delivery) error {
+	body, err := json.Marshal(dv.event)
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dv.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "day5-webhooks/1")
+	req.Header.Set("X-Webhook-ID", dv.hook.ID)
+	req.Header.Set("X-Webhook-Delivery", dv.id)
+	req.Header.Set("X-Webhook-Event", dv.event.Type)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", signWebhook(dv.hook.Secret, ts, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // lets the connection be reused
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops the workers. Deliveries still queued or waiting for a retry
+// are moved to the dead-letter list. Use it as a lifecycle stop hook.
+func (d *WebhookDispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	d.closed = true
+	for dv, t := range d.retries {
+		t.Stop()
+		delete(d.retries, dv)
+		d.deadLetterLocked(dv, "webhook dispatcher stopped")
+	}
+	close(d.stop)
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() { d.wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		select {
+		case dv := <-d.queue:
+			d.deadLetterLocked(dv, "webhook dispatcher stopped")
+		default:
+			return nil
+		}
+	}
+}
+
+// Signatures
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature is what a receiver runs on an incoming delivery.
+// Signing the timestamp too means a captured request can't be replayed
+// later than tolerance.
+func VerifyWebhookSignature(secret string, r *http.Request, body []byte, tolerance time.Duration) error {
+	ts := r.Header.Get("X-Webhook-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errors.New("missing or bad X-Webhook-Timestamp")
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp outside tolerance (%s)", age.Round(time.Second))
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Webhook-Signature")), []byte(signWebhook(secret, ts, body))) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// HTTP handlers (public mux, scoped to the request's tenant)
+
+// handleListWebhooks serves GET /webhooks.
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, s.webhooks.Webhooks(s.storeFor(r).tenant))
+}
+
+// handleCreateWebhook serves POST /webhooks.
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var wh Webhook
+	if err := decodeBody(r, &wh); err != nil {
+		writeProblem(w, bodyErrorStatus(err), err.Error())
+		return
+	}
+	wh.Tenant = s.storeFor(r).tenant
+	created, err := s.webhooks.Subscribe(wh)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	respond(w, r, http.StatusCreated, created)
+}
+
+// handleDeleteWebhook serves DELETE /webhooks/{id}.
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.webhooks.Unsubscribe(s.storeFor(r).tenant, id) {
+		writeProblem(w, http.StatusNotFound, fmt.Sprintf("webhook %s not found", id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDeadLetters serves GET /webhooks/dead-letters.
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	respond(w, r, http.StatusOK, s.webhooks.DeadLetters(s.storeFor(r).tenant))
+}
+
+// handleRedeliver serves POST /webhooks/dead-letters/{id}/redeliver.
+func (s *Server) handleRedeliver(w http.ResponseWriter, r *http.Request) {
+	if err := s.webhooks.Redeliver(s.storeFor(r).tenant, r.PathValue("id")); err != nil {
+		writeProblem(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
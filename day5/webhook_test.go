@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an httptest webhook endpoint that verifies signatures and
+// fails the first `failures` deliveries.
+type receiver struct {
+	t        *testing.T
+	secret   string
+	failures int
+
+	mu       sync.Mutex
+	attempts int
+	events   []UserEvent
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.attempts++
+	if rc.secret != "" {
+		if err := VerifyWebhookSignature(rc.secret, r, body, time.Minute); err != nil {
+			rc.t.Errorf("bad signature: %v", err)
+		}
+	}
+	if rc.attempts <= rc.failures {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	var ev UserEvent
+	json.Unmarshal(body, &ev)
+	if r.Header.Get("X-Webhook-Event") != ev.Type {
+		rc.t.Errorf("X-Webhook-Event = %q; body type %q", r.Header.Get("X-Webhook-Event"), ev.Type)
+	}
+	rc.events = append(rc.events, ev)
+}
+
+func (rc *receiver) snapshot() (int, []UserEvent) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.attempts, append([]UserEvent(nil), rc.events...)
+}
+
+// eventually polls cond until it holds or the deadline passes.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// loopback lets test dispatchers deliver to httptest servers.
+var loopback = netip.MustParsePrefix("127.0.0.0/8")
+
+func newWebhookStore(t *testing.T, maxAttempts int) (*UserStore, *WebhookDispatcher) {
+	t.Helper()
+	d := NewWebhookDispatcher(nil, maxAttempts, time.Millisecond, loopback)
+	t.Cleanup(func() { d.Close(context.Background()) })
+	us := NewUserStore()
+	us.OnEvent(d.Publish)
+	return us, d
+}
+
+func TestWebhook_SignedDeliveryAndFilter(t *testing.T) {
+	rc := &receiver{t: t, secret: "shh"}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	us, d := newWebhookStore(t, 3)
+	if _, err := d.Subscribe(Webhook{URL: srv.URL, Secret: "shh", Events: []string{EventUserDeleted}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	us.Create(ctx, User{ID: "1", Name: "Alice", Age: 30})
+	us.Delete(ctx, "1")
+
+	eventually(t, "delete event", func() bool { _, evs := rc.snapshot(); return len(evs) == 1 })
+	_, evs := rc.snapshot()
+	if evs[0].Type != EventUserDeleted || evs[0].User.Name != "Alice" {
+		t.Errorf("event = %+v; want user.deleted for Alice", evs[0])
+	}
+}
+
+func TestWebhook_RetriesThenDelivers(t *testing.T) {
+	rc := &receiver{t: t, failures: 2}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	us, d := newWebhookStore(t, 5)
+	d.Subscribe(Webhook{URL: srv.URL})
+	us.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+
+	eventually(t, "delivery after retries", func() bool { _, evs := rc.snapshot(); return len(evs) == 1 })
+	if attempts, _ := rc.snapshot(); attempts != 3 {
+		t.Errorf("attempts = %d; want 3", attempts)
+	}
+	if dl := d.DeadLetters(""); len(dl) != 0 {
+		t.Errorf("dead letters = %+v; want none", dl)
+	}
+}
+
+func TestWebhook_DeadLetterAndRedeliver(t *testing.T) {
+	rc := &receiver{t: t, failures: 3}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	us, d := newWebhookStore(t, 3)
+	s := &Server{store: us, webhooks: d}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+	d.Subscribe(Webhook{URL: srv.URL})
+	us.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+
+	eventually(t, "dead letter", func() bool { return len(d.DeadLetters("")) == 1 })
+	dl := d.DeadLetters("")[0]
+	if dl.Attempts != 3 || !strings.Contains(dl.LastError, "503") {
+		t.Errorf("dead letter = %+v; want 3 attempts ending in 503", dl)
+	}
+
+	// listed over HTTP, then redelivered by hand (the receiver is healthy now)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/webhooks/dead-letters", nil))
+	if !strings.Contains(rr.Body.String(), dl.ID) {
+		t.Errorf("GET dead-letters = %s; want %s listed", rr.Body.String(), dl.ID)
+	}
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/webhooks/dead-letters/"+dl.ID+"/redeliver", nil))
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("redeliver = %d; want 202 (%s)", rr.Code, rr.Body.String())
+	}
+	eventually(t, "redelivery", func() bool { _, evs := rc.snapshot(); return len(evs) == 1 })
+	if len(d.DeadLetters("")) != 0 {
+		t.Error("dead letter still listed after successful redelivery")
+	}
+}
+
+func TestWebhook_HTTPSubscriptions(t *testing.T) {
+	s := &Server{store: NewUserStore()}
+	h := s.routes()
+	defer s.stopCurrentLimiter(context.Background())
+	defer s.webhooks.Close(context.Background())
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"valid", `{"url":"http://hooks.example.com/hook","events":["user.created"]}`, http.StatusCreated},
+		{"bad scheme", `{"url":"ftp://example.com"}`, http.StatusBadRequest},
+		{"loopback", `{"url":"http://127.0.0.1:6060/admin/keys/rotate"}`, http.StatusBadRequest},
+		{"mapped loopback", `{"url":"http://[::ffff:127.0.0.1]/"}`, http.StatusBadRequest},
+		{"private", `{"url":"https://10.0.0.5/hook"}`, http.StatusBadRequest},
+		{"link-local", `{"url":"http://169.254.169.254/latest/meta-data/"}`, http.StatusBadRequest},
+		{"unknown event", `{"url":"http://example.com","events":["user.renamed"]}`, http.StatusBadRequest},
+	}
+	var created Webhook
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(tt.body)))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d; want %d (%s)", rr.Code, tt.wantStatus, rr.Body.String())
+			}
+			if rr.Code == http.StatusCreated {
+				json.NewDecoder(rr.Body).Decode(&created)
+			}
+		})
+	}
+	if created.ID == "" || created.Secret == "" {
+		t.Fatalf("created = %+v; want generated id and secret", created)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/webhooks", nil))
+	var list []Webhook
+	json.NewDecoder(rr.Body).Decode(&list)
+	if len(list) != 1 || list[0].ID != created.ID || list[0].Secret != "" {
+		t.Errorf("list = %+v; want one webhook without its secret", list)
+	}
+
+	for _, want := range []int{http.StatusNoContent, http.StatusNotFound} {
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/webhooks/"+created.ID, nil))
+		if rr.Code != want {
+			t.Errorf("DELETE = %d; want %d", rr.Code, want)
+		}
+	}
+}
+
+func TestWebhook_CloseDeadLettersPendingRetries(t *testing.T) {
+	rc := &receiver{t: t, failures: 100}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	d := NewWebhookDispatcher(nil, 5, time.Hour, loopback) // first retry far in the future
+	us := NewUserStore()
+	us.OnEvent(d.Publish)
+	d.Subscribe(Webhook{URL: srv.URL})
+	us.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+
+	eventually(t, "first attempt", func() bool { n, _ := rc.snapshot(); return n == 1 })
+	eventually(t, "retry scheduled", func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.retries) == 1
+	})
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dl := d.DeadLetters(""); len(dl) != 1 || dl[0].Attempts != 1 {
+		t.Errorf("dead letters after Close = %+v; want the pending delivery", dl)
+	}
+}
+
+func TestWebhook_RefusesNonPublicAddresses(t *testing.T) {
+	rc := &receiver{t: t}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+	// a host name passes Subscribe; the dialer sees where it resolves to
+	byName := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	tests := []struct {
+		name      string
+		allow     []netip.Prefix
+		delivered bool
+	}{
+		{"refused by default", nil, false},
+		{"allowed network", []netip.Prefix{loopback, netip.MustParsePrefix("::1/128")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewWebhookDispatcher(nil, 1, time.Millisecond, tt.allow...)
+			defer d.Close(context.Background())
+			us := NewUserStore()
+			us.OnEvent(d.Publish)
+			if _, err := d.Subscribe(Webhook{URL: byName}); err != nil {
+				t.Fatal(err)
+			}
+			before, _ := rc.snapshot()
+			us.Create(context.Background(), User{ID: "1", Name: "Alice", Age: 30})
+
+			if tt.delivered {
+				eventually(t, "delivery", func() bool { n, _ := rc.snapshot(); return n == before+1 })
+				return
+			}
+			eventually(t, "dead letter", func() bool { return len(d.DeadLetters("")) == 1 })
+			if dl := d.DeadLetters("")[0]; !strings.Contains(dl.LastError, "not a public address") {
+				t.Errorf("last error = %q; want the address refused", dl.LastError)
+			}
+			if n, _ := rc.snapshot(); n != before {
+				t.Error("receiver on loopback was reached")
+			}
+		})
+	}
+}
+
+func TestWebhook_DeadLettersCapped(t *testing.T) {
+	d := NewWebhookDispatcher(nil, 1, time.Millisecond)
+	d.maxDead = 3
+	d.mu.Lock()
+	for i := range 5 {
+		d.deadLetterLocked(&delivery{id: fmt.Sprint("dlv_", i), hook: &Webhook{ID: "wh"}}, "down")
+	}
+	d.mu.Unlock()
+
+	var ids []string
+	for _, dl := range d.DeadLetters("") {
+		ids = append(ids, dl.ID)
+	}
+	if got := strings.Join(ids, ","); got != "dlv_2,dlv_3,dlv_4" {
+		t.Errorf("dead letters = %s; want the newest 3", got)
+	}
+}
+
+func TestWebhook_RetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		backoff  time.Duration
+		attempts int
+		min, max time.Duration
+	}{
+		{"first retry", time.Second, 1, 500 * time.Millisecond, time.Second},
+		{"doubles", time.Second, 3, 2 * time.Second, 4 * time.Second},
+		{"capped", time.Second, 20, 150 * time.Second, 5 * time.Minute},
+		{"overflow is capped", time.Second, 64, 150 * time.Second, 5 * time.Minute},
+		{"zero backoff waits the minimum", 0, 1, minRetryDelay / 2, minRetryDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewWebhookDispatcher(nil, 5, tt.backoff)
+			for range 20 {
+				if got := d.retryDelay(tt.attempts); got < tt.min || got > tt.max {
+					t.Fatalf("retryDelay(%d) = %s; want %s-%s", tt.attempts, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
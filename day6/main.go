@@ -55,6 +55,12 @@ type User struct {
 type UserStore struct {
 	users map[string]User
 	mu    sync.RWMutex
+
+	// Latency simulates a slow backend in Create (100ms from
+	// NewUserStore); set it to 0 for fast tests and benchmarks. Create
+	// stops waiting when ctx is done. (day5's chaos.go injects latency,
+	// errors and panics at runtime instead.)
+	Latency time.Duration
 }
 
 type Response struct {
@@ -64,7 +70,8 @@ type Response struct {
 
 func NewUserStore() *UserStore {
 	return &UserStore{
-		users: make(map[string]User),
+		users:   make(map[string]User),
+		Latency: 100 * time.Millisecond,
 	}
 }
 
@@ -75,7 +82,15 @@ func (us *UserStore) Create(ctx context.Context, user User) Response {
 	default:
 	}
 
-	time.Sleep(100 * time.Millisecond)
+	if us.Latency > 0 {
+		t := time.NewTimer(us.Latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return Response{Message: "operation cancelled", ErrorCode: 2}
+		}
+	}
 	us.mu.Lock()
 	defer us.mu.Unlock()
 
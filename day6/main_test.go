@@ -149,11 +149,27 @@ func TestUserStore_Create(t *testing.T) {
 			t.Errorf("Create with cancelled context: expected error code 2, got %d", response.ErrorCode)
 		}
 	})
+
+	t.Run("Deadline During Latency", func(t *testing.T) {
+		CreatedUserStore := NewUserStore()
+		CreatedUserStore.Latency = time.Minute
+		ctx, cancel := createTimeoutContext(10)
+		defer cancel()
+		start := time.Now()
+		response := CreatedUserStore.Create(ctx, User{ID: "1", Name: "Alice", Age: 30})
+		if response.ErrorCode != 2 || time.Since(start) > time.Second {
+			t.Errorf("Create past its deadline: error code %d after %v; want 2 right away", response.ErrorCode, time.Since(start))
+		}
+		if _, err := CreatedUserStore.Get(context.Background(), "1"); err == nil {
+			t.Errorf("cancelled Create stored the user")
+		}
+	})
 }
 
 func TestUserStore_Get(t *testing.T) {
 
 	CreatedUserStore := NewUserStore()
+	CreatedUserStore.Latency = 0 // the 1ms context would cancel the simulated wait
 	ctx, cancel := createTimeoutContext(1)
 	user := User{ID: "1", Name: "Alice", Age: 30}
 	defer cancel()
@@ -177,7 +177,7 @@ func handleGetUser(store *SimpleUserStore) http.HandlerFunc {
 			return
 		}
 
-		id := strings.TrimPrefix(r.URL.Path, "/users/")
+		id := userID(r)
 		// escape id for invalid chars like %
 		if id == "" || !isNumeric(id) { // give error for non-numeric IDs
 			http.Error(w, "invalid id", http.StatusBadRequest)
@@ -214,7 +214,7 @@ func handleDeleteUser(store *SimpleUserStore) http.HandlerFunc {
 			return
 		}
 
-		id := strings.TrimPrefix(r.URL.Path, "/users/")
+		id := userID(r)
 		if id == "" || !isNumeric(id) { // give error for non-numeric IDs
 			http.Error(w, "invalid id", http.StatusBadRequest)
 			return
@@ -231,39 +231,44 @@ func handleDeleteUser(store *SimpleUserStore) http.HandlerFunc {
 	}
 }
 
-// setupRouter creates an HTTP mux with all routes
+// setupRouter creates an HTTP mux with all routes.
+// The patterns (Go 1.22+) match on method and path, so the mux itself
+// answers 405 with an Allow header for a wrong method, and {id} matches a
+// single segment: /users/1/extra is a 404 instead of user "1/extra".
+// Every route lives under /v1 (a /v2 can be registered next to it) and,
+// for older clients, without a prefix too.
 func setupRouter(store *SimpleUserStore) *http.ServeMux {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/users", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodGet {
-			handleListUsers(store)(w, r)
-		} else if r.Method == http.MethodPost {
-			handleCreateUser(store)(w, r)
-		} else {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		}
-	})
+	for _, version := range []string{"/v1", ""} {
+		mux.HandleFunc("GET "+version+"/users", handleListUsers(store))
+		mux.HandleFunc("POST "+version+"/users", handleCreateUser(store))
+		mux.HandleFunc("GET "+version+"/users/{id}", handleGetUser(store))
+		mux.HandleFunc("DELETE "+version+"/users/{id}", handleDeleteUser(store))
+	}
 
-	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
-		id := strings.TrimPrefix(r.URL.Path, "/users/")
-		if id == "" {
-			http.Error(w, "invalid path", http.StatusBadRequest)
-			return
-		}
-
-		if r.Method == http.MethodGet {
-			handleGetUser(store)(w, r)
-		} else if r.Method == http.MethodDelete {
-			handleDeleteUser(store)(w, r)
-		} else {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-		}
-	})
+	// The unversioned API answered "/users/" (no id) with 400; keep that for
+	// old clients. /v1 leaves it a plain 404.
+	mux.HandleFunc("GET /users/{$}", handleMissingID)
+	mux.HandleFunc("DELETE /users/{$}", handleMissingID)
 
 	return mux
 }
 
+// handleMissingID answers "/users/" requests that carry no id.
+func handleMissingID(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "invalid path", http.StatusBadRequest)
+}
+
+// userID returns the {id} matched by the router, or the rest of the path
+// when a handler is called directly (as the handler tests do).
+func userID(r *http.Request) string {
+	if id := r.PathValue("id"); id != "" {
+		return id
+	}
+	return strings.TrimPrefix(r.URL.Path, "/users/")
+}
+
 func isNumeric(s string) bool {
 	for _, r := range s {
 		if r < '0' || r > '9' {
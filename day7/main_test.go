@@ -538,6 +538,40 @@ func TestHTTPEndpoints_TableDriven(t *testing.T) {
 
 }
 
+// TestRouter_PatternsAndVersions checks method/path routing: 405 with Allow,
+// no IDs spanning segments, and /v1 serving the same data as the aliases.
+func TestRouter_PatternsAndVersions(t *testing.T) {
+	store := NewSimpleUserStore()
+	store.Create(User{ID: "1", Name: "Alice", Age: 30})
+	router := setupRouter(store)
+
+	tests := []struct {
+		method, path   string
+		expectedStatus int
+		expectedAllow  string
+	}{
+		{http.MethodGet, "/v1/users/1", http.StatusOK, ""},
+		{http.MethodGet, "/v1/users", http.StatusOK, ""},
+		{http.MethodGet, "/users/1/extra", http.StatusNotFound, ""},
+		{http.MethodGet, "/v1/users/1/extra", http.StatusNotFound, ""},
+		{http.MethodPut, "/users/1", http.StatusMethodNotAllowed, "DELETE, GET, HEAD"},
+		{http.MethodPatch, "/v1/users", http.StatusMethodNotAllowed, "GET, HEAD, POST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+"_"+tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.expectedAllow {
+				t.Errorf("expected Allow %q, got %q", tt.expectedAllow, got)
+			}
+		})
+	}
+}
+
 // 6. Middleware Integration (if implemented)
 func TestMiddleware_Logging(t *testing.T) {
 	// TODO: If logging middleware exists, test that it executes